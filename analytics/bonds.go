@@ -0,0 +1,492 @@
+package analytics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// ytmTolerance, ytmMaxIterations - Точность и число итераций поиска доходности к погашению
+	ytmTolerance     = 1e-10
+	ytmMaxIterations = 200
+	ytmMin           = -0.99
+	ytmMax           = 100.0
+	// bondCouponsHorizon - Горизонт запроса купонов, если дата погашения неизвестна
+	bondCouponsHorizon = 50 * 365 * investgo.DAY
+)
+
+// CashFlowKind - Тип выплаты по облигации
+type CashFlowKind int
+
+const (
+	// CASH_FLOW_COUPON - Купон
+	CASH_FLOW_COUPON CashFlowKind = iota
+	// CASH_FLOW_AMORTIZATION - Частичное погашение номинала
+	CASH_FLOW_AMORTIZATION
+	// CASH_FLOW_NOMINAL - Погашение оставшегося номинала
+	CASH_FLOW_NOMINAL
+)
+
+func (k CashFlowKind) String() string {
+	switch k {
+	case CASH_FLOW_COUPON:
+		return "coupon"
+	case CASH_FLOW_AMORTIZATION:
+		return "amortization"
+	case CASH_FLOW_NOMINAL:
+		return "nominal"
+	}
+	return fmt.Sprintf("CashFlowKind(%d)", int(k))
+}
+
+// UnknownCouponPolicy - Способ оценки будущих купонов, размер которых еще не объявлен (плавающие и переменные купоны)
+type UnknownCouponPolicy int
+
+const (
+	// UNKNOWN_COUPON_ERROR - Возвращать ErrUnknownCoupon
+	UNKNOWN_COUPON_ERROR UnknownCouponPolicy = iota
+	// UNKNOWN_COUPON_LAST_KNOWN - Считать по ставке последнего объявленного купона
+	UNKNOWN_COUPON_LAST_KNOWN
+	// UNKNOWN_COUPON_RATE - Считать по годовой ставке CashFlowConfig.CouponRate
+	UNKNOWN_COUPON_RATE
+)
+
+func (p UnknownCouponPolicy) String() string {
+	switch p {
+	case UNKNOWN_COUPON_ERROR:
+		return "error"
+	case UNKNOWN_COUPON_LAST_KNOWN:
+		return "last-known"
+	case UNKNOWN_COUPON_RATE:
+		return "rate"
+	}
+	return fmt.Sprintf("UnknownCouponPolicy(%d)", int(p))
+}
+
+var (
+	// ErrUnknownCoupon - Размер будущего купона не объявлен, а CashFlowConfig.UnknownCoupons = UNKNOWN_COUPON_ERROR
+	ErrUnknownCoupon = errors.New("coupon amount is unknown")
+	// ErrUnknownAmortization - Облигация с амортизацией, но график амортизации не передан
+	ErrUnknownAmortization = errors.New("amortization schedule is unknown")
+	// ErrNoMaturity - У облигации нет даты погашения (бессрочная облигация) и не задана CashFlowConfig.Maturity
+	ErrNoMaturity = errors.New("bond has no maturity date")
+	// ErrNoYield - Доходность не находится: нет будущих выплат или цена не положительна
+	ErrNoYield = errors.New("yield does not exist for price")
+)
+
+// CashFlow - Будущая выплата по одной облигации
+type CashFlow struct {
+	Date time.Time
+	Kind CashFlowKind
+	// Amount - Размер выплаты в валюте номинала
+	Amount decimal.Decimal
+	// Nominal - Непогашенный номинал перед выплатой
+	Nominal decimal.Decimal
+	// Estimated - Размер купона не объявлен и оценен по CashFlowConfig.UnknownCoupons
+	Estimated bool
+}
+
+// Amortization - Частичное погашение номинала, Amount - погашаемая сумма на одну облигацию
+type Amortization struct {
+	Date   time.Time
+	Amount decimal.Decimal
+}
+
+// CashFlowConfig - Параметры построения графика выплат по облигации
+type CashFlowConfig struct {
+	// Settlement - Дата расчетов, выплаты до нее не учитываются. По умолчанию текущее время Clock
+	Settlement time.Time
+	// Clock - Часы для даты расчетов по умолчанию. По умолчанию часы клиента в LoadBondSchedule
+	// и системное время в NewBondSchedule
+	Clock investgo.Clock
+	// Maturity - Дата погашения оставшегося номинала вместо даты погашения облигации, например дата оферты.
+	// Обязательна для бессрочных облигаций
+	Maturity time.Time
+	// UnknownCoupons - Оценка необъявленных купонов, по умолчанию UNKNOWN_COUPON_ERROR
+	UnknownCoupons UnknownCouponPolicy
+	// CouponRate - Годовая ставка купона от непогашенного номинала для UNKNOWN_COUPON_RATE, 0.12 = 12%
+	CouponRate float64
+	// Amortizations - График амортизации. API не возвращает его, поэтому для облигаций с AmortizationFlag
+	// он обязателен, если не задан IgnoreAmortizations
+	Amortizations []Amortization
+	// IgnoreAmortizations - Считать, что весь непогашенный номинал выплачивается в дату погашения
+	IgnoreAmortizations bool
+}
+
+// BondSchedule - График будущих выплат по облигации на дату расчетов
+type BondSchedule struct {
+	Bond       *pb.Bond
+	Settlement time.Time
+	Maturity   time.Time
+	// Nominal - Непогашенный номинал на дату расчетов
+	Nominal decimal.Decimal
+	// AccruedInterest - НКД на дату расчетов
+	AccruedInterest decimal.Decimal
+	// CouponsPerYear - Количество купонов в год
+	CouponsPerYear int32
+	// Flows - Выплаты по возрастанию даты
+	Flows []CashFlow
+	// Estimated - В графике есть оцененные купоны
+	Estimated bool
+}
+
+// BondMetrics - Показатели облигации при заданной цене
+type BondMetrics struct {
+	// CleanPrice - Чистая цена в процентах от номинала
+	CleanPrice decimal.Decimal
+	// AccruedInterest - НКД, DirtyPrice - полная цена, в валюте номинала
+	AccruedInterest decimal.Decimal
+	DirtyPrice      decimal.Decimal
+	// CurrentYield - Текущая доходность: годовой купон к чистой цене
+	CurrentYield float64
+	// YieldToMaturity - Эффективная годовая доходность к погашению
+	YieldToMaturity float64
+	// MacaulayDuration - Дюрация Маколея в годах, ModifiedDuration - модифицированная дюрация
+	MacaulayDuration float64
+	ModifiedDuration float64
+	Convexity        float64
+	// Estimated - Расчет использует оцененные купоны
+	Estimated bool
+}
+
+// LoadBondSchedule - Загрузка облигации и ее купонов и построение графика выплат
+func LoadBondSchedule(is *investgo.InstrumentsServiceClient, figi string, conf CashFlowConfig) (*BondSchedule, error) {
+	resp, err := is.BondByFigi(figi)
+	if err != nil {
+		return nil, err
+	}
+	bond := resp.GetInstrument()
+	if conf.Settlement.IsZero() {
+		if conf.Clock == nil {
+			conf.Clock = is.Clock()
+		}
+		conf.Settlement = conf.Clock.Now()
+	}
+	settlement := conf.Settlement
+	from := settlement.AddDate(-1, 0, 0)
+	if bond.GetPlacementDate() != nil && bond.GetPlacementDate().AsTime().Before(from) {
+		from = bond.GetPlacementDate().AsTime()
+	}
+	to := conf.Maturity
+	if to.IsZero() && bond.GetMaturityDate() != nil {
+		to = bond.GetMaturityDate().AsTime()
+	}
+	if to.IsZero() || to.Before(settlement) {
+		to = settlement.Add(bondCouponsHorizon)
+	}
+	coupons, err := is.GetBondCoupons(figi, from, to.Add(investgo.DAY))
+	if err != nil {
+		return nil, err
+	}
+	return NewBondSchedule(bond, coupons.GetEvents(), conf)
+}
+
+// NewBondSchedule - Построение графика выплат из облигации и ее купонов из GetBondCoupons. Купоны
+// должны включать текущий купонный период для расчета НКД
+func NewBondSchedule(bond *pb.Bond, coupons []*pb.Coupon, conf CashFlowConfig) (*BondSchedule, error) {
+	if conf.Settlement.IsZero() {
+		if conf.Clock == nil {
+			conf.Clock = investgo.RealClock{}
+		}
+		conf.Settlement = conf.Clock.Now()
+	}
+	s := &BondSchedule{
+		Bond:           bond,
+		Settlement:     conf.Settlement,
+		Maturity:       conf.Maturity,
+		Nominal:        investgo.MoneyValueToDecimal(bond.GetNominal()),
+		CouponsPerYear: bond.GetCouponQuantityPerYear(),
+		Flows:          make([]CashFlow, 0, len(coupons)+len(conf.Amortizations)+1),
+	}
+	if s.Maturity.IsZero() && bond.GetMaturityDate() != nil && !bond.GetPerpetualFlag() {
+		s.Maturity = bond.GetMaturityDate().AsTime()
+	}
+	if s.Maturity.IsZero() || s.Maturity.Unix() <= 0 {
+		return nil, fmt.Errorf("%v: %w", bond.GetTicker(), ErrNoMaturity)
+	}
+	if bond.GetAmortizationFlag() && len(conf.Amortizations) == 0 && !conf.IgnoreAmortizations {
+		return nil, fmt.Errorf("%v: %w", bond.GetTicker(), ErrUnknownAmortization)
+	}
+
+	amortizations := make([]Amortization, 0, len(conf.Amortizations))
+	if !conf.IgnoreAmortizations {
+		for _, a := range conf.Amortizations {
+			if a.Date.After(s.Settlement) && a.Date.Before(s.Maturity) {
+				amortizations = append(amortizations, a)
+			}
+		}
+	}
+	sort.SliceStable(amortizations, func(i, j int) bool {
+		return amortizations[i].Date.Before(amortizations[j].Date)
+	})
+	// outstanding - Непогашенный номинал на дату t, амортизация в день купона учитывается после купона
+	outstanding := func(t time.Time) decimal.Decimal {
+		nominal := s.Nominal
+		for _, a := range amortizations {
+			if !a.Date.Before(t) {
+				break
+			}
+			nominal = nominal.Sub(a.Amount)
+		}
+		return nominal
+	}
+
+	sorted := make([]*pb.Coupon, 0, len(coupons))
+	for _, c := range coupons {
+		if c.GetCouponDate() != nil {
+			sorted = append(sorted, c)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetCouponDate().AsTime().Before(sorted[j].GetCouponDate().AsTime())
+	})
+
+	// lastRate - Годовая ставка последнего объявленного купона от номинала
+	lastRate := math.NaN()
+	current := true
+	for i, c := range sorted {
+		date := c.GetCouponDate().AsTime()
+		if date.After(s.Maturity) {
+			break
+		}
+		start, periodDays := couponPeriod(bond, sorted, i)
+		nominal := outstanding(date)
+		amount := investgo.MoneyValueToDecimal(c.GetPayOneBond())
+		estimated := false
+		if amount.IsPositive() {
+			if periodDays > 0 && nominal.IsPositive() {
+				lastRate = amount.Div(nominal).InexactFloat64() * DAYS_IN_YEAR / periodDays
+			}
+		} else if c.GetCouponType() != pb.CouponType_COUPON_TYPE_DISCOUNT && date.After(s.Settlement) {
+			rate := conf.CouponRate
+			switch conf.UnknownCoupons {
+			case UNKNOWN_COUPON_LAST_KNOWN:
+				if math.IsNaN(lastRate) {
+					return nil, fmt.Errorf("%v coupon %v on %v: %w: no announced coupons before it",
+						bond.GetTicker(), c.GetCouponNumber(), date.Format(time.DateOnly), ErrUnknownCoupon)
+				}
+				rate = lastRate
+			case UNKNOWN_COUPON_RATE:
+			default:
+				return nil, fmt.Errorf("%v coupon %v on %v: %w", bond.GetTicker(), c.GetCouponNumber(),
+					date.Format(time.DateOnly), ErrUnknownCoupon)
+			}
+			amount = nominal.Mul(decimal.NewFromFloat(rate * periodDays / DAYS_IN_YEAR)).Round(2)
+			estimated = true
+		}
+		if !date.After(s.Settlement) {
+			continue
+		}
+		// НКД считается по первому купону после даты расчетов
+		if current {
+			current = false
+			if !start.IsZero() && s.Settlement.After(start) && periodDays > 0 {
+				elapsed := math.Floor(s.Settlement.Sub(start).Hours() / 24)
+				s.AccruedInterest = amount.Mul(decimal.NewFromFloat(elapsed / periodDays)).Round(2)
+			}
+		}
+		s.Flows = append(s.Flows, CashFlow{
+			Date:      date,
+			Kind:      CASH_FLOW_COUPON,
+			Amount:    amount,
+			Nominal:   nominal,
+			Estimated: estimated,
+		})
+		s.Estimated = s.Estimated || estimated
+	}
+
+	remaining := s.Nominal
+	for _, a := range amortizations {
+		s.Flows = append(s.Flows, CashFlow{
+			Date:    a.Date,
+			Kind:    CASH_FLOW_AMORTIZATION,
+			Amount:  a.Amount,
+			Nominal: remaining,
+		})
+		remaining = remaining.Sub(a.Amount)
+	}
+	if s.Maturity.After(s.Settlement) && remaining.IsPositive() {
+		s.Flows = append(s.Flows, CashFlow{
+			Date:    s.Maturity,
+			Kind:    CASH_FLOW_NOMINAL,
+			Amount:  remaining,
+			Nominal: remaining,
+		})
+	}
+	sort.SliceStable(s.Flows, func(i, j int) bool {
+		return s.Flows[i].Date.Before(s.Flows[j].Date)
+	})
+	return s, nil
+}
+
+// couponPeriod - Начало купонного периода и его длительность в днях
+func couponPeriod(bond *pb.Bond, coupons []*pb.Coupon, i int) (time.Time, float64) {
+	c := coupons[i]
+	var start time.Time
+	switch {
+	case c.GetCouponStartDate() != nil && c.GetCouponStartDate().AsTime().Unix() > 0:
+		start = c.GetCouponStartDate().AsTime()
+	case i > 0:
+		start = coupons[i-1].GetCouponDate().AsTime()
+	case bond.GetPlacementDate() != nil && bond.GetPlacementDate().AsTime().Unix() > 0:
+		start = bond.GetPlacementDate().AsTime()
+	}
+	days := float64(c.GetCouponPeriod())
+	if days <= 0 && !start.IsZero() {
+		days = math.Round(c.GetCouponDate().AsTime().Sub(start).Hours() / 24)
+	}
+	if days <= 0 && bond.GetCouponQuantityPerYear() > 0 {
+		days = math.Round(DAYS_IN_YEAR / float64(bond.GetCouponQuantityPerYear()))
+	}
+	if start.IsZero() && days > 0 {
+		start = c.GetCouponDate().AsTime().Add(-time.Duration(days) * investgo.DAY)
+	}
+	return start, days
+}
+
+// DirtyPrice - Полная цена в валюте номинала по чистой цене в процентах от номинала
+func (s *BondSchedule) DirtyPrice(cleanPercent decimal.Decimal) decimal.Decimal {
+	return cleanPercent.Mul(s.Nominal).Div(decimal.NewFromInt(100)).Add(s.AccruedInterest)
+}
+
+// CleanPrice - Чистая цена в процентах от номинала по полной цене в валюте номинала
+func (s *BondSchedule) CleanPrice(dirty decimal.Decimal) decimal.Decimal {
+	if s.Nominal.IsZero() {
+		return decimal.Zero
+	}
+	return dirty.Sub(s.AccruedInterest).Mul(decimal.NewFromInt(100)).Div(s.Nominal)
+}
+
+// AnnualCoupon - Купонный доход за год: ближайший купон, умноженный на количество купонов в год, или сумма
+// купонов за год после даты расчетов, если количество купонов в год неизвестно
+func (s *BondSchedule) AnnualCoupon() decimal.Decimal {
+	yearEnd := s.Settlement.AddDate(1, 0, 0)
+	sum := decimal.Zero
+	for _, f := range s.Flows {
+		if f.Kind != CASH_FLOW_COUPON {
+			continue
+		}
+		if s.CouponsPerYear > 0 {
+			return f.Amount.Mul(decimal.NewFromInt32(s.CouponsPerYear))
+		}
+		if f.Date.After(yearEnd) {
+			break
+		}
+		sum = sum.Add(f.Amount)
+	}
+	return sum
+}
+
+// CurrentYield - Текущая доходность по чистой цене в процентах от номинала
+func (s *BondSchedule) CurrentYield(cleanPercent decimal.Decimal) float64 {
+	clean := cleanPercent.Mul(s.Nominal).Div(decimal.NewFromInt(100))
+	if !clean.IsPositive() {
+		return 0
+	}
+	return s.AnnualCoupon().Div(clean).InexactFloat64()
+}
+
+// PriceFromYield - Полная цена в валюте номинала при эффективной годовой доходности y
+func (s *BondSchedule) PriceFromYield(y float64) decimal.Decimal {
+	return decimal.NewFromFloat(s.presentValue(y)).Round(2)
+}
+
+// YieldToMaturity - Эффективная годовая доходность к погашению по чистой цене в процентах от номинала
+func (s *BondSchedule) YieldToMaturity(cleanPercent decimal.Decimal) (float64, error) {
+	dirty := s.DirtyPrice(cleanPercent).InexactFloat64()
+	if dirty <= 0 || len(s.Flows) == 0 {
+		return 0, fmt.Errorf("%w %v", ErrNoYield, cleanPercent)
+	}
+	// приведенная стоимость монотонно убывает по доходности: метод Ньютона с защитой бисекцией
+	lo, hi := ytmMin, ytmMax
+	if s.presentValue(lo) < dirty || s.presentValue(hi) > dirty {
+		return 0, fmt.Errorf("%w %v", ErrNoYield, cleanPercent)
+	}
+	y := 0.1
+	for i := 0; i < ytmMaxIterations; i++ {
+		diff := s.presentValue(y) - dirty
+		if math.Abs(diff) < ytmTolerance {
+			return y, nil
+		}
+		if diff > 0 {
+			lo = y
+		} else {
+			hi = y
+		}
+		next := lo + (hi-lo)/2
+		if derivative := s.derivative(y); derivative < 0 {
+			if newton := y - diff/derivative; newton > lo && newton < hi {
+				next = newton
+			}
+		}
+		if hi-lo < ytmTolerance {
+			return next, nil
+		}
+		y = next
+	}
+	return y, nil
+}
+
+// Duration - Дюрация Маколея в годах, модифицированная дюрация и выпуклость при доходности y
+func (s *BondSchedule) Duration(y float64) (float64, float64, float64) {
+	var pv, weighted, convexity float64
+	for _, f := range s.Flows {
+		t := s.years(f.Date)
+		v := f.Amount.InexactFloat64() / math.Pow(1+y, t)
+		pv += v
+		weighted += t * v
+		convexity += t * (t + 1) * v
+	}
+	if pv == 0 {
+		return 0, 0, 0
+	}
+	macaulay := weighted / pv
+	return macaulay, macaulay / (1 + y), convexity / (pv * (1 + y) * (1 + y))
+}
+
+// Analyze - Все показатели облигации по чистой цене в процентах от номинала
+func (s *BondSchedule) Analyze(cleanPercent decimal.Decimal) (BondMetrics, error) {
+	m := BondMetrics{
+		CleanPrice:      cleanPercent,
+		AccruedInterest: s.AccruedInterest,
+		DirtyPrice:      s.DirtyPrice(cleanPercent),
+		CurrentYield:    s.CurrentYield(cleanPercent),
+		Estimated:       s.Estimated,
+	}
+	y, err := s.YieldToMaturity(cleanPercent)
+	if err != nil {
+		return m, err
+	}
+	m.YieldToMaturity = y
+	m.MacaulayDuration, m.ModifiedDuration, m.Convexity = s.Duration(y)
+	return m, nil
+}
+
+func (s *BondSchedule) presentValue(y float64) float64 {
+	var pv float64
+	for _, f := range s.Flows {
+		pv += f.Amount.InexactFloat64() / math.Pow(1+y, s.years(f.Date))
+	}
+	return pv
+}
+
+func (s *BondSchedule) derivative(y float64) float64 {
+	var d float64
+	for _, f := range s.Flows {
+		t := s.years(f.Date)
+		d -= t * f.Amount.InexactFloat64() / math.Pow(1+y, t+1)
+	}
+	return d
+}
+
+// years - Срок до выплаты в годах из DAYS_IN_YEAR дней
+func (s *BondSchedule) years(t time.Time) float64 {
+	return t.Sub(s.Settlement).Hours() / 24 / DAYS_IN_YEAR
+}
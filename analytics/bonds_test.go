@@ -0,0 +1,244 @@
+package analytics
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+func bondDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// bondSettlement - Дата расчетов, годы 2025 и 2026 без 29 февраля, поэтому год купона равен DAYS_IN_YEAR
+var bondSettlement = bondDate(2025, 1, 1)
+
+// annualBond - Облигация номиналом 1000 с ежегодным купоном и погашением 1 января 2027
+func annualBond() *pb.Bond {
+	return &pb.Bond{
+		Figi:                  "BOND",
+		Ticker:                "BOND",
+		Nominal:               &pb.MoneyValue{Currency: "rub", Units: 1000},
+		CouponQuantityPerYear: 1,
+		PlacementDate:         investgo.TimeToTimestamp(bondDate(2024, 1, 1)),
+		MaturityDate:          investgo.TimeToTimestamp(bondDate(2027, 1, 1)),
+	}
+}
+
+// bondCoupon - Купон за период с start по date, pay = 0 - размер не объявлен
+func bondCoupon(number int64, start, date time.Time, pay int64) *pb.Coupon {
+	couponType := pb.CouponType_COUPON_TYPE_CONSTANT
+	if pay == 0 {
+		couponType = pb.CouponType_COUPON_TYPE_FLOATING
+	}
+	return &pb.Coupon{
+		CouponNumber:    number,
+		CouponDate:      investgo.TimeToTimestamp(date),
+		CouponStartDate: investgo.TimeToTimestamp(start),
+		CouponType:      couponType,
+		PayOneBond:      &pb.MoneyValue{Currency: "rub", Units: pay},
+		CouponPeriod:    int32(math.Round(date.Sub(start).Hours() / 24)),
+	}
+}
+
+// annualCoupons - Купоны 2025, 2026 и 2027 годов размером pays
+func annualCoupons(pays ...int64) []*pb.Coupon {
+	res := make([]*pb.Coupon, 0, len(pays))
+	for i, pay := range pays {
+		res = append(res, bondCoupon(int64(i+1), bondDate(2024+i, 1, 1), bondDate(2025+i, 1, 1), pay))
+	}
+	return res
+}
+
+// flowsString - Выплаты графика в виде "дата вид сумма/номинал"
+func flowsString(flows []CashFlow) []string {
+	res := make([]string, 0, len(flows))
+	for _, f := range flows {
+		s := f.Date.Format(time.DateOnly) + " " + f.Kind.String() + " " + f.Amount.String() + "/" + f.Nominal.String()
+		if f.Estimated {
+			s += " estimated"
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func TestBondAtPar(t *testing.T) {
+	// купон 2025 года выплачен в дату расчетов и не входит в график
+	s, err := NewBondSchedule(annualBond(), annualCoupons(100, 100, 100), CashFlowConfig{Settlement: bondSettlement})
+	if err != nil {
+		t.Fatalf("NewBondSchedule: %v", err)
+	}
+	want := []string{"2026-01-01 coupon 100/1000", "2027-01-01 coupon 100/1000", "2027-01-01 nominal 1000/1000"}
+	if got := flowsString(s.Flows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("flows = %v, want %v", got, want)
+	}
+	if !s.AccruedInterest.IsZero() || !s.AnnualCoupon().Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("accrued = %v, annual coupon = %v", s.AccruedInterest, s.AnnualCoupon())
+	}
+
+	// доходность облигации по номиналу равна ставке купона
+	m, err := s.Analyze(decimal.NewFromInt(100))
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	checkClose(t, "ytm", m.YieldToMaturity, 0.1, 1e-9)
+	checkClose(t, "current yield", m.CurrentYield, 0.1, 1e-9)
+	// D = (1·100/1.1 + 2·1100/1.1²) / 1000
+	checkClose(t, "macaulay", m.MacaulayDuration, 1.909091, 1e-6)
+	checkClose(t, "modified", m.ModifiedDuration, 1.735537, 1e-6)
+	checkClose(t, "convexity", m.Convexity, 4.658152, 1e-6)
+	if !m.DirtyPrice.Equal(decimal.NewFromInt(1000)) || m.Estimated {
+		t.Fatalf("metrics = %+v", m)
+	}
+	if got := s.PriceFromYield(0.1); !got.Equal(decimal.NewFromInt(1000)) {
+		t.Fatalf("PriceFromYield = %v", got)
+	}
+
+	// ниже номинала доходность выше купона, цена по найденной доходности совпадает с исходной
+	y, err := s.YieldToMaturity(decimal.NewFromInt(95))
+	if err != nil || y <= 0.1 {
+		t.Fatalf("ytm at 95 = %v, %v", y, err)
+	}
+	if got := s.PriceFromYield(y); !got.Equal(decimal.NewFromInt(950)) {
+		t.Fatalf("PriceFromYield(%v) = %v", y, got)
+	}
+	if _, err := s.YieldToMaturity(decimal.Zero); !errors.Is(err, ErrNoYield) {
+		t.Fatalf("zero price: err = %v", err)
+	}
+}
+
+func TestBondAccruedInterest(t *testing.T) {
+	settlement := bondSettlement.AddDate(0, 0, 73)
+	s, err := NewBondSchedule(annualBond(), annualCoupons(100, 100, 100), CashFlowConfig{Settlement: settlement})
+	if err != nil {
+		t.Fatalf("NewBondSchedule: %v", err)
+	}
+	// НКД = 100 · 73 / 365
+	if !s.AccruedInterest.Equal(decimal.NewFromInt(20)) || !s.DirtyPrice(decimal.NewFromInt(100)).Equal(decimal.NewFromInt(1020)) {
+		t.Fatalf("accrued = %v", s.AccruedInterest)
+	}
+	if got := s.CleanPrice(decimal.NewFromInt(1020)); !got.Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("CleanPrice = %v", got)
+	}
+}
+
+func TestBondUnknownCoupons(t *testing.T) {
+	coupons := annualCoupons(100, 100, 0)
+	_, err := NewBondSchedule(annualBond(), coupons, CashFlowConfig{Settlement: bondSettlement})
+	if !errors.Is(err, ErrUnknownCoupon) {
+		t.Fatalf("err = %v, want ErrUnknownCoupon", err)
+	}
+
+	tests := []struct {
+		name string
+		conf CashFlowConfig
+		want string
+	}{
+		// ставка последнего объявленного купона 100 / 1000 за 365 дней
+		{"last known", CashFlowConfig{UnknownCoupons: UNKNOWN_COUPON_LAST_KNOWN}, "2027-01-01 coupon 100/1000 estimated"},
+		{"rate", CashFlowConfig{UnknownCoupons: UNKNOWN_COUPON_RATE, CouponRate: 0.125}, "2027-01-01 coupon 125/1000 estimated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Settlement = bondSettlement
+			s, err := NewBondSchedule(annualBond(), coupons, tt.conf)
+			if err != nil {
+				t.Fatalf("NewBondSchedule: %v", err)
+			}
+			if got := flowsString(s.Flows); len(got) != 3 || got[0] != "2026-01-01 coupon 100/1000" || got[1] != tt.want {
+				t.Fatalf("flows = %v", got)
+			}
+			if m, err := s.Analyze(decimal.NewFromInt(100)); err != nil || !m.Estimated || !s.Estimated {
+				t.Fatalf("metrics = %+v, %v", m, err)
+			}
+		})
+	}
+
+	// до первого объявленного купона ставка неизвестна
+	_, err = NewBondSchedule(annualBond(), annualCoupons(0, 0, 0), CashFlowConfig{Settlement: bondSettlement.Add(-investgo.DAY),
+		UnknownCoupons: UNKNOWN_COUPON_LAST_KNOWN})
+	if !errors.Is(err, ErrUnknownCoupon) {
+		t.Fatalf("err = %v, want ErrUnknownCoupon", err)
+	}
+}
+
+func TestBondAmortization(t *testing.T) {
+	bond := annualBond()
+	bond.AmortizationFlag = true
+	coupons := annualCoupons(100, 100, 0)
+	if _, err := NewBondSchedule(bond, coupons, CashFlowConfig{Settlement: bondSettlement}); !errors.Is(err, ErrUnknownAmortization) {
+		t.Fatalf("err = %v, want ErrUnknownAmortization", err)
+	}
+
+	// половина номинала гасится в день купона 2026 года, купон этого дня начисляется на весь номинал
+	s, err := NewBondSchedule(bond, coupons, CashFlowConfig{
+		Settlement:     bondSettlement,
+		UnknownCoupons: UNKNOWN_COUPON_LAST_KNOWN,
+		Amortizations: []Amortization{
+			{Date: bondDate(2026, 1, 1), Amount: decimal.NewFromInt(500)},
+			// погашения до даты расчетов не учитываются
+			{Date: bondDate(2024, 7, 1), Amount: decimal.NewFromInt(100)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewBondSchedule: %v", err)
+	}
+	want := []string{
+		"2026-01-01 coupon 100/1000",
+		"2026-01-01 amortization 500/1000",
+		"2027-01-01 coupon 50/500 estimated",
+		"2027-01-01 nominal 500/500",
+	}
+	if got := flowsString(s.Flows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("flows = %v, want %v", got, want)
+	}
+	// у облигации с амортизацией по номиналу доходность тоже равна ставке купона
+	m, err := s.Analyze(decimal.NewFromInt(100))
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	checkClose(t, "ytm", m.YieldToMaturity, 0.1, 1e-9)
+	// D = (1·600/1.1 + 2·550/1.1²) / 1000
+	checkClose(t, "macaulay", m.MacaulayDuration, 1.454545, 1e-6)
+
+	s, err = NewBondSchedule(bond, coupons, CashFlowConfig{Settlement: bondSettlement, UnknownCoupons: UNKNOWN_COUPON_LAST_KNOWN,
+		IgnoreAmortizations: true})
+	if err != nil || flowsString(s.Flows)[2] != "2027-01-01 nominal 1000/1000" {
+		t.Fatalf("flows without amortizations = %v, %v", flowsString(s.Flows), err)
+	}
+}
+
+func TestBondScheduleClock(t *testing.T) {
+	clock := investgo.NewSimulatedClock(bondSettlement)
+	s, err := NewBondSchedule(annualBond(), annualCoupons(100, 100, 100), CashFlowConfig{Clock: clock})
+	if err != nil || !s.Settlement.Equal(bondSettlement) {
+		t.Fatalf("settlement = %v, %v", s.Settlement, err)
+	}
+
+	perpetual := annualBond()
+	perpetual.PerpetualFlag = true
+	if _, err := NewBondSchedule(perpetual, nil, CashFlowConfig{Clock: clock}); !errors.Is(err, ErrNoMaturity) {
+		t.Fatalf("err = %v, want ErrNoMaturity", err)
+	}
+
+	// без даты расчетов используется время часов клиента
+	api := &fakeIncomeApi{
+		bonds:   map[string]*pb.Bond{"BOND": annualBond()},
+		coupons: map[string][]*pb.Coupon{"BOND": annualCoupons(100, 100, 100)},
+	}
+	client := newIncomeClient(t, api, clock)
+	s, err = LoadBondSchedule(client.NewInstrumentsServiceClient(), "BOND", CashFlowConfig{})
+	if err != nil {
+		t.Fatalf("LoadBondSchedule: %v", err)
+	}
+	if !s.Settlement.Equal(bondSettlement) || len(s.Flows) != 3 {
+		t.Fatalf("settlement = %v, flows = %v", s.Settlement, flowsString(s.Flows))
+	}
+}
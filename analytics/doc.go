@@ -0,0 +1,51 @@
+/*
+Package analytics предоставляет расчеты по инструментам без обращения к торговым методам API.
+
+Опционы оцениваются по модели Блэка (MODEL_BLACK_76) для опционов на фьючерсы или Блэка-Шоулза
+(MODEL_BLACK_SCHOLES). Параметры оценки строятся по страйку, дате экспирации, направлению и типу расчетов
+из pb.Option и цене базового актива. По рыночной цене опциона находится подразумеваемая волатильность:
+
+	params, err := analytics.NewOptionParams(option, analytics.OptionInputs{Underlying: futuresPrice})
+	params.Volatility, err = analytics.ImpliedVolatility(params, optionPrice)
+	greeks := analytics.OptionGreeks(params)
+
+Для опционных позиций портфеля из OperationsServiceClient.GetPositions чувствительности рассчитываются
+с учетом количества и размера базового актива и суммируются через AggregateGreeks:
+
+	positions, err := analytics.OptionPositions(resp.GetOptions(), analytics.OptionPositionsConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		MarketData:  client.NewMarketDataServiceClient(),
+	})
+	total := analytics.AggregateGreeks(positions)
+
+График выплат облигации BondSchedule строится из pb.Bond и купонов GetBondCoupons: купоны, амортизация
+и погашение номинала. Необъявленные плавающие купоны оцениваются явно по CashFlowConfig.UnknownCoupons,
+по умолчанию возвращается ErrUnknownCoupon. По чистой цене в процентах от номинала рассчитываются полная
+цена, текущая доходность, доходность к погашению, дюрация и выпуклость:
+
+	schedule, err := analytics.LoadBondSchedule(client.NewInstrumentsServiceClient(), figi, analytics.CashFlowConfig{
+		UnknownCoupons: analytics.UNKNOWN_COUPON_LAST_KNOWN,
+	})
+	metrics, err := schedule.Analyze(decimal.RequireFromString("98.5"))
+
+FuturesSpec переводит пункты фьючерса в деньги по стоимости шага цены из GetFuturesMargin, рассчитывает
+гарантийное обеспечение и размер позиции, а FuturesPositions - результат фьючерсных позиций портфеля:
+
+	spec, err := analytics.LoadFuturesSpec(client.NewInstrumentsServiceClient(), figi)
+	lots := spec.MaxLots(freeMoney, pb.OrderDirection_ORDER_DIRECTION_BUY)
+	loss := spec.PointsToMoney(decimal.NewFromInt(500))
+
+IncomeCalendar собирает ожидаемые дивиденды, купоны, амортизации и погашения по позициям одного или нескольких
+счетов из GetPortfolio. Налог удерживается по ставке страны риска эмитента из IncomeConfig.TaxRates, суммы
+по дням и валютам возвращает Totals, а календарь выгружается в CSV и iCalendar (.ics) для подписки.
+Облигации, выплаты которых нельзя рассчитать, пропускаются с ошибкой в IncomeCalendar.Errors:
+
+	calendar, err := analytics.NewIncomeCalendar(analytics.IncomeConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		Operations:  client.NewOperationsServiceClient(),
+		Accounts:    []string{client.Config.AccountId},
+		Bonds:       analytics.CashFlowConfig{UnknownCoupons: analytics.UNKNOWN_COUPON_LAST_KNOWN},
+	})
+	err = calendar.WriteICS(file, "Выплаты по портфелю")
+*/
+package analytics
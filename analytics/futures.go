@@ -0,0 +1,208 @@
+package analytics
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// ErrNoTickValue - Шаг цены или его стоимость не заданы, пункты не переводятся в деньги
+var ErrNoTickValue = errors.New("min price increment or its amount is not set")
+
+// FuturesSpec - Экономика фьючерсного контракта: стоимость шага цены и гарантийное обеспечение.
+// Цены фьючерса указываются в пунктах, суммы - в валюте гарантийного обеспечения
+type FuturesSpec struct {
+	Uid    string
+	Figi   string
+	Ticker string
+	// Lot - Количество контрактов в лоте
+	Lot int64
+	// MinPriceIncrement - Шаг цены в пунктах, MinPriceIncrementAmount - стоимость шага цены одного контракта
+	MinPriceIncrement       decimal.Decimal
+	MinPriceIncrementAmount decimal.Decimal
+	// InitialMarginOnBuy, InitialMarginOnSell - Гарантийное обеспечение одного контракта для покупки и продажи
+	InitialMarginOnBuy  decimal.Decimal
+	InitialMarginOnSell decimal.Decimal
+	Currency            string
+}
+
+// FuturesPositionsConfig - Параметры оценки фьючерсных позиций портфеля
+type FuturesPositionsConfig struct {
+	Instruments *investgo.InstrumentsServiceClient
+	MarketData  *investgo.MarketDataServiceClient
+	// Portfolio - Позиции из OperationsServiceClient.GetPortfolio для средней цены и вариационной маржи.
+	// Если позиции нет в Portfolio, то AveragePrice и PnL нулевые
+	Portfolio []*pb.PortfolioPosition
+}
+
+// FuturesPosition - Фьючерсная позиция с финансовым результатом
+type FuturesPosition struct {
+	Spec *FuturesSpec
+	// Quantity - Количество контрактов, отрицательное для короткой позиции
+	Quantity int64
+	// AveragePrice - Средняя цена позиции, CurrentPrice - цена последней сделки, в пунктах
+	AveragePrice decimal.Decimal
+	CurrentPrice decimal.Decimal
+	// PnL - Результат позиции от средней цены до текущей в валюте
+	PnL decimal.Decimal
+	// VarMargin - Вариационная маржа из портфеля
+	VarMargin decimal.Decimal
+	// Margin - Гарантийное обеспечение позиции
+	Margin decimal.Decimal
+}
+
+// LoadFuturesSpec - Загрузка фьючерса и его гарантийного обеспечения по figi
+func LoadFuturesSpec(is *investgo.InstrumentsServiceClient, figi string) (*FuturesSpec, error) {
+	future, err := is.FutureByFigi(figi)
+	if err != nil {
+		return nil, err
+	}
+	margin, err := is.GetFuturesMargin(figi)
+	if err != nil {
+		return nil, err
+	}
+	return NewFuturesSpec(future.GetInstrument(), margin.GetFuturesMarginResponse)
+}
+
+// NewFuturesSpec - Экономика контракта из фьючерса и ответа GetFuturesMargin
+func NewFuturesSpec(future *pb.Future, margin *pb.GetFuturesMarginResponse) (*FuturesSpec, error) {
+	s := &FuturesSpec{
+		Uid:                     future.GetUid(),
+		Figi:                    future.GetFigi(),
+		Ticker:                  future.GetTicker(),
+		Lot:                     int64(future.GetLot()),
+		MinPriceIncrement:       investgo.QuotationToDecimal(margin.GetMinPriceIncrement()),
+		MinPriceIncrementAmount: investgo.QuotationToDecimal(margin.GetMinPriceIncrementAmount()),
+		InitialMarginOnBuy:      investgo.MoneyValueToDecimal(margin.GetInitialMarginOnBuy()),
+		InitialMarginOnSell:     investgo.MoneyValueToDecimal(margin.GetInitialMarginOnSell()),
+		Currency:                margin.GetInitialMarginOnBuy().GetCurrency(),
+	}
+	if s.Lot <= 0 {
+		s.Lot = 1
+	}
+	if s.MinPriceIncrement.IsZero() {
+		s.MinPriceIncrement = investgo.QuotationToDecimal(future.GetMinPriceIncrement())
+	}
+	if !s.MinPriceIncrement.IsPositive() || !s.MinPriceIncrementAmount.IsPositive() {
+		return nil, fmt.Errorf("%v: %w", future.GetTicker(), ErrNoTickValue)
+	}
+	return s, nil
+}
+
+// PointValue - Стоимость одного пункта цены одного контракта
+func (s *FuturesSpec) PointValue() decimal.Decimal {
+	return s.MinPriceIncrementAmount.Div(s.MinPriceIncrement)
+}
+
+// PointsToMoney - Стоимость изменения цены на points пунктов для одного контракта
+func (s *FuturesSpec) PointsToMoney(points decimal.Decimal) decimal.Decimal {
+	return points.Mul(s.MinPriceIncrementAmount).Div(s.MinPriceIncrement)
+}
+
+// MoneyToPoints - Изменение цены в пунктах, соответствующее сумме money для одного контракта
+func (s *FuturesSpec) MoneyToPoints(money decimal.Decimal) decimal.Decimal {
+	return money.Mul(s.MinPriceIncrement).Div(s.MinPriceIncrementAmount)
+}
+
+// Margin - Гарантийное обеспечение для quantity лотов в направлении direction
+func (s *FuturesSpec) Margin(quantity int64, direction pb.OrderDirection) decimal.Decimal {
+	return s.lotMargin(direction).Mul(decimal.NewFromInt(quantity))
+}
+
+// MaxLots - Количество лотов, которое можно открыть в направлении direction на сумму money
+func (s *FuturesSpec) MaxLots(money decimal.Decimal, direction pb.OrderDirection) int64 {
+	margin := s.lotMargin(direction)
+	if !margin.IsPositive() || !money.IsPositive() {
+		return 0
+	}
+	return money.Div(margin).Floor().IntPart()
+}
+
+// LotsForRisk - Количество лотов, при котором движение цены против позиции на stopPoints пунктов
+// приводит к убытку не больше risk
+func (s *FuturesSpec) LotsForRisk(risk, stopPoints decimal.Decimal) int64 {
+	lotRisk := s.PointsToMoney(stopPoints.Abs()).Mul(decimal.NewFromInt(s.Lot))
+	if !lotRisk.IsPositive() || !risk.IsPositive() {
+		return 0
+	}
+	return risk.Div(lotRisk).Floor().IntPart()
+}
+
+// PnL - Результат quantity контрактов от цены entry до цены exit в пунктах, quantity отрицательное для продажи
+func (s *FuturesSpec) PnL(entry, exit decimal.Decimal, quantity int64) decimal.Decimal {
+	return s.PointsToMoney(exit.Sub(entry)).Mul(decimal.NewFromInt(quantity))
+}
+
+func (s *FuturesSpec) lotMargin(direction pb.OrderDirection) decimal.Decimal {
+	margin := s.InitialMarginOnBuy
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		margin = s.InitialMarginOnSell
+	}
+	return margin.Mul(decimal.NewFromInt(s.Lot))
+}
+
+// FuturesPositions - Оценка фьючерсных позиций из OperationsServiceClient.GetPositions по ценам последних
+// сделок. Средняя цена позиции в портфеле указана в валюте и переводится в пункты по стоимости шага цены
+func FuturesPositions(positions []*pb.PositionsFutures, conf FuturesPositionsConfig) ([]FuturesPosition, error) {
+	portfolio := make(map[string]*pb.PortfolioPosition, len(conf.Portfolio))
+	for _, p := range conf.Portfolio {
+		portfolio[p.GetInstrumentUid()] = p
+	}
+	res := make([]FuturesPosition, 0, len(positions))
+	ids := make([]string, 0, len(positions))
+	for _, pos := range positions {
+		quantity := pos.GetBalance() + pos.GetBlocked()
+		if quantity == 0 {
+			continue
+		}
+		spec, err := LoadFuturesSpec(conf.Instruments, pos.GetFigi())
+		if err != nil {
+			return nil, err
+		}
+		p := FuturesPosition{Spec: spec, Quantity: quantity}
+		direction := pb.OrderDirection_ORDER_DIRECTION_BUY
+		if quantity < 0 {
+			direction = pb.OrderDirection_ORDER_DIRECTION_SELL
+		}
+		lots := quantity / spec.Lot
+		if lots < 0 {
+			lots = -lots
+		}
+		p.Margin = spec.Margin(lots, direction)
+		if pp, ok := portfolio[spec.Uid]; ok {
+			p.AveragePrice = spec.MoneyToPoints(investgo.MoneyValueToDecimal(pp.GetAveragePositionPrice()))
+			p.VarMargin = investgo.MoneyValueToDecimal(pp.GetVarMargin())
+		}
+		res = append(res, p)
+		ids = append(ids, spec.Uid)
+	}
+	if len(res) == 0 {
+		return res, nil
+	}
+
+	lastPrices, err := conf.MarketData.GetLastPrices(ids)
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[string]decimal.Decimal, len(ids))
+	for _, lp := range lastPrices.GetLastPrices() {
+		if lp.GetTime() != nil {
+			prices[lp.GetInstrumentUid()] = investgo.QuotationToDecimal(lp.GetPrice())
+		}
+	}
+	for i := range res {
+		p := &res[i]
+		price, ok := prices[p.Spec.Uid]
+		if !ok {
+			return nil, fmt.Errorf("futures %v: no last price", p.Spec.Ticker)
+		}
+		p.CurrentPrice = price
+		if !p.AveragePrice.IsZero() {
+			p.PnL = p.Spec.PnL(p.AveragePrice, p.CurrentPrice, p.Quantity)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,234 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func dec(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func money(s string) *pb.MoneyValue {
+	return investgo.DecimalToMoneyValue(dec(s), "rub")
+}
+
+// siFuture, rtsFuture - Фьючерсы на курс доллара и индекс РТС
+func siFuture() *pb.Future {
+	return &pb.Future{Uid: "uid-si", Figi: "FUTSI0624000", Ticker: "SiM4", Lot: 1, MinPriceIncrement: &pb.Quotation{Units: 1}}
+}
+
+func rtsFuture() *pb.Future {
+	return &pb.Future{Uid: "uid-rts", Figi: "FUTRTS062400", Ticker: "RIM4", Lot: 1, MinPriceIncrement: &pb.Quotation{Units: 10}}
+}
+
+// siMargin - Шаг цены 1 пункт стоимостью 1 рубль
+func siMargin() *pb.GetFuturesMarginResponse {
+	return &pb.GetFuturesMarginResponse{
+		InitialMarginOnBuy:      money("15000"),
+		InitialMarginOnSell:     money("14000"),
+		MinPriceIncrement:       &pb.Quotation{Units: 1},
+		MinPriceIncrementAmount: &pb.Quotation{Units: 1},
+	}
+}
+
+// rtsMargin - Шаг цены 10 пунктов стоимостью 14.1234 рубля
+func rtsMargin() *pb.GetFuturesMarginResponse {
+	return &pb.GetFuturesMarginResponse{
+		InitialMarginOnBuy:      money("20000.5"),
+		InitialMarginOnSell:     money("21000"),
+		MinPriceIncrement:       &pb.Quotation{Units: 10},
+		MinPriceIncrementAmount: investgo.DecimalToQuotation(dec("14.1234")),
+	}
+}
+
+func TestNewFuturesSpec(t *testing.T) {
+	s, err := NewFuturesSpec(rtsFuture(), rtsMargin())
+	if err != nil {
+		t.Fatalf("NewFuturesSpec: %v", err)
+	}
+	if s.Uid != "uid-rts" || s.Ticker != "RIM4" || s.Lot != 1 || s.Currency != "rub" || !s.PointValue().Equal(dec("1.41234")) {
+		t.Fatalf("spec = %+v", s)
+	}
+
+	// шаг цены берется из фьючерса, если его нет в ответе GetFuturesMargin, лот по умолчанию 1
+	future, margin := rtsFuture(), rtsMargin()
+	future.Lot, margin.MinPriceIncrement = 0, nil
+	if s, err = NewFuturesSpec(future, margin); err != nil || !s.MinPriceIncrement.Equal(dec("10")) || s.Lot != 1 {
+		t.Fatalf("spec = %+v, %v", s, err)
+	}
+	margin.MinPriceIncrementAmount = nil
+	if _, err := NewFuturesSpec(future, margin); !errors.Is(err, ErrNoTickValue) {
+		t.Fatalf("err = %v, want ErrNoTickValue", err)
+	}
+}
+
+func TestFuturesSpec(t *testing.T) {
+	buy, sell := pb.OrderDirection_ORDER_DIRECTION_BUY, pb.OrderDirection_ORDER_DIRECTION_SELL
+	tests := []struct {
+		name   string
+		future *pb.Future
+		margin *pb.GetFuturesMarginResponse
+		// points, money - PointsToMoney(points) = money и MoneyToPoints(money) = points
+		points, money string
+		// margin - Margin(3, direction)
+		direction pb.OrderDirection
+		lotMargin string
+		// maxLots - MaxLots(funds, direction)
+		funds   string
+		maxLots int64
+		// riskLots - LotsForRisk(risk, stop)
+		risk, stop string
+		riskLots   int64
+		// pnl - PnL(entry, exit, quantity)
+		entry, exit string
+		quantity    int64
+		pnl         string
+	}{
+		{"Si buy", siFuture(), siMargin(), "250", "250", buy, "45000", "44999", 2, "1000", "150", 6,
+			"90000", "90500", 3, "1500"},
+		{"Si sell", siFuture(), siMargin(), "-37", "-37", sell, "42000", "28000", 2, "1000", "-150", 6,
+			"90000", "90500", -3, "-1500"},
+		{"RTS buy", rtsFuture(), rtsMargin(), "100", "141.234", buy, "60001.5", "100000", 4, "10000", "500", 14,
+			"110000", "111000", 2, "2824.68"},
+		{"RTS sell", rtsFuture(), rtsMargin(), "12.5", "17.65425", sell, "63000", "62999.99", 2, "100", "500", 0,
+			"110000", "108750", -1, "1765.425"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFuturesSpec(tt.future, tt.margin)
+			if err != nil {
+				t.Fatalf("NewFuturesSpec: %v", err)
+			}
+			if got := s.PointsToMoney(dec(tt.points)); !got.Equal(dec(tt.money)) {
+				t.Errorf("PointsToMoney(%v) = %v, want %v", tt.points, got, tt.money)
+			}
+			if got := s.MoneyToPoints(dec(tt.money)); !got.Equal(dec(tt.points)) {
+				t.Errorf("MoneyToPoints(%v) = %v, want %v", tt.money, got, tt.points)
+			}
+			if got := s.Margin(3, tt.direction); !got.Equal(dec(tt.lotMargin)) {
+				t.Errorf("Margin = %v, want %v", got, tt.lotMargin)
+			}
+			if got := s.MaxLots(dec(tt.funds), tt.direction); got != tt.maxLots {
+				t.Errorf("MaxLots(%v) = %v, want %v", tt.funds, got, tt.maxLots)
+			}
+			if got := s.LotsForRisk(dec(tt.risk), dec(tt.stop)); got != tt.riskLots {
+				t.Errorf("LotsForRisk(%v, %v) = %v, want %v", tt.risk, tt.stop, got, tt.riskLots)
+			}
+			if got := s.PnL(dec(tt.entry), dec(tt.exit), tt.quantity); !got.Equal(dec(tt.pnl)) {
+				t.Errorf("PnL = %v, want %v", got, tt.pnl)
+			}
+			// без денег и без стопа лоты не открываются
+			if s.MaxLots(dec("-1"), tt.direction) != 0 || s.LotsForRisk(dec("1000"), decimal.Zero) != 0 {
+				t.Errorf("MaxLots or LotsForRisk of zero = %v, %v", s.MaxLots(dec("-1"), tt.direction), s.LotsForRisk(dec("1000"), decimal.Zero))
+			}
+		})
+	}
+
+	// лот из нескольких контрактов умножает обеспечение и риск лота
+	future := rtsFuture()
+	future.Lot = 2
+	s, err := NewFuturesSpec(future, rtsMargin())
+	if err != nil {
+		t.Fatalf("NewFuturesSpec: %v", err)
+	}
+	if got := s.Margin(3, buy); !got.Equal(dec("120003")) {
+		t.Errorf("Margin of lot 2 = %v", got)
+	}
+	if got := s.LotsForRisk(dec("10000"), dec("500")); got != 7 {
+		t.Errorf("LotsForRisk of lot 2 = %v", got)
+	}
+}
+
+// fakeFuturesApi - Фьючерсы Si и RTS и цены их последних сделок
+type fakeFuturesApi struct {
+	pb.UnimplementedInstrumentsServiceServer
+	pb.UnimplementedMarketDataServiceServer
+	prices map[string]decimal.Decimal
+}
+
+func (f *fakeFuturesApi) FutureBy(_ context.Context, in *pb.InstrumentRequest) (*pb.FutureResponse, error) {
+	for _, future := range []*pb.Future{siFuture(), rtsFuture()} {
+		if future.GetFigi() == in.GetId() {
+			return &pb.FutureResponse{Instrument: future}, nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "future not found")
+}
+
+func (f *fakeFuturesApi) GetFuturesMargin(_ context.Context, in *pb.GetFuturesMarginRequest) (*pb.GetFuturesMarginResponse, error) {
+	if in.GetFigi() == siFuture().GetFigi() {
+		return siMargin(), nil
+	}
+	return rtsMargin(), nil
+}
+
+func (f *fakeFuturesApi) GetLastPrices(_ context.Context, in *pb.GetLastPricesRequest) (*pb.GetLastPricesResponse, error) {
+	resp := &pb.GetLastPricesResponse{}
+	for _, id := range in.GetInstrumentId() {
+		if price, ok := f.prices[id]; ok {
+			resp.LastPrices = append(resp.LastPrices, &pb.LastPrice{
+				InstrumentUid: id,
+				Price:         investgo.DecimalToQuotation(price),
+				Time:          investgo.TimeToTimestamp(optionNow),
+			})
+		}
+	}
+	return resp, nil
+}
+
+func TestFuturesPositions(t *testing.T) {
+	api := &fakeFuturesApi{prices: map[string]decimal.Decimal{"uid-si": dec("90500"), "uid-rts": dec("108750")}}
+	client := newTestClient(t, investgo.NewSimulatedClock(optionNow), func(server *grpc.Server) {
+		pb.RegisterInstrumentsServiceServer(server, api)
+		pb.RegisterMarketDataServiceServer(server, api)
+	})
+	conf := FuturesPositionsConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		MarketData:  client.NewMarketDataServiceClient(),
+		// средняя цена в портфеле в рублях: 90000 пунктов Si и 110000 пунктов RTS по 1.41234 рубля
+		Portfolio: []*pb.PortfolioPosition{
+			{InstrumentUid: "uid-si", AveragePositionPrice: money("90000"), VarMargin: money("1200")},
+			{InstrumentUid: "uid-rts", AveragePositionPrice: money("155357.4"), VarMargin: money("-500")},
+		},
+	}
+	positions, err := FuturesPositions([]*pb.PositionsFutures{
+		{Figi: "FUTSI0624000", Balance: 2, Blocked: 1},
+		{Figi: "FUTRTS062400", Balance: -1},
+		{Figi: "FUTSI0924000"},
+	}, conf)
+	if err != nil {
+		t.Fatalf("FuturesPositions: %v", err)
+	}
+	want := []struct {
+		quantity                                     int64
+		average, current, pnl, varMargin, lotsMargin string
+	}{
+		{3, "90000", "90500", "1500", "1200", "45000"},
+		{-1, "110000", "108750", "1765.425", "-500", "21000"},
+	}
+	if len(positions) != len(want) {
+		t.Fatalf("positions = %+v", positions)
+	}
+	for i, w := range want {
+		p := positions[i]
+		if p.Quantity != w.quantity || !p.AveragePrice.Equal(dec(w.average)) || !p.CurrentPrice.Equal(dec(w.current)) ||
+			!p.PnL.Equal(dec(w.pnl)) || !p.VarMargin.Equal(dec(w.varMargin)) || !p.Margin.Equal(dec(w.lotsMargin)) {
+			t.Errorf("position %v = %+v", i, p)
+		}
+	}
+
+	// без цены последней сделки позиция не оценивается
+	delete(api.prices, "uid-rts")
+	if _, err := FuturesPositions([]*pb.PositionsFutures{{Figi: "FUTRTS062400", Balance: 1}}, conf); err == nil {
+		t.Fatal("position without last price must fail")
+	}
+}
@@ -0,0 +1,458 @@
+package analytics
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_INCOME_HORIZON - Горизонт календаря выплат по умолчанию
+	DEFAULT_INCOME_HORIZON = 365 * investgo.DAY
+	// icsLineLimit - Максимальная длина строки iCalendar в байтах, длинные строки переносятся
+	icsLineLimit = 75
+)
+
+// DEFAULT_INCOME_TAX_RATES - Ставки удержания налога по стране риска эмитента по умолчанию
+var DEFAULT_INCOME_TAX_RATES = map[string]float64{
+	"RU": 0.13,
+}
+
+// IncomeKind - Тип выплаты в календаре
+type IncomeKind int
+
+const (
+	// INCOME_DIVIDEND - Дивиденд
+	INCOME_DIVIDEND IncomeKind = iota
+	// INCOME_COUPON - Купон
+	INCOME_COUPON
+	// INCOME_AMORTIZATION - Частичное погашение номинала
+	INCOME_AMORTIZATION
+	// INCOME_REDEMPTION - Погашение облигации
+	INCOME_REDEMPTION
+)
+
+func (k IncomeKind) String() string {
+	switch k {
+	case INCOME_DIVIDEND:
+		return "dividend"
+	case INCOME_COUPON:
+		return "coupon"
+	case INCOME_AMORTIZATION:
+		return "amortization"
+	case INCOME_REDEMPTION:
+		return "redemption"
+	}
+	return fmt.Sprintf("IncomeKind(%d)", int(k))
+}
+
+// Taxable - С выплаты удерживается налог, погашение номинала налогом не облагается
+func (k IncomeKind) Taxable() bool {
+	return k == INCOME_DIVIDEND || k == INCOME_COUPON
+}
+
+// IncomeConfig - Параметры календаря выплат
+type IncomeConfig struct {
+	Instruments *investgo.InstrumentsServiceClient
+	Operations  *investgo.OperationsServiceClient
+	// Accounts - Счета, по позициям которых строится календарь
+	Accounts []string
+	// From, To - Период календаря, по умолчанию от текущего времени на DEFAULT_INCOME_HORIZON вперед
+	From time.Time
+	To   time.Time
+	// TaxRates - Ставки удержания налога по коду страны риска эмитента, 0.13 = 13%.
+	// По умолчанию DEFAULT_INCOME_TAX_RATES
+	TaxRates map[string]float64
+	// DefaultTaxRate - Ставка для стран, которых нет в TaxRates
+	DefaultTaxRate float64
+	// Bonds - Параметры графика выплат облигаций: оценка необъявленных купонов и амортизация.
+	// Settlement заменяется на From
+	Bonds CashFlowConfig
+	// Amortizations - Графики амортизации по figi облигации, дополняют Bonds.Amortizations
+	Amortizations map[string][]Amortization
+	// Clock - Часы для периода по умолчанию и времени построения календаря, по умолчанию системное время
+	Clock investgo.Clock
+}
+
+// IncomeEvent - Ожидаемая выплата по позиции одного счета
+type IncomeEvent struct {
+	Date      time.Time
+	Kind      IncomeKind
+	AccountId string
+	Uid       string
+	Figi      string
+	Ticker    string
+	Name      string
+	// Country - Страна риска эмитента, по ней выбирается ставка налога
+	Country  string
+	Currency string
+	// Quantity - Количество бумаг в позиции, PerUnit - выплата на одну бумагу
+	Quantity decimal.Decimal
+	PerUnit  decimal.Decimal
+	// Gross - Выплата до налога, Tax - удержанный налог, Net - сумма к получению
+	Gross decimal.Decimal
+	Tax   decimal.Decimal
+	Net   decimal.Decimal
+	// LastBuyDate - Последний день покупки для получения дивиденда
+	LastBuyDate time.Time
+	// Estimated - Размер купона не объявлен или дата выплаты дивиденда не известна
+	Estimated bool
+}
+
+// IncomeTotal - Сумма выплат за день в одной валюте
+type IncomeTotal struct {
+	Date     time.Time
+	Currency string
+	Gross    decimal.Decimal
+	Tax      decimal.Decimal
+	Net      decimal.Decimal
+}
+
+// IncomeCalendar - Календарь ожидаемых выплат по позициям портфеля
+type IncomeCalendar struct {
+	From time.Time
+	To   time.Time
+	// Created - Время построения календаря
+	Created time.Time
+	// Events - Выплаты по возрастанию даты
+	Events []IncomeEvent
+	// Errors - Ошибки по figi облигаций, выплаты которых нельзя рассчитать: не передан график амортизации
+	// (ErrUnknownAmortization) или не объявлен купон при Bonds.UnknownCoupons = UNKNOWN_COUPON_ERROR
+	// (ErrUnknownCoupon). Такие облигации пропускаются, остальные выплаты попадают в календарь
+	Errors map[string]error
+}
+
+// NewIncomeCalendar - Календарь дивидендов, купонов, амортизаций и погашений по позициям счетов из GetPortfolio.
+// Учитываются акции, фонды и облигации. Ошибки запросов к API прерывают построение, а облигации с неизвестными
+// выплатами пропускаются и попадают в IncomeCalendar.Errors
+func NewIncomeCalendar(conf IncomeConfig) (*IncomeCalendar, error) {
+	if len(conf.Accounts) == 0 {
+		return nil, errors.New("income calendar requires at least one account")
+	}
+	if conf.Clock == nil {
+		conf.Clock = investgo.RealClock{}
+	}
+	now := conf.Clock.Now()
+	if conf.From.IsZero() {
+		conf.From = now
+	}
+	if conf.To.IsZero() {
+		conf.To = conf.From.Add(DEFAULT_INCOME_HORIZON)
+	}
+	if conf.TaxRates == nil {
+		conf.TaxRates = DEFAULT_INCOME_TAX_RATES
+	}
+	c := &IncomeCalendar{
+		From:    conf.From,
+		To:      conf.To,
+		Created: now,
+		Events:  make([]IncomeEvent, 0),
+		Errors:  make(map[string]error),
+	}
+	// выплаты на одну бумагу загружаются один раз для всех счетов
+	payments := make(map[string][]IncomeEvent)
+	for _, account := range conf.Accounts {
+		resp, err := conf.Operations.GetPortfolio(account, pb.PortfolioRequest_RUB)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range resp.GetPositions() {
+			quantity := investgo.QuotationToDecimal(p.GetQuantity())
+			if quantity.IsZero() {
+				continue
+			}
+			perUnit, ok := payments[p.GetFigi()]
+			if !ok {
+				perUnit, err = loadPayments(p, conf)
+				if errors.Is(err, ErrUnknownAmortization) || errors.Is(err, ErrUnknownCoupon) {
+					c.Errors[p.GetFigi()] = err
+					perUnit, err = nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				payments[p.GetFigi()] = perUnit
+			}
+			for _, ev := range perUnit {
+				ev.AccountId = account
+				ev.Quantity = quantity
+				ev.Gross = ev.PerUnit.Mul(quantity).Round(2)
+				if ev.Kind.Taxable() && ev.Gross.IsPositive() {
+					ev.Tax = ev.Gross.Mul(decimal.NewFromFloat(conf.taxRate(ev.Country))).Round(2)
+				}
+				ev.Net = ev.Gross.Sub(ev.Tax)
+				c.Events = append(c.Events, ev)
+			}
+		}
+	}
+	sort.SliceStable(c.Events, func(i, j int) bool {
+		return c.Events[i].Date.Before(c.Events[j].Date)
+	})
+	return c, nil
+}
+
+func (conf IncomeConfig) taxRate(country string) float64 {
+	if rate, ok := conf.TaxRates[country]; ok {
+		return rate
+	}
+	return conf.DefaultTaxRate
+}
+
+// inPeriod - Дата выплаты попадает в период (From, To]
+func (conf IncomeConfig) inPeriod(t time.Time) bool {
+	return t.After(conf.From) && !t.After(conf.To)
+}
+
+// loadPayments - Выплаты на одну бумагу позиции за период
+func loadPayments(p *pb.PortfolioPosition, conf IncomeConfig) ([]IncomeEvent, error) {
+	switch p.GetInstrumentType() {
+	case "share":
+		resp, err := conf.Instruments.ShareByFigi(p.GetFigi())
+		if err != nil {
+			return nil, err
+		}
+		share := resp.GetInstrument()
+		return loadDividends(conf, IncomeEvent{
+			Uid:     share.GetUid(),
+			Figi:    share.GetFigi(),
+			Ticker:  share.GetTicker(),
+			Name:    share.GetName(),
+			Country: share.GetCountryOfRisk(),
+		})
+	case "etf":
+		resp, err := conf.Instruments.EtfByFigi(p.GetFigi())
+		if err != nil {
+			return nil, err
+		}
+		etf := resp.GetInstrument()
+		return loadDividends(conf, IncomeEvent{
+			Uid:     etf.GetUid(),
+			Figi:    etf.GetFigi(),
+			Ticker:  etf.GetTicker(),
+			Name:    etf.GetName(),
+			Country: etf.GetCountryOfRisk(),
+		})
+	case "bond":
+		return loadBondPayments(conf, p.GetFigi())
+	}
+	return nil, nil
+}
+
+func loadDividends(conf IncomeConfig, base IncomeEvent) ([]IncomeEvent, error) {
+	// дивиденд с датой выплаты в периоде может иметь дату фиксации реестра до него
+	resp, err := conf.Instruments.GetDividents(base.Figi, conf.From.AddDate(0, -3, 0), conf.To)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]IncomeEvent, 0, len(resp.GetDividends()))
+	for _, d := range resp.GetDividends() {
+		if strings.EqualFold(d.GetDividendType(), "Cancelled") {
+			continue
+		}
+		ev := base
+		ev.Kind = INCOME_DIVIDEND
+		ev.Currency = d.GetDividendNet().GetCurrency()
+		ev.PerUnit = investgo.MoneyValueToDecimal(d.GetDividendNet())
+		ev.Date = d.GetPaymentDate().AsTime()
+		if d.GetPaymentDate() == nil || ev.Date.Unix() <= 0 {
+			ev.Date = d.GetRecordDate().AsTime()
+			ev.Estimated = true
+		}
+		if d.GetLastBuyDate() != nil && d.GetLastBuyDate().AsTime().Unix() > 0 {
+			ev.LastBuyDate = d.GetLastBuyDate().AsTime()
+		}
+		if !conf.inPeriod(ev.Date) || !ev.PerUnit.IsPositive() {
+			continue
+		}
+		res = append(res, ev)
+	}
+	return res, nil
+}
+
+func loadBondPayments(conf IncomeConfig, figi string) ([]IncomeEvent, error) {
+	bondConf := conf.Bonds
+	bondConf.Settlement = conf.From
+	if amortizations, ok := conf.Amortizations[figi]; ok {
+		bondConf.Amortizations = append(append([]Amortization{}, bondConf.Amortizations...), amortizations...)
+	}
+	schedule, err := LoadBondSchedule(conf.Instruments, figi, bondConf)
+	if errors.Is(err, ErrNoMaturity) {
+		// у бессрочной облигации учитываются только купоны, погашение за горизонтом календаря
+		bondConf.Maturity = conf.To.Add(investgo.DAY)
+		schedule, err = LoadBondSchedule(conf.Instruments, figi, bondConf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bond := schedule.Bond
+	res := make([]IncomeEvent, 0, len(schedule.Flows))
+	for _, f := range schedule.Flows {
+		if !conf.inPeriod(f.Date) {
+			continue
+		}
+		kind := INCOME_COUPON
+		switch f.Kind {
+		case CASH_FLOW_AMORTIZATION:
+			kind = INCOME_AMORTIZATION
+		case CASH_FLOW_NOMINAL:
+			kind = INCOME_REDEMPTION
+		}
+		res = append(res, IncomeEvent{
+			Date:      f.Date,
+			Kind:      kind,
+			Uid:       bond.GetUid(),
+			Figi:      bond.GetFigi(),
+			Ticker:    bond.GetTicker(),
+			Name:      bond.GetName(),
+			Country:   bond.GetCountryOfRisk(),
+			Currency:  bond.GetNominal().GetCurrency(),
+			PerUnit:   f.Amount,
+			Estimated: f.Estimated,
+		})
+	}
+	return res, nil
+}
+
+// Totals - Суммы выплат по дням (по UTC) и валютам
+func (c *IncomeCalendar) Totals() []IncomeTotal {
+	res := make([]IncomeTotal, 0)
+	index := make(map[string]int)
+	for _, ev := range c.Events {
+		date := ev.Date.UTC().Truncate(investgo.DAY)
+		key := date.Format(time.DateOnly) + ev.Currency
+		i, ok := index[key]
+		if !ok {
+			i = len(res)
+			index[key] = i
+			res = append(res, IncomeTotal{Date: date, Currency: ev.Currency})
+		}
+		res[i].Gross = res[i].Gross.Add(ev.Gross)
+		res[i].Tax = res[i].Tax.Add(ev.Tax)
+		res[i].Net = res[i].Net.Add(ev.Net)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if !res[i].Date.Equal(res[j].Date) {
+			return res[i].Date.Before(res[j].Date)
+		}
+		return res[i].Currency < res[j].Currency
+	})
+	return res
+}
+
+// WriteCSV - Запись выплат в формате CSV, одна строка на выплату по позиции счета
+func (c *IncomeCalendar) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"date", "account_id", "kind", "ticker", "name", "figi", "country", "currency", "quantity",
+		"per_unit", "gross", "tax", "net", "last_buy_date", "estimated"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, ev := range c.Events {
+		lastBuy := ""
+		if !ev.LastBuyDate.IsZero() {
+			lastBuy = ev.LastBuyDate.UTC().Format(time.DateOnly)
+		}
+		row := []string{ev.Date.UTC().Format(time.DateOnly), ev.AccountId, ev.Kind.String(), ev.Ticker, ev.Name,
+			ev.Figi, ev.Country, ev.Currency, ev.Quantity.String(), ev.PerUnit.String(), ev.Gross.StringFixed(2),
+			ev.Tax.StringFixed(2), ev.Net.StringFixed(2), lastBuy, fmt.Sprint(ev.Estimated)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTotalsCSV - Запись сумм выплат по дням и валютам в формате CSV
+func (c *IncomeCalendar) WriteTotalsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"date", "currency", "gross", "tax", "net"}); err != nil {
+		return err
+	}
+	for _, t := range c.Totals() {
+		row := []string{t.Date.Format(time.DateOnly), t.Currency, t.Gross.StringFixed(2), t.Tax.StringFixed(2),
+			t.Net.StringFixed(2)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteICS - Запись выплат в формате iCalendar (.ics) для подписки в календаре, каждая выплата - событие
+// на весь день. UID событий не меняются между построениями, поэтому календарь обновляет их, а не дублирует
+func (c *IncomeCalendar) WriteICS(w io.Writer, name string) error {
+	var b strings.Builder
+	line := func(s string) {
+		b.WriteString(foldICSLine(s))
+		b.WriteString("\r\n")
+	}
+	stamp := c.Created.UTC().Format("20060102T150405Z")
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Tinkoff//invest-api-go-sdk//RU")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	if name != "" {
+		line("X-WR-CALNAME:" + escapeICS(name))
+	}
+	for _, ev := range c.Events {
+		date := ev.Date.UTC()
+		summary := fmt.Sprintf("%v %v %v %v", ev.Ticker, ev.Kind, ev.Net.StringFixed(2), strings.ToUpper(ev.Currency))
+		if ev.Estimated {
+			summary += " (est.)"
+		}
+		description := fmt.Sprintf("%v\nСчет: %v\nКоличество: %v\nНа одну бумагу: %v\nДо налога: %v\nНалог: %v",
+			ev.Name, ev.AccountId, ev.Quantity.String(), ev.PerUnit.String(), ev.Gross.StringFixed(2),
+			ev.Tax.StringFixed(2))
+		if !ev.LastBuyDate.IsZero() {
+			description += "\nПоследний день покупки: " + ev.LastBuyDate.UTC().Format(time.DateOnly)
+		}
+		line("BEGIN:VEVENT")
+		line(fmt.Sprintf("UID:%v-%v-%v-%v@invest-api-go-sdk", ev.Kind, ev.Figi, ev.AccountId, date.Format("20060102")))
+		line("DTSTAMP:" + stamp)
+		line("DTSTART;VALUE=DATE:" + date.Format("20060102"))
+		line("DTEND;VALUE=DATE:" + date.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:" + escapeICS(summary))
+		line("DESCRIPTION:" + escapeICS(description))
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escapeICS - Экранирование текста iCalendar
+func escapeICS(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n").Replace(s)
+}
+
+// foldICSLine - Перенос строки длиннее icsLineLimit байт без разрыва символов UTF-8
+func foldICSLine(s string) string {
+	if len(s) <= icsLineLimit {
+		return s
+	}
+	var b strings.Builder
+	size, limit := 0, icsLineLimit
+	for _, r := range s {
+		n := len(string(r))
+		if size+n > limit {
+			b.WriteString("\r\n ")
+			// продолжение начинается с пробела, он входит в длину строки
+			size, limit = 0, icsLineLimit-1
+		}
+		b.WriteRune(r)
+		size += n
+	}
+	return b.String()
+}
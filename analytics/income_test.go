@@ -0,0 +1,216 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var incomeNow = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Infof(template string, args ...any) {
+	l.t.Logf(template, args...)
+}
+
+func (l testLogger) Errorf(template string, args ...any) {
+	l.t.Logf("ERROR "+template, args...)
+}
+
+func (l testLogger) Fatalf(template string, args ...any) {
+	l.t.Fatalf(template, args...)
+}
+
+// fakeIncomeApi - Сервисы инструментов и операций с одним портфелем
+type fakeIncomeApi struct {
+	pb.UnimplementedInstrumentsServiceServer
+	pb.UnimplementedOperationsServiceServer
+	positions []*pb.PortfolioPosition
+	bonds     map[string]*pb.Bond
+	coupons   map[string][]*pb.Coupon
+	dividends map[string][]*pb.Dividend
+}
+
+func (f *fakeIncomeApi) GetPortfolio(context.Context, *pb.PortfolioRequest) (*pb.PortfolioResponse, error) {
+	return &pb.PortfolioResponse{Positions: f.positions}, nil
+}
+
+func (f *fakeIncomeApi) BondBy(_ context.Context, in *pb.InstrumentRequest) (*pb.BondResponse, error) {
+	bond, ok := f.bonds[in.GetId()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "bond not found")
+	}
+	return &pb.BondResponse{Instrument: bond}, nil
+}
+
+func (f *fakeIncomeApi) GetBondCoupons(_ context.Context, in *pb.GetBondCouponsRequest) (*pb.GetBondCouponsResponse, error) {
+	return &pb.GetBondCouponsResponse{Events: f.coupons[in.GetFigi()]}, nil
+}
+
+func (f *fakeIncomeApi) ShareBy(_ context.Context, in *pb.InstrumentRequest) (*pb.ShareResponse, error) {
+	return &pb.ShareResponse{Instrument: &pb.Share{Figi: in.GetId(), Ticker: in.GetId(), CountryOfRisk: "RU"}}, nil
+}
+
+func (f *fakeIncomeApi) GetDividends(_ context.Context, in *pb.GetDividendsRequest) (*pb.GetDividendsResponse, error) {
+	return &pb.GetDividendsResponse{Dividends: f.dividends[in.GetFigi()]}, nil
+}
+
+// newIncomeClient - Клиент сдк, подключенный к fakeIncomeApi на локальном порту
+func newIncomeClient(t *testing.T, api *fakeIncomeApi, clock investgo.Clock) *investgo.Client {
+	return newTestClient(t, clock, func(server *grpc.Server) {
+		pb.RegisterInstrumentsServiceServer(server, api)
+		pb.RegisterOperationsServiceServer(server, api)
+	})
+}
+
+// newTestClient - Клиент сдк, подключенный к сервисам, которые регистрирует register, на локальном порту
+func newTestClient(t *testing.T, clock investgo.Clock, register func(server *grpc.Server)) *investgo.Client {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := grpc.NewServer()
+	register(server)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	client, err := investgo.NewClient(context.Background(), investgo.Config{
+		EndPoint:        lis.Addr().String(),
+		AccountId:       "account",
+		DisableTLS:      true,
+		DisableAllRetry: true,
+		Clock:           clock,
+	}, testLogger{t})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+	})
+	return client
+}
+
+func incomePosition(figi, instrumentType string) *pb.PortfolioPosition {
+	return &pb.PortfolioPosition{Figi: figi, InstrumentType: instrumentType, Quantity: &pb.Quotation{Units: 10}}
+}
+
+func incomeBond(figi string, maturity time.Time) *pb.Bond {
+	return &pb.Bond{
+		Figi:                  figi,
+		Ticker:                figi,
+		CountryOfRisk:         "RU",
+		Nominal:               &pb.MoneyValue{Currency: "rub", Units: 1000},
+		CouponQuantityPerYear: 2,
+		MaturityDate:          investgo.TimeToTimestamp(maturity),
+	}
+}
+
+func incomeCoupon(date time.Time, pay int64) *pb.Coupon {
+	return &pb.Coupon{
+		CouponDate:   investgo.TimeToTimestamp(date),
+		CouponType:   pb.CouponType_COUPON_TYPE_CONSTANT,
+		PayOneBond:   &pb.MoneyValue{Currency: "rub", Units: pay},
+		CouponPeriod: 182,
+	}
+}
+
+func TestIncomeCalendarSkipsUnknownBonds(t *testing.T) {
+	maturity := incomeNow.AddDate(0, 6, 0)
+	coupon := incomeNow.AddDate(0, 3, 0)
+	amortized := incomeBond("AMORT", maturity)
+	amortized.AmortizationFlag = true
+	api := &fakeIncomeApi{
+		positions: []*pb.PortfolioPosition{
+			incomePosition("AMORT", "bond"),
+			incomePosition("SBER", "share"),
+			incomePosition("FLOAT", "bond"),
+			incomePosition("OFZ", "bond"),
+		},
+		bonds: map[string]*pb.Bond{
+			"OFZ":   incomeBond("OFZ", maturity),
+			"AMORT": amortized,
+			"FLOAT": incomeBond("FLOAT", maturity),
+		},
+		coupons: map[string][]*pb.Coupon{
+			"OFZ":   {incomeCoupon(coupon, 40)},
+			"AMORT": {incomeCoupon(coupon, 40)},
+			// размер купона не объявлен
+			"FLOAT": {incomeCoupon(coupon, 0)},
+		},
+		dividends: map[string][]*pb.Dividend{
+			"SBER": {{
+				DividendNet: &pb.MoneyValue{Currency: "rub", Units: 33},
+				PaymentDate: investgo.TimeToTimestamp(incomeNow.AddDate(0, 4, 0)),
+			}},
+		},
+	}
+	clock := investgo.NewSimulatedClock(incomeNow)
+	client := newIncomeClient(t, api, clock)
+
+	calendar, err := NewIncomeCalendar(IncomeConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		Operations:  client.NewOperationsServiceClient(),
+		Accounts:    []string{"account"},
+		Clock:       clock,
+	})
+	if err != nil {
+		t.Fatalf("NewIncomeCalendar: %v", err)
+	}
+	// период по умолчанию отсчитывается от часов конфигурации
+	if !calendar.Created.Equal(incomeNow) || !calendar.From.Equal(incomeNow) ||
+		!calendar.To.Equal(incomeNow.Add(DEFAULT_INCOME_HORIZON)) {
+		t.Fatalf("calendar period = %v - %v, created %v", calendar.From, calendar.To, calendar.Created)
+	}
+	if len(calendar.Errors) != 2 || !errors.Is(calendar.Errors["AMORT"], ErrUnknownAmortization) ||
+		!errors.Is(calendar.Errors["FLOAT"], ErrUnknownCoupon) {
+		t.Fatalf("errors = %v", calendar.Errors)
+	}
+
+	want := []struct {
+		figi  string
+		kind  IncomeKind
+		date  time.Time
+		gross int64
+	}{
+		{"OFZ", INCOME_COUPON, coupon, 400},
+		{"SBER", INCOME_DIVIDEND, incomeNow.AddDate(0, 4, 0), 330},
+		{"OFZ", INCOME_REDEMPTION, maturity, 10000},
+	}
+	if len(calendar.Events) != len(want) {
+		t.Fatalf("events = %+v, want %v", calendar.Events, len(want))
+	}
+	for i, w := range want {
+		ev := calendar.Events[i]
+		if ev.Figi != w.figi || ev.Kind != w.kind || !ev.Date.Equal(w.date) || ev.Gross.IntPart() != w.gross ||
+			ev.AccountId != "account" || ev.Estimated {
+			t.Errorf("event %v = %+v, want %+v", i, ev, w)
+		}
+	}
+}
+
+func TestIncomeCalendarApiError(t *testing.T) {
+	// ошибка запроса к API по-прежнему прерывает построение
+	api := &fakeIncomeApi{positions: []*pb.PortfolioPosition{incomePosition("MISSING", "bond")}}
+	clock := investgo.NewSimulatedClock(incomeNow)
+	client := newIncomeClient(t, api, clock)
+	_, err := NewIncomeCalendar(IncomeConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		Operations:  client.NewOperationsServiceClient(),
+		Accounts:    []string{"account"},
+		Clock:       clock,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("err = %v, want NotFound", err)
+	}
+}
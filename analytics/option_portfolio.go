@@ -0,0 +1,152 @@
+package analytics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// OptionPosition - Позиция по опциону с параметрами оценки
+type OptionPosition struct {
+	Option *pb.Option
+	// Quantity - Количество опционов, отрицательное для короткой позиции
+	Quantity int64
+	Params   OptionParams
+	// Greeks - Цена и чувствительности одного опциона
+	Greeks Greeks
+}
+
+// OptionPositionsConfig - Параметры оценки опционных позиций портфеля
+type OptionPositionsConfig struct {
+	Instruments *investgo.InstrumentsServiceClient
+	MarketData  *investgo.MarketDataServiceClient
+	// Now, Rate, DividendYield, Model - Параметры оценки, как в OptionInputs
+	Now           time.Time
+	Rate          float64
+	DividendYield float64
+	Model         OptionModel
+	// Clock - Часы для Now по умолчанию, по умолчанию часы MarketData
+	Clock investgo.Clock
+	// Volatility - Волатильность для опционов без цены последней сделки. Если 0, то для таких опционов
+	// возвращается ошибка. Для остальных опционов волатильность находится по цене последней сделки
+	Volatility float64
+}
+
+// Exposure - Чувствительности позиции: Greeks одного опциона, умноженные на количество опционов и количество
+// базового актива в одном опционе. Delta - эквивалент позиции в единицах базового актива
+func (p OptionPosition) Exposure() Greeks {
+	size := float64(p.Quantity)
+	if basicAssetSize := p.Option.GetBasicAssetSize(); basicAssetSize != nil {
+		size *= investgo.QuotationToDecimal(basicAssetSize).InexactFloat64()
+	}
+	return Greeks{
+		Price: p.Greeks.Price * size,
+		Delta: p.Greeks.Delta * size,
+		Gamma: p.Greeks.Gamma * size,
+		Vega:  p.Greeks.Vega * size,
+		Theta: p.Greeks.Theta * size,
+	}
+}
+
+// AggregateGreeks - Суммарные чувствительности позиций. Суммирование имеет смысл для опционов на один
+// базовый актив, для разных активов сумму дельт нужно переводить в деньги
+func AggregateGreeks(positions []OptionPosition) Greeks {
+	var total Greeks
+	for _, p := range positions {
+		e := p.Exposure()
+		total.Price += e.Price
+		total.Delta += e.Delta
+		total.Gamma += e.Gamma
+		total.Vega += e.Vega
+		total.Theta += e.Theta
+	}
+	return total
+}
+
+// OptionPositions - Оценка опционных позиций из OperationsServiceClient.GetPositions. Цена базового актива
+// и волатильность каждого опциона определяются по ценам последних сделок
+func OptionPositions(positions []*pb.PositionsOptions, conf OptionPositionsConfig) ([]OptionPosition, error) {
+	if conf.Now.IsZero() {
+		switch {
+		case conf.Clock != nil:
+		case conf.MarketData != nil:
+			conf.Clock = conf.MarketData.Clock()
+		default:
+			conf.Clock = investgo.RealClock{}
+		}
+		conf.Now = conf.Clock.Now()
+	}
+	res := make([]OptionPosition, 0, len(positions))
+	underlyings := make(map[string]string)
+	ids := make([]string, 0, len(positions)*2)
+	for _, pos := range positions {
+		quantity := pos.GetBalance() + pos.GetBlocked()
+		if quantity == 0 {
+			continue
+		}
+		resp, err := conf.Instruments.OptionByUid(pos.GetInstrumentUid())
+		if err != nil {
+			return nil, err
+		}
+		option := resp.GetInstrument()
+		basic := option.GetBasicAssetPositionUid()
+		if _, ok := underlyings[basic]; !ok {
+			instrument, err := conf.Instruments.InstrumentByPositionUid(basic)
+			if err != nil {
+				return nil, fmt.Errorf("option %v basic asset: %w", option.GetTicker(), err)
+			}
+			underlyings[basic] = instrument.GetInstrument().GetUid()
+			ids = append(ids, underlyings[basic])
+		}
+		ids = append(ids, option.GetUid())
+		res = append(res, OptionPosition{Option: option, Quantity: quantity})
+	}
+	if len(res) == 0 {
+		return res, nil
+	}
+
+	lastPrices, err := conf.MarketData.GetLastPrices(ids)
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[string]decimal.Decimal, len(ids))
+	for _, lp := range lastPrices.GetLastPrices() {
+		if lp.GetTime() != nil {
+			prices[lp.GetInstrumentUid()] = investgo.QuotationToDecimal(lp.GetPrice())
+		}
+	}
+
+	for i := range res {
+		p := &res[i]
+		underlying, ok := prices[underlyings[p.Option.GetBasicAssetPositionUid()]]
+		if !ok {
+			return nil, fmt.Errorf("option %v: no last price for basic asset %v", p.Option.GetTicker(), p.Option.GetBasicAsset())
+		}
+		p.Params, err = NewOptionParams(p.Option, OptionInputs{
+			Underlying:    underlying,
+			Now:           conf.Now,
+			Rate:          conf.Rate,
+			DividendYield: conf.DividendYield,
+			Volatility:    conf.Volatility,
+			Model:         conf.Model,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if price, ok := prices[p.Option.GetUid()]; ok {
+			iv, err := ImpliedVolatility(p.Params, price.InexactFloat64())
+			if err == nil {
+				p.Params.Volatility = iv
+			} else if conf.Volatility == 0 {
+				return nil, fmt.Errorf("option %v: %w", p.Option.GetTicker(), err)
+			}
+		} else if conf.Volatility == 0 {
+			return nil, fmt.Errorf("option %v: no last price and no volatility", p.Option.GetTicker())
+		}
+		p.Greeks = OptionGreeks(p.Params)
+	}
+	return res, nil
+}
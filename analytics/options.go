@@ -0,0 +1,266 @@
+package analytics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DAYS_IN_YEAR - Количество календарных дней в году для перевода срока до экспирации в годы
+	DAYS_IN_YEAR = 365
+	// ivTolerance, ivMaxIterations - Точность и число итераций поиска подразумеваемой волатильности
+	ivTolerance     = 1e-10
+	ivMaxIterations = 200
+	ivMin           = 1e-6
+	ivMax           = 20.0
+)
+
+// OptionModel - Модель оценки опциона
+type OptionModel int
+
+const (
+	// MODEL_BLACK_76 - Модель Блэка для опционов на фьючерсы, Underlying - цена фьючерса
+	MODEL_BLACK_76 OptionModel = iota
+	// MODEL_BLACK_SCHOLES - Модель Блэка-Шоулза для опционов на акции и индексы с непрерывной дивидендной доходностью
+	MODEL_BLACK_SCHOLES
+)
+
+func (m OptionModel) String() string {
+	switch m {
+	case MODEL_BLACK_76:
+		return "black-76"
+	case MODEL_BLACK_SCHOLES:
+		return "black-scholes"
+	}
+	return fmt.Sprintf("OptionModel(%d)", int(m))
+}
+
+// ErrNoImpliedVolatility - Цена опциона вне границ, допустимых моделью, волатильность не существует
+var ErrNoImpliedVolatility = errors.New("implied volatility does not exist for price")
+
+// OptionParams - Параметры оценки опциона
+type OptionParams struct {
+	Model OptionModel
+	Call  bool
+	// Underlying - Цена базового актива, Strike - страйк, в одних единицах с ценой опциона
+	Underlying float64
+	Strike     float64
+	// Expiry - Срок до экспирации в годах
+	Expiry float64
+	// Rate - Безрисковая ставка, непрерывное начисление, 0.12 = 12%. Для маржируемых опционов премия
+	// не дисконтируется и ставка должна быть 0
+	Rate float64
+	// DividendYield - Непрерывная дивидендная доходность базового актива, только для MODEL_BLACK_SCHOLES
+	DividendYield float64
+	// Volatility - Годовая волатильность, 0.3 = 30%
+	Volatility float64
+}
+
+// Greeks - Теоретическая цена и чувствительности опциона
+type Greeks struct {
+	Price float64
+	// Delta - Изменение цены при изменении цены базового актива на 1
+	Delta float64
+	// Gamma - Изменение дельты при изменении цены базового актива на 1
+	Gamma float64
+	// Vega - Изменение цены при изменении волатильности на 1 процентный пункт
+	Vega float64
+	// Theta - Изменение цены за один календарный день
+	Theta float64
+}
+
+// OptionInputs - Рыночные данные для оценки опциона из pb.Option
+type OptionInputs struct {
+	// Underlying - Цена последней сделки базового актива
+	Underlying decimal.Decimal
+	// Now - Момент оценки, по умолчанию текущее время Clock
+	Now time.Time
+	// Clock - Часы для момента оценки по умолчанию, по умолчанию системное время
+	Clock investgo.Clock
+	// Rate - Безрисковая ставка, для маржируемых опционов не используется
+	Rate float64
+	// DividendYield - Дивидендная доходность для MODEL_BLACK_SCHOLES
+	DividendYield float64
+	// Volatility - Волатильность, если она известна. Иначе ее можно найти через ImpliedVolatility
+	Volatility float64
+	// Model - Модель оценки. Базовым активом опционов срочного рынка является фьючерс, поэтому по умолчанию
+	// используется MODEL_BLACK_76
+	Model OptionModel
+}
+
+// NewOptionParams - Параметры оценки по страйку, дате экспирации, направлению и типу расчетов опциона.
+// Американские опционы оцениваются как европейские: для маржируемых опционов на фьючерсы досрочное исполнение
+// не имеет ценности и оценка точна, в остальных случаях это нижняя граница цены
+func NewOptionParams(o *pb.Option, in OptionInputs) (OptionParams, error) {
+	if in.Now.IsZero() {
+		if in.Clock == nil {
+			in.Clock = investgo.RealClock{}
+		}
+		in.Now = in.Clock.Now()
+	}
+	p := OptionParams{
+		Model:         in.Model,
+		Underlying:    in.Underlying.InexactFloat64(),
+		Strike:        investgo.MoneyValueToDecimal(o.GetStrikePrice()).InexactFloat64(),
+		Rate:          in.Rate,
+		DividendYield: in.DividendYield,
+		Volatility:    in.Volatility,
+	}
+	switch o.GetDirection() {
+	case pb.OptionDirection_OPTION_DIRECTION_CALL:
+		p.Call = true
+	case pb.OptionDirection_OPTION_DIRECTION_PUT:
+	default:
+		return p, fmt.Errorf("option %v direction is not specified", o.GetTicker())
+	}
+	if o.GetExpirationDate() == nil {
+		return p, fmt.Errorf("option %v expiration date is not specified", o.GetTicker())
+	}
+	if p.Strike <= 0 || p.Underlying <= 0 {
+		return p, fmt.Errorf("option %v strike and underlying price must be positive", o.GetTicker())
+	}
+	p.Expiry = o.GetExpirationDate().AsTime().Sub(in.Now).Hours() / 24 / DAYS_IN_YEAR
+	if p.Expiry < 0 {
+		p.Expiry = 0
+	}
+	if o.GetPaymentType() == pb.OptionPaymentType_OPTION_PAYMENT_TYPE_MARGINAL {
+		p.Rate = 0
+	}
+	return p, nil
+}
+
+// OptionPrice - Теоретическая цена опциона
+func OptionPrice(p OptionParams) float64 {
+	if p.Expiry <= 0 || p.Volatility <= 0 {
+		return intrinsic(p)
+	}
+	carry, discount := p.carry()
+	d1, d2 := p.d()
+	if p.Call {
+		return p.Underlying*carry*normCDF(d1) - p.Strike*discount*normCDF(d2)
+	}
+	return p.Strike*discount*normCDF(-d2) - p.Underlying*carry*normCDF(-d1)
+}
+
+// OptionGreeks - Теоретическая цена, дельта, гамма, вега и тета опциона
+func OptionGreeks(p OptionParams) Greeks {
+	price := OptionPrice(p)
+	g := Greeks{Price: price}
+	carry, discount := p.carry()
+	if p.Expiry <= 0 || p.Volatility <= 0 {
+		// без времени или волатильности опцион стоит как внутренняя стоимость
+		if price > 0 {
+			g.Delta = carry
+			if !p.Call {
+				g.Delta = -carry
+			}
+		}
+		return g
+	}
+	d1, d2 := p.d()
+	sqrtT := math.Sqrt(p.Expiry)
+	pdf := normPDF(d1)
+	b := p.costOfCarry()
+	g.Gamma = carry * pdf / (p.Underlying * p.Volatility * sqrtT)
+	g.Vega = p.Underlying * carry * pdf * sqrtT / 100
+	decay := -p.Underlying * carry * pdf * p.Volatility / (2 * sqrtT)
+	if p.Call {
+		g.Delta = carry * normCDF(d1)
+		g.Theta = decay - (b-p.Rate)*p.Underlying*carry*normCDF(d1) - p.Rate*p.Strike*discount*normCDF(d2)
+	} else {
+		g.Delta = carry * (normCDF(d1) - 1)
+		g.Theta = decay + (b-p.Rate)*p.Underlying*carry*normCDF(-d1) + p.Rate*p.Strike*discount*normCDF(-d2)
+	}
+	g.Theta /= DAYS_IN_YEAR
+	return g
+}
+
+// ImpliedVolatility - Волатильность, при которой теоретическая цена равна price. Поле Volatility в p игнорируется
+func ImpliedVolatility(p OptionParams, price float64) (float64, error) {
+	if p.Expiry <= 0 {
+		return 0, fmt.Errorf("%w: option is expired", ErrNoImpliedVolatility)
+	}
+	carry, discount := p.carry()
+	lower, upper := intrinsic(p), p.Underlying*carry
+	if !p.Call {
+		upper = p.Strike * discount
+	}
+	if price <= lower || price >= upper {
+		return 0, fmt.Errorf("%w %v: bounds (%v, %v)", ErrNoImpliedVolatility, price, lower, upper)
+	}
+	// метод Ньютона с защитой бисекцией: цена монотонно растет по волатильности
+	lo, hi := ivMin, ivMax
+	p.Volatility = 0.3
+	for i := 0; i < ivMaxIterations; i++ {
+		diff := OptionPrice(p) - price
+		if math.Abs(diff) < ivTolerance {
+			return p.Volatility, nil
+		}
+		if diff > 0 {
+			hi = p.Volatility
+		} else {
+			lo = p.Volatility
+		}
+		next := lo + (hi-lo)/2
+		if vega := OptionGreeks(p).Vega * 100; vega > 1e-12 {
+			if newton := p.Volatility - diff/vega; newton > lo && newton < hi {
+				next = newton
+			}
+		}
+		if hi-lo < ivTolerance {
+			return next, nil
+		}
+		p.Volatility = next
+	}
+	return p.Volatility, nil
+}
+
+// costOfCarry - Стоимость переноса базового актива: 0 для фьючерса, r - q для акции
+func (p OptionParams) costOfCarry() float64 {
+	if p.Model == MODEL_BLACK_SCHOLES {
+		return p.Rate - p.DividendYield
+	}
+	return 0
+}
+
+// carry - Множители exp((b-r)T) для базового актива и exp(-rT) для страйка
+func (p OptionParams) carry() (float64, float64) {
+	t := p.Expiry
+	if t < 0 {
+		t = 0
+	}
+	return math.Exp((p.costOfCarry() - p.Rate) * t), math.Exp(-p.Rate * t)
+}
+
+func (p OptionParams) d() (float64, float64) {
+	volT := p.Volatility * math.Sqrt(p.Expiry)
+	d1 := (math.Log(p.Underlying/p.Strike) + (p.costOfCarry()+p.Volatility*p.Volatility/2)*p.Expiry) / volT
+	return d1, d1 - volT
+}
+
+// intrinsic - Дисконтированная внутренняя стоимость, нижняя граница цены европейского опциона
+func intrinsic(p OptionParams) float64 {
+	carry, discount := p.carry()
+	v := p.Underlying*carry - p.Strike*discount
+	if !p.Call {
+		v = -v
+	}
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func normCDF(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+func normPDF(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
@@ -0,0 +1,274 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// atTheMoney - Опцион на деньгах: S = K = 100, T = 1 год, r = 5%, σ = 20%
+func atTheMoney(model OptionModel, call bool) OptionParams {
+	return OptionParams{Model: model, Call: call, Underlying: 100, Strike: 100, Expiry: 1, Rate: 0.05, Volatility: 0.2}
+}
+
+func checkClose(t *testing.T, name string, got, want, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%v = %v, want %v", name, got, want)
+	}
+}
+
+func TestOptionGreeks(t *testing.T) {
+	tests := []struct {
+		name                             string
+		p                                OptionParams
+		price, delta, gamma, vega, theta float64
+	}{
+		{"black-scholes call", atTheMoney(MODEL_BLACK_SCHOLES, true), 10.4506, 0.6368, 0.018762, 0.37524, -0.017573},
+		{"black-scholes put", atTheMoney(MODEL_BLACK_SCHOLES, false), 5.5735, -0.3632, 0.018762, 0.37524, -0.004542},
+		{"black-76 call", atTheMoney(MODEL_BLACK_76, true), 7.5771, 0.5135, 0.018880, 0.37759, -0.009307},
+		{"black-76 put", atTheMoney(MODEL_BLACK_76, false), 7.5771, -0.4377, 0.018880, 0.37759, -0.009307},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := OptionGreeks(tt.p)
+			checkClose(t, "price", g.Price, tt.price, 1e-4)
+			checkClose(t, "OptionPrice", OptionPrice(tt.p), g.Price, 1e-12)
+			checkClose(t, "delta", g.Delta, tt.delta, 1e-4)
+			checkClose(t, "gamma", g.Gamma, tt.gamma, 1e-6)
+			checkClose(t, "vega", g.Vega, tt.vega, 1e-5)
+			checkClose(t, "theta", g.Theta, tt.theta, 1e-6)
+		})
+	}
+
+	// Black-76 на форвардной цене совпадает с Black-Scholes на споте
+	forward := atTheMoney(MODEL_BLACK_76, true)
+	forward.Underlying = 100 * math.Exp(0.05)
+	checkClose(t, "black-76 on forward", OptionPrice(forward), 10.4506, 1e-4)
+}
+
+func TestPutCallParity(t *testing.T) {
+	for _, model := range []OptionModel{MODEL_BLACK_SCHOLES, MODEL_BLACK_76} {
+		for _, strike := range []float64{70, 100, 130} {
+			call := atTheMoney(model, true)
+			call.Strike, call.DividendYield = strike, 0.02
+			put := call
+			put.Call = false
+			// C - P = S·exp((b-r)T) - K·exp(-rT)
+			carry, discount := call.carry()
+			want := call.Underlying*carry - strike*discount
+			checkClose(t, model.String()+" parity", OptionPrice(call)-OptionPrice(put), want, 1e-9)
+			checkClose(t, model.String()+" delta parity", OptionGreeks(call).Delta-OptionGreeks(put).Delta, carry, 1e-9)
+		}
+	}
+}
+
+func TestImpliedVolatility(t *testing.T) {
+	for _, model := range []OptionModel{MODEL_BLACK_SCHOLES, MODEL_BLACK_76} {
+		for _, call := range []bool{true, false} {
+			for _, strike := range []float64{80, 100, 125} {
+				for _, vol := range []float64{0.1, 0.2, 0.8, 3} {
+					p := atTheMoney(model, call)
+					p.Strike, p.Volatility = strike, vol
+					price := OptionPrice(p)
+					p.Volatility = 0
+					iv, err := ImpliedVolatility(p, price)
+					if err != nil || math.Abs(iv-vol) > 1e-6 {
+						t.Errorf("%v call=%v K=%v σ=%v: iv = %v, %v", model, call, strike, vol, iv, err)
+					}
+				}
+			}
+		}
+	}
+
+	call := atTheMoney(MODEL_BLACK_SCHOLES, true)
+	for _, price := range []float64{0, 4.8, 100} {
+		if _, err := ImpliedVolatility(call, price); !errors.Is(err, ErrNoImpliedVolatility) {
+			t.Errorf("price %v: err = %v", price, err)
+		}
+	}
+	call.Expiry = 0
+	if _, err := ImpliedVolatility(call, 10); !errors.Is(err, ErrNoImpliedVolatility) {
+		t.Errorf("expired: err = %v", err)
+	}
+}
+
+func TestOptionGreeksEdges(t *testing.T) {
+	tests := []struct {
+		name         string
+		p            func() OptionParams
+		price, delta float64
+	}{
+		{"expired in the money", func() OptionParams {
+			p := atTheMoney(MODEL_BLACK_SCHOLES, true)
+			p.Underlying, p.Expiry = 110, 0
+			return p
+		}, 10, 1},
+		{"expired out of the money", func() OptionParams {
+			p := atTheMoney(MODEL_BLACK_SCHOLES, true)
+			p.Underlying, p.Expiry = 90, 0
+			return p
+		}, 0, 0},
+		{"expired put", func() OptionParams {
+			p := atTheMoney(MODEL_BLACK_76, false)
+			p.Underlying, p.Expiry = 90, -0.1
+			return p
+		}, 10, -1},
+		// без волатильности цена - дисконтированная внутренняя стоимость: 100 - 100·exp(-0.05)
+		{"zero volatility call", func() OptionParams {
+			p := atTheMoney(MODEL_BLACK_SCHOLES, true)
+			p.Volatility = 0
+			return p
+		}, 4.877058, 1},
+		{"zero volatility put", func() OptionParams {
+			p := atTheMoney(MODEL_BLACK_SCHOLES, false)
+			p.Volatility = 0
+			return p
+		}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := OptionGreeks(tt.p())
+			checkClose(t, "price", g.Price, tt.price, 1e-6)
+			checkClose(t, "delta", g.Delta, tt.delta, 1e-9)
+			if g.Gamma != 0 || g.Vega != 0 || g.Theta != 0 {
+				t.Errorf("greeks = %+v", g)
+			}
+		})
+	}
+}
+
+var optionNow = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+// testOptionContract - Маржируемый колл на фьючерс со страйком 100 и экспирацией через год после optionNow
+func testOptionContract() *pb.Option {
+	return &pb.Option{
+		Uid:                   "uid-option",
+		Ticker:                "SI100C",
+		BasicAssetPositionUid: "pos-future",
+		BasicAssetSize:        &pb.Quotation{Units: 10},
+		StrikePrice:           &pb.MoneyValue{Currency: "rub", Units: 100},
+		Direction:             pb.OptionDirection_OPTION_DIRECTION_CALL,
+		PaymentType:           pb.OptionPaymentType_OPTION_PAYMENT_TYPE_MARGINAL,
+		ExpirationDate:        investgo.TimeToTimestamp(optionNow.AddDate(1, 0, 0)),
+	}
+}
+
+func TestNewOptionParams(t *testing.T) {
+	in := OptionInputs{Underlying: decimal.NewFromInt(100), Rate: 0.05, Clock: investgo.NewSimulatedClock(optionNow)}
+	p, err := NewOptionParams(testOptionContract(), in)
+	if err != nil {
+		t.Fatalf("NewOptionParams: %v", err)
+	}
+	// срок считается от часов, ставка маржируемого опциона обнуляется
+	if p.Expiry != 1 || p.Rate != 0 || !p.Call || p.Strike != 100 || p.Underlying != 100 || p.Model != MODEL_BLACK_76 {
+		t.Fatalf("params = %+v", p)
+	}
+	in.Now = optionNow.Add(DAYS_IN_YEAR * 12 * time.Hour)
+	if p, err = NewOptionParams(testOptionContract(), in); err != nil || p.Expiry != 0.5 {
+		t.Fatalf("params at Now = %+v, %v", p, err)
+	}
+	in.Now = optionNow.AddDate(2, 0, 0)
+	if p, err = NewOptionParams(testOptionContract(), in); err != nil || p.Expiry != 0 {
+		t.Fatalf("expired params = %+v, %v", p, err)
+	}
+
+	option := testOptionContract()
+	option.Direction = pb.OptionDirection_OPTION_DIRECTION_UNSPECIFIED
+	if _, err := NewOptionParams(option, in); err == nil {
+		t.Fatal("unspecified direction must fail")
+	}
+	in.Underlying = decimal.Zero
+	if _, err := NewOptionParams(testOptionContract(), in); err == nil {
+		t.Fatal("zero underlying must fail")
+	}
+}
+
+// fakeOptionApi - Опцион testOptionContract, его базовый актив и цены последних сделок по uid
+type fakeOptionApi struct {
+	pb.UnimplementedInstrumentsServiceServer
+	pb.UnimplementedMarketDataServiceServer
+	prices map[string]decimal.Decimal
+}
+
+func (f *fakeOptionApi) OptionBy(_ context.Context, in *pb.InstrumentRequest) (*pb.OptionResponse, error) {
+	if in.GetId() != "uid-option" {
+		return nil, status.Error(codes.NotFound, "option not found")
+	}
+	return &pb.OptionResponse{Instrument: testOptionContract()}, nil
+}
+
+func (f *fakeOptionApi) GetInstrumentBy(_ context.Context, in *pb.InstrumentRequest) (*pb.InstrumentResponse, error) {
+	if in.GetId() != "pos-future" {
+		return nil, status.Error(codes.NotFound, "instrument not found")
+	}
+	return &pb.InstrumentResponse{Instrument: &pb.Instrument{Uid: "uid-future", PositionUid: "pos-future"}}, nil
+}
+
+func (f *fakeOptionApi) GetLastPrices(_ context.Context, in *pb.GetLastPricesRequest) (*pb.GetLastPricesResponse, error) {
+	resp := &pb.GetLastPricesResponse{}
+	for _, id := range in.GetInstrumentId() {
+		if price, ok := f.prices[id]; ok {
+			resp.LastPrices = append(resp.LastPrices, &pb.LastPrice{
+				InstrumentUid: id,
+				Price:         investgo.DecimalToQuotation(price),
+				Time:          investgo.TimeToTimestamp(optionNow),
+			})
+		}
+	}
+	return resp, nil
+}
+
+func TestOptionPositions(t *testing.T) {
+	params := OptionParams{Model: MODEL_BLACK_76, Call: true, Underlying: 100, Strike: 100, Expiry: 1, Volatility: 0.25}
+	api := &fakeOptionApi{prices: map[string]decimal.Decimal{
+		"uid-future": decimal.NewFromInt(100),
+		"uid-option": decimal.NewFromFloat(OptionPrice(params)).Round(9),
+	}}
+	client := newTestClient(t, investgo.NewSimulatedClock(optionNow), func(server *grpc.Server) {
+		pb.RegisterInstrumentsServiceServer(server, api)
+		pb.RegisterMarketDataServiceServer(server, api)
+	})
+	conf := OptionPositionsConfig{
+		Instruments: client.NewInstrumentsServiceClient(),
+		MarketData:  client.NewMarketDataServiceClient(),
+		Rate:        0.1,
+	}
+	positions, err := OptionPositions([]*pb.PositionsOptions{
+		{InstrumentUid: "uid-option", Balance: 1, Blocked: 1},
+		{InstrumentUid: "uid-closed"},
+	}, conf)
+	if err != nil {
+		t.Fatalf("OptionPositions: %v", err)
+	}
+	// срок до экспирации считается по часам клиента, волатильность - по цене последней сделки
+	if len(positions) != 1 || positions[0].Quantity != 2 || positions[0].Params.Expiry != 1 || positions[0].Params.Rate != 0 {
+		t.Fatalf("positions = %+v", positions)
+	}
+	p := positions[0]
+	checkClose(t, "volatility", p.Params.Volatility, 0.25, 1e-6)
+	want := OptionGreeks(params)
+	exposure := AggregateGreeks(positions)
+	checkClose(t, "price", exposure.Price, want.Price*20, 1e-6)
+	checkClose(t, "delta", exposure.Delta, want.Delta*20, 1e-6)
+
+	// без цены опциона и без волатильности по умолчанию оценка невозможна
+	delete(api.prices, "uid-option")
+	if _, err := OptionPositions([]*pb.PositionsOptions{{InstrumentUid: "uid-option", Balance: -1}}, conf); err == nil {
+		t.Fatal("option without price and volatility must fail")
+	}
+	conf.Volatility = 0.3
+	positions, err = OptionPositions([]*pb.PositionsOptions{{InstrumentUid: "uid-option", Balance: -1}}, conf)
+	if err != nil || len(positions) != 1 || positions[0].Params.Volatility != 0.3 || positions[0].Exposure().Delta >= 0 {
+		t.Fatalf("positions = %+v, %v", positions, err)
+	}
+}
@@ -0,0 +1,371 @@
+package backtest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/internal/matching"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+var (
+	// ErrNotEnoughMoney - Недостаточно денежных средств для исполнения заявки, та же ошибка, что у симулятора
+	ErrNotEnoughMoney = simulator.ErrNotEnoughMoney
+	// ErrNotEnoughAssets - Недостаточно бумаг для продажи, если короткие позиции запрещены
+	ErrNotEnoughAssets = simulator.ErrNotEnoughAssets
+)
+
+// OrderRequest - Запрос на выставление заявки в бектесте
+type OrderRequest struct {
+	// InstrumentId - uid или figi инструмента
+	InstrumentId string
+	Direction    pb.OrderDirection
+	// Type - Тип заявки, поддерживаются рыночные и лимитные заявки
+	Type pb.OrderType
+	// Lots - Количество лотов
+	Lots int64
+	// Price - Цена за 1 инструмент для лимитной заявки
+	Price decimal.Decimal
+}
+
+// Order - Заявка стратегии
+type Order struct {
+	Id string
+	// InstrumentId - uid инструмента
+	InstrumentId string
+	Direction    pb.OrderDirection
+	Type         pb.OrderType
+	Lots         int64
+	Price        decimal.Decimal
+	Status       pb.OrderExecutionReportStatus
+	Created      time.Time
+}
+
+// Trade - Сделка по заявке стратегии
+type Trade struct {
+	OrderId      string
+	InstrumentId string
+	Time         time.Time
+	Direction    pb.OrderDirection
+	Price        decimal.Decimal
+	// Quantity - Количество в штуках
+	Quantity   int64
+	Commission decimal.Decimal
+	// Closing - Сделка полностью или частично закрывает позицию
+	Closing bool
+	// PnL - Реализованный результат по закрытой части позиции за вычетом комиссии этой сделки
+	PnL decimal.Decimal
+}
+
+// Position - Позиция по инструменту
+type Position struct {
+	InstrumentId string
+	// Quantity - Количество в штуках, отрицательное для короткой позиции
+	Quantity int64
+	AvgPrice decimal.Decimal
+	// RealizedPnL - Реализованный результат по инструменту без учета комиссий
+	RealizedPnL decimal.Decimal
+}
+
+// quote - Цены последнего события по инструменту, по ним исполняются заявки
+type quote struct {
+	low, high, open decimal.Decimal
+	// bid, ask - Лучшие цены стакана, если событие - стакан
+	bid, ask decimal.Decimal
+	book     bool
+}
+
+// Broker - Симулятор брокера для стратегии, исполняет заявки по следующим после их выставления событиям
+type Broker struct {
+	conf        *Config
+	instruments map[string]*simulator.Instrument
+
+	now        time.Time
+	cash       decimal.Decimal
+	positions  map[string]*Position
+	lastPrices map[string]decimal.Decimal
+	orders     []*Order
+	orderSeq   int64
+	trades     []Trade
+	// fills - Исполнения, о которых еще не уведомлена стратегия
+	fills []Trade
+}
+
+func newBroker(conf *Config, instruments map[string]*simulator.Instrument) *Broker {
+	return &Broker{
+		conf:        conf,
+		instruments: instruments,
+		cash:        decimal.NewFromFloat(conf.InitialCash),
+		positions:   make(map[string]*Position),
+		lastPrices:  make(map[string]decimal.Decimal),
+		orders:      make([]*Order, 0),
+		trades:      make([]Trade, 0),
+	}
+}
+
+// Now - Время текущего события
+func (b *Broker) Now() time.Time {
+	return b.now
+}
+
+// Cash - Свободные денежные средства
+func (b *Broker) Cash() decimal.Decimal {
+	return b.cash
+}
+
+// Equity - Стоимость портфеля по последним ценам
+func (b *Broker) Equity() decimal.Decimal {
+	equity := b.cash
+	for id, p := range b.positions {
+		price, ok := b.lastPrices[id]
+		if !ok {
+			price = p.AvgPrice
+		}
+		equity = equity.Add(price.Mul(decimal.NewFromInt(p.Quantity)))
+	}
+	return equity
+}
+
+// Position - Позиция по инструменту, если позиции нет, то Quantity = 0
+func (b *Broker) Position(instrumentId string) Position {
+	inst, ok := b.instruments[instrumentId]
+	if !ok {
+		return Position{InstrumentId: instrumentId}
+	}
+	p, ok := b.positions[inst.Uid]
+	if !ok {
+		return Position{InstrumentId: inst.Uid}
+	}
+	return *p
+}
+
+// Positions - Все открытые позиции
+func (b *Broker) Positions() []Position {
+	res := make([]Position, 0, len(b.positions))
+	for _, p := range b.positions {
+		if p.Quantity != 0 {
+			res = append(res, *p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].InstrumentId < res[j].InstrumentId
+	})
+	return res
+}
+
+// LastPrice - Последняя известная цена инструмента
+func (b *Broker) LastPrice(instrumentId string) (decimal.Decimal, bool) {
+	inst, ok := b.instruments[instrumentId]
+	if !ok {
+		return decimal.Zero, false
+	}
+	price, ok := b.lastPrices[inst.Uid]
+	return price, ok
+}
+
+// ActiveOrders - Активные заявки
+func (b *Broker) ActiveOrders() []Order {
+	res := make([]Order, 0, len(b.orders))
+	for _, o := range b.orders {
+		res = append(res, *o)
+	}
+	return res
+}
+
+// PostOrder - Выставление заявки, возвращает идентификатор заявки. Заявка исполняется не раньше следующего события
+// по инструменту, чтобы стратегия не могла заглянуть в будущее
+func (b *Broker) PostOrder(req OrderRequest) (string, error) {
+	inst, ok := b.instruments[req.InstrumentId]
+	if !ok {
+		return "", fmt.Errorf("instrument %v not found", req.InstrumentId)
+	}
+	if req.Lots < 1 {
+		return "", fmt.Errorf("lots must be positive")
+	}
+	if req.Direction == pb.OrderDirection_ORDER_DIRECTION_UNSPECIFIED {
+		return "", fmt.Errorf("direction is unspecified")
+	}
+	switch req.Type {
+	case pb.OrderType_ORDER_TYPE_MARKET, pb.OrderType_ORDER_TYPE_BESTPRICE:
+		req.Type = pb.OrderType_ORDER_TYPE_MARKET
+	case pb.OrderType_ORDER_TYPE_LIMIT:
+		if err := matching.CheckPriceStep(req.Price, investgo.QuotationToDecimal(inst.MinPriceIncrement)); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("order type %v is not supported", req.Type.String())
+	}
+	b.orderSeq++
+	o := &Order{
+		Id:           fmt.Sprintf("%v", b.orderSeq),
+		InstrumentId: inst.Uid,
+		Direction:    req.Direction,
+		Type:         req.Type,
+		Lots:         req.Lots,
+		Price:        req.Price,
+		Status:       pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW,
+		Created:      b.now,
+	}
+	b.orders = append(b.orders, o)
+	return o.Id, nil
+}
+
+// Buy - Рыночная заявка на покупку
+func (b *Broker) Buy(instrumentId string, lots int64) (string, error) {
+	return b.PostOrder(OrderRequest{
+		InstrumentId: instrumentId,
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_BUY,
+		Type:         pb.OrderType_ORDER_TYPE_MARKET,
+		Lots:         lots,
+	})
+}
+
+// Sell - Рыночная заявка на продажу
+func (b *Broker) Sell(instrumentId string, lots int64) (string, error) {
+	return b.PostOrder(OrderRequest{
+		InstrumentId: instrumentId,
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_SELL,
+		Type:         pb.OrderType_ORDER_TYPE_MARKET,
+		Lots:         lots,
+	})
+}
+
+// BuyLimit - Лимитная заявка на покупку
+func (b *Broker) BuyLimit(instrumentId string, lots int64, price decimal.Decimal) (string, error) {
+	return b.PostOrder(OrderRequest{
+		InstrumentId: instrumentId,
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_BUY,
+		Type:         pb.OrderType_ORDER_TYPE_LIMIT,
+		Lots:         lots,
+		Price:        price,
+	})
+}
+
+// SellLimit - Лимитная заявка на продажу
+func (b *Broker) SellLimit(instrumentId string, lots int64, price decimal.Decimal) (string, error) {
+	return b.PostOrder(OrderRequest{
+		InstrumentId: instrumentId,
+		Direction:    pb.OrderDirection_ORDER_DIRECTION_SELL,
+		Type:         pb.OrderType_ORDER_TYPE_LIMIT,
+		Lots:         lots,
+		Price:        price,
+	})
+}
+
+// CancelOrder - Отмена активной заявки
+func (b *Broker) CancelOrder(orderId string) error {
+	for i, o := range b.orders {
+		if o.Id == orderId {
+			b.orders = append(b.orders[:i], b.orders[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("order %v not found", orderId)
+}
+
+// CancelAll - Отмена всех активных заявок по инструменту, если instrumentId пустой - по всем инструментам
+func (b *Broker) CancelAll(instrumentId string) {
+	uid := instrumentId
+	if inst, ok := b.instruments[instrumentId]; ok {
+		uid = inst.Uid
+	}
+	active := b.orders[:0]
+	for _, o := range b.orders {
+		if instrumentId != "" && o.InstrumentId != uid {
+			active = append(active, o)
+		}
+	}
+	b.orders = active
+}
+
+// match - Исполнение активных заявок инструмента по ценам нового события
+func (b *Broker) match(inst *simulator.Instrument, q quote) {
+	// заявки, выставленные стратегией в OnFill во время сопоставления, исполняются со следующим событием
+	pending := make([]*Order, len(b.orders))
+	copy(pending, b.orders)
+	for _, o := range pending {
+		if o.InstrumentId != inst.Uid {
+			continue
+		}
+		low, high, open := q.low, q.high, q.open
+		if q.book {
+			low, high, open = q.ask, q.ask, q.ask
+			if o.Direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+				low, high, open = q.bid, q.bid, q.bid
+			}
+			if !open.IsPositive() {
+				continue
+			}
+		}
+		price := open
+		if o.Type == pb.OrderType_ORDER_TYPE_MARKET {
+			if b.conf.Slippage != nil {
+				price = b.conf.Slippage.Price(inst, o.Direction, open, o.Lots*inst.Lot)
+			}
+		} else {
+			var ok bool
+			if price, ok = matching.LimitPrice(o.Direction, o.Price, low, high, open); !ok {
+				continue
+			}
+		}
+		b.removeOrder(o.Id)
+		if err := b.fill(inst, o, price); err != nil {
+			o.Status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED
+			b.conf.errorf("order %v rejected: %v", o.Id, err.Error())
+		}
+	}
+}
+
+func (b *Broker) removeOrder(id string) {
+	for i, o := range b.orders {
+		if o.Id == id {
+			b.orders = append(b.orders[:i], b.orders[i+1:]...)
+			return
+		}
+	}
+}
+
+// fill - Исполнение заявки целиком по цене price, изменение денежных средств и позиции
+func (b *Broker) fill(inst *simulator.Instrument, o *Order, price decimal.Decimal) error {
+	pieces := o.Lots * inst.Lot
+	var commission decimal.Decimal
+	if b.conf.Commission != nil {
+		commission = b.conf.Commission.Commission(inst, price, pieces)
+	}
+	p, ok := b.positions[inst.Uid]
+	if !ok {
+		p = &Position{InstrumentId: inst.Uid}
+	}
+	mp := matching.Position{Quantity: p.Quantity, AvgPrice: p.AvgPrice}
+	cash, realized, closing, err := matching.Settle(b.cash, &mp, o.Direction, price, pieces, commission, b.conf.AllowShort)
+	if err != nil {
+		return err
+	}
+	b.cash = cash
+	p.Quantity, p.AvgPrice = mp.Quantity, mp.AvgPrice
+	p.RealizedPnL = p.RealizedPnL.Add(realized)
+	b.positions[inst.Uid] = p
+	if p.Quantity == 0 {
+		delete(b.positions, inst.Uid)
+	}
+
+	o.Status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL
+	t := Trade{
+		OrderId:      o.Id,
+		InstrumentId: inst.Uid,
+		Time:         b.now,
+		Direction:    o.Direction,
+		Price:        price,
+		Quantity:     pieces,
+		Commission:   commission,
+		Closing:      closing,
+		PnL:          realized.Sub(commission),
+	}
+	b.trades = append(b.trades, t)
+	b.fills = append(b.fills, t)
+	return nil
+}
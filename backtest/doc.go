@@ -0,0 +1,21 @@
+/*
+Package backtest предоставляет движок для проверки торговых стратегий на исторических данных.
+
+Стратегия реализует интерфейс Strategy и получает события ленты рыночных данных: свечи, обезличенные сделки
+и стаканы, а так же уведомления об исполнении своих заявок. Заявки выставляются через Broker, который
+исполняет их по следующим событиям ленты с учетом модели комиссии и проскальзывания. Учет денежных средств
+и позиций по нескольким инструментам ведется в decimal.Decimal без потери точности, расчет сделок и цены
+исполнения лимитных заявок общие с симулятором биржи simulator.
+
+	engine := backtest.NewEngine(backtest.Config{
+		InitialCash: 100000,
+		Instruments: []simulator.Instrument{{Uid: uid, Lot: 1}},
+		Commission:  backtest.PercentCommission{Percent: decimal.RequireFromString("0.05")},
+		Slippage:    backtest.TickSlippage{Ticks: 1},
+	})
+	res, err := engine.Run(ctx, strategy, simulator.CandleEvents(uid, candles))
+
+Результат Result содержит список сделок, кривую доходности с просадками, максимальную просадку,
+долю прибыльных сделок и коэффициент Шарпа.
+*/
+package backtest
@@ -0,0 +1,223 @@
+package backtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/internal/matching"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+// Config - Конфигурация бектеста
+type Config struct {
+	// InitialCash - Начальный баланс денежных средств
+	InitialCash float64
+	// Instruments - Инструменты, которыми торгует стратегия
+	Instruments []simulator.Instrument
+	// Commission - Модель комиссии, если nil - без комиссии
+	Commission CommissionModel
+	// Slippage - Модель проскальзывания рыночных заявок, если nil - без проскальзывания
+	Slippage SlippageModel
+	// AllowShort - Разрешение на открытие коротких позиций
+	AllowShort bool
+	// ClosePositions - Закрыть все позиции по последним ценам после окончания ленты событий
+	ClosePositions bool
+	// RiskFreeRate - Годовая безрисковая ставка в процентах для расчета коэффициента Шарпа
+	RiskFreeRate float64
+	// PeriodsPerYear - Количество торговых дней в году для расчета коэффициента Шарпа, по умолчанию = 252
+	PeriodsPerYear float64
+	// Logger - Логгер, может быть nil
+	Logger investgo.Logger
+}
+
+func (c *Config) infof(template string, args ...any) {
+	if c.Logger != nil {
+		c.Logger.Infof(template, args...)
+	}
+}
+
+func (c *Config) errorf(template string, args ...any) {
+	if c.Logger != nil {
+		c.Logger.Errorf(template, args...)
+	}
+}
+
+// Engine - Движок бектеста. Один Engine можно использовать для нескольких прогонов, в том числе параллельных,
+// лента событий при прогоне не изменяется
+type Engine struct {
+	conf        Config
+	instruments map[string]*simulator.Instrument
+}
+
+// NewEngine - Создание движка бектеста
+func NewEngine(conf Config) *Engine {
+	if conf.PeriodsPerYear <= 0 {
+		conf.PeriodsPerYear = 252
+	}
+	e := &Engine{
+		conf:        conf,
+		instruments: make(map[string]*simulator.Instrument, len(conf.Instruments)*2),
+	}
+	for i := range conf.Instruments {
+		inst := conf.Instruments[i]
+		if inst.Lot < 1 {
+			inst.Lot = 1
+		}
+		if inst.Uid != "" {
+			e.instruments[inst.Uid] = &inst
+		}
+		if inst.Figi != "" {
+			e.instruments[inst.Figi] = &inst
+		}
+	}
+	return e
+}
+
+// Run - Прогон стратегии по ленте событий, события должны быть отсортированы по времени (simulator.SortEvents)
+func (e *Engine) Run(ctx context.Context, s Strategy, events []simulator.Event) (*Result, error) {
+	b := newBroker(&e.conf, e.instruments)
+	curve := make([]EquityPoint, 0)
+	for _, ev := range events {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if err := e.process(b, s, ev); err != nil {
+			return nil, err
+		}
+		curve = appendEquity(curve, b.now, b.Equity())
+	}
+	if e.conf.ClosePositions {
+		e.closePositions(b, s)
+		curve = appendEquity(curve, b.now, b.Equity())
+	}
+	e.conf.infof("backtest finished: %v events, %v trades", len(events), len(b.trades))
+	return newResult(&e.conf, b, curve), nil
+}
+
+// process - Обработка события: исполнение заявок по новым ценам, уведомление стратегии
+func (e *Engine) process(b *Broker, s Strategy, ev simulator.Event) error {
+	var (
+		id string
+		q  quote
+		// last - Последняя цена после события
+		last decimal.Decimal
+	)
+	switch {
+	case ev.Candle != nil:
+		id = ev.InstrumentId
+		q = quote{
+			low:  investgo.QuotationToDecimal(ev.Candle.GetLow()),
+			high: investgo.QuotationToDecimal(ev.Candle.GetHigh()),
+			open: investgo.QuotationToDecimal(ev.Candle.GetOpen()),
+		}
+		last = investgo.QuotationToDecimal(ev.Candle.GetClose())
+	case ev.Trade != nil:
+		id = ev.Trade.GetInstrumentUid()
+		if id == "" {
+			id = ev.Trade.GetFigi()
+		}
+		price := investgo.QuotationToDecimal(ev.Trade.GetPrice())
+		q = quote{low: price, high: price, open: price}
+		last = price
+	case ev.OrderBook != nil:
+		id = ev.OrderBook.GetInstrumentUid()
+		if id == "" {
+			id = ev.OrderBook.GetFigi()
+		}
+		q.book = true
+		if len(ev.OrderBook.GetBids()) > 0 {
+			q.bid = investgo.QuotationToDecimal(ev.OrderBook.GetBids()[0].GetPrice())
+		}
+		if len(ev.OrderBook.GetAsks()) > 0 {
+			q.ask = investgo.QuotationToDecimal(ev.OrderBook.GetAsks()[0].GetPrice())
+		}
+		switch {
+		case q.bid.IsPositive() && q.ask.IsPositive():
+			last = q.bid.Add(q.ask).Div(decimal.NewFromInt(2))
+		case q.bid.IsPositive():
+			last = q.bid
+		default:
+			last = q.ask
+		}
+	default:
+		return fmt.Errorf("empty event")
+	}
+	inst, ok := e.instruments[id]
+	if !ok {
+		return fmt.Errorf("instrument %v not found", id)
+	}
+	if t := ev.Time(); t.After(b.now) {
+		b.now = t
+	}
+
+	b.match(inst, q)
+	e.notifyFills(b, s)
+	if last.IsPositive() {
+		b.lastPrices[inst.Uid] = last
+	}
+
+	switch {
+	case ev.Candle != nil:
+		s.OnCandle(b, inst.Uid, ev.Candle)
+	case ev.Trade != nil:
+		s.OnTrade(b, ev.Trade)
+	case ev.OrderBook != nil:
+		s.OnOrderBook(b, ev.OrderBook)
+	}
+	return nil
+}
+
+// notifyFills - Уведомление стратегии об исполнениях, в том числе о вызванных ее реакцией на исполнение
+func (e *Engine) notifyFills(b *Broker, s Strategy) {
+	for len(b.fills) > 0 {
+		f := b.fills[0]
+		b.fills = b.fills[1:]
+		s.OnFill(b, f)
+	}
+}
+
+// closePositions - Снятие заявок и закрытие позиций по последним ценам
+func (e *Engine) closePositions(b *Broker, s Strategy) {
+	b.CancelAll("")
+	for _, p := range b.Positions() {
+		inst := e.instruments[p.InstrumentId]
+		direction := pb.OrderDirection_ORDER_DIRECTION_SELL
+		if p.Quantity < 0 {
+			direction = pb.OrderDirection_ORDER_DIRECTION_BUY
+		}
+		// позиция может быть не кратна лоту, поэтому закрываем ее заявкой с лотностью 1
+		unit := *inst
+		unit.Lot = 1
+		b.orderSeq++
+		o := &Order{
+			Id:           fmt.Sprintf("%v", b.orderSeq),
+			InstrumentId: inst.Uid,
+			Direction:    direction,
+			Type:         pb.OrderType_ORDER_TYPE_MARKET,
+			Lots:         matching.Abs(p.Quantity),
+			Created:      b.now,
+		}
+		price := b.lastPrices[inst.Uid]
+		if e.conf.Slippage != nil {
+			price = e.conf.Slippage.Price(inst, direction, price, matching.Abs(p.Quantity))
+		}
+		if err := b.fill(&unit, o, price); err != nil {
+			e.conf.errorf("close position %v: %v", inst.Uid, err.Error())
+		}
+	}
+	e.notifyFills(b, s)
+}
+
+func appendEquity(curve []EquityPoint, t time.Time, equity decimal.Decimal) []EquityPoint {
+	if n := len(curve); n > 0 && curve[n-1].Time.Equal(t) {
+		curve[n-1].Equity = equity
+		return curve
+	}
+	return append(curve, EquityPoint{Time: t, Equity: equity})
+}
@@ -0,0 +1,292 @@
+package backtest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+const testUid = "uid"
+
+var testStart = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+// testStrategy - Стратегия из функций, nil функции ничего не делают
+type testStrategy struct {
+	BaseStrategy
+	onCandle func(b *Broker, i int, c *pb.HistoricCandle)
+	onFill   func(b *Broker, fill Trade)
+	candles  int
+}
+
+func (s *testStrategy) OnCandle(b *Broker, _ string, c *pb.HistoricCandle) {
+	if s.onCandle != nil {
+		s.onCandle(b, s.candles, c)
+	}
+	s.candles++
+}
+
+func (s *testStrategy) OnFill(b *Broker, fill Trade) {
+	if s.onFill != nil {
+		s.onFill(b, fill)
+	}
+}
+
+func price(v float64) *pb.Quotation {
+	return investgo.DecimalToQuotation(decimal.NewFromFloat(v))
+}
+
+// candles - Свечи по одной в день, каждая задана как open, high, low, close
+func candles(ohlc ...[4]float64) []simulator.Event {
+	res := make([]*pb.HistoricCandle, 0, len(ohlc))
+	for i, c := range ohlc {
+		res = append(res, &pb.HistoricCandle{
+			Open:  price(c[0]),
+			High:  price(c[1]),
+			Low:   price(c[2]),
+			Close: price(c[3]),
+			Time:  investgo.TimeToTimestamp(testStart.Add(time.Duration(i) * 24 * time.Hour)),
+		})
+	}
+	return simulator.CandleEvents(testUid, res)
+}
+
+func newTestEngine(cash float64, conf Config) *Engine {
+	conf.InitialCash = cash
+	conf.Instruments = []simulator.Instrument{{Uid: testUid, Lot: 1, MinPriceIncrement: &pb.Quotation{Nano: 10000000}}}
+	return NewEngine(conf)
+}
+
+func TestMarketOrderFillsAtNextOpen(t *testing.T) {
+	events := candles(
+		[4]float64{100, 101, 99, 100},
+		[4]float64{110, 112, 108, 111},
+	)
+	var seenOnCandle []int64
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, c *pb.HistoricCandle) {
+			seenOnCandle = append(seenOnCandle, b.Position(testUid).Quantity)
+			if i == 0 {
+				if _, err := b.Buy(testUid, 1); err != nil {
+					t.Fatalf("Buy: %v", err)
+				}
+			}
+		},
+	}
+	res, err := newTestEngine(1000, Config{}).Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Trades) != 1 {
+		t.Fatalf("trades = %v, want 1", len(res.Trades))
+	}
+	tr := res.Trades[0]
+	// заявка выставлена по закрытию первой свечи и не может исполниться по ее ценам
+	if !tr.Price.Equal(decimal.NewFromInt(110)) {
+		t.Errorf("fill price = %v, want open of the next candle 110", tr.Price)
+	}
+	if !tr.Time.Equal(events[1].Time()) {
+		t.Errorf("fill time = %v, want %v", tr.Time, events[1].Time())
+	}
+	// исполнение видно стратегии уже при обработке следующей свечи
+	if seenOnCandle[0] != 0 || seenOnCandle[1] != 1 {
+		t.Errorf("positions seen by strategy = %v", seenOnCandle)
+	}
+	if !res.FinalEquity.Equal(decimal.NewFromInt(1001)) {
+		t.Errorf("final equity = %v, want 1001", res.FinalEquity)
+	}
+}
+
+func TestLimitOrderIgnoresCurrentCandle(t *testing.T) {
+	events := candles(
+		// цена дошла до 90 в той же свече, по которой стратегия принимает решение
+		[4]float64{100, 101, 90, 100},
+		[4]float64{100, 102, 96, 101},
+		[4]float64{98, 99, 94, 95},
+	)
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			if i == 0 {
+				if _, err := b.BuyLimit(testUid, 1, decimal.NewFromInt(95)); err != nil {
+					t.Fatalf("BuyLimit: %v", err)
+				}
+			}
+		},
+	}
+	res, err := newTestEngine(1000, Config{}).Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Trades) != 1 || !res.Trades[0].Time.Equal(events[2].Time()) {
+		t.Fatalf("trades = %+v, want one fill on the third candle", res.Trades)
+	}
+	if !res.Trades[0].Price.Equal(decimal.NewFromInt(95)) {
+		t.Fatalf("fill price = %v, want 95", res.Trades[0].Price)
+	}
+}
+
+func TestRoundTripCommissionSlippage(t *testing.T) {
+	events := candles(
+		[4]float64{100, 100, 100, 100},
+		[4]float64{100, 100, 100, 100},
+		[4]float64{120, 120, 120, 120},
+		[4]float64{120, 120, 120, 120},
+	)
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			var err error
+			switch i {
+			case 0:
+				_, err = b.Buy(testUid, 2)
+			case 2:
+				_, err = b.Sell(testUid, 2)
+			}
+			if err != nil {
+				t.Fatalf("order: %v", err)
+			}
+		},
+	}
+	engine := newTestEngine(1000, Config{
+		Commission: FixedCommission{PerTrade: decimal.NewFromInt(1)},
+		Slippage:   TickSlippage{Ticks: 100},
+	})
+	res, err := engine.Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Trades) != 2 {
+		t.Fatalf("trades = %v, want 2", len(res.Trades))
+	}
+	buy, sell := res.Trades[0], res.Trades[1]
+	// проскальзывание 100 шагов по 0.01 в худшую сторону
+	if !buy.Price.Equal(decimal.NewFromInt(101)) || !sell.Price.Equal(decimal.NewFromInt(119)) {
+		t.Fatalf("prices = %v, %v, want 101, 119", buy.Price, sell.Price)
+	}
+	if buy.Closing || !sell.Closing {
+		t.Fatal("only the sell must close the position")
+	}
+	if !sell.PnL.Equal(decimal.NewFromInt(35)) {
+		t.Fatalf("sell PnL = %v, want (119-101)*2-1 = 35", sell.PnL)
+	}
+	if !res.FinalEquity.Equal(decimal.NewFromInt(1034)) {
+		t.Fatalf("final equity = %v, want 1034", res.FinalEquity)
+	}
+	if !res.TotalCommission.Equal(decimal.NewFromInt(2)) || res.WinRate != 100 {
+		t.Fatalf("commission = %v, win rate = %v", res.TotalCommission, res.WinRate)
+	}
+	if len(res.Positions) != 0 {
+		t.Fatalf("positions = %+v, want none", res.Positions)
+	}
+}
+
+func TestRejectedOrders(t *testing.T) {
+	events := candles(
+		[4]float64{100, 100, 100, 100},
+		[4]float64{100, 100, 100, 100},
+	)
+	var fills int
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			if i != 0 {
+				return
+			}
+			if _, err := b.Buy(testUid, 20); err != nil {
+				t.Fatalf("Buy: %v", err)
+			}
+			if _, err := b.Sell(testUid, 1); err != nil {
+				t.Fatalf("Sell: %v", err)
+			}
+			if _, err := b.BuyLimit(testUid, 1, decimal.RequireFromString("99.999")); err == nil {
+				t.Fatal("price not multiple of step must be rejected")
+			}
+			if _, err := b.Buy("unknown", 1); err == nil {
+				t.Fatal("unknown instrument must be rejected")
+			}
+		},
+		onFill: func(*Broker, Trade) { fills++ },
+	}
+	res, err := newTestEngine(1000, Config{}).Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fills != 0 || len(res.Trades) != 0 {
+		t.Fatalf("fills = %v, trades = %v, want none", fills, len(res.Trades))
+	}
+	if !res.FinalEquity.Equal(decimal.NewFromInt(1000)) {
+		t.Fatalf("final equity = %v, want 1000", res.FinalEquity)
+	}
+}
+
+func TestBrokerFillErrors(t *testing.T) {
+	engine := newTestEngine(100, Config{})
+	b := newBroker(&engine.conf, engine.instruments)
+	inst := engine.instruments[testUid]
+	tests := []struct {
+		name      string
+		direction pb.OrderDirection
+		lots      int64
+		err       error
+	}{
+		{name: "not enough money", direction: pb.OrderDirection_ORDER_DIRECTION_BUY, lots: 2, err: ErrNotEnoughMoney},
+		{name: "not enough assets", direction: pb.OrderDirection_ORDER_DIRECTION_SELL, lots: 1, err: ErrNotEnoughAssets},
+		{name: "buy", direction: pb.OrderDirection_ORDER_DIRECTION_BUY, lots: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.fill(inst, &Order{Direction: tt.direction, Lots: tt.lots}, decimal.NewFromInt(100))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+	if !errors.Is(ErrNotEnoughMoney, simulator.ErrNotEnoughMoney) || !errors.Is(ErrNotEnoughAssets, simulator.ErrNotEnoughAssets) {
+		t.Fatal("backtest and simulator must share errors")
+	}
+	if !b.Cash().IsZero() || b.Position(testUid).Quantity != 1 {
+		t.Fatalf("cash = %v, position = %v", b.Cash(), b.Position(testUid).Quantity)
+	}
+}
+
+func TestClosePositions(t *testing.T) {
+	events := candles(
+		[4]float64{100, 100, 100, 100},
+		[4]float64{100, 100, 100, 110},
+	)
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			if i == 0 {
+				if _, err := b.Buy(testUid, 3); err != nil {
+					t.Fatalf("Buy: %v", err)
+				}
+			}
+		},
+	}
+	res, err := newTestEngine(1000, Config{ClosePositions: true}).Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Positions) != 0 || len(res.Trades) != 2 {
+		t.Fatalf("positions = %v, trades = %v", len(res.Positions), len(res.Trades))
+	}
+	if last := res.Trades[1]; !last.Price.Equal(decimal.NewFromInt(110)) || !last.PnL.Equal(decimal.NewFromInt(30)) {
+		t.Fatalf("closing trade = %v, PnL %v", last.Price, last.PnL)
+	}
+	if math.Abs(res.TotalReturn-3) > 1e-9 {
+		t.Fatalf("total return = %v, want 3", res.TotalReturn)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := newTestEngine(1000, Config{}).Run(ctx, &testStrategy{}, candles([4]float64{1, 1, 1, 1}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
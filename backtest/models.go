@@ -0,0 +1,90 @@
+package backtest
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+// CommissionModel - Модель комиссии брокера
+type CommissionModel interface {
+	// Commission - Комиссия за сделку объемом quantity штук по цене price
+	Commission(inst *simulator.Instrument, price decimal.Decimal, quantity int64) decimal.Decimal
+}
+
+// SlippageModel - Модель проскальзывания для рыночных заявок
+type SlippageModel interface {
+	// Price - Цена исполнения рыночной заявки с учетом проскальзывания относительно цены price
+	Price(inst *simulator.Instrument, direction pb.OrderDirection, price decimal.Decimal, quantity int64) decimal.Decimal
+}
+
+// PercentCommission - Комиссия в процентах от объема сделки, но не меньше Min
+type PercentCommission struct {
+	Percent decimal.Decimal
+	Min     decimal.Decimal
+}
+
+func (c PercentCommission) Commission(_ *simulator.Instrument, price decimal.Decimal, quantity int64) decimal.Decimal {
+	res := price.Mul(decimal.NewFromInt(quantity)).Mul(c.Percent).Div(decimal.NewFromInt(100)).Round(2)
+	return decimal.Max(res, c.Min)
+}
+
+// FixedCommission - Фиксированная комиссия за сделку
+type FixedCommission struct {
+	PerTrade decimal.Decimal
+}
+
+func (c FixedCommission) Commission(*simulator.Instrument, decimal.Decimal, int64) decimal.Decimal {
+	return c.PerTrade
+}
+
+// PerUnitCommission - Комиссия за каждую штуку инструмента в сделке, например для фьючерсов
+type PerUnitCommission struct {
+	PerUnit decimal.Decimal
+}
+
+func (c PerUnitCommission) Commission(_ *simulator.Instrument, _ decimal.Decimal, quantity int64) decimal.Decimal {
+	return c.PerUnit.Mul(decimal.NewFromInt(quantity))
+}
+
+// PercentSlippage - Проскальзывание в процентах от цены, цена округляется до шага цены инструмента в худшую сторону
+type PercentSlippage struct {
+	Percent decimal.Decimal
+}
+
+func (s PercentSlippage) Price(inst *simulator.Instrument, direction pb.OrderDirection, price decimal.Decimal, _ int64) decimal.Decimal {
+	delta := price.Mul(s.Percent).Div(decimal.NewFromInt(100))
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		return roundToStep(price.Sub(delta), inst, false)
+	}
+	return roundToStep(price.Add(delta), inst, true)
+}
+
+// TickSlippage - Проскальзывание на фиксированное количество шагов цены
+type TickSlippage struct {
+	Ticks int64
+}
+
+func (s TickSlippage) Price(inst *simulator.Instrument, direction pb.OrderDirection, price decimal.Decimal, _ int64) decimal.Decimal {
+	delta := investgo.QuotationToDecimal(inst.MinPriceIncrement).Mul(decimal.NewFromInt(s.Ticks))
+	if direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		return price.Sub(delta)
+	}
+	return price.Add(delta)
+}
+
+// roundToStep - Округление цены до шага цены инструмента вверх или вниз
+func roundToStep(price decimal.Decimal, inst *simulator.Instrument, up bool) decimal.Decimal {
+	step := investgo.QuotationToDecimal(inst.MinPriceIncrement)
+	if !step.IsPositive() {
+		return price
+	}
+	n := price.Div(step)
+	if up {
+		n = n.Ceil()
+	} else {
+		n = n.Floor()
+	}
+	return n.Mul(step)
+}
@@ -0,0 +1,445 @@
+package backtest
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+// Params - Значения параметров стратегии по именам
+type Params map[string]float64
+
+// Param - Параметр стратегии для перебора
+type Param struct {
+	Name string
+	// Min, Max, Step - Границы и шаг перебора, если Step = 0, то при случайном поиске значение берется
+	// из непрерывного диапазона Min-Max, а при переборе по сетке используется только Min
+	Min, Max, Step float64
+	// Values - Явный список значений, если задан, то Min, Max и Step не используются
+	Values []float64
+}
+
+// values - Значения параметра для перебора по сетке
+func (p Param) values() []float64 {
+	if len(p.Values) > 0 {
+		return p.Values
+	}
+	if p.Step <= 0 || p.Max < p.Min {
+		return []float64{p.Min}
+	}
+	n := int(math.Floor((p.Max-p.Min)/p.Step+1e-9)) + 1
+	res := make([]float64, 0, n)
+	for i := 0; i < n; i++ {
+		// округление убирает накопленную погрешность float64
+		res = append(res, math.Round((p.Min+float64(i)*p.Step)*1e9)/1e9)
+	}
+	return res
+}
+
+// SearchSpace - Пространство поиска параметров
+type SearchSpace struct {
+	Params []Param
+	// Random - Если > 0, то вместо полного перебора проверяется Random случайных наборов параметров
+	Random int
+	// Seed - Зерно генератора случайных чисел для воспроизводимости случайного поиска
+	Seed int64
+}
+
+// Generate - Генерация наборов параметров: декартово произведение значений или случайная выборка
+func (s SearchSpace) Generate() []Params {
+	if s.Random > 0 {
+		r := rand.New(rand.NewSource(s.Seed))
+		res := make([]Params, 0, s.Random)
+		for i := 0; i < s.Random; i++ {
+			p := make(Params, len(s.Params))
+			for _, param := range s.Params {
+				if len(param.Values) == 0 && param.Step <= 0 {
+					p[param.Name] = param.Min + r.Float64()*(param.Max-param.Min)
+					continue
+				}
+				values := param.values()
+				p[param.Name] = values[r.Intn(len(values))]
+			}
+			res = append(res, p)
+		}
+		return res
+	}
+	res := []Params{{}}
+	for _, param := range s.Params {
+		values := param.values()
+		next := make([]Params, 0, len(res)*len(values))
+		for _, prev := range res {
+			for _, v := range values {
+				p := make(Params, len(prev)+1)
+				for k, pv := range prev {
+					p[k] = pv
+				}
+				p[param.Name] = v
+				next = append(next, p)
+			}
+		}
+		res = next
+	}
+	return res
+}
+
+// StrategyFactory - Создание новой стратегии с набором параметров, вызывается на каждый прогон
+type StrategyFactory func(p Params) (Strategy, error)
+
+// Objective - Целевая функция, по которой ранжируются результаты, больше - лучше
+type Objective func(r *Result) float64
+
+// ObjectiveTotalReturn - Доходность за период
+func ObjectiveTotalReturn(r *Result) float64 {
+	return r.TotalReturn
+}
+
+// ObjectiveSharpe - Коэффициент Шарпа
+func ObjectiveSharpe(r *Result) float64 {
+	return r.SharpeRatio
+}
+
+// ObjectiveReturnToDrawdown - Отношение доходности к максимальной просадке
+func ObjectiveReturnToDrawdown(r *Result) float64 {
+	if r.MaxDrawdown == 0 {
+		return r.TotalReturn
+	}
+	return r.TotalReturn / r.MaxDrawdown
+}
+
+// ObjectiveWinRate - Доля прибыльных сделок
+func ObjectiveWinRate(r *Result) float64 {
+	return r.WinRate
+}
+
+// SplitMode - Режим разбиения ленты событий при оптимизации
+type SplitMode int
+
+const (
+	// SPLIT_NONE - Все наборы параметров проверяются на всей ленте
+	SPLIT_NONE SplitMode = iota
+	// SPLIT_TRAIN_TEST - Лента делится на обучающую и тестовую части, наборы ранжируются по обучающей,
+	// для каждого набора считается результат на тестовой
+	SPLIT_TRAIN_TEST
+	// SPLIT_WALK_FORWARD - Скользящие окна: в каждом окне лучший на обучающем периоде набор параметров
+	// проверяется на следующем за ним тестовом периоде
+	SPLIT_WALK_FORWARD
+)
+
+// OptimizerConfig - Конфигурация оптимизатора
+type OptimizerConfig struct {
+	Space SearchSpace
+	// Objective - Целевая функция, по умолчанию = ObjectiveTotalReturn
+	Objective Objective
+	// Workers - Количество параллельных прогонов, по умолчанию = runtime.NumCPU()
+	Workers int
+	Split   SplitMode
+	// TrainRatio - Доля обучающей части по времени для SPLIT_TRAIN_TEST, по умолчанию = 0.7
+	TrainRatio float64
+	// TrainPeriod, TestPeriod - Длины обучающего и тестового периодов для SPLIT_WALK_FORWARD,
+	// окна сдвигаются на TestPeriod
+	TrainPeriod time.Duration
+	TestPeriod  time.Duration
+	// Logger - Логгер, может быть nil
+	Logger investgo.Logger
+}
+
+// Optimizer - Параллельный подбор параметров стратегии
+type Optimizer struct {
+	engine  *Engine
+	factory StrategyFactory
+	conf    OptimizerConfig
+}
+
+// NewOptimizer - Создание оптимизатора, все прогоны используют engine и общую ленту событий только на чтение
+func NewOptimizer(engine *Engine, factory StrategyFactory, conf OptimizerConfig) *Optimizer {
+	if conf.Objective == nil {
+		conf.Objective = ObjectiveTotalReturn
+	}
+	if conf.Workers < 1 {
+		conf.Workers = runtime.NumCPU()
+	}
+	if conf.TrainRatio <= 0 || conf.TrainRatio >= 1 {
+		conf.TrainRatio = 0.7
+	}
+	return &Optimizer{
+		engine:  engine,
+		factory: factory,
+		conf:    conf,
+	}
+}
+
+// Entry - Строка таблицы результатов
+type Entry struct {
+	Rank int `json:"rank"`
+	// Fold - Номер окна для SPLIT_WALK_FORWARD, иначе 0
+	Fold   int    `json:"fold"`
+	Params Params `json:"params"`
+	// Score - Значение целевой функции на обучающем периоде (на всей ленте для SPLIT_NONE)
+	Score float64 `json:"score"`
+	// TestScore - Значение целевой функции на тестовом периоде, nil для SPLIT_NONE
+	TestScore *float64 `json:"test_score,omitempty"`
+	// Метрики результата на тестовом периоде, а для SPLIT_NONE - на всей ленте
+	TotalReturn float64 `json:"total_return"`
+	MaxDrawdown float64 `json:"max_drawdown"`
+	SharpeRatio float64 `json:"sharpe_ratio"`
+	WinRate     float64 `json:"win_rate"`
+	Trades      int     `json:"trades"`
+	// TrainFrom, TrainTo, TestFrom, TestTo - Границы периодов
+	TrainFrom time.Time `json:"train_from"`
+	TrainTo   time.Time `json:"train_to"`
+	TestFrom  time.Time `json:"test_from"`
+	TestTo    time.Time `json:"test_to"`
+}
+
+// Leaderboard - Результаты оптимизации, для SPLIT_WALK_FORWARD по одной строке на окно в порядке окон,
+// иначе все наборы параметров по убыванию Score
+type Leaderboard struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Best - Лучший результат, для SPLIT_WALK_FORWARD - набор параметров последнего окна
+func (l *Leaderboard) Best() (Entry, bool) {
+	if len(l.Entries) == 0 {
+		return Entry{}, false
+	}
+	if l.Entries[0].Fold > 0 {
+		return l.Entries[len(l.Entries)-1], true
+	}
+	return l.Entries[0], true
+}
+
+// WriteJSON - Запись таблицы результатов в формате JSON
+func (l *Leaderboard) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// WriteCSV - Запись таблицы результатов в формате CSV, каждый параметр в отдельной колонке
+func (l *Leaderboard) WriteCSV(w io.Writer) error {
+	names := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, e := range l.Entries {
+		for name := range e.Params {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	cw := csv.NewWriter(w)
+	header := []string{"rank", "fold"}
+	header = append(header, names...)
+	header = append(header, "score", "test_score", "total_return", "max_drawdown", "sharpe_ratio", "win_rate", "trades",
+		"train_from", "train_to", "test_from", "test_to")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, e := range l.Entries {
+		row := []string{strconv.Itoa(e.Rank), strconv.Itoa(e.Fold)}
+		for _, name := range names {
+			row = append(row, formatFloat(e.Params[name]))
+		}
+		testScore := ""
+		if e.TestScore != nil {
+			testScore = formatFloat(*e.TestScore)
+		}
+		row = append(row, formatFloat(e.Score), testScore, formatFloat(e.TotalReturn), formatFloat(e.MaxDrawdown),
+			formatFloat(e.SharpeRatio), formatFloat(e.WinRate), strconv.Itoa(e.Trades),
+			formatTime(e.TrainFrom), formatTime(e.TrainTo), formatTime(e.TestFrom), formatTime(e.TestTo))
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Run - Запуск оптимизации на отсортированной по времени ленте событий
+func (o *Optimizer) Run(ctx context.Context, events []simulator.Event) (*Leaderboard, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("events are empty")
+	}
+	params := o.conf.Space.Generate()
+	first, last := events[0].Time(), events[len(events)-1].Time()
+	o.infof("optimizer: %v parameter sets, events from %v to %v", len(params), first, last)
+
+	switch o.conf.Split {
+	case SPLIT_TRAIN_TEST:
+		cut := first.Add(time.Duration(float64(last.Sub(first)) * o.conf.TrainRatio))
+		train, test := eventsBetween(events, first, cut), eventsBetween(events, cut, last.Add(time.Nanosecond))
+		trainRes, err := o.runAll(ctx, params, train)
+		if err != nil {
+			return nil, err
+		}
+		testRes, err := o.runAll(ctx, params, test)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]Entry, 0, len(params))
+		for i := range params {
+			e := o.entry(params[i], trainRes[i], testRes[i])
+			e.TrainFrom, e.TrainTo, e.TestFrom, e.TestTo = first, cut, cut, last
+			entries = append(entries, e)
+		}
+		return &Leaderboard{Entries: rank(entries)}, nil
+	case SPLIT_WALK_FORWARD:
+		return o.walkForward(ctx, params, events, first, last)
+	default:
+		res, err := o.runAll(ctx, params, events)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]Entry, 0, len(params))
+		for i := range params {
+			e := o.entry(params[i], res[i], nil)
+			e.TrainFrom, e.TrainTo = first, last
+			entries = append(entries, e)
+		}
+		return &Leaderboard{Entries: rank(entries)}, nil
+	}
+}
+
+// walkForward - Оптимизация на скользящих окнах
+func (o *Optimizer) walkForward(ctx context.Context, params []Params, events []simulator.Event, first, last time.Time) (*Leaderboard, error) {
+	if o.conf.TrainPeriod <= 0 || o.conf.TestPeriod <= 0 {
+		return nil, fmt.Errorf("TrainPeriod and TestPeriod are required for walk forward")
+	}
+	entries := make([]Entry, 0)
+	fold := 0
+	for start := first; !start.Add(o.conf.TrainPeriod).After(last); start = start.Add(o.conf.TestPeriod) {
+		fold++
+		trainTo := start.Add(o.conf.TrainPeriod)
+		testTo := trainTo.Add(o.conf.TestPeriod)
+		trainRes, err := o.runAll(ctx, params, eventsBetween(events, start, trainTo))
+		if err != nil {
+			return nil, err
+		}
+		best := 0
+		for i := range trainRes {
+			if o.conf.Objective(trainRes[i]) > o.conf.Objective(trainRes[best]) {
+				best = i
+			}
+		}
+		testRes, err := o.runAll(ctx, params[best:best+1], eventsBetween(events, trainTo, testTo))
+		if err != nil {
+			return nil, err
+		}
+		e := o.entry(params[best], trainRes[best], testRes[0])
+		e.Fold = fold
+		e.Rank = 1
+		e.TrainFrom, e.TrainTo, e.TestFrom, e.TestTo = start, trainTo, trainTo, testTo
+		o.infof("walk forward fold %v: params %v, train score %v, test score %v", fold, params[best], e.Score, *e.TestScore)
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("events period %v is shorter than TrainPeriod", last.Sub(first))
+	}
+	return &Leaderboard{Entries: entries}, nil
+}
+
+// runAll - Параллельный прогон всех наборов параметров, результаты в порядке params
+func (o *Optimizer) runAll(ctx context.Context, params []Params, events []simulator.Event) ([]*Result, error) {
+	type indexed struct {
+		i   int
+		res *Result
+	}
+	p := pool.NewWithResults[indexed]().WithContext(ctx).WithCancelOnError().WithMaxGoroutines(o.conf.Workers)
+	for i := range params {
+		i := i
+		p.Go(func(ctx context.Context) (indexed, error) {
+			s, err := o.factory(params[i])
+			if err != nil {
+				return indexed{}, err
+			}
+			res, err := o.engine.Run(ctx, s, events)
+			if err != nil {
+				return indexed{}, err
+			}
+			return indexed{i: i, res: res}, nil
+		})
+	}
+	out, err := p.Wait()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Result, len(params))
+	for _, r := range out {
+		results[r.i] = r.res
+	}
+	return results, nil
+}
+
+// entry - Строка таблицы по результатам на обучающем и тестовом периодах, test может быть nil
+func (o *Optimizer) entry(p Params, train, test *Result) Entry {
+	e := Entry{
+		Params: p,
+		Score:  o.conf.Objective(train),
+	}
+	metrics := train
+	if test != nil {
+		score := o.conf.Objective(test)
+		e.TestScore = &score
+		metrics = test
+	}
+	e.TotalReturn = metrics.TotalReturn
+	e.MaxDrawdown = metrics.MaxDrawdown
+	e.SharpeRatio = metrics.SharpeRatio
+	e.WinRate = metrics.WinRate
+	e.Trades = len(metrics.Trades)
+	return e
+}
+
+func (o *Optimizer) infof(template string, args ...any) {
+	if o.conf.Logger != nil {
+		o.conf.Logger.Infof(template, args...)
+	}
+}
+
+// rank - Сортировка по убыванию Score и проставление мест
+func rank(entries []Entry) []Entry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Score > entries[j].Score
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+// eventsBetween - События в интервале [from, to), лента должна быть отсортирована по времени
+func eventsBetween(events []simulator.Event, from, to time.Time) []simulator.Event {
+	start := sort.Search(len(events), func(i int) bool {
+		return !events[i].Time().Before(from)
+	})
+	end := sort.Search(len(events), func(i int) bool {
+		return !events[i].Time().Before(to)
+	})
+	return events[start:end]
+}
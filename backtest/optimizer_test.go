@@ -0,0 +1,266 @@
+package backtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/simulator"
+)
+
+// holdStrategy - Покупка params["lots"] лотов по первой свече прогона, позиция закрывается движком
+func holdStrategy(p Params) (Strategy, error) {
+	lots := int64(p["lots"])
+	return &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			if i == 0 && lots > 0 {
+				b.Buy(testUid, lots)
+			}
+		},
+	}, nil
+}
+
+// risingFalling - Цена растет пять дней со 100 до 140, затем пять дней падает до 90
+func risingFalling() []simulator.Event {
+	closes := []float64{100, 110, 120, 130, 140, 130, 120, 110, 100, 90}
+	ohlc := make([][4]float64, 0, len(closes))
+	for _, c := range closes {
+		ohlc = append(ohlc, [4]float64{c, c, c, c})
+	}
+	return candles(ohlc...)
+}
+
+func day(n int) time.Time {
+	return testStart.Add(time.Duration(n) * 24 * time.Hour)
+}
+
+func newTestOptimizer(conf OptimizerConfig) *Optimizer {
+	conf.Space = SearchSpace{Params: []Param{{Name: "lots", Values: []float64{0, 1, 2}}}}
+	return NewOptimizer(newTestEngine(1000, Config{ClosePositions: true}), holdStrategy, conf)
+}
+
+func TestSearchSpaceGrid(t *testing.T) {
+	if got := (Param{Min: 0, Max: 0.3, Step: 0.1}).values(); !reflect.DeepEqual(got, []float64{0, 0.1, 0.2, 0.3}) {
+		t.Fatalf("values = %v", got)
+	}
+	if got := (Param{Min: 5, Max: 10}).values(); !reflect.DeepEqual(got, []float64{5}) {
+		t.Fatalf("values without step = %v", got)
+	}
+	space := SearchSpace{Params: []Param{
+		{Name: "a", Min: 1, Max: 2, Step: 0.5},
+		{Name: "b", Values: []float64{10, 20}},
+	}}
+	want := []Params{
+		{"a": 1, "b": 10}, {"a": 1, "b": 20},
+		{"a": 1.5, "b": 10}, {"a": 1.5, "b": 20},
+		{"a": 2, "b": 10}, {"a": 2, "b": 20},
+	}
+	if got := space.Generate(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("grid = %v, want %v", got, want)
+	}
+}
+
+func TestSearchSpaceRandom(t *testing.T) {
+	space := SearchSpace{
+		Params: []Param{
+			{Name: "continuous", Min: 1, Max: 2},
+			{Name: "step", Min: 10, Max: 20, Step: 5},
+		},
+		Random: 50,
+		Seed:   42,
+	}
+	got := space.Generate()
+	if len(got) != 50 {
+		t.Fatalf("random sets = %v, want 50", len(got))
+	}
+	for _, p := range got {
+		if c := p["continuous"]; c < 1 || c > 2 {
+			t.Fatalf("continuous = %v out of range", c)
+		}
+		if s := p["step"]; s != 10 && s != 15 && s != 20 {
+			t.Fatalf("step = %v is not on the grid", s)
+		}
+	}
+	// одно зерно - одна выборка
+	if !reflect.DeepEqual(got, space.Generate()) {
+		t.Fatal("random search is not reproducible with the same seed")
+	}
+}
+
+func TestEventsBetween(t *testing.T) {
+	events := risingFalling()
+	got := eventsBetween(events, day(2), day(5))
+	if len(got) != 3 || !got[0].Time().Equal(day(2)) || !got[2].Time().Equal(day(4)) {
+		t.Fatalf("events in [2, 5) = %v", len(got))
+	}
+	if got := eventsBetween(events, day(2).Add(time.Nanosecond), day(3)); len(got) != 0 {
+		t.Fatalf("events in (2, 3) = %v, want none", len(got))
+	}
+	if got := eventsBetween(events, day(-5), day(20)); len(got) != len(events) {
+		t.Fatalf("all events = %v, want %v", len(got), len(events))
+	}
+}
+
+func entryLots(entries []Entry) []float64 {
+	res := make([]float64, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e.Params["lots"])
+	}
+	return res
+}
+
+func TestOptimizerRanking(t *testing.T) {
+	// только рост цены
+	events := risingFalling()[:5]
+	board, err := newTestOptimizer(OptimizerConfig{Workers: 2}).Run(context.Background(), events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if lots := entryLots(board.Entries); !reflect.DeepEqual(lots, []float64{2, 1, 0}) {
+		t.Fatalf("ranking by lots = %v, want [2 1 0]", lots)
+	}
+	for i, e := range board.Entries {
+		if e.Rank != i+1 || e.TestScore != nil || e.Fold != 0 {
+			t.Fatalf("entry %v = %+v", i, e)
+		}
+		if !e.TrainFrom.Equal(day(0)) || !e.TrainTo.Equal(day(4)) || !e.TestFrom.IsZero() {
+			t.Fatalf("entry %v periods = %v - %v, test from %v", i, e.TrainFrom, e.TrainTo, e.TestFrom)
+		}
+	}
+	best, ok := board.Best()
+	// покупка по 110, закрытие по 140: 2 * 30 = 60 на 1000
+	if !ok || best.Params["lots"] != 2 || best.Score != 6 || best.TotalReturn != 6 || best.Trades != 2 {
+		t.Fatalf("best = %+v", best)
+	}
+	if board.Entries[2].Score != 0 || board.Entries[2].Trades != 0 {
+		t.Fatalf("no trades entry = %+v", board.Entries[2])
+	}
+}
+
+func TestOptimizerTrainTest(t *testing.T) {
+	board, err := newTestOptimizer(OptimizerConfig{Split: SPLIT_TRAIN_TEST, TrainRatio: 0.5}).Run(context.Background(), risingFalling())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// обучающая часть - рост, тестовая - падение
+	if lots := entryLots(board.Entries); !reflect.DeepEqual(lots, []float64{2, 1, 0}) {
+		t.Fatalf("ranking by lots = %v, want [2 1 0]", lots)
+	}
+	cut := day(0).Add(9 * 24 * time.Hour / 2)
+	best := board.Entries[0]
+	if !best.TrainTo.Equal(cut) || !best.TestFrom.Equal(cut) || !best.TestTo.Equal(day(9)) {
+		t.Fatalf("periods = %v - %v, %v - %v", best.TrainFrom, best.TrainTo, best.TestFrom, best.TestTo)
+	}
+	// покупка по 110, продажа по 140 на обучении, покупка по 120, продажа по 90 на тесте
+	if best.Score != 6 || best.TestScore == nil || *best.TestScore != -6 || best.TotalReturn != -6 {
+		t.Fatalf("best = %+v, test score %v", best, best.TestScore)
+	}
+}
+
+func TestOptimizerWalkForward(t *testing.T) {
+	board, err := newTestOptimizer(OptimizerConfig{
+		Split:       SPLIT_WALK_FORWARD,
+		TrainPeriod: 3 * 24 * time.Hour,
+		TestPeriod:  2 * 24 * time.Hour,
+	}).Run(context.Background(), risingFalling())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// окна обучения [0, 3), [2, 5), [4, 7), [6, 9): на росте лучше 2 лота, на падении - не покупать
+	if lots := entryLots(board.Entries); !reflect.DeepEqual(lots, []float64{2, 2, 0, 0}) {
+		t.Fatalf("best lots by fold = %v, want [2 2 0 0]", lots)
+	}
+	for i, e := range board.Entries {
+		start := day(2 * i)
+		if e.Fold != i+1 || e.Rank != 1 || !e.TrainFrom.Equal(start) || !e.TrainTo.Equal(start.Add(3*24*time.Hour)) ||
+			!e.TestFrom.Equal(e.TrainTo) || !e.TestTo.Equal(start.Add(5*24*time.Hour)) || e.TestScore == nil {
+			t.Fatalf("fold %v = %+v", i+1, e)
+		}
+	}
+	if best, _ := board.Best(); best.Fold != 4 {
+		t.Fatalf("best fold = %v, want the last one", best.Fold)
+	}
+
+	_, err = newTestOptimizer(OptimizerConfig{Split: SPLIT_WALK_FORWARD}).Run(context.Background(), risingFalling())
+	if err == nil {
+		t.Fatal("walk forward without periods must fail")
+	}
+	_, err = newTestOptimizer(OptimizerConfig{
+		Split:       SPLIT_WALK_FORWARD,
+		TrainPeriod: 30 * 24 * time.Hour,
+		TestPeriod:  24 * time.Hour,
+	}).Run(context.Background(), risingFalling())
+	if err == nil {
+		t.Fatal("walk forward with too long TrainPeriod must fail")
+	}
+}
+
+func TestOptimizerFactoryError(t *testing.T) {
+	errFactory := errors.New("bad params")
+	o := NewOptimizer(newTestEngine(1000, Config{}), func(p Params) (Strategy, error) {
+		if p["lots"] == 1 {
+			return nil, errFactory
+		}
+		return holdStrategy(p)
+	}, OptimizerConfig{Space: SearchSpace{Params: []Param{{Name: "lots", Values: []float64{0, 1, 2}}}}})
+	if _, err := o.Run(context.Background(), risingFalling()); !errors.Is(err, errFactory) {
+		t.Fatalf("err = %v, want factory error", err)
+	}
+	if _, err := o.Run(context.Background(), nil); err == nil {
+		t.Fatal("empty events must fail")
+	}
+}
+
+func TestLeaderboardOutput(t *testing.T) {
+	testScore := -1.5
+	board := &Leaderboard{Entries: []Entry{
+		{Rank: 1, Params: Params{"slow": 20, "fast": 5}, Score: 2.5, TestScore: &testScore, TotalReturn: -1.5, Trades: 4,
+			TrainFrom: day(0), TrainTo: day(7), TestFrom: day(7), TestTo: day(9)},
+		{Rank: 2, Params: Params{"fast": 10}, Score: 1},
+	}}
+
+	var buf bytes.Buffer
+	if err := board.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("read CSV: %v", err)
+	}
+	wantHeader := []string{"rank", "fold", "fast", "slow", "score", "test_score", "total_return", "max_drawdown",
+		"sharpe_ratio", "win_rate", "trades", "train_from", "train_to", "test_from", "test_to"}
+	if len(rows) != 3 || !reflect.DeepEqual(rows[0], wantHeader) {
+		t.Fatalf("CSV = %v", rows)
+	}
+	wantFirst := []string{"1", "0", "5", "20", "2.5", "-1.5", "-1.5", "0", "0", "0", "4",
+		"2024-03-04T10:00:00Z", "2024-03-11T10:00:00Z", "2024-03-11T10:00:00Z", "2024-03-13T10:00:00Z"}
+	if !reflect.DeepEqual(rows[1], wantFirst) {
+		t.Fatalf("CSV row = %v, want %v", rows[1], wantFirst)
+	}
+	// отсутствующий параметр - 0, пустые тестовая оценка и периоды
+	if r := rows[2]; r[2] != "10" || r[3] != "0" || r[5] != "" || r[11] != "" {
+		t.Fatalf("CSV row = %v", r)
+	}
+
+	buf.Reset()
+	if err := board.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var decoded Leaderboard
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("read JSON: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Entries[0].Params, board.Entries[0].Params) || *decoded.Entries[0].TestScore != testScore ||
+		!decoded.Entries[0].TestTo.Equal(day(9)) || decoded.Entries[1].TestScore != nil {
+		t.Fatalf("JSON = %+v", decoded)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"test_score": -1.5`)) || bytes.Count(buf.Bytes(), []byte("test_score")) != 1 {
+		t.Fatalf("JSON test_score = %s", buf.String())
+	}
+}
@@ -0,0 +1,118 @@
+package backtest
+
+import (
+	"math"
+	"time"
+
+	"github.com/montanaflynn/stats"
+	"github.com/shopspring/decimal"
+)
+
+// EquityPoint - Точка кривой доходности
+type EquityPoint struct {
+	Time   time.Time
+	Equity decimal.Decimal
+	// Drawdown - Просадка от предыдущего максимума в процентах
+	Drawdown float64
+}
+
+// Result - Результат бектеста
+type Result struct {
+	InitialCash decimal.Decimal
+	FinalEquity decimal.Decimal
+	// TotalReturn - Доходность за весь период в процентах
+	TotalReturn float64
+	// TotalCommission - Сумма уплаченных комиссий
+	TotalCommission decimal.Decimal
+	// Trades - Все сделки стратегии
+	Trades []Trade
+	// Positions - Позиции, открытые на конец бектеста
+	Positions []Position
+	// EquityCurve - Стоимость портфеля после каждого момента времени ленты событий
+	EquityCurve []EquityPoint
+	// MaxDrawdown - Максимальная просадка в процентах
+	MaxDrawdown float64
+	// WinRate - Доля прибыльных сделок среди закрывающих позицию в процентах
+	WinRate float64
+	// SharpeRatio - Годовой коэффициент Шарпа, считается по дневным доходностям
+	SharpeRatio float64
+}
+
+func newResult(conf *Config, b *Broker, curve []EquityPoint) *Result {
+	res := &Result{
+		InitialCash: decimal.NewFromFloat(conf.InitialCash),
+		FinalEquity: b.Equity(),
+		Trades:      b.trades,
+		Positions:   b.Positions(),
+		EquityCurve: curve,
+	}
+	if res.InitialCash.IsPositive() {
+		res.TotalReturn = res.FinalEquity.Sub(res.InitialCash).Div(res.InitialCash).Mul(decimal.NewFromInt(100)).InexactFloat64()
+	}
+
+	var closing, wins int
+	for _, t := range b.trades {
+		res.TotalCommission = res.TotalCommission.Add(t.Commission)
+		if t.Closing {
+			closing++
+			if t.PnL.IsPositive() {
+				wins++
+			}
+		}
+	}
+	if closing > 0 {
+		res.WinRate = float64(wins) / float64(closing) * 100
+	}
+
+	peak := res.InitialCash
+	for i := range curve {
+		if curve[i].Equity.GreaterThan(peak) {
+			peak = curve[i].Equity
+		}
+		if peak.IsPositive() {
+			curve[i].Drawdown = peak.Sub(curve[i].Equity).Div(peak).Mul(decimal.NewFromInt(100)).InexactFloat64()
+		}
+		if curve[i].Drawdown > res.MaxDrawdown {
+			res.MaxDrawdown = curve[i].Drawdown
+		}
+	}
+	res.SharpeRatio = sharpeRatio(res.InitialCash, curve, conf.RiskFreeRate, conf.PeriodsPerYear)
+	return res
+}
+
+// sharpeRatio - Годовой коэффициент Шарпа по дневным доходностям кривой доходности
+func sharpeRatio(initial decimal.Decimal, curve []EquityPoint, riskFreeRate, periodsPerYear float64) float64 {
+	// стоимость портфеля на конец каждого дня
+	daily := make([]float64, 0)
+	prevDay := ""
+	for _, p := range curve {
+		day := p.Time.UTC().Format(time.DateOnly)
+		if day == prevDay {
+			daily[len(daily)-1] = p.Equity.InexactFloat64()
+			continue
+		}
+		daily = append(daily, p.Equity.InexactFloat64())
+		prevDay = day
+	}
+	returns := make([]float64, 0, len(daily))
+	prev := initial.InexactFloat64()
+	rf := riskFreeRate / 100 / periodsPerYear
+	for _, equity := range daily {
+		if prev > 0 {
+			returns = append(returns, equity/prev-1-rf)
+		}
+		prev = equity
+	}
+	if len(returns) < 2 {
+		return 0
+	}
+	mean, err := stats.Mean(returns)
+	if err != nil {
+		return 0
+	}
+	std, err := stats.StandardDeviationSample(returns)
+	if err != nil || std == 0 {
+		return 0
+	}
+	return mean / std * math.Sqrt(periodsPerYear)
+}
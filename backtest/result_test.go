@@ -0,0 +1,114 @@
+package backtest
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+func equityCurve(start time.Time, step time.Duration, values ...float64) []EquityPoint {
+	curve := make([]EquityPoint, 0, len(values))
+	for i, v := range values {
+		curve = append(curve, EquityPoint{Time: start.Add(time.Duration(i) * step), Equity: decimal.NewFromFloat(v)})
+	}
+	return curve
+}
+
+func TestSharpeRatio(t *testing.T) {
+	initial := decimal.NewFromInt(100)
+	// дневные доходности 10%, -10%, 10%: среднее 1/30, выборочная дисперсия 0.04/3
+	want := (0.1 / 3) / math.Sqrt(0.04/3) * math.Sqrt(252)
+	tests := []struct {
+		name  string
+		curve []EquityPoint
+		rf    float64
+		want  float64
+	}{
+		{
+			name:  "daily points",
+			curve: equityCurve(testStart, 24*time.Hour, 110, 99, 108.9),
+			want:  want,
+		},
+		{
+			name: "intraday points use day close",
+			curve: append(
+				equityCurve(testStart, time.Hour, 150, 60, 110),
+				equityCurve(testStart.Add(24*time.Hour), 24*time.Hour, 99, 108.9)...,
+			),
+			want: want,
+		},
+		{
+			name:  "risk free rate shifts returns",
+			curve: equityCurve(testStart, 24*time.Hour, 110, 99, 108.9),
+			rf:    25.2,
+			want:  (0.1/3 - 0.001) / math.Sqrt(0.04/3) * math.Sqrt(252),
+		},
+		{
+			name:  "single return",
+			curve: equityCurve(testStart, 24*time.Hour, 110),
+		},
+		{
+			name:  "zero volatility",
+			curve: equityCurve(testStart, 24*time.Hour, 100, 100, 100),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sharpeRatio(initial, tt.curve, tt.rf, 252); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("sharpe = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrawdown(t *testing.T) {
+	events := candles(
+		[4]float64{100, 100, 100, 100},
+		[4]float64{100, 120, 100, 120},
+		[4]float64{120, 120, 90, 90},
+		[4]float64{90, 110, 90, 110},
+		[4]float64{110, 130, 110, 130},
+	)
+	s := &testStrategy{
+		onCandle: func(b *Broker, i int, _ *pb.HistoricCandle) {
+			if i == 0 {
+				if _, err := b.Buy(testUid, 1); err != nil {
+					t.Fatalf("Buy: %v", err)
+				}
+			}
+		},
+	}
+	res, err := newTestEngine(100, Config{}).Run(context.Background(), s, events)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	wantEquity := []float64{100, 120, 90, 110, 130}
+	wantDrawdown := []float64{0, 0, 25, 100.0 / 12, 0}
+	if len(res.EquityCurve) != len(wantEquity) {
+		t.Fatalf("curve = %v points, want %v", len(res.EquityCurve), len(wantEquity))
+	}
+	for i, p := range res.EquityCurve {
+		if p.Equity.InexactFloat64() != wantEquity[i] || math.Abs(p.Drawdown-wantDrawdown[i]) > 1e-9 {
+			t.Errorf("point %v = %v (drawdown %v), want %v (%v)", i, p.Equity, p.Drawdown, wantEquity[i], wantDrawdown[i])
+		}
+	}
+	if math.Abs(res.MaxDrawdown-25) > 1e-9 {
+		t.Errorf("max drawdown = %v, want 25", res.MaxDrawdown)
+	}
+	if math.Abs(res.TotalReturn-30) > 1e-9 {
+		t.Errorf("total return = %v, want 30", res.TotalReturn)
+	}
+}
+
+func TestAppendEquitySameTime(t *testing.T) {
+	curve := appendEquity(nil, testStart, decimal.NewFromInt(1))
+	curve = appendEquity(curve, testStart, decimal.NewFromInt(2))
+	curve = appendEquity(curve, testStart.Add(time.Minute), decimal.NewFromInt(3))
+	if len(curve) != 2 || !curve[0].Equity.Equal(decimal.NewFromInt(2)) {
+		t.Fatalf("curve = %+v", curve)
+	}
+}
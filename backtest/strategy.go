@@ -0,0 +1,29 @@
+package backtest
+
+import (
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// Strategy - Торговая стратегия для бектеста. Методы вызываются последовательно из одной горутины,
+// заявки выставляются через переданный Broker
+type Strategy interface {
+	// OnCandle - Обработка закрытой свечи инструмента
+	OnCandle(b *Broker, instrumentId string, candle *pb.HistoricCandle)
+	// OnOrderBook - Обработка нового стакана
+	OnOrderBook(b *Broker, ob *pb.OrderBook)
+	// OnTrade - Обработка обезличенной сделки
+	OnTrade(b *Broker, trade *pb.Trade)
+	// OnFill - Обработка исполнения заявки стратегии
+	OnFill(b *Broker, fill Trade)
+}
+
+// BaseStrategy - Пустая реализация Strategy, удобно встраивать в свою стратегию и переопределять только нужные методы
+type BaseStrategy struct{}
+
+func (BaseStrategy) OnCandle(*Broker, string, *pb.HistoricCandle) {}
+
+func (BaseStrategy) OnOrderBook(*Broker, *pb.OrderBook) {}
+
+func (BaseStrategy) OnTrade(*Broker, *pb.Trade) {}
+
+func (BaseStrategy) OnFill(*Broker, Trade) {}
@@ -6,7 +6,6 @@ import (
 	"math"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -112,66 +111,45 @@ func main() {
 
 	// для создания стратеги нужно ее сконфигурировать, для этого получим список идентификаторов инструментов,
 	// которыми предстоит торговать
-	// слайс идентификаторов торговых инструментов instrument_uid
-	instrumentIds := make([]string, 0, INSTRUMENTS_MAX)
 	instrumentsService := client.NewInstrumentsServiceClient()
-	// получаем список фондов доступных для торговли через investAPI
-	etfsResp, err := instrumentsService.Etfs(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые фонды с московской биржи
-	etfs := etfsResp.GetInstruments()
-	// получаем список акций доступных для торговли через investAPI
-	sharesResp, err := instrumentsService.Shares(pb.InstrumentStatus_INSTRUMENT_STATUS_BASE)
-	if err != nil {
-		logger.Errorf(err.Error())
-	}
-	// рублевые акции c московской биржи
-	shares := sharesResp.GetInstruments()
-	// результаты отбора фондов и акций по бирже и валюте
-	shareIds := make([]string, 0)
-	etfsIds := make([]string, 0)
-
-	for _, share := range shares {
-		if len(shareIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		exchange := strings.EqualFold(share.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(share.GetCurrency(), CURRENCY)
-		if exchange && currency && !share.GetForQualInvestorFlag() {
-			shareIds = append(shareIds, share.GetUid())
-		}
+	// отбираем рублевые инструменты с московской биржи, доступные неквалифицированным инвесторам,
+	// с ценой лота не больше MaxPositionPrice. Условия отбора можно описать в .yaml файле
+	// и загрузить через investgo.LoadScreenerConfig
+	screenRequest := investgo.ScreenRequest{
+		Filters: []investgo.ScreenerFilter{
+			investgo.FilterExchange(EXCHANGE),
+			investgo.FilterCurrency(CURRENCY),
+			investgo.FilterForQualInvestor(false),
+			investgo.FilterLotPrice(0, intervalConfig.MaxPositionPrice),
+		},
+		Limit: INSTRUMENTS_MAX,
 	}
-
-	for _, etf := range etfs {
-		if len(etfsIds) > INSTRUMENTS_MAX-1 {
-			break
-		}
-		exchange := strings.EqualFold(etf.GetExchange(), EXCHANGE)
-		currency := strings.EqualFold(etf.GetCurrency(), CURRENCY)
-		if exchange && currency {
-			etfsIds = append(etfsIds, etf.GetUid())
-		}
-	}
-	// заполняем instrumentIds в зависимости от выбранного selection
+	// заполняем типы инструментов в зависимости от выбранного selection
 	switch selection {
 	case SHARES:
-		instrumentIds = shareIds
+		screenRequest.Types = []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SHARE}
 	case ETFS:
-		instrumentIds = etfsIds
+		screenRequest.Types = []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_ETF}
 	case SHARES_AND_ETFS:
-		instrumentIds = append(instrumentIds, shareIds...)
-		instrumentIds = append(instrumentIds, etfsIds...)
+		screenRequest.Types = []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SHARE, pb.InstrumentType_INSTRUMENT_TYPE_ETF}
+	}
+	screened, err := client.NewScreener().Screen(screenRequest)
+	if err != nil {
+		logger.Errorf(err.Error())
+	}
+	// слайс идентификаторов торговых инструментов instrument_uid
+	instrumentIds := make([]string, 0, len(screened))
+	for _, item := range screened {
+		instrumentIds = append(instrumentIds, item.Info.Uid)
 	}
 	logger.Infof("got %v instruments", len(instrumentIds))
 
 	// передаем инструменты в конфиг
 	intervalConfig.Instruments = instrumentIds
 	// запрашиваемое время для свечей не может быть раньше StorageFromTime
-	now := time.Now()
+	now := client.Config.Clock.Now()
 	if now.Add(-time.Hour * 24 * time.Duration(intervalConfig.DaysToCalculateInterval)).Before(intervalConfig.StorageFromTime) {
-		intervalConfig.StorageFromTime = time.Now().Add(-time.Hour * 24 * time.Duration(intervalConfig.DaysToCalculateInterval))
+		intervalConfig.StorageFromTime = now.Add(-time.Hour * 24 * time.Duration(intervalConfig.DaysToCalculateInterval))
 	}
 	// Далее создаем внешние зависимости для бота - хранилище и исполнитель
 	// по конфигу стратегии заполняем map для executor
@@ -125,7 +125,7 @@ func (b *Bot) Run() error {
 
 	// интервал запроса свечей по инструментам для нахождения интервала
 	// далее раз в IntervalUpdateDelay будут запрашиваться новые свечи
-	from, to := timeIntervalByDays(b.StrategyConfig.DaysToCalculateInterval, time.Now())
+	from, to := timeIntervalByDays(b.StrategyConfig.DaysToCalculateInterval, b.Client.Config.Clock.Now())
 
 	// запуск анализа инструментов по их историческим свечам
 	for _, id := range b.StrategyConfig.Instruments {
@@ -193,13 +193,13 @@ func (b *Bot) Run() error {
 	b.wg.Add(1)
 	go func(ctx context.Context) {
 		defer b.wg.Done()
-		ticker := time.NewTicker(b.StrategyConfig.IntervalUpdateDelay)
+		ticker := b.Client.Config.Clock.NewTicker(b.StrategyConfig.IntervalUpdateDelay)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				err := b.UpdateIntervals(from, topInstrumentsIds)
 				if err != nil {
 					b.Client.Logger.Errorf(err.Error())
@@ -233,7 +233,7 @@ func (b *Bot) Stop() error {
 
 func (b *Bot) UpdateIntervals(from time.Time, ids []string) error {
 	for _, id := range ids {
-		now := time.Now()
+		now := b.Client.Config.Clock.Now()
 		// обновляем историю по инструменту
 		err := b.storage.UpdateCandlesHistory(id)
 		if err != nil {
@@ -6,7 +6,6 @@ import (
 	"reflect"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
@@ -518,7 +517,7 @@ func (e *Executor) updatePositionsUnary() error {
 		Securities: resp.GetSecurities(),
 		Futures:    resp.GetFutures(),
 		Options:    resp.GetOptions(),
-		Date:       investgo.TimeToTimestamp(time.Now()),
+		Date:       investgo.TimeToTimestamp(e.client.Config.Clock.Now()),
 	})
 
 	return nil
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/tinkoff/invest-api-go-sdk/investgo"
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
@@ -281,7 +280,7 @@ func (e *Executor) updatePositionsUnary() error {
 		Securities: resp.GetSecurities(),
 		Futures:    resp.GetFutures(),
 		Options:    resp.GetOptions(),
-		Date:       investgo.TimeToTimestamp(time.Now()),
+		Date:       investgo.TimeToTimestamp(e.client.Config.Clock.Now()),
 	})
 
 	return nil
@@ -0,0 +1,93 @@
+package export
+
+import (
+	"io"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/storage"
+)
+
+// CandlesSchema - Схема таблицы свечей
+var CandlesSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "instrument_uid", Type: arrow.BinaryTypes.String},
+	{Name: "interval", Type: arrow.BinaryTypes.String},
+	{Name: "time", Type: TimeType, Nullable: true},
+	{Name: "open", Type: PriceType, Nullable: true},
+	{Name: "high", Type: PriceType, Nullable: true},
+	{Name: "low", Type: PriceType, Nullable: true},
+	{Name: "close", Type: PriceType, Nullable: true},
+	{Name: "volume", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "is_complete", Type: arrow.FixedWidthTypes.Boolean},
+}, nil)
+
+// CandleSeries - Свечи одного инструмента и интервала
+type CandleSeries struct {
+	InstrumentId string
+	Interval     pb.CandleInterval
+	Candles      []*pb.HistoricCandle
+}
+
+// WriteCandles - Запись свечей одного или нескольких рядов в одну таблицу со схемой CandlesSchema
+func WriteCandles(w io.Writer, format Format, series ...CandleSeries) error {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, CandlesSchema)
+	defer b.Release()
+	var (
+		ids        = b.Field(0).(*array.StringBuilder)
+		intervals  = b.Field(1).(*array.StringBuilder)
+		times      = b.Field(2).(*array.TimestampBuilder)
+		opens      = b.Field(3).(*array.Decimal128Builder)
+		highs      = b.Field(4).(*array.Decimal128Builder)
+		lows       = b.Field(5).(*array.Decimal128Builder)
+		closes     = b.Field(6).(*array.Decimal128Builder)
+		volumes    = b.Field(7).(*array.Int64Builder)
+		isComplete = b.Field(8).(*array.BooleanBuilder)
+	)
+	for _, s := range series {
+		for _, c := range s.Candles {
+			ids.Append(s.InstrumentId)
+			intervals.Append(s.Interval.String())
+			appendTime(times, c.GetTime())
+			appendPrice(opens, c.GetOpen())
+			appendPrice(highs, c.GetHigh())
+			appendPrice(lows, c.GetLow())
+			appendPrice(closes, c.GetClose())
+			volumes.Append(c.GetVolume())
+			isComplete.Append(c.GetIsComplete())
+		}
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+	return writeRecord(w, format, rec)
+}
+
+// CandlesToFile - Запись свечей в файл, формат определяется по расширению (см. FormatFromFileName)
+func CandlesToFile(path string, series ...CandleSeries) error {
+	return writeFile(path, func(w io.Writer, format Format) error {
+		return WriteCandles(w, format, series...)
+	})
+}
+
+// WriteStoredCandles - Запись всех рядов хранилища в диапазоне [from, to) в одну таблицу со схемой CandlesSchema
+func WriteStoredCandles(w io.Writer, format Format, store storage.CandleStore, from, to time.Time) error {
+	all, err := store.Series()
+	if err != nil {
+		return err
+	}
+	series := make([]CandleSeries, 0, len(all))
+	for _, s := range all {
+		candles, err := store.Candles(s.InstrumentId, s.Interval, from, to)
+		if err != nil {
+			return err
+		}
+		series = append(series, CandleSeries{
+			InstrumentId: s.InstrumentId,
+			Interval:     s.Interval,
+			Candles:      candles,
+		})
+	}
+	return WriteCandles(w, format, series...)
+}
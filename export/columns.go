@@ -0,0 +1,36 @@
+package export
+
+import (
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/decimal128"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// PriceType - Тип колонок с ценами, decimal без потери точности Quotation (9 знаков после запятой)
+	PriceType = &arrow.Decimal128Type{Precision: 28, Scale: 9}
+	// TimeType - Тип колонок со временем, наносекунды в UTC
+	TimeType = &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}
+)
+
+var nanoMultiplier = decimal128.FromI64(1e9)
+
+// appendPrice - Добавление цены в колонку PriceType, nil записывается как null
+func appendPrice(b *array.Decimal128Builder, q *pb.Quotation) {
+	if q == nil {
+		b.AppendNull()
+		return
+	}
+	b.Append(decimal128.FromI64(q.GetUnits()).Mul(nanoMultiplier).Add(decimal128.FromI64(int64(q.GetNano()))))
+}
+
+// appendTime - Добавление времени в колонку TimeType, nil записывается как null
+func appendTime(b *array.TimestampBuilder, t *timestamppb.Timestamp) {
+	if t == nil {
+		b.AppendNull()
+		return
+	}
+	b.Append(arrow.Timestamp(t.AsTime().UnixNano()))
+}
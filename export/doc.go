@@ -0,0 +1,26 @@
+/*
+Package export выгружает свечи, обезличенные сделки и снимки стаканов в колоночные форматы Apache Parquet
+и Arrow IPC, которые читаются в pandas и polars без разбора строк.
+
+Пакет - отдельный модуль github.com/tinkoff/invest-api-go-sdk/export, зависимости Apache Arrow подключаются
+только вместе с ним.
+
+Колонки типизированы: время - timestamp[ns, UTC], цены - decimal128(28, 9) без потери точности Quotation,
+объемы - int64, идентификаторы, интервалы и направления - строки. Схемы таблиц: CandlesSchema, TradesSchema,
+OrderBooksSchema.
+
+	candles, err := md.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{...})
+	err = export.CandlesToFile("sber.parquet", export.CandleSeries{
+		InstrumentId: uid,
+		Interval:     pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+		Candles:      candles,
+	})
+
+Все ряды хранилища из пакета storage выгружаются одной таблицей с помощью WriteStoredCandles.
+
+Чтение в python:
+
+	pd.read_parquet("sber.parquet")
+	pl.read_ipc("sber.arrow")
+*/
+package export
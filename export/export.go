@@ -0,0 +1,124 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/parquet"
+	"github.com/apache/arrow/go/v12/parquet/compress"
+	"github.com/apache/arrow/go/v12/parquet/pqarrow"
+)
+
+// Format - Формат файла выгрузки
+type Format int
+
+const (
+	// FORMAT_PARQUET - Apache Parquet со сжатием snappy
+	FORMAT_PARQUET Format = iota
+	// FORMAT_ARROW - Arrow IPC в файловом формате (Feather v2)
+	FORMAT_ARROW
+)
+
+func (f Format) String() string {
+	switch f {
+	case FORMAT_PARQUET:
+		return "parquet"
+	case FORMAT_ARROW:
+		return "arrow"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ErrUnknownFormat - Формат не поддерживается или не удалось определить его по расширению файла
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// FormatFromFileName - Формат по расширению файла: .parquet - FORMAT_PARQUET, .arrow, .feather, .ipc - FORMAT_ARROW
+func FormatFromFileName(name string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".parquet":
+		return FORMAT_PARQUET, nil
+	case ".arrow", ".feather", ".ipc":
+		return FORMAT_ARROW, nil
+	}
+	return 0, fmt.Errorf("%w: %v", ErrUnknownFormat, name)
+}
+
+// writeRecord - Запись таблицы в w в формате format. w не закрывается
+func writeRecord(w io.Writer, format Format, rec arrow.Record) error {
+	switch format {
+	case FORMAT_PARQUET:
+		props := parquet.NewWriterProperties(
+			parquet.WithCompression(compress.Codecs.Snappy),
+			parquet.WithVersion(parquet.V2_LATEST),
+		)
+		// WithStoreSchema сохраняет часовой пояс колонок времени
+		fw, err := pqarrow.NewFileWriter(rec.Schema(), noCloseWriter{w}, props,
+			pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+		if err != nil {
+			return err
+		}
+		if err := fw.Write(rec); err != nil {
+			fw.Close()
+			return err
+		}
+		return fw.Close()
+	case FORMAT_ARROW:
+		fw, err := ipc.NewFileWriter(&positionWriter{w: w}, ipc.WithSchema(rec.Schema()))
+		if err != nil {
+			return err
+		}
+		if err := fw.Write(rec); err != nil {
+			fw.Close()
+			return err
+		}
+		return fw.Close()
+	}
+	return fmt.Errorf("%w: %v", ErrUnknownFormat, format)
+}
+
+// writeFile - Запись таблицы в файл, формат определяется по расширению
+func writeFile(path string, write func(w io.Writer, format Format) error) error {
+	format, err := FormatFromFileName(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file, format); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// noCloseWriter - Скрывает Close, чтобы писатель parquet не закрыл writer пользователя
+type noCloseWriter struct {
+	io.Writer
+}
+
+// positionWriter - Writer с поддержкой Seek(0, io.SeekCurrent), которого достаточно писателю Arrow IPC
+type positionWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (p *positionWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *positionWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("export: writer supports only current position")
+	}
+	return p.pos, nil
+}
@@ -0,0 +1,267 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/apache/arrow/go/v12/parquet/pqarrow"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/storage"
+)
+
+var (
+	exportStart = time.Date(2024, 3, 4, 7, 0, 0, 123456789, time.UTC)
+	formats     = []Format{FORMAT_PARQUET, FORMAT_ARROW}
+)
+
+// readTable - Чтение таблицы, записанной в формате format
+func readTable(t *testing.T, data []byte, format Format) arrow.Table {
+	t.Helper()
+	switch format {
+	case FORMAT_PARQUET:
+		tbl, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(data), nil, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		if err != nil {
+			t.Fatalf("read parquet: %v", err)
+		}
+		return tbl
+	case FORMAT_ARROW:
+		r, err := ipc.NewFileReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("read arrow: %v", err)
+		}
+		defer r.Close()
+		recs := make([]arrow.Record, 0, r.NumRecords())
+		for i := 0; i < r.NumRecords(); i++ {
+			rec, err := r.Record(i)
+			if err != nil {
+				t.Fatalf("read arrow record: %v", err)
+			}
+			rec.Retain()
+			recs = append(recs, rec)
+		}
+		return array.NewTableFromRecords(r.Schema(), recs)
+	}
+	t.Fatalf("unknown format %v", format)
+	return nil
+}
+
+// tableRows - Строки таблицы, значения колонок приведены к string, time.Time, int64, int32, bool или nil
+func tableRows(t *testing.T, tbl arrow.Table, schema *arrow.Schema) [][]any {
+	t.Helper()
+	// типы колонок, включая часовой пояс времени и точность цен, сохраняются в обоих форматах
+	if len(tbl.Schema().Fields()) != len(schema.Fields()) {
+		t.Fatalf("schema = %v, want %v", tbl.Schema(), schema)
+	}
+	for i, f := range tbl.Schema().Fields() {
+		want := schema.Field(i)
+		if f.Name != want.Name || !arrow.TypeEqual(f.Type, want.Type) {
+			t.Fatalf("column %v = %v %v, want %v %v", i, f.Name, f.Type, want.Name, want.Type)
+		}
+	}
+	rows := make([][]any, 0, tbl.NumRows())
+	reader := array.NewTableReader(tbl, 0)
+	defer reader.Release()
+	for reader.Next() {
+		rec := reader.Record()
+		for i := 0; i < int(rec.NumRows()); i++ {
+			row := make([]any, 0, rec.NumCols())
+			for _, col := range rec.Columns() {
+				if col.IsNull(i) {
+					row = append(row, nil)
+					continue
+				}
+				switch a := col.(type) {
+				case *array.String:
+					row = append(row, a.Value(i))
+				case *array.Timestamp:
+					row = append(row, a.Value(i).ToTime(arrow.Nanosecond))
+				case *array.Decimal128:
+					row = append(row, a.Value(i).ToString(PriceType.Scale))
+				case *array.Int64:
+					row = append(row, a.Value(i))
+				case *array.Int32:
+					row = append(row, a.Value(i))
+				case *array.Boolean:
+					row = append(row, a.Value(i))
+				default:
+					t.Fatalf("unexpected column type %T", col)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// price - Цена в виде строки колонки PriceType
+func price(q *pb.Quotation) string {
+	return investgo.QuotationToDecimal(q).StringFixed(PriceType.Scale)
+}
+
+func checkRows(t *testing.T, got, want [][]any) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("rows = %v, want %v", len(got), len(want))
+	}
+	for i := range want {
+		for j := range want[i] {
+			g, w := got[i][j], want[i][j]
+			if gt, ok := g.(time.Time); ok {
+				if wt, ok := w.(time.Time); !ok || !gt.Equal(wt) {
+					t.Fatalf("row %v column %v = %v, want %v", i, j, g, w)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(g, w) {
+				t.Fatalf("row %v column %v = %#v, want %#v", i, j, g, w)
+			}
+		}
+	}
+}
+
+func TestCandlesRoundTrip(t *testing.T) {
+	candles := []*pb.HistoricCandle{
+		{
+			Time:       investgo.TimeToTimestamp(exportStart),
+			Open:       &pb.Quotation{Units: 250, Nano: 100000000},
+			High:       &pb.Quotation{Units: 251, Nano: 1},
+			Low:        &pb.Quotation{Units: -3, Nano: -500000000},
+			Close:      &pb.Quotation{Units: 250, Nano: 999999999},
+			Volume:     1234567890123,
+			IsComplete: true,
+		},
+		// незаполненные цены и время записываются как null
+		{Volume: 1},
+	}
+	series := []CandleSeries{
+		{InstrumentId: "uid1", Interval: pb.CandleInterval_CANDLE_INTERVAL_1_MIN, Candles: candles},
+		{InstrumentId: "uid2", Interval: pb.CandleInterval_CANDLE_INTERVAL_DAY, Candles: candles[:1]},
+	}
+	c := candles[0]
+	full := []any{exportStart, price(c.Open), price(c.High), "-3.500000000", price(c.Close), int64(1234567890123), true}
+	want := [][]any{
+		append([]any{"uid1", "CANDLE_INTERVAL_1_MIN"}, full...),
+		{"uid1", "CANDLE_INTERVAL_1_MIN", nil, nil, nil, nil, nil, int64(1), false},
+		append([]any{"uid2", "CANDLE_INTERVAL_DAY"}, full...),
+	}
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteCandles(&buf, format, series...); err != nil {
+				t.Fatalf("WriteCandles: %v", err)
+			}
+			checkRows(t, tableRows(t, readTable(t, buf.Bytes(), format), CandlesSchema), want)
+		})
+	}
+}
+
+func TestStoredCandles(t *testing.T) {
+	store := storage.NewMemoryStore()
+	minute := pb.CandleInterval_CANDLE_INTERVAL_1_MIN
+	candle := func(m int, close int64) *pb.HistoricCandle {
+		return &pb.HistoricCandle{Time: investgo.TimeToTimestamp(exportStart.Add(time.Duration(m) * time.Minute)), Close: &pb.Quotation{Units: close}}
+	}
+	if err := store.Store("a", minute, []*pb.HistoricCandle{candle(0, 1), candle(1, 2), candle(2, 3)}, time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := store.Store("b", minute, []*pb.HistoricCandle{candle(1, 10)}, time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	var buf bytes.Buffer
+	// свечи в диапазоне [1, 2) минут всех рядов
+	if err := WriteStoredCandles(&buf, FORMAT_ARROW, store, exportStart.Add(time.Minute), exportStart.Add(2*time.Minute)); err != nil {
+		t.Fatalf("WriteStoredCandles: %v", err)
+	}
+	rows := tableRows(t, readTable(t, buf.Bytes(), FORMAT_ARROW), CandlesSchema)
+	if len(rows) != 2 || rows[0][0] != "a" || rows[0][6] != "2.000000000" || rows[1][0] != "b" || rows[1][6] != "10.000000000" {
+		t.Fatalf("rows = %v", rows)
+	}
+}
+
+func TestTradesRoundTrip(t *testing.T) {
+	trades := []*pb.Trade{
+		{InstrumentUid: "uid", Figi: "figi", Time: investgo.TimeToTimestamp(exportStart), Direction: pb.TradeDirection_TRADE_DIRECTION_BUY,
+			Price: &pb.Quotation{Units: 99, Nano: 990000000}, Quantity: 7},
+		{InstrumentUid: "uid", Figi: "figi", Time: investgo.TimeToTimestamp(exportStart.Add(time.Nanosecond)),
+			Direction: pb.TradeDirection_TRADE_DIRECTION_SELL, Price: &pb.Quotation{Units: 100}, Quantity: 1},
+	}
+	want := [][]any{
+		{"uid", "figi", exportStart, "TRADE_DIRECTION_BUY", "99.990000000", int64(7)},
+		{"uid", "figi", exportStart.Add(time.Nanosecond), "TRADE_DIRECTION_SELL", "100.000000000", int64(1)},
+	}
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteTrades(&buf, format, trades); err != nil {
+				t.Fatalf("WriteTrades: %v", err)
+			}
+			checkRows(t, tableRows(t, readTable(t, buf.Bytes(), format), TradesSchema), want)
+		})
+	}
+}
+
+func TestOrderBooksRoundTrip(t *testing.T) {
+	books := []*pb.OrderBook{
+		{
+			InstrumentUid: "uid", Figi: "figi", Depth: 2, IsConsistent: true, Time: investgo.TimeToTimestamp(exportStart),
+			Bids: []*pb.Order{{Price: &pb.Quotation{Units: 99}, Quantity: 5}, {Price: &pb.Quotation{Units: 98}, Quantity: 6}},
+			Asks: []*pb.Order{{Price: &pb.Quotation{Units: 101}, Quantity: 7}},
+		},
+		// пустой стакан не дает строк
+		{InstrumentUid: "uid", Figi: "figi", Depth: 2, Time: investgo.TimeToTimestamp(exportStart.Add(time.Second))},
+	}
+	want := [][]any{
+		{"uid", "figi", exportStart, int32(2), true, SIDE_BID, int32(0), "99.000000000", int64(5)},
+		{"uid", "figi", exportStart, int32(2), true, SIDE_BID, int32(1), "98.000000000", int64(6)},
+		{"uid", "figi", exportStart, int32(2), true, SIDE_ASK, int32(0), "101.000000000", int64(7)},
+	}
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteOrderBooks(&buf, format, books); err != nil {
+				t.Fatalf("WriteOrderBooks: %v", err)
+			}
+			checkRows(t, tableRows(t, readTable(t, buf.Bytes(), format), OrderBooksSchema), want)
+		})
+	}
+}
+
+func TestToFile(t *testing.T) {
+	dir := t.TempDir()
+	trades := []*pb.Trade{{InstrumentUid: "uid", Time: investgo.TimeToTimestamp(exportStart), Price: &pb.Quotation{Units: 1}, Quantity: 1}}
+	for _, name := range []string{"trades.parquet", "trades.arrow", "trades.FEATHER", "trades.ipc"} {
+		path := filepath.Join(dir, name)
+		if err := TradesToFile(path, trades); err != nil {
+			t.Fatalf("TradesToFile %v: %v", name, err)
+		}
+		format, err := FormatFromFileName(name)
+		if err != nil {
+			t.Fatalf("FormatFromFileName: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %v: %v", name, err)
+		}
+		if rows := tableRows(t, readTable(t, data, format), TradesSchema); len(rows) != 1 {
+			t.Fatalf("%v rows = %v", name, rows)
+		}
+	}
+	path := filepath.Join(dir, "trades.csv")
+	if err := TradesToFile(path, trades); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("err = %v, want ErrUnknownFormat", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("file with unknown format must not be created")
+	}
+}
@@ -0,0 +1,116 @@
+package export
+
+import (
+	"io"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// SIDE_BID, SIDE_ASK - Значения колонки side в таблице стаканов
+	SIDE_BID = "bid"
+	SIDE_ASK = "ask"
+)
+
+// TradesSchema - Схема таблицы обезличенных сделок
+var TradesSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "instrument_uid", Type: arrow.BinaryTypes.String},
+	{Name: "figi", Type: arrow.BinaryTypes.String},
+	{Name: "time", Type: TimeType, Nullable: true},
+	{Name: "direction", Type: arrow.BinaryTypes.String},
+	{Name: "price", Type: PriceType, Nullable: true},
+	{Name: "quantity", Type: arrow.PrimitiveTypes.Int64},
+}, nil)
+
+// OrderBooksSchema - Схема таблицы снимков стаканов. Каждый уровень стакана - отдельная строка,
+// снимок определяется парой instrument_uid, time, level - номер уровня от лучшей цены начиная с 0
+var OrderBooksSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "instrument_uid", Type: arrow.BinaryTypes.String},
+	{Name: "figi", Type: arrow.BinaryTypes.String},
+	{Name: "time", Type: TimeType, Nullable: true},
+	{Name: "depth", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "is_consistent", Type: arrow.FixedWidthTypes.Boolean},
+	{Name: "side", Type: arrow.BinaryTypes.String},
+	{Name: "level", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "price", Type: PriceType, Nullable: true},
+	{Name: "quantity", Type: arrow.PrimitiveTypes.Int64},
+}, nil)
+
+// WriteTrades - Запись сделок в таблицу со схемой TradesSchema
+func WriteTrades(w io.Writer, format Format, trades []*pb.Trade) error {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, TradesSchema)
+	defer b.Release()
+	var (
+		ids        = b.Field(0).(*array.StringBuilder)
+		figis      = b.Field(1).(*array.StringBuilder)
+		times      = b.Field(2).(*array.TimestampBuilder)
+		directions = b.Field(3).(*array.StringBuilder)
+		prices     = b.Field(4).(*array.Decimal128Builder)
+		quantities = b.Field(5).(*array.Int64Builder)
+	)
+	for _, t := range trades {
+		ids.Append(t.GetInstrumentUid())
+		figis.Append(t.GetFigi())
+		appendTime(times, t.GetTime())
+		directions.Append(t.GetDirection().String())
+		appendPrice(prices, t.GetPrice())
+		quantities.Append(t.GetQuantity())
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+	return writeRecord(w, format, rec)
+}
+
+// TradesToFile - Запись сделок в файл, формат определяется по расширению (см. FormatFromFileName)
+func TradesToFile(path string, trades []*pb.Trade) error {
+	return writeFile(path, func(w io.Writer, format Format) error {
+		return WriteTrades(w, format, trades)
+	})
+}
+
+// WriteOrderBooks - Запись снимков стаканов в таблицу со схемой OrderBooksSchema
+func WriteOrderBooks(w io.Writer, format Format, books []*pb.OrderBook) error {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, OrderBooksSchema)
+	defer b.Release()
+	var (
+		ids          = b.Field(0).(*array.StringBuilder)
+		figis        = b.Field(1).(*array.StringBuilder)
+		times        = b.Field(2).(*array.TimestampBuilder)
+		depths       = b.Field(3).(*array.Int32Builder)
+		isConsistent = b.Field(4).(*array.BooleanBuilder)
+		sides        = b.Field(5).(*array.StringBuilder)
+		levels       = b.Field(6).(*array.Int32Builder)
+		prices       = b.Field(7).(*array.Decimal128Builder)
+		quantities   = b.Field(8).(*array.Int64Builder)
+	)
+	appendSide := func(book *pb.OrderBook, side string, orders []*pb.Order) {
+		for i, o := range orders {
+			ids.Append(book.GetInstrumentUid())
+			figis.Append(book.GetFigi())
+			appendTime(times, book.GetTime())
+			depths.Append(book.GetDepth())
+			isConsistent.Append(book.GetIsConsistent())
+			sides.Append(side)
+			levels.Append(int32(i))
+			appendPrice(prices, o.GetPrice())
+			quantities.Append(o.GetQuantity())
+		}
+	}
+	for _, book := range books {
+		appendSide(book, SIDE_BID, book.GetBids())
+		appendSide(book, SIDE_ASK, book.GetAsks())
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+	return writeRecord(w, format, rec)
+}
+
+// OrderBooksToFile - Запись снимков стаканов в файл, формат определяется по расширению (см. FormatFromFileName)
+func OrderBooksToFile(path string, books []*pb.OrderBook) error {
+	return writeFile(path, func(w io.Writer, format Format) error {
+		return WriteOrderBooks(w, format, books)
+	})
+}
@@ -0,0 +1,123 @@
+// Package matching - Общая логика исполнения заявок для симулятора биржи и бектеста: расчет сделки по счету,
+// учет позиции и цена исполнения лимитной заявки
+package matching
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+var (
+	// ErrNotEnoughMoney - Недостаточно денежных средств для исполнения заявки
+	ErrNotEnoughMoney = errors.New("not enough money")
+	// ErrNotEnoughAssets - Недостаточно бумаг для продажи, если короткие позиции запрещены
+	ErrNotEnoughAssets = errors.New("not enough assets")
+)
+
+// Position - Позиция по инструменту
+type Position struct {
+	// Quantity - Количество в штуках, отрицательное для короткой позиции
+	Quantity int64
+	AvgPrice decimal.Decimal
+}
+
+// Apply - Изменение позиции на delta штук по цене price, возвращает реализованный результат по закрытой части
+// позиции без учета комиссии и признак того, что сделка закрывает позицию
+func (p *Position) Apply(price decimal.Decimal, delta int64) (decimal.Decimal, bool) {
+	q := p.Quantity
+	newQuantity := q + delta
+	if q == 0 || (q > 0) == (delta > 0) {
+		// открытие или увеличение позиции
+		total := p.AvgPrice.Mul(decimal.NewFromInt(Abs(q))).Add(price.Mul(decimal.NewFromInt(Abs(delta))))
+		p.AvgPrice = total.Div(decimal.NewFromInt(Abs(newQuantity)))
+		p.Quantity = newQuantity
+		return decimal.Zero, false
+	}
+	closed := Abs(delta)
+	if closed > Abs(q) {
+		closed = Abs(q)
+	}
+	realized := price.Sub(p.AvgPrice).Mul(decimal.NewFromInt(closed))
+	if q < 0 {
+		realized = realized.Neg()
+	}
+	switch {
+	case newQuantity == 0:
+		p.AvgPrice = decimal.Zero
+	case (newQuantity > 0) != (q > 0):
+		// переворот позиции
+		p.AvgPrice = price
+	}
+	p.Quantity = newQuantity
+	return realized, true
+}
+
+// Check - Проверка, что денежных средств cash хватает на покупку, а позиции held - на продажу pieces штук по цене price
+func Check(cash decimal.Decimal, held int64, direction pb.OrderDirection, price decimal.Decimal, pieces int64, commission decimal.Decimal, allowShort bool) error {
+	amount := price.Mul(decimal.NewFromInt(pieces))
+	if direction == pb.OrderDirection_ORDER_DIRECTION_BUY {
+		if required := amount.Add(commission); cash.LessThan(required) {
+			return fmt.Errorf("%w: %v available, %v required", ErrNotEnoughMoney, cash, required)
+		}
+		return nil
+	}
+	if !allowShort && held < pieces {
+		return fmt.Errorf("%w: %v available, %v required", ErrNotEnoughAssets, held, pieces)
+	}
+	if cash.Add(amount).LessThan(commission) {
+		return fmt.Errorf("%w: %v available, commission %v", ErrNotEnoughMoney, cash.Add(amount), commission)
+	}
+	return nil
+}
+
+// Settle - Расчет сделки на pieces штук по цене price: проверка по Check, изменение позиции p, возвращает
+// денежные средства после сделки и результат Position.Apply. При ошибке позиция не изменяется
+func Settle(cash decimal.Decimal, p *Position, direction pb.OrderDirection, price decimal.Decimal, pieces int64, commission decimal.Decimal, allowShort bool) (decimal.Decimal, decimal.Decimal, bool, error) {
+	if err := Check(cash, p.Quantity, direction, price, pieces, commission, allowShort); err != nil {
+		return cash, decimal.Zero, false, err
+	}
+	amount := price.Mul(decimal.NewFromInt(pieces))
+	delta := pieces
+	if direction == pb.OrderDirection_ORDER_DIRECTION_BUY {
+		cash = cash.Sub(amount)
+	} else {
+		cash = cash.Add(amount)
+		delta = -pieces
+	}
+	realized, closing := p.Apply(price, delta)
+	return cash.Sub(commission), realized, closing, nil
+}
+
+// LimitPrice - Цена исполнения лимитной заявки по цене limit, если за период цены были в диапазоне low-high,
+// а период начался с цены open. Если цена открылась лучше лимитной цены, то заявка исполняется по цене открытия
+func LimitPrice(direction pb.OrderDirection, limit, low, high, open decimal.Decimal) (decimal.Decimal, bool) {
+	switch {
+	case direction == pb.OrderDirection_ORDER_DIRECTION_BUY && low.LessThanOrEqual(limit):
+		return decimal.Min(limit, open), true
+	case direction == pb.OrderDirection_ORDER_DIRECTION_SELL && high.GreaterThanOrEqual(limit):
+		return decimal.Max(limit, open), true
+	}
+	return decimal.Zero, false
+}
+
+// CheckPriceStep - Проверка, что цена положительна и кратна шагу цены step
+func CheckPriceStep(price, step decimal.Decimal) error {
+	if !price.IsPositive() {
+		return fmt.Errorf("price must be positive")
+	}
+	if step.IsPositive() && !price.Mod(step).IsZero() {
+		return fmt.Errorf("price %v is not a multiple of min price increment %v", price, step)
+	}
+	return nil
+}
+
+// Abs - Модуль числа
+func Abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
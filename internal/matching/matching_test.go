@@ -0,0 +1,107 @@
+package matching
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+func TestPositionApply(t *testing.T) {
+	d := decimal.NewFromInt
+	tests := []struct {
+		name     string
+		start    Position
+		price    int64
+		delta    int64
+		want     Position
+		realized int64
+		closing  bool
+	}{
+		{name: "open long", price: 100, delta: 10, want: Position{10, d(100)}},
+		{name: "add to long", start: Position{10, d(100)}, price: 130, delta: 20, want: Position{30, d(120)}},
+		{name: "reduce long", start: Position{10, d(100)}, price: 110, delta: -4, want: Position{6, d(100)}, realized: 40, closing: true},
+		{name: "close long", start: Position{10, d(100)}, price: 90, delta: -10, want: Position{0, decimal.Zero}, realized: -100, closing: true},
+		{name: "reverse long", start: Position{10, d(100)}, price: 110, delta: -15, want: Position{-5, d(110)}, realized: 100, closing: true},
+		{name: "open short", price: 100, delta: -10, want: Position{-10, d(100)}},
+		{name: "cover short", start: Position{-10, d(100)}, price: 90, delta: 10, want: Position{0, decimal.Zero}, realized: 100, closing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.start
+			realized, closing := p.Apply(d(tt.price), tt.delta)
+			if p.Quantity != tt.want.Quantity || !p.AvgPrice.Equal(tt.want.AvgPrice) {
+				t.Errorf("position = %v @ %v, want %v @ %v", p.Quantity, p.AvgPrice, tt.want.Quantity, tt.want.AvgPrice)
+			}
+			if !realized.Equal(d(tt.realized)) || closing != tt.closing {
+				t.Errorf("realized = %v, closing = %v, want %v, %v", realized, closing, tt.realized, tt.closing)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	d := decimal.NewFromInt
+	buy, sell := pb.OrderDirection_ORDER_DIRECTION_BUY, pb.OrderDirection_ORDER_DIRECTION_SELL
+	tests := []struct {
+		name      string
+		cash      int64
+		held      int64
+		direction pb.OrderDirection
+		pieces    int64
+		short     bool
+		wantCash  int64
+		err       error
+	}{
+		{name: "buy", cash: 1000, direction: buy, pieces: 9, wantCash: 99},
+		{name: "buy without money for commission", cash: 1000, direction: buy, pieces: 10, wantCash: 1000, err: ErrNotEnoughMoney},
+		{name: "sell", cash: 0, held: 5, direction: sell, pieces: 5, wantCash: 499},
+		{name: "sell without assets", cash: 0, held: 4, direction: sell, pieces: 5, err: ErrNotEnoughAssets},
+		{name: "short", cash: 0, direction: sell, pieces: 5, short: true, wantCash: 499},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Position{Quantity: tt.held, AvgPrice: d(100)}
+			cash, _, _, err := Settle(d(tt.cash), &p, tt.direction, d(100), tt.pieces, d(1), tt.short)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !cash.Equal(d(tt.wantCash)) {
+				t.Fatalf("cash = %v, want %v", cash, tt.wantCash)
+			}
+			if err != nil && p.Quantity != tt.held {
+				t.Fatal("position must not change on error")
+			}
+		})
+	}
+}
+
+func TestLimitPrice(t *testing.T) {
+	d := decimal.NewFromInt
+	buy, sell := pb.OrderDirection_ORDER_DIRECTION_BUY, pb.OrderDirection_ORDER_DIRECTION_SELL
+	tests := []struct {
+		name      string
+		direction pb.OrderDirection
+		limit     int64
+		low, high int64
+		open      int64
+		want      int64
+		ok        bool
+	}{
+		{name: "buy reached", direction: buy, limit: 95, low: 94, high: 101, open: 100, want: 95, ok: true},
+		{name: "buy gap", direction: buy, limit: 95, low: 89, high: 91, open: 90, want: 90, ok: true},
+		{name: "buy not reached", direction: buy, limit: 95, low: 96, high: 101, open: 100},
+		{name: "sell reached", direction: sell, limit: 105, low: 99, high: 106, open: 100, want: 105, ok: true},
+		{name: "sell gap", direction: sell, limit: 105, low: 109, high: 111, open: 110, want: 110, ok: true},
+		{name: "sell not reached", direction: sell, limit: 105, low: 99, high: 104, open: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := LimitPrice(tt.direction, d(tt.limit), d(tt.low), d(tt.high), d(tt.open))
+			if ok != tt.ok || (ok && !got.Equal(d(tt.want))) {
+				t.Fatalf("LimitPrice = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package investgo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// DEFAULT_CANDLES_LIMIT - Лимит запросов GetCandles в минуту, если его не удалось получить из тарифа
+	DEFAULT_CANDLES_LIMIT = 300
+	// DEFAULT_DOWNLOAD_WORKERS - Количество параллельных запросов загрузчика по умолчанию
+	DEFAULT_DOWNLOAD_WORKERS = 8
+	// candlesMethod - Суффикс имени метода GetCandles в тарифе пользователя
+	candlesMethod = "MarketDataService/GetCandles"
+	// downloadMaxAttempts - Количество попыток загрузки одного окна
+	downloadMaxAttempts = 5
+)
+
+// DownloadCandlesRequest - Запрос на загрузку исторических свечей
+type DownloadCandlesRequest struct {
+	// Instruments - Идентификаторы инструментов
+	Instruments []string
+	Interval    pb.CandleInterval
+	From        time.Time
+	To          time.Time
+	// Workers - Количество параллельных запросов, по умолчанию = DEFAULT_DOWNLOAD_WORKERS
+	Workers int
+	// CacheDir - Директория для сохранения загруженных окон. Если указана, то после прерывания загрузка
+	// продолжается с незагруженных окон, а уже загруженные читаются с диска
+	CacheDir string
+	// OnProgress - Функция, вызываемая после загрузки каждого окна, может быть nil
+	OnProgress func(p DownloadProgress)
+}
+
+// DownloadProgress - Прогресс загрузки свечей
+type DownloadProgress struct {
+	// InstrumentId - Инструмент, окно которого загружено
+	InstrumentId string
+	// Done, Total - Количество загруженных и всех окон по всем инструментам
+	Done  int
+	Total int
+	// Cached - Окно прочитано из CacheDir
+	Cached bool
+}
+
+// CandlesDownloader - Параллельный загрузчик исторических свечей с учетом лимитов запросов
+type CandlesDownloader struct {
+	md     *MarketDataServiceClient
+	users  *UsersServiceClient
+	logger Logger
+
+	limiterOnce sync.Once
+	limiter     *rateLimiter
+}
+
+// Download - Загрузка свечей по инструментам за период From-To. Период каждого инструмента делится на окна
+// максимальной для интервала длины, окна загружаются параллельно, свечи объединяются, сортируются по времени
+// и очищаются от дублей
+func (d *CandlesDownloader) Download(ctx context.Context, req DownloadCandlesRequest) (map[string][]*pb.HistoricCandle, error) {
+	if req.Interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		req.Interval = pb.CandleInterval_CANDLE_INTERVAL_HOUR
+	}
+	if req.Workers < 1 {
+		req.Workers = DEFAULT_DOWNLOAD_WORKERS
+	}
+	if !req.To.After(req.From) {
+		return nil, fmt.Errorf("invalid period from %v to %v", req.From, req.To)
+	}
+	if req.CacheDir != "" {
+		if err := os.MkdirAll(req.CacheDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	d.limiterOnce.Do(func() {
+		d.limiter = newRateLimiter(d.candlesLimit(), d.md.config.clock())
+	})
+
+	windows := downloadWindows(req)
+	var (
+		mu   sync.Mutex
+		done int
+		// results - Свечи по индексу окна, чтобы объединять окна в порядке времени, а не завершения загрузки
+		results = make([][]*pb.HistoricCandle, len(windows))
+	)
+	p := pool.New().WithContext(ctx).WithCancelOnError().WithMaxGoroutines(req.Workers)
+	for i, w := range windows {
+		i, w := i, w
+		p.Go(func(ctx context.Context) error {
+			candles, cached, err := d.window(ctx, req, w.instrumentId, w.from, w.to)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			results[i] = candles
+			done++
+			progress := DownloadProgress{InstrumentId: w.instrumentId, Done: done, Total: len(windows), Cached: cached}
+			mu.Unlock()
+			if req.OnProgress != nil {
+				req.OnProgress(progress)
+			}
+			return nil
+		})
+	}
+	if err := p.Wait(); err != nil {
+		return nil, err
+	}
+
+	byInstrument := make(map[string][][]*pb.HistoricCandle, len(req.Instruments))
+	for i, w := range windows {
+		byInstrument[w.instrumentId] = append(byInstrument[w.instrumentId], results[i])
+	}
+	res := make(map[string][]*pb.HistoricCandle, len(req.Instruments))
+	for _, id := range req.Instruments {
+		res[id] = mergeCandles(byInstrument[id])
+	}
+	return res, nil
+}
+
+// downloadWindow - Окно загрузки свечей одного инструмента
+type downloadWindow struct {
+	instrumentId string
+	from, to     time.Time
+}
+
+// downloadWindows - Деление периода каждого инструмента на окна максимальной для интервала длины
+func downloadWindows(req DownloadCandlesRequest) []downloadWindow {
+	duration := selectDuration(req.Interval)
+	windows := make([]downloadWindow, 0)
+	for _, id := range req.Instruments {
+		for from := req.From; from.Before(req.To); from = from.Add(duration) {
+			to := from.Add(duration)
+			if to.After(req.To) {
+				to = req.To
+			}
+			windows = append(windows, downloadWindow{instrumentId: id, from: from, to: to})
+		}
+	}
+	return windows
+}
+
+// window - Загрузка одного окна с учетом лимитов, с повтором при превышении лимита. Повтор ResourceExhausted
+// интерцептором клиента для этих запросов отключен: загрузчик сам ждет сброса лимита, и все воркеры
+// останавливаются вместе, а не повторяют запросы независимо друг от друга
+func (d *CandlesDownloader) window(ctx context.Context, req DownloadCandlesRequest, id string, from, to time.Time) ([]*pb.HistoricCandle, bool, error) {
+	cacheFile := ""
+	if req.CacheDir != "" {
+		cacheFile = filepath.Join(req.CacheDir, fmt.Sprintf("%v_%v_%v_%v.json",
+			safeFileName(id), req.Interval.String(), from.Unix(), to.Unix()))
+		if candles, err := readCandlesWindow(cacheFile); err == nil {
+			return candles, true, nil
+		}
+	}
+	var lastErr error
+	for attempt := 0; attempt < downloadMaxAttempts; attempt++ {
+		if err := d.limiter.wait(ctx); err != nil {
+			return nil, false, err
+		}
+		resp, err := d.md.getCandles(id, req.Interval, from, to, retry.WithoutResourceExhausted())
+		d.limiter.update(resp.GetHeader())
+		if err != nil {
+			lastErr = err
+			if status.Code(err) == codes.ResourceExhausted {
+				// лимит исчерпан другими запросами, ждем сброса и пробуем снова
+				d.limiter.exhaust(ResetLimitFromHeader(resp.GetHeader()))
+				continue
+			}
+			return nil, false, fmt.Errorf("%v candles from %v to %v: %w", id, from, to, err)
+		}
+		if cacheFile != "" && completeWindow(resp.GetCandles(), to, d.md.config.clock().Now()) {
+			if err := writeCandlesWindow(cacheFile, resp.GetCandlesResponse); err != nil {
+				d.logger.Errorf("candles cache writing error %v", err.Error())
+			}
+		}
+		return resp.GetCandles(), false, nil
+	}
+	return nil, false, fmt.Errorf("%v candles from %v to %v: %w", id, from, to, lastErr)
+}
+
+// candlesLimit - Лимит запросов GetCandles в минуту из тарифа пользователя
+func (d *CandlesDownloader) candlesLimit() int {
+	resp, err := d.users.GetUserTariff()
+	if err != nil {
+		d.logger.Errorf("GetUserTariff error %v, default candles limit is used", err.Error())
+		return DEFAULT_CANDLES_LIMIT
+	}
+	for _, l := range resp.GetUnaryLimits() {
+		for _, m := range l.GetMethods() {
+			if strings.HasSuffix(m, candlesMethod) {
+				return int(l.GetLimitPerMinute())
+			}
+		}
+	}
+	return DEFAULT_CANDLES_LIMIT
+}
+
+// mergeCandles - Объединение свечей окон с сортировкой по времени и удалением дублей, окна должны идти по времени
+func mergeCandles(windows [][]*pb.HistoricCandle) []*pb.HistoricCandle {
+	size := 0
+	for _, w := range windows {
+		size += len(w)
+	}
+	all := make([]*pb.HistoricCandle, 0, size)
+	for _, w := range windows {
+		all = append(all, w...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].GetTime().AsTime().Before(all[j].GetTime().AsTime())
+	})
+	res := all[:0]
+	for _, c := range all {
+		if n := len(res); n > 0 && res[n-1].GetTime().AsTime().Equal(c.GetTime().AsTime()) {
+			// на стыке окон свеча может прийти дважды, оставляем последнюю версию
+			res[n-1] = c
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// completeWindow - Окно можно кэшировать, только если оно в прошлом относительно now и все свечи в нем сформированы
+func completeWindow(candles []*pb.HistoricCandle, to, now time.Time) bool {
+	if !to.Before(now) {
+		return false
+	}
+	for _, c := range candles {
+		if !c.GetIsComplete() {
+			return false
+		}
+	}
+	return true
+}
+
+func readCandlesWindow(path string) ([]*pb.HistoricCandle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.GetCandlesResponse{}
+	if err := protojson.Unmarshal(data, resp); err != nil {
+		return nil, err
+	}
+	return resp.GetCandles(), nil
+}
+
+// writeCandlesWindow - Запись окна через временный файл, чтобы прерванная запись не оставила битый кэш
+func writeCandlesWindow(path string, resp *pb.GetCandlesResponse) error {
+	data, err := protojson.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func safeFileName(s string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(s)
+}
+
+// rateLimiter - Ограничитель запросов в минуту, уточняется по заголовкам x-ratelimit-remaining и x-ratelimit-reset
+type rateLimiter struct {
+	clock     Clock
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	resetAt   time.Time
+}
+
+func newRateLimiter(limit int, clock Clock) *rateLimiter {
+	if limit < 1 {
+		limit = DEFAULT_CANDLES_LIMIT
+	}
+	return &rateLimiter{
+		clock:     clock,
+		limit:     limit,
+		remaining: limit,
+		resetAt:   clock.Now().Add(time.Minute),
+	}
+}
+
+// wait - Ожидание возможности сделать запрос
+func (r *rateLimiter) wait(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		now := r.clock.Now()
+		if !now.Before(r.resetAt) {
+			r.remaining = r.limit
+			r.resetAt = now.Add(time.Minute)
+		}
+		if r.remaining > 0 {
+			r.remaining--
+			r.mu.Unlock()
+			return nil
+		}
+		pause := r.resetAt.Sub(now)
+		r.mu.Unlock()
+
+		t := r.clock.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C():
+		}
+	}
+}
+
+// update - Уточнение остатка по заголовкам ответа
+func (r *rateLimiter) update(md metadata.MD) {
+	remaining := RemainingLimitFromHeader(md)
+	reset := ResetLimitFromHeader(md)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if remaining >= 0 && remaining < r.remaining {
+		r.remaining = remaining
+	}
+	if reset >= 0 && remaining >= 0 {
+		r.resetAt = r.clock.Now().Add(time.Duration(reset) * time.Second)
+	}
+}
+
+// exhaust - Лимит исчерпан до сброса через reset секунд
+func (r *rateLimiter) exhaust(reset int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remaining = 0
+	if reset < 0 {
+		reset = 60
+	}
+	r.resetAt = r.clock.Now().Add(time.Duration(reset) * time.Second)
+}
@@ -0,0 +1,280 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"github.com/tinkoff/invest-api-go-sdk/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var downloadStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeMarketData - GetCandles возвращает часовые свечи окна, включая свечу на его правой границе,
+// поэтому соседние окна пересекаются. exhausted первых запросов отвечают ResourceExhausted, а запросы
+// по окну, которое начинается с failFrom, завершаются ошибкой
+type fakeMarketData struct {
+	pb.MarketDataServiceClient
+
+	mu        sync.Mutex
+	calls     []*pb.GetCandlesRequest
+	exhausted int
+	failFrom  time.Time
+	// skipOptions - Количество вызовов без retry.WithoutResourceExhausted
+	skipOptions int
+}
+
+func (f *fakeMarketData) GetCandles(_ context.Context, in *pb.GetCandlesRequest, opts ...grpc.CallOption) (*pb.GetCandlesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, in)
+	hasRetryOption := false
+	for _, o := range opts {
+		if _, ok := o.(retry.CallOption); ok {
+			hasRetryOption = true
+		}
+	}
+	if !hasRetryOption {
+		f.skipOptions++
+	}
+	if f.exhausted > 0 {
+		f.exhausted--
+		for _, o := range opts {
+			if t, ok := o.(grpc.TrailerCallOption); ok {
+				*t.TrailerAddr = metadata.Pairs("x-ratelimit-reset", "0")
+			}
+		}
+		return nil, status.Error(codes.ResourceExhausted, "limit")
+	}
+	from, to := in.GetFrom().AsTime(), in.GetTo().AsTime()
+	if from.Equal(f.failFrom) {
+		return nil, status.Error(codes.Internal, "internal")
+	}
+	resp := &pb.GetCandlesResponse{}
+	for t := from; !t.After(to); t = t.Add(time.Hour) {
+		resp.Candles = append(resp.Candles, &pb.HistoricCandle{
+			Time:       TimeToTimestamp(t),
+			Close:      &pb.Quotation{Units: int64(t.Sub(downloadStart).Hours())},
+			IsComplete: true,
+		})
+	}
+	return resp, nil
+}
+
+type fakeUsers struct {
+	pb.UsersServiceClient
+}
+
+func (fakeUsers) GetUserTariff(context.Context, *pb.GetUserTariffRequest, ...grpc.CallOption) (*pb.GetUserTariffResponse, error) {
+	return &pb.GetUserTariffResponse{UnaryLimits: []*pb.UnaryLimit{{
+		LimitPerMinute: 1000,
+		Methods:        []string{"tinkoff.public.invest.api.contract.v1." + candlesMethod},
+	}}}, nil
+}
+
+// errCode - Код grpc ошибки, обернутой загрузчиком
+func errCode(err error) codes.Code {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Code()
+	}
+	return status.Code(err)
+}
+
+func newTestDownloader(t *testing.T, md *fakeMarketData) *CandlesDownloader {
+	ctx := context.Background()
+	return &CandlesDownloader{
+		md:     &MarketDataServiceClient{ctx: ctx, pbClient: md, logger: testLogger{t}},
+		users:  &UsersServiceClient{ctx: ctx, pbClient: fakeUsers{}, logger: testLogger{t}},
+		logger: testLogger{t},
+	}
+}
+
+func TestDownloadWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval pb.CandleInterval
+		days     int
+		// want - Длительности окон одного инструмента в днях
+		want []int
+	}{
+		{name: "shorter than window", interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR, days: 3, want: []int{3}},
+		{name: "exact windows", interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR, days: 14, want: []int{7, 7}},
+		{name: "last window is cut", interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR, days: 15, want: []int{7, 7, 1}},
+		{name: "minute candles by day", interval: pb.CandleInterval_CANDLE_INTERVAL_1_MIN, days: 2, want: []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := DownloadCandlesRequest{
+				Instruments: []string{"a", "b"},
+				Interval:    tt.interval,
+				From:        downloadStart,
+				To:          downloadStart.Add(time.Duration(tt.days) * DAY),
+			}
+			windows := downloadWindows(req)
+			if len(windows) != 2*len(tt.want) {
+				t.Fatalf("windows = %v, want %v", len(windows), 2*len(tt.want))
+			}
+			for i, w := range windows {
+				id := req.Instruments[i/len(tt.want)]
+				n := i % len(tt.want)
+				if w.instrumentId != id {
+					t.Errorf("window %v instrument = %v, want %v", i, w.instrumentId, id)
+				}
+				if n == 0 && !w.from.Equal(req.From) {
+					t.Errorf("window %v starts at %v, want %v", i, w.from, req.From)
+				}
+				if n > 0 && !w.from.Equal(windows[i-1].to) {
+					t.Errorf("window %v starts at %v, previous ends at %v", i, w.from, windows[i-1].to)
+				}
+				if got := w.to.Sub(w.from); got != time.Duration(tt.want[n])*DAY {
+					t.Errorf("window %v duration = %v, want %v days", i, got, tt.want[n])
+				}
+			}
+			if last := windows[len(windows)-1]; !last.to.Equal(req.To) {
+				t.Errorf("last window ends at %v, want %v", last.to, req.To)
+			}
+		})
+	}
+}
+
+func TestMergeCandles(t *testing.T) {
+	candle := func(hour int, close int64) *pb.HistoricCandle {
+		return &pb.HistoricCandle{Time: TimeToTimestamp(downloadStart.Add(time.Duration(hour) * time.Hour)), Close: &pb.Quotation{Units: close}}
+	}
+	merged := mergeCandles([][]*pb.HistoricCandle{
+		{candle(1, 1), candle(0, 0), candle(2, 2)},
+		{},
+		// на стыке окон свеча 2 пришла повторно и уже изменилась, берется версия из более позднего окна
+		{candle(2, 20), candle(3, 3)},
+		{candle(3, 30), candle(4, 4)},
+	})
+	want := []int64{0, 1, 20, 30, 4}
+	if len(merged) != len(want) {
+		t.Fatalf("merged = %v candles, want %v", len(merged), len(want))
+	}
+	for i, c := range merged {
+		if !c.GetTime().AsTime().Equal(downloadStart.Add(time.Duration(i)*time.Hour)) || c.GetClose().GetUnits() != want[i] {
+			t.Errorf("candle %v = %v %v, want close %v", i, c.GetTime().AsTime(), c.GetClose().GetUnits(), want[i])
+		}
+	}
+	if res := mergeCandles(nil); len(res) != 0 {
+		t.Fatalf("merge of no windows = %v", res)
+	}
+}
+
+func TestDownloadMergesWindows(t *testing.T) {
+	md := &fakeMarketData{}
+	req := DownloadCandlesRequest{
+		Instruments: []string{"a", "b"},
+		Interval:    pb.CandleInterval_CANDLE_INTERVAL_HOUR,
+		From:        downloadStart,
+		To:          downloadStart.Add(15 * DAY),
+		Workers:     4,
+	}
+	res, err := newTestDownloader(t, md).Download(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if len(md.calls) != 6 {
+		t.Fatalf("calls = %v, want 6", len(md.calls))
+	}
+	hours := int(req.To.Sub(req.From).Hours())
+	for _, id := range req.Instruments {
+		candles := res[id]
+		// окна пересекаются на границах, после удаления дублей остается по одной свече на час
+		if len(candles) != hours+1 {
+			t.Fatalf("%v candles = %v, want %v", id, len(candles), hours+1)
+		}
+		for i, c := range candles {
+			if c.GetClose().GetUnits() != int64(i) {
+				t.Fatalf("%v candle %v close = %v", id, i, c.GetClose().GetUnits())
+			}
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	dir := t.TempDir()
+	req := DownloadCandlesRequest{
+		Instruments: []string{"a"},
+		Interval:    pb.CandleInterval_CANDLE_INTERVAL_HOUR,
+		From:        downloadStart,
+		To:          downloadStart.Add(28 * DAY),
+		Workers:     1,
+		CacheDir:    dir,
+	}
+	// первая загрузка прерывается ошибкой на третьем окне
+	failing := &fakeMarketData{failFrom: downloadStart.Add(14 * DAY)}
+	if _, err := newTestDownloader(t, failing).Download(context.Background(), req); errCode(err) != codes.Internal {
+		t.Fatalf("err = %v, want Internal", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	cachedWindows := len(entries)
+	if cachedWindows < 2 || cachedWindows >= 4 {
+		t.Fatalf("cached windows = %v, want windows before the failure", cachedWindows)
+	}
+
+	md := &fakeMarketData{}
+	var mu sync.Mutex
+	cached := 0
+	req.OnProgress = func(p DownloadProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Cached {
+			cached++
+		}
+	}
+	res, err := newTestDownloader(t, md).Download(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if cached != cachedWindows || len(md.calls) != 4-cachedWindows {
+		t.Fatalf("cached = %v, requested = %v, want %v cached of 4", cached, len(md.calls), cachedWindows)
+	}
+	for _, call := range md.calls {
+		if call.GetFrom().AsTime().Before(downloadStart.Add(14 * DAY)) {
+			t.Fatalf("cached window from %v is requested again", call.GetFrom().AsTime())
+		}
+	}
+	if got, want := len(res["a"]), 28*24+1; got != want {
+		t.Fatalf("candles = %v, want %v", got, want)
+	}
+}
+
+func TestDownloadResourceExhausted(t *testing.T) {
+	md := &fakeMarketData{exhausted: 2}
+	req := DownloadCandlesRequest{
+		Instruments: []string{"a"},
+		Interval:    pb.CandleInterval_CANDLE_INTERVAL_DAY,
+		From:        downloadStart,
+		To:          downloadStart.Add(DAY),
+	}
+	res, err := newTestDownloader(t, md).Download(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if len(md.calls) != 3 || len(res["a"]) != 25 {
+		t.Fatalf("calls = %v, candles = %v", len(md.calls), len(res["a"]))
+	}
+	// повтор ResourceExhausted интерцептором клиента должен быть отключен
+	if md.skipOptions != 0 {
+		t.Fatalf("%v calls without retry.WithoutResourceExhausted", md.skipOptions)
+	}
+
+	md = &fakeMarketData{exhausted: downloadMaxAttempts}
+	if _, err := newTestDownloader(t, md).Download(context.Background(), req); errCode(err) != codes.ResourceExhausted {
+		t.Fatalf("err = %v, want ResourceExhausted after %v attempts", err, downloadMaxAttempts)
+	}
+}
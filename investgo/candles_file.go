@@ -0,0 +1,377 @@
+package investgo
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// CandlesFileFormat - Формат файла со свечами
+type CandlesFileFormat int
+
+const (
+	// CANDLES_FORMAT_LEGACY - instrumentId;time;open;close;high;low;volume без заголовка, время в Unix секундах
+	CANDLES_FORMAT_LEGACY CandlesFileFormat = iota
+	// CANDLES_FORMAT_CSV - CSV с заголовком instrument_id,time,open,high,low,close,volume,is_complete
+	CANDLES_FORMAT_CSV
+	// CANDLES_FORMAT_JSONL - JSON Lines, по объекту на свечу с полями как в CANDLES_FORMAT_CSV
+	CANDLES_FORMAT_JSONL
+	// CANDLES_FORMAT_FINAM - Текстовый формат Metastock в варианте Finam:
+	// <TICKER>,<PER>,<DATE>,<TIME>,<OPEN>,<HIGH>,<LOW>,<CLOSE>,<VOL>, дата YYYYMMDD и время HHMMSS по часовому поясу биржи
+	CANDLES_FORMAT_FINAM
+)
+
+// MoscowLocation - Часовой пояс Московской биржи
+var MoscowLocation = time.FixedZone("MSK", 3*60*60)
+
+var (
+	candlesCSVHeader   = []string{"instrument_id", "time", "open", "high", "low", "close", "volume", "is_complete"}
+	candlesFinamHeader = []string{"<TICKER>", "<PER>", "<DATE>", "<TIME>", "<OPEN>", "<HIGH>", "<LOW>", "<CLOSE>", "<VOL>"}
+)
+
+// CandlesFileOptions - Параметры файла со свечами
+type CandlesFileOptions struct {
+	Format CandlesFileFormat
+	// Delimiter - Разделитель для CANDLES_FORMAT_CSV и CANDLES_FORMAT_FINAM, по умолчанию запятая
+	Delimiter rune
+	// Location - Часовой пояс времени свечей. Для CSV и JSON Lines по умолчанию UTC, время пишется в RFC3339
+	// со смещением, для Finam по умолчанию MoscowLocation
+	Location *time.Location
+}
+
+// candleJSON - Свеча в формате JSON Lines, цены - числа без потери точности
+type candleJSON struct {
+	InstrumentId string      `json:"instrument_id"`
+	Time         string      `json:"time"`
+	Open         json.Number `json:"open"`
+	High         json.Number `json:"high"`
+	Low          json.Number `json:"low"`
+	Close        json.Number `json:"close"`
+	Volume       int64       `json:"volume"`
+	IsComplete   bool        `json:"is_complete"`
+}
+
+func (f CandlesFileFormat) String() string {
+	switch f {
+	case CANDLES_FORMAT_LEGACY:
+		return "legacy"
+	case CANDLES_FORMAT_CSV:
+		return "csv"
+	case CANDLES_FORMAT_JSONL:
+		return "jsonl"
+	case CANDLES_FORMAT_FINAM:
+		return "finam"
+	}
+	return fmt.Sprintf("CandlesFileFormat(%d)", int(f))
+}
+
+// Extension - Расширение файла для формата
+func (f CandlesFileFormat) Extension() string {
+	switch f {
+	case CANDLES_FORMAT_JSONL:
+		return ".jsonl"
+	case CANDLES_FORMAT_FINAM:
+		return ".txt"
+	}
+	return ".csv"
+}
+
+// WriteCandles - Запись свечей инструмента в w в формате opts.Format. interval используется только для
+// поля <PER> формата Finam
+func WriteCandles(w io.Writer, instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, opts CandlesFileOptions) error {
+	opts = opts.withDefaults()
+	switch opts.Format {
+	case CANDLES_FORMAT_LEGACY:
+		bw := bufio.NewWriter(w)
+		for _, candle := range candles {
+			if _, err := fmt.Fprintf(bw, "%v;%v\n", instrumentId, candle.ToCSV()); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	case CANDLES_FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		cw.Comma = opts.Delimiter
+		if err := cw.Write(candlesCSVHeader); err != nil {
+			return err
+		}
+		for _, c := range candles {
+			err := cw.Write([]string{
+				instrumentId,
+				c.GetTime().AsTime().In(opts.Location).Format(time.RFC3339),
+				QuotationToDecimal(c.GetOpen()).String(),
+				QuotationToDecimal(c.GetHigh()).String(),
+				QuotationToDecimal(c.GetLow()).String(),
+				QuotationToDecimal(c.GetClose()).String(),
+				strconv.FormatInt(c.GetVolume(), 10),
+				strconv.FormatBool(c.GetIsComplete()),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case CANDLES_FORMAT_JSONL:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for _, c := range candles {
+			err := enc.Encode(candleJSON{
+				InstrumentId: instrumentId,
+				Time:         c.GetTime().AsTime().In(opts.Location).Format(time.RFC3339),
+				Open:         json.Number(QuotationToDecimal(c.GetOpen()).String()),
+				High:         json.Number(QuotationToDecimal(c.GetHigh()).String()),
+				Low:          json.Number(QuotationToDecimal(c.GetLow()).String()),
+				Close:        json.Number(QuotationToDecimal(c.GetClose()).String()),
+				Volume:       c.GetVolume(),
+				IsComplete:   c.GetIsComplete(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	case CANDLES_FORMAT_FINAM:
+		cw := csv.NewWriter(w)
+		cw.Comma = opts.Delimiter
+		if err := cw.Write(candlesFinamHeader); err != nil {
+			return err
+		}
+		period := finamPeriod(interval)
+		for _, c := range candles {
+			t := c.GetTime().AsTime().In(opts.Location)
+			err := cw.Write([]string{
+				instrumentId,
+				period,
+				t.Format("20060102"),
+				t.Format("150405"),
+				QuotationToDecimal(c.GetOpen()).String(),
+				QuotationToDecimal(c.GetHigh()).String(),
+				QuotationToDecimal(c.GetLow()).String(),
+				QuotationToDecimal(c.GetClose()).String(),
+				strconv.FormatInt(c.GetVolume(), 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown candles file format %v", opts.Format)
+}
+
+// ReadCandles - Чтение свечей из r в формате opts.Format. Для форматов без признака is_complete
+// все свечи считаются сформированными
+func ReadCandles(r io.Reader, opts CandlesFileOptions) ([]*pb.HistoricCandle, error) {
+	opts = opts.withDefaults()
+	candles := make([]*pb.HistoricCandle, 0)
+	switch opts.Format {
+	case CANDLES_FORMAT_LEGACY:
+		cr := csv.NewReader(r)
+		cr.Comma = ';'
+		cr.FieldsPerRecord = 7
+		for line := 1; ; line++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return candles, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			unix, err := strconv.ParseInt(rec[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			// порядок цен в legacy формате: open, close, high, low
+			c, err := newFileCandle(time.Unix(unix, 0), rec[2], rec[4], rec[5], rec[3], rec[6], true)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			candles = append(candles, c)
+		}
+	case CANDLES_FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.Comma = opts.Delimiter
+		cr.FieldsPerRecord = len(candlesCSVHeader)
+		for line := 1; ; line++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return candles, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if line == 1 && rec[0] == candlesCSVHeader[0] {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, rec[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			complete, err := strconv.ParseBool(rec[7])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			c, err := newFileCandle(t, rec[2], rec[3], rec[4], rec[5], rec[6], complete)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			candles = append(candles, c)
+		}
+	case CANDLES_FORMAT_JSONL:
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		for line := 1; ; line++ {
+			var cj candleJSON
+			err := dec.Decode(&cj)
+			if err == io.EOF {
+				return candles, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", line, err)
+			}
+			t, err := time.Parse(time.RFC3339, cj.Time)
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", line, err)
+			}
+			c, err := newFileCandle(t, cj.Open.String(), cj.High.String(), cj.Low.String(), cj.Close.String(),
+				strconv.FormatInt(cj.Volume, 10), cj.IsComplete)
+			if err != nil {
+				return nil, fmt.Errorf("record %v: %w", line, err)
+			}
+			candles = append(candles, c)
+		}
+	case CANDLES_FORMAT_FINAM:
+		cr := csv.NewReader(r)
+		cr.Comma = opts.Delimiter
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err == io.EOF {
+			return candles, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		columns := make(map[string]int, len(header))
+		for i, name := range header {
+			columns[strings.ToUpper(strings.TrimSpace(name))] = i
+		}
+		for _, name := range []string{"<DATE>", "<TIME>", "<OPEN>", "<HIGH>", "<LOW>", "<CLOSE>", "<VOL>"} {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("column %v not found in finam header", name)
+			}
+		}
+		for line := 2; ; line++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return candles, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(rec) != len(header) {
+				return nil, fmt.Errorf("line %v: wrong number of fields", line)
+			}
+			t, err := time.ParseInLocation("20060102150405", rec[columns["<DATE>"]]+rec[columns["<TIME>"]], opts.Location)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			c, err := newFileCandle(t, rec[columns["<OPEN>"]], rec[columns["<HIGH>"]], rec[columns["<LOW>"]],
+				rec[columns["<CLOSE>"]], rec[columns["<VOL>"]], true)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			candles = append(candles, c)
+		}
+	}
+	return nil, fmt.Errorf("unknown candles file format %v", opts.Format)
+}
+
+// WriteCandlesFile - Запись свечей в файл path
+func WriteCandlesFile(path, instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, opts CandlesFileOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteCandles(file, instrumentId, interval, candles, opts); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadCandlesFile - Чтение свечей из файла path
+func ReadCandlesFile(path string, opts CandlesFileOptions) ([]*pb.HistoricCandle, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadCandles(file, opts)
+}
+
+func (opts CandlesFileOptions) withDefaults() CandlesFileOptions {
+	if opts.Delimiter == 0 {
+		opts.Delimiter = ','
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+		if opts.Format == CANDLES_FORMAT_FINAM {
+			opts.Location = MoscowLocation
+		}
+	}
+	return opts
+}
+
+func newFileCandle(t time.Time, open, high, low, close, volume string, complete bool) (*pb.HistoricCandle, error) {
+	prices := [4]string{open, high, low, close}
+	quotations := [4]*pb.Quotation{}
+	for i, p := range prices {
+		d, err := decimal.NewFromString(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		quotations[i] = DecimalToQuotation(d)
+	}
+	// объем в формате Finam может быть записан дробным числом
+	vol, err := decimal.NewFromString(strings.TrimSpace(volume))
+	if err != nil {
+		return nil, err
+	}
+	if !vol.Equal(vol.Truncate(0)) {
+		return nil, errors.New("fractional volume " + volume)
+	}
+	return &pb.HistoricCandle{
+		Open:       quotations[0],
+		High:       quotations[1],
+		Low:        quotations[2],
+		Close:      quotations[3],
+		Volume:     vol.IntPart(),
+		Time:       TimeToTimestamp(t),
+		IsComplete: complete,
+	}, nil
+}
+
+// finamPeriod - Значение <PER> формата Finam: число минут, D, W или M
+func finamPeriod(interval pb.CandleInterval) string {
+	switch interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		return "D"
+	case pb.CandleInterval_CANDLE_INTERVAL_WEEK:
+		return "W"
+	case pb.CandleInterval_CANDLE_INTERVAL_MONTH:
+		return "M"
+	}
+	return strconv.FormatInt(int64(CandleIntervalDuration(interval)/time.Minute), 10)
+}
@@ -0,0 +1,126 @@
+package investgo
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+var fileCandlesStart = time.Date(2024, 3, 4, 6, 59, 0, 0, time.UTC)
+
+func fileCandles() []*pb.HistoricCandle {
+	return []*pb.HistoricCandle{
+		{
+			Time:       TimeToTimestamp(fileCandlesStart),
+			Open:       &pb.Quotation{Units: 280, Nano: 100000000},
+			High:       &pb.Quotation{Units: 281},
+			Low:        &pb.Quotation{Units: 279, Nano: 990000000},
+			Close:      &pb.Quotation{Units: 280, Nano: 550000000},
+			Volume:     1500,
+			IsComplete: true,
+		},
+		{
+			// цена с шагом 1e-9 и отрицательная цена не должны терять точность
+			Time:   TimeToTimestamp(fileCandlesStart.Add(time.Minute)),
+			Open:   &pb.Quotation{Nano: 1},
+			High:   &pb.Quotation{Units: 1, Nano: 123456789},
+			Low:    &pb.Quotation{Units: -1, Nano: -500000000},
+			Close:  &pb.Quotation{Nano: 999999999},
+			Volume: 0,
+		},
+	}
+}
+
+func TestCandlesFileRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CandlesFileOptions
+		// complete - Формат не хранит is_complete, все свечи читаются сформированными
+		complete bool
+	}{
+		{name: "legacy", opts: CandlesFileOptions{Format: CANDLES_FORMAT_LEGACY}, complete: true},
+		{name: "csv", opts: CandlesFileOptions{Format: CANDLES_FORMAT_CSV}},
+		{name: "csv with delimiter and location", opts: CandlesFileOptions{Format: CANDLES_FORMAT_CSV, Delimiter: ';', Location: MoscowLocation}},
+		{name: "jsonl", opts: CandlesFileOptions{Format: CANDLES_FORMAT_JSONL}},
+		{name: "jsonl with location", opts: CandlesFileOptions{Format: CANDLES_FORMAT_JSONL, Location: time.FixedZone("", -5*60*60)}},
+		{name: "finam", opts: CandlesFileOptions{Format: CANDLES_FORMAT_FINAM}, complete: true},
+		{name: "finam utc", opts: CandlesFileOptions{Format: CANDLES_FORMAT_FINAM, Delimiter: ';', Location: time.UTC}, complete: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := fileCandles()
+			buf := &bytes.Buffer{}
+			if err := WriteCandles(buf, "SBER", pb.CandleInterval_CANDLE_INTERVAL_1_MIN, want, tt.opts); err != nil {
+				t.Fatalf("WriteCandles: %v", err)
+			}
+			got, err := ReadCandles(bytes.NewReader(buf.Bytes()), tt.opts)
+			if err != nil {
+				t.Fatalf("ReadCandles: %v\n%v", err, buf.String())
+			}
+			if len(got) != len(want) {
+				t.Fatalf("candles = %v, want %v", len(got), len(want))
+			}
+			for i := range got {
+				g, w := got[i], want[i]
+				if !g.GetTime().AsTime().Equal(w.GetTime().AsTime()) {
+					t.Errorf("candle %v time = %v, want %v", i, g.GetTime().AsTime(), w.GetTime().AsTime())
+				}
+				for _, p := range []struct {
+					name      string
+					got, want *pb.Quotation
+				}{
+					{"open", g.GetOpen(), w.GetOpen()},
+					{"high", g.GetHigh(), w.GetHigh()},
+					{"low", g.GetLow(), w.GetLow()},
+					{"close", g.GetClose(), w.GetClose()},
+				} {
+					if !QuotationToDecimal(p.got).Equal(QuotationToDecimal(p.want)) {
+						t.Errorf("candle %v %v = %v, want %v", i, p.name, QuotationToDecimal(p.got), QuotationToDecimal(p.want))
+					}
+				}
+				if g.GetVolume() != w.GetVolume() {
+					t.Errorf("candle %v volume = %v, want %v", i, g.GetVolume(), w.GetVolume())
+				}
+				if complete := w.GetIsComplete() || tt.complete; g.GetIsComplete() != complete {
+					t.Errorf("candle %v is complete = %v, want %v", i, g.GetIsComplete(), complete)
+				}
+			}
+		})
+	}
+}
+
+func TestCandlesFileFinamLocation(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteCandles(buf, "SBER", pb.CandleInterval_CANDLE_INTERVAL_HOUR, fileCandles()[:1], CandlesFileOptions{Format: CANDLES_FORMAT_FINAM}); err != nil {
+		t.Fatalf("WriteCandles: %v", err)
+	}
+	// время Finam по умолчанию записывается по Москве
+	want := "<TICKER>,<PER>,<DATE>,<TIME>,<OPEN>,<HIGH>,<LOW>,<CLOSE>,<VOL>\nSBER,60,20240304,095900,280.1,281,279.99,280.55,1500\n"
+	if buf.String() != want {
+		t.Fatalf("file = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestCandlesFileName(t *testing.T) {
+	dir := t.TempDir()
+	name := candlesFileName("TCS/a:b\\c", pb.CandleInterval_CANDLE_INTERVAL_HOUR, fileCandlesStart, fileCandlesStart.Add(DAY))
+	if want := "TCS_a_b_c_CANDLE_INTERVAL_HOUR_20240304T065900Z-20240305T065900Z"; name != want {
+		t.Fatalf("name = %v, want %v", name, want)
+	}
+	if strings.ContainsAny(name, `/\: `) {
+		t.Fatalf("name %v contains characters not allowed in file names", name)
+	}
+	opts := CandlesFileOptions{Format: CANDLES_FORMAT_JSONL}
+	path := filepath.Join(dir, name+opts.Format.Extension())
+	if err := WriteCandlesFile(path, "TCS", pb.CandleInterval_CANDLE_INTERVAL_HOUR, fileCandles(), opts); err != nil {
+		t.Fatalf("WriteCandlesFile: %v", err)
+	}
+	candles, err := ReadCandlesFile(path, opts)
+	if err != nil || len(candles) != 2 {
+		t.Fatalf("ReadCandlesFile = %v, %v", len(candles), err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/credentials/oauth"
 	"google.golang.org/grpc/metadata"
 )
@@ -27,7 +28,9 @@ type Client struct {
 	conn   *grpc.ClientConn
 	Config Config
 	Logger Logger
-	ctx    context.Context
+	// KillSwitch - Общий для всех сервисов клиента выключатель торговли
+	KillSwitch *KillSwitch
+	ctx        context.Context
 }
 
 // NewClient - создание клиента для API Тинькофф инвестиций
@@ -69,13 +72,23 @@ func NewClient(ctx context.Context, conf Config, l Logger) (*Client, error) {
 		}
 	}
 
-	conn, err := grpc.Dial(conf.EndPoint,
-		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})),
-		grpc.WithPerRPCCredentials(oauth.TokenSource{
-			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: conf.Token}),
-		}),
+	dialOpts := []grpc.DialOption{
 		grpc.WithChainUnaryInterceptor(unaryInterceptors...),
-		grpc.WithChainStreamInterceptor(streamInterceptors...))
+		grpc.WithChainStreamInterceptor(streamInterceptors...),
+	}
+	if conf.DisableTLS {
+		// oauth.TokenSource требует защищенного соединения, поэтому токен передаем в метаданных
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", fmt.Sprintf("Bearer %s", conf.Token))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		dialOpts = append(dialOpts,
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})),
+			grpc.WithPerRPCCredentials(oauth.TokenSource{
+				TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: conf.Token}),
+			}))
+	}
+
+	conn, err := grpc.Dial(conf.EndPoint, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +100,11 @@ func NewClient(ctx context.Context, conf Config, l Logger) (*Client, error) {
 		ctx:    ctx,
 	}
 
+	client.KillSwitch, err = newKillSwitch(client, conf.KillSwitchFile)
+	if err != nil {
+		return nil, err
+	}
+
 	if conf.AccountId == "" {
 		s := client.NewSandboxServiceClient()
 		accountsResp, err := s.GetSandboxAccounts()
@@ -117,6 +135,9 @@ func setDefaultConfig(conf *Config) {
 	if conf.AppName == "" {
 		conf.AppName = "invest-api-go-sdk"
 	}
+	if conf.Clock == nil {
+		conf.Clock = RealClock{}
+	}
 	if conf.EndPoint == "" {
 		conf.EndPoint = "sandbox-invest-public-api.tinkoff.ru:443"
 	}
@@ -163,11 +184,12 @@ func (c *Client) NewMDStreamClient() *MDStreamClient {
 func (c *Client) NewOrdersServiceClient() *OrdersServiceClient {
 	pbClient := pb.NewOrdersServiceClient(c.conn)
 	return &OrdersServiceClient{
-		conn:     c.conn,
-		config:   c.Config,
-		logger:   c.Logger,
-		ctx:      c.ctx,
-		pbClient: pbClient,
+		conn:       c.conn,
+		config:     c.Config,
+		logger:     c.Logger,
+		ctx:        c.ctx,
+		pbClient:   pbClient,
+		killSwitch: c.KillSwitch,
 	}
 }
 
@@ -183,6 +205,15 @@ func (c *Client) NewMarketDataServiceClient() *MarketDataServiceClient {
 	}
 }
 
+// NewCandlesDownloader - создание параллельного загрузчика исторических свечей
+func (c *Client) NewCandlesDownloader() *CandlesDownloader {
+	return &CandlesDownloader{
+		md:     c.NewMarketDataServiceClient(),
+		users:  c.NewUsersServiceClient(),
+		logger: c.Logger,
+	}
+}
+
 // NewInstrumentsServiceClient - создание клиента сервиса инструментов
 func (c *Client) NewInstrumentsServiceClient() *InstrumentsServiceClient {
 	pbClient := pb.NewInstrumentsServiceClient(c.conn)
@@ -195,6 +226,37 @@ func (c *Client) NewInstrumentsServiceClient() *InstrumentsServiceClient {
 	}
 }
 
+// NewInstrumentRegistry - создание справочника инструментов, для заполнения нужно вызвать Load
+func (c *Client) NewInstrumentRegistry(conf InstrumentRegistryConfig) *InstrumentRegistry {
+	if conf.TTL <= 0 {
+		conf.TTL = DEFAULT_REGISTRY_TTL
+	}
+	if conf.Status == pb.InstrumentStatus_INSTRUMENT_STATUS_UNSPECIFIED {
+		conf.Status = pb.InstrumentStatus_INSTRUMENT_STATUS_BASE
+	}
+	if len(conf.Types) == 0 {
+		conf.Types = registryTypes
+	}
+	return &InstrumentRegistry{
+		conf:   conf,
+		is:     c.NewInstrumentsServiceClient(),
+		logger: c.Logger,
+		index:  newRegistryIndex(nil),
+	}
+}
+
+// NewInstrumentResolver - создание поиска инструментов по любому идентификатору
+func (c *Client) NewInstrumentResolver(conf ResolverConfig) *InstrumentResolver {
+	if len(conf.ClassCodes) == 0 {
+		conf.ClassCodes = DEFAULT_CLASS_CODES
+	}
+	return &InstrumentResolver{
+		conf:  conf,
+		is:    c.NewInstrumentsServiceClient(),
+		cache: make(map[string]*InstrumentInfo),
+	}
+}
+
 // NewUsersServiceClient - создание клиента сервиса счетов
 func (c *Client) NewUsersServiceClient() *UsersServiceClient {
 	pbClient := pb.NewUsersServiceClient(c.conn)
@@ -223,11 +285,12 @@ func (c *Client) NewOperationsServiceClient() *OperationsServiceClient {
 func (c *Client) NewStopOrdersServiceClient() *StopOrdersServiceClient {
 	pbClient := pb.NewStopOrdersServiceClient(c.conn)
 	return &StopOrdersServiceClient{
-		conn:     c.conn,
-		config:   c.Config,
-		logger:   c.Logger,
-		ctx:      c.ctx,
-		pbClient: pbClient,
+		conn:       c.conn,
+		config:     c.Config,
+		logger:     c.Logger,
+		ctx:        c.ctx,
+		pbClient:   pbClient,
+		killSwitch: c.KillSwitch,
 	}
 }
 
@@ -235,11 +298,12 @@ func (c *Client) NewStopOrdersServiceClient() *StopOrdersServiceClient {
 func (c *Client) NewSandboxServiceClient() *SandboxServiceClient {
 	pbClient := pb.NewSandboxServiceClient(c.conn)
 	return &SandboxServiceClient{
-		conn:     c.conn,
-		config:   c.Config,
-		logger:   c.Logger,
-		ctx:      c.ctx,
-		pbClient: pbClient,
+		conn:       c.conn,
+		config:     c.Config,
+		logger:     c.Logger,
+		ctx:        c.ctx,
+		pbClient:   pbClient,
+		killSwitch: c.KillSwitch,
 	}
 }
 
@@ -0,0 +1,253 @@
+package investgo
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock - Источник времени для компонентов сдк. RealClock - системное время, SimulatedClock - управляемое время
+// для тестов и бэктестов. Часы передаются через Config.Clock и доступны всем сервисам клиента
+type Clock interface {
+	// Now - Текущее время
+	Now() time.Time
+	// Since - Время, прошедшее с t
+	Since(t time.Time) time.Duration
+	// Until - Время, оставшееся до t
+	Until(t time.Time) time.Duration
+	// After - Канал, в который придет время через d
+	After(d time.Duration) <-chan time.Time
+	// Sleep - Ожидание d
+	Sleep(d time.Duration)
+	// NewTimer - Таймер, срабатывающий один раз через d
+	NewTimer(d time.Duration) ClockTimer
+	// NewTicker - Тикер с периодом d, d должен быть больше нуля
+	NewTicker(d time.Duration) ClockTicker
+}
+
+// ClockTimer - Таймер часов Clock, аналог time.Timer
+type ClockTimer interface {
+	C() <-chan time.Time
+	// Stop - Остановка таймера, false если таймер уже сработал или остановлен
+	Stop() bool
+	// Reset - Перезапуск таймера на d, false если таймер уже сработал или остановлен
+	Reset(d time.Duration) bool
+}
+
+// ClockTicker - Тикер часов Clock, аналог time.Ticker
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// RealClock - Системное время
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (RealClock) Until(t time.Time) time.Duration {
+	return time.Until(t)
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (RealClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (RealClock) NewTicker(d time.Duration) ClockTicker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// SimulatedClock - Управляемые часы, время меняется только через Set и Advance. Таймеры и тикеры срабатывают
+// по порядку своего времени, когда часы переводятся вперед. Как и у time.Ticker, тики, которые получатель
+// не успел прочитать, пропускаются
+type SimulatedClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*simulatedWaiter
+}
+
+type simulatedWaiter struct {
+	clock  *SimulatedClock
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewSimulatedClock - Управляемые часы с начальным временем start
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimulatedClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *SimulatedClock) Until(t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Sleep - Блокирует, пока часы не будут переведены на d вперед
+func (c *SimulatedClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *SimulatedClock) NewTimer(d time.Duration) ClockTimer {
+	return c.add(d, 0)
+}
+
+func (c *SimulatedClock) NewTicker(d time.Duration) ClockTicker {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedClock.NewTicker")
+	}
+	return &simulatedTicker{c.add(d, d)}
+}
+
+// Advance - Перевод часов вперед на d
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set - Установка времени t. Если t позже текущего времени, то срабатывают все таймеры и тикеры до t включительно,
+// перевод часов назад ничего не запускает
+func (c *SimulatedClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) > 0 && !c.waiters[0].at.After(t) {
+		w := c.waiters[0]
+		if w.at.After(c.now) {
+			c.now = w.at
+		}
+		select {
+		case w.ch <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+			c.sort()
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = t
+}
+
+// Waiters - Количество активных таймеров и тикеров, позволяет дождаться, пока компонент начнет ожидание
+func (c *SimulatedClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (c *SimulatedClock) add(d, period time.Duration) *simulatedWaiter {
+	w := &simulatedWaiter{clock: c, period: period, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	w.at = c.now.Add(d)
+	c.waiters = append(c.waiters, w)
+	c.sort()
+	c.mu.Unlock()
+	if d <= 0 {
+		// таймер с неположительной длительностью срабатывает сразу
+		c.Set(c.Now())
+	}
+	return w
+}
+
+// remove - Удаление таймера, вызывается под мьютексом
+func (c *SimulatedClock) remove(w *simulatedWaiter) bool {
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SimulatedClock) sort() {
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].at.Before(c.waiters[j].at)
+	})
+}
+
+func (w *simulatedWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *simulatedWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.remove(w)
+}
+
+func (w *simulatedWaiter) Reset(d time.Duration) bool {
+	c := w.clock
+	c.mu.Lock()
+	active := c.remove(w)
+	w.at = c.now.Add(d)
+	if w.period > 0 {
+		w.period = d
+	}
+	c.waiters = append(c.waiters, w)
+	c.sort()
+	c.mu.Unlock()
+	if d <= 0 {
+		c.Set(c.Now())
+	}
+	return active
+}
+
+type simulatedTicker struct {
+	*simulatedWaiter
+}
+
+func (t *simulatedTicker) Stop() {
+	t.simulatedWaiter.Stop()
+}
+
+func (t *simulatedTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedClock.Ticker.Reset")
+	}
+	t.simulatedWaiter.Reset(d)
+}
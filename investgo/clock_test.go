@@ -0,0 +1,201 @@
+package investgo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var clockStart = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+// fired - Время срабатывания, если оно есть в канале
+func fired(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestSimulatedClockOrder(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	late := clock.NewTimer(3 * time.Second)
+	early := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+	order := make([]string, 0)
+	// получатели читают каналы сразу, поэтому видят все срабатывания по порядку
+	check := func() {
+		for {
+			if _, ok := fired(early.C()); ok {
+				order = append(order, "early")
+				continue
+			}
+			if _, ok := fired(ticker.C()); ok {
+				order = append(order, "tick")
+				continue
+			}
+			if _, ok := fired(late.C()); ok {
+				order = append(order, "late")
+				continue
+			}
+			return
+		}
+	}
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Second)
+		check()
+	}
+	want := []string{"early", "tick", "late", "tick"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+	if !clock.Now().Equal(clockStart.Add(4 * time.Second)) {
+		t.Fatalf("now = %v", clock.Now())
+	}
+	// остается только тикер
+	if n := clock.Waiters(); n != 1 {
+		t.Fatalf("waiters = %v, want 1", n)
+	}
+	ticker.Stop()
+	if n := clock.Waiters(); n != 0 {
+		t.Fatalf("waiters after Stop = %v, want 0", n)
+	}
+}
+
+func TestSimulatedClockSet(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	timer := clock.NewTimer(time.Minute)
+	// перевод назад ничего не запускает
+	clock.Set(clockStart.Add(-time.Hour))
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("timer fired after setting clock back")
+	}
+	clock.Set(clockStart.Add(time.Hour))
+	// таймер получает время своего срабатывания, а не время Set
+	if at, ok := fired(timer.C()); !ok || !at.Equal(clockStart.Add(time.Minute)) {
+		t.Fatalf("timer fired = %v, %v, want %v", at, ok, clockStart.Add(time.Minute))
+	}
+	if !clock.Now().Equal(clockStart.Add(time.Hour)) {
+		t.Fatalf("now = %v", clock.Now())
+	}
+	if timer.Stop() {
+		t.Fatal("Stop of fired timer = true")
+	}
+	// неположительная длительность срабатывает сразу
+	if _, ok := fired(clock.After(0)); !ok {
+		t.Fatal("After(0) did not fire")
+	}
+	if d := clock.Since(clockStart); d != time.Hour {
+		t.Fatalf("Since = %v", d)
+	}
+	if d := clock.Until(clockStart.Add(2 * time.Hour)); d != time.Hour {
+		t.Fatalf("Until = %v", d)
+	}
+}
+
+func TestSimulatedClockTickerDrop(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	// тики, которые никто не прочитал, пропускаются, в канале остается первый
+	clock.Advance(5 * time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(clockStart.Add(time.Second)) {
+		t.Fatalf("tick = %v, %v, want %v", at, ok, clockStart.Add(time.Second))
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("dropped tick received")
+	}
+	// тикер продолжает работать с исходной фазой
+	clock.Advance(time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(clockStart.Add(6*time.Second)) {
+		t.Fatalf("tick = %v, %v, want %v", at, ok, clockStart.Add(6*time.Second))
+	}
+}
+
+func TestSimulatedClockReset(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	timer := clock.NewTimer(time.Second)
+	clock.Advance(500 * time.Millisecond)
+	if !timer.Reset(time.Second) {
+		t.Fatal("Reset of active timer = false")
+	}
+	// отсчет идет от момента Reset
+	clock.Advance(700 * time.Millisecond)
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("timer fired before reset deadline")
+	}
+	clock.Advance(300 * time.Millisecond)
+	if at, ok := fired(timer.C()); !ok || !at.Equal(clockStart.Add(1500*time.Millisecond)) {
+		t.Fatalf("timer fired = %v, %v", at, ok)
+	}
+	// сработавший таймер можно запустить снова
+	if timer.Reset(time.Second) {
+		t.Fatal("Reset of fired timer = true")
+	}
+	clock.Advance(time.Second)
+	if _, ok := fired(timer.C()); !ok {
+		t.Fatal("timer did not fire after Reset")
+	}
+
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	ticker.Reset(3 * time.Second)
+	clock.Advance(2 * time.Second)
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("ticker fired with old period")
+	}
+	clock.Advance(time.Second)
+	if _, ok := fired(ticker.C()); !ok {
+		t.Fatal("ticker did not fire with new period")
+	}
+}
+
+func TestSimulatedClockSleep(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Minute)
+		close(done)
+	}()
+	waitTimer(t, clock)
+	clock.Advance(59 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Sleep returned early")
+	default:
+	}
+	clock.Advance(time.Second)
+	receive(t, done)
+}
+
+func TestRateLimiterClock(t *testing.T) {
+	clock := NewSimulatedClock(clockStart)
+	limiter := newRateLimiter(2, clock)
+	for i := 0; i < 2; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.wait(context.Background())
+	}()
+	// лимит исчерпан, запрос ждет начала следующей минуты по часам
+	waitTimer(t, clock)
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned before reset: %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := receive(t, done); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+}
@@ -28,6 +28,18 @@ type Config struct {
 	// MaxRetries - Максимальное количество попыток переподключения, по умолчанию = 3
 	// (если указать значение 0 это не отключит ретраи, для отключения нужно прописать DisableAllRetry = true)
 	MaxRetries uint `yaml:"MaxRetries"`
+	// DisableTLS - Подключение без TLS, например к локальному симулятору биржи из пакета simulator.
+	// По умолчанию = false
+	DisableTLS bool `yaml:"DisableTLS"`
+	// KillSwitchFile - Путь к файлу, в котором хранится состояние KillSwitch. Если не указан, то состояние
+	// не переживает перезапуск
+	KillSwitchFile string `yaml:"KillSwitchFile"`
+	// KillSwitchFlatten - Если true, то при срабатывании KillSwitch отменяются все заявки и закрываются
+	// все позиции по счету AccountId
+	KillSwitchFlatten bool `yaml:"KillSwitchFlatten"`
+	// Clock - Источник времени для таймера, загрузки свечей и других компонентов сдк, по умолчанию RealClock.
+	// Для тестов и бэктестов можно передать SimulatedClock
+	Clock Clock `yaml:"-"`
 }
 
 // LoadConfig - загрузка конфигурации для сдк из .yaml файла
@@ -43,3 +55,11 @@ func LoadConfig(filename string) (Config, error) {
 	}
 	return c, nil
 }
+
+// clock - Часы из конфигурации или RealClock, если они не указаны
+func (c Config) clock() Clock {
+	if c.Clock == nil {
+		return RealClock{}
+	}
+	return c.Clock
+}
@@ -34,3 +34,33 @@ func FloatToQuotation(number float64, step *pb.Quotation) *pb.Quotation {
 		Nano:  int32(nano),
 	}
 }
+
+// QuotationToDecimal - Перевод Quotation в decimal.Decimal без потери точности
+func QuotationToDecimal(q *pb.Quotation) decimal.Decimal {
+	return decimal.New(q.GetUnits(), 0).Add(decimal.New(int64(q.GetNano()), -9))
+}
+
+// MoneyValueToDecimal - Перевод MoneyValue в decimal.Decimal без потери точности, валюта отбрасывается
+func MoneyValueToDecimal(mv *pb.MoneyValue) decimal.Decimal {
+	return decimal.New(mv.GetUnits(), 0).Add(decimal.New(int64(mv.GetNano()), -9))
+}
+
+// DecimalToQuotation - Перевод decimal.Decimal в Quotation, знаки после 9-го разряда отбрасываются
+func DecimalToQuotation(d decimal.Decimal) *pb.Quotation {
+	units := d.IntPart()
+	nano := d.Sub(decimal.NewFromInt(units)).Shift(9).IntPart()
+	return &pb.Quotation{
+		Units: units,
+		Nano:  int32(nano),
+	}
+}
+
+// DecimalToMoneyValue - Перевод decimal.Decimal в MoneyValue с валютой currency
+func DecimalToMoneyValue(d decimal.Decimal, currency string) *pb.MoneyValue {
+	q := DecimalToQuotation(d)
+	return &pb.MoneyValue{
+		Currency: currency,
+		Units:    q.GetUnits(),
+		Nano:     q.GetNano(),
+	}
+}
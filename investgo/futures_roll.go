@@ -0,0 +1,506 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_ROLL_DAYS_BEFORE - За сколько календарных дней до последнего дня торгов контрактом выполняется переход
+	DEFAULT_ROLL_DAYS_BEFORE = 3
+	// DEFAULT_ROLL_CHECK_INTERVAL - Период проверки позиций и повтора неудавшихся переходов
+	DEFAULT_ROLL_CHECK_INTERVAL = time.Hour
+)
+
+var (
+	// ErrNoNextContract - Для базового актива нет контракта с более поздней датой последнего дня торгов
+	ErrNoNextContract = errors.New("next futures contract not found")
+	// ErrRollOrderRejected - Заявка перехода принята API, но отклонена биржей или брокером
+	ErrRollOrderRejected = errors.New("roll order rejected")
+)
+
+// FuturesRollConfig - Параметры перехода позиций на следующий фьючерсный контракт
+type FuturesRollConfig struct {
+	// AccountId - Счет, по умолчанию Config.AccountId клиента
+	AccountId string
+	// Instruments - uid фьючерсов, позиции по которым нужно переносить. Если пусто, то переносятся все
+	// фьючерсные позиции счета
+	Instruments []string
+	// DaysBefore - За сколько дней до последнего дня торгов выполняется переход, по умолчанию DEFAULT_ROLL_DAYS_BEFORE
+	DaysBefore int
+	// CheckInterval - Период проверки позиций, по умолчанию DEFAULT_ROLL_CHECK_INTERVAL
+	CheckInterval time.Duration
+	// OnRoll - Функция, вызываемая после каждой попытки перехода, может быть nil
+	OnRoll func(r *FuturesRoll)
+}
+
+// FuturesRoll - Переход позиции с контракта From на контракт To
+type FuturesRoll struct {
+	From *pb.Future
+	To   *pb.Future
+	// RollAt - Время перехода: последний день торгов From минус FuturesRollConfig.DaysBefore дней
+	RollAt time.Time
+	// Quantity - Количество лотов, отрицательное для короткой позиции
+	Quantity int64
+	// Close, Open - Ответы на заявки закрытия позиции по From и открытия по To
+	Close *PostOrderResponse
+	Open  *PostOrderResponse
+	// Err - Ошибка перехода. Если Close != nil, а Open == nil, то позиция закрыта, но не открыта заново,
+	// повторный Roll выставит только заявку открытия
+	Err error
+
+	// closeOrderId, openOrderId - Ключи идемпотентности заявок, сохраняются между повторами
+	closeOrderId string
+	openOrderId  string
+}
+
+// ContractCandles - Свечи одного контракта для непрерывного ряда
+type ContractCandles struct {
+	Future *pb.Future
+	// RollAt - Время перехода на следующий контракт, свечи контракта начиная с этого времени не используются
+	RollAt  time.Time
+	Candles []*pb.HistoricCandle
+}
+
+// FuturesRollManager - Перенос фьючерсных позиций на следующий контракт того же базового актива
+// перед экспирацией парой рыночных заявок: закрытие по текущему контракту и открытие по следующему
+type FuturesRollManager struct {
+	conf        FuturesRollConfig
+	instruments *InstrumentsServiceClient
+	orders      *OrdersServiceClient
+	operations  *OperationsServiceClient
+	logger      Logger
+
+	mu sync.Mutex
+	// pending - Переходы с закрытой позицией и неудавшимся открытием по uid контракта From
+	pending map[string]*FuturesRoll
+	// rolled - Выполненные переходы по uid контракта From. Хранятся, пока позиция по From не станет
+	// нулевой, чтобы позиция, которая еще не обновилась после исполнения заявки закрытия, не переносилась повторно
+	rolled map[string]*FuturesRoll
+}
+
+// NewFuturesRollManager - создание менеджера перехода фьючерсных позиций
+func (c *Client) NewFuturesRollManager(conf FuturesRollConfig) *FuturesRollManager {
+	if conf.AccountId == "" {
+		conf.AccountId = c.Config.AccountId
+	}
+	if conf.DaysBefore <= 0 {
+		conf.DaysBefore = DEFAULT_ROLL_DAYS_BEFORE
+	}
+	if conf.CheckInterval <= 0 {
+		conf.CheckInterval = DEFAULT_ROLL_CHECK_INTERVAL
+	}
+	return &FuturesRollManager{
+		conf:        conf,
+		instruments: c.NewInstrumentsServiceClient(),
+		orders:      c.NewOrdersServiceClient(),
+		operations:  c.NewOperationsServiceClient(),
+		logger:      c.Logger,
+		pending:     make(map[string]*FuturesRoll),
+		rolled:      make(map[string]*FuturesRoll),
+	}
+}
+
+// FuturesChain - Контракты того же базового актива и режима торгов, что и future, по возрастанию
+// последнего дня торгов. Включает сам future
+func (is *InstrumentsServiceClient) FuturesChain(future *pb.Future) ([]*pb.Future, error) {
+	resp, err := is.Futures(pb.InstrumentStatus_INSTRUMENT_STATUS_ALL)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]*pb.Future, 0)
+	for _, f := range resp.GetInstruments() {
+		if f.GetClassCode() != future.GetClassCode() {
+			continue
+		}
+		if future.GetBasicAssetPositionUid() != "" {
+			if f.GetBasicAssetPositionUid() != future.GetBasicAssetPositionUid() {
+				continue
+			}
+		} else if !strings.EqualFold(f.GetBasicAsset(), future.GetBasicAsset()) {
+			continue
+		}
+		chain = append(chain, f)
+	}
+	sort.SliceStable(chain, func(i, j int) bool {
+		return lastTradeTime(chain[i]).Before(lastTradeTime(chain[j]))
+	})
+	return chain, nil
+}
+
+// NextContract - Ближайший контракт того же базового актива с более поздним последним днем торгов
+func (is *InstrumentsServiceClient) NextContract(future *pb.Future) (*pb.Future, error) {
+	chain, err := is.FuturesChain(future)
+	if err != nil {
+		return nil, err
+	}
+	last := lastTradeTime(future)
+	for _, f := range chain {
+		if lastTradeTime(f).After(last) {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoNextContract, future.GetTicker())
+}
+
+// RollTime - Время перехода с контракта future на следующий
+func (m *FuturesRollManager) RollTime(future *pb.Future) time.Time {
+	return lastTradeTime(future).AddDate(0, 0, -m.conf.DaysBefore)
+}
+
+// Plan - План перехода для позиции quantity лотов по фьючерсу instrumentId
+func (m *FuturesRollManager) Plan(instrumentId string, quantity int64) (*FuturesRoll, error) {
+	resp, err := m.instruments.FutureByUid(instrumentId)
+	if err != nil {
+		return nil, err
+	}
+	from := resp.GetInstrument()
+	to, err := m.instruments.NextContract(from)
+	if err != nil {
+		return nil, err
+	}
+	return &FuturesRoll{
+		From:     from,
+		To:       to,
+		RollAt:   m.RollTime(from),
+		Quantity: quantity,
+	}, nil
+}
+
+// Roll - Выполнение перехода рыночными заявками: сначала закрытие позиции по From, затем открытие по To.
+// Если закрытие не удалось, открытие не выполняется. Если позиция уже закрыта (Close != nil), то выставляется
+// только заявка открытия. Повтор после ошибки запроса использует тот же OrderId, поэтому заявка не
+// выставляется дважды, после отклонения заявки (ErrRollOrderRejected) выставляется новая
+func (m *FuturesRollManager) Roll(r *FuturesRoll) error {
+	quantity := r.Quantity
+	closeDirection, openDirection := pb.OrderDirection_ORDER_DIRECTION_SELL, pb.OrderDirection_ORDER_DIRECTION_BUY
+	if quantity < 0 {
+		quantity = -quantity
+		closeDirection, openDirection = openDirection, closeDirection
+	}
+	if quantity == 0 {
+		return nil
+	}
+	if r.Close == nil {
+		resp, err := m.postMarket(r.From, quantity, closeDirection, &r.closeOrderId)
+		if err != nil {
+			r.Err = fmt.Errorf("close %v: %w", r.From.GetTicker(), err)
+			return r.Err
+		}
+		r.Close = resp
+	}
+	resp, err := m.postMarket(r.To, quantity, openDirection, &r.openOrderId)
+	if err != nil {
+		r.Err = fmt.Errorf("position %v is closed, open %v: %w", r.From.GetTicker(), r.To.GetTicker(), err)
+		return r.Err
+	}
+	r.Open, r.Err = resp, nil
+	m.logger.Infof("rolled %v lots from %v to %v", r.Quantity, r.From.GetTicker(), r.To.GetTicker())
+	return nil
+}
+
+// Pending - Переходы, в которых позиция по From закрыта, а открытие по To не удалось. Run повторяет
+// для них только открытие. Хранятся в памяти и теряются при перезапуске
+func (m *FuturesRollManager) Pending() []*FuturesRoll {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]*FuturesRoll, 0, len(m.pending))
+	for _, r := range m.pending {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].From.GetUid() < res[j].From.GetUid()
+	})
+	return res
+}
+
+// postMarket - Рыночная заявка по future с ключом идемпотентности orderId. Новый ключ создается, если он пуст,
+// и сбрасывается после отклонения заявки
+func (m *FuturesRollManager) postMarket(future *pb.Future, quantity int64, direction pb.OrderDirection, orderId *string) (*PostOrderResponse, error) {
+	if *orderId == "" {
+		*orderId = CreateUid()
+	}
+	resp, err := m.orders.PostOrder(&PostOrderRequest{
+		InstrumentId: future.GetUid(),
+		Quantity:     quantity,
+		Direction:    direction,
+		AccountId:    m.conf.AccountId,
+		OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+		OrderId:      *orderId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetExecutionReportStatus() == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED {
+		*orderId = ""
+		return nil, fmt.Errorf("%w: %v", ErrRollOrderRejected, resp.GetMessage())
+	}
+	return resp, nil
+}
+
+// attempt - Попытка перехода из Run. Переход с закрытой позицией и неудавшимся открытием сохраняется в pending,
+// выполненный переход - в rolled
+func (m *FuturesRollManager) attempt(r *FuturesRoll) {
+	err := m.Roll(r)
+	if err != nil {
+		m.logger.Errorf("futures roll: %v", err.Error())
+	}
+	m.mu.Lock()
+	switch {
+	case r.Close != nil && r.Open == nil:
+		m.pending[r.From.GetUid()] = r
+	case r.Open != nil:
+		delete(m.pending, r.From.GetUid())
+		m.rolled[r.From.GetUid()] = r
+	default:
+		delete(m.pending, r.From.GetUid())
+	}
+	m.mu.Unlock()
+	if m.conf.OnRoll != nil {
+		m.conf.OnRoll(r)
+	}
+}
+
+// Plans - Планы перехода для текущих фьючерсных позиций счета. Позиции, для которых нет следующего
+// контракта, пропускаются с записью в лог. Позиции, переход по которым уже выполнен, пропускаются, пока
+// они не станут нулевыми. Если позиция не делится на лот, то переносятся только целые лоты, а остаток
+// записывается в лог
+func (m *FuturesRollManager) Plans() ([]*FuturesRoll, error) {
+	resp, err := m.operations.GetPositions(m.conf.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	m.forgetClosed(resp.GetFutures())
+	plans := make([]*FuturesRoll, 0)
+	for _, pos := range resp.GetFutures() {
+		if !m.tracked(pos.GetInstrumentUid()) || pos.GetBalance() == 0 || m.isPending(pos.GetInstrumentUid()) {
+			continue
+		}
+		if r, ok := m.isRolled(pos.GetInstrumentUid()); ok {
+			m.logger.Infof("futures roll %v: position %v is still open after roll to %v, waiting for close order %v",
+				r.From.GetTicker(), pos.GetBalance(), r.To.GetTicker(), r.Close.GetOrderId())
+			continue
+		}
+		plan, err := m.Plan(pos.GetInstrumentUid(), pos.GetBalance())
+		if err != nil {
+			m.logger.Errorf("futures roll plan %v: %v", pos.GetInstrumentUid(), err.Error())
+			continue
+		}
+		if lot := int64(plan.From.GetLot()); lot > 1 {
+			if rest := plan.Quantity % lot; rest != 0 {
+				m.logger.Errorf("futures roll plan %v: position %v is not a multiple of lot %v, %v contracts are not rolled",
+					plan.From.GetTicker(), plan.Quantity, lot, rest)
+			}
+			plan.Quantity /= lot
+			if plan.Quantity == 0 {
+				continue
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// forgetClosed - Удаление из rolled переходов, позиция по From которых стала нулевой
+func (m *FuturesRollManager) forgetClosed(positions []*pb.PositionsFutures) {
+	open := make(map[string]bool, len(positions))
+	for _, pos := range positions {
+		if pos.GetBalance() != 0 {
+			open[pos.GetInstrumentUid()] = true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uid := range m.rolled {
+		if !open[uid] {
+			delete(m.rolled, uid)
+		}
+	}
+}
+
+// Run - Проверка позиций каждые CheckInterval и переход по тем, для которых наступило RollAt.
+// Если закрытие не удалось, переход заново планируется по позиции при следующей проверке. Если позиция
+// закрыта, а открытие не удалось, переход сохраняется в Pending и при следующих проверках повторяется только
+// открытие, пока оно не выполнится. Выполненный переход не повторяется, пока позиция по From не станет нулевой.
+// Блокирует до отмены ctx
+func (m *FuturesRollManager) Run(ctx context.Context) error {
+	clock := m.instruments.config.clock()
+	for {
+		wait := m.conf.CheckInterval
+		for _, r := range m.Pending() {
+			m.attempt(r)
+		}
+		plans, err := m.Plans()
+		if err != nil {
+			m.logger.Errorf("futures roll: %v", err.Error())
+		}
+		now := clock.Now()
+		for _, plan := range plans {
+			if now.Before(plan.RollAt) {
+				if d := plan.RollAt.Sub(now); d < wait {
+					wait = d
+				}
+				continue
+			}
+			m.attempt(plan)
+		}
+		timer := clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+	}
+}
+
+func (m *FuturesRollManager) isPending(uid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.pending[uid]
+	return ok
+}
+
+func (m *FuturesRollManager) isRolled(uid string) (*FuturesRoll, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rolled[uid]
+	return r, ok
+}
+
+func (m *FuturesRollManager) tracked(uid string) bool {
+	if len(m.conf.Instruments) == 0 {
+		return true
+	}
+	for _, id := range m.conf.Instruments {
+		if id == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// ContinuousCandles - Загрузка свечей контрактов chain (например из FuturesChain) и построение непрерывного
+// ряда с обратной корректировкой. Переход на следующий контракт выполняется за daysBefore дней до последнего дня торгов
+func (md *MarketDataServiceClient) ContinuousCandles(chain []*pb.Future, interval pb.CandleInterval, from, to time.Time, daysBefore int) ([]*pb.HistoricCandle, error) {
+	contracts := make([]ContractCandles, 0, len(chain))
+	start := from
+	for _, f := range chain {
+		rollAt := lastTradeTime(f).AddDate(0, 0, -daysBefore)
+		if !rollAt.After(start) {
+			continue
+		}
+		end := rollAt
+		if end.After(to) {
+			end = to
+		}
+		// свечи контракта нужны и до предыдущего перехода, чтобы найти разрыв цен в момент перехода
+		begin := start.Add(-rollGapLookback(interval))
+		if begin.Before(from) {
+			begin = from
+		}
+		candles, err := md.GetHistoricCandles(&GetHistoricCandlesRequest{
+			Instrument: f.GetUid(),
+			Interval:   interval,
+			From:       begin,
+			To:         end,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%v candles: %w", f.GetTicker(), err)
+		}
+		contracts = append(contracts, ContractCandles{Future: f, RollAt: rollAt, Candles: candles})
+		if !rollAt.Before(to) {
+			break
+		}
+		start = rollAt
+	}
+	return BackAdjustCandles(contracts), nil
+}
+
+// BackAdjustCandles - Непрерывный ряд из свечей последовательных контрактов с обратной корректировкой:
+// цены каждого контракта сдвигаются на разрыв между закрытиями следующего и текущего контрактов
+// в последней общей свече перед переходом, поэтому цены последнего контракта остаются без изменений
+func BackAdjustCandles(contracts []ContractCandles) []*pb.HistoricCandle {
+	offsets := make([]decimal.Decimal, len(contracts))
+	offset := decimal.Zero
+	for i := len(contracts) - 1; i >= 0; i-- {
+		if i < len(contracts)-1 {
+			offset = offset.Add(rollGap(contracts[i], contracts[i+1]))
+		}
+		offsets[i] = offset
+	}
+
+	res := make([]*pb.HistoricCandle, 0)
+	var start time.Time
+	for i, c := range contracts {
+		last := i == len(contracts)-1
+		for _, candle := range c.Candles {
+			t := candle.GetTime().AsTime()
+			if t.Before(start) || (!last && !t.Before(c.RollAt)) {
+				continue
+			}
+			res = append(res, shiftCandle(candle, offsets[i]))
+		}
+		start = c.RollAt
+	}
+	return res
+}
+
+// rollGap - Разница цен закрытия следующего и текущего контрактов в последней общей свече перед переходом
+func rollGap(current, next ContractCandles) decimal.Decimal {
+	closes := make(map[int64]decimal.Decimal, len(next.Candles))
+	for _, candle := range next.Candles {
+		closes[candle.GetTime().AsTime().UnixNano()] = QuotationToDecimal(candle.GetClose())
+	}
+	for i := len(current.Candles) - 1; i >= 0; i-- {
+		candle := current.Candles[i]
+		t := candle.GetTime().AsTime()
+		if !t.Before(current.RollAt) {
+			continue
+		}
+		if nextClose, ok := closes[t.UnixNano()]; ok {
+			return nextClose.Sub(QuotationToDecimal(candle.GetClose()))
+		}
+	}
+	return decimal.Zero
+}
+
+func shiftCandle(c *pb.HistoricCandle, offset decimal.Decimal) *pb.HistoricCandle {
+	if offset.IsZero() {
+		return c
+	}
+	return &pb.HistoricCandle{
+		Open:       DecimalToQuotation(QuotationToDecimal(c.GetOpen()).Add(offset)),
+		High:       DecimalToQuotation(QuotationToDecimal(c.GetHigh()).Add(offset)),
+		Low:        DecimalToQuotation(QuotationToDecimal(c.GetLow()).Add(offset)),
+		Close:      DecimalToQuotation(QuotationToDecimal(c.GetClose()).Add(offset)),
+		Volume:     c.GetVolume(),
+		Time:       c.GetTime(),
+		IsComplete: c.GetIsComplete(),
+	}
+}
+
+// rollGapLookback - Период до перехода, в котором ищется общая свеча текущего и следующего контрактов
+func rollGapLookback(interval pb.CandleInterval) time.Duration {
+	lookback := 10 * CandleIntervalDuration(interval)
+	if lookback < 7*DAY {
+		lookback = 7 * DAY
+	}
+	return lookback
+}
+
+// lastTradeTime - Последний день торгов контрактом, если он не задан - дата экспирации
+func lastTradeTime(f *pb.Future) time.Time {
+	if f.GetLastTradeDate() != nil && f.GetLastTradeDate().AsTime().Unix() > 0 {
+		return f.GetLastTradeDate().AsTime()
+	}
+	return f.GetExpirationDate().AsTime()
+}
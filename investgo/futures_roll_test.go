@@ -0,0 +1,230 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRollOrders - PostOrder по очереди возвращает ответы из results, затем исполняет заявки
+type fakeRollOrders struct {
+	pb.OrdersServiceClient
+	calls   []*pb.PostOrderRequest
+	results []error
+}
+
+// errRejected - Результат fakeRollOrders, при котором заявка принимается со статусом REJECTED
+var errRejected = errors.New("rejected")
+
+func (f *fakeRollOrders) PostOrder(_ context.Context, in *pb.PostOrderRequest, _ ...grpc.CallOption) (*pb.PostOrderResponse, error) {
+	f.calls = append(f.calls, in)
+	if len(f.results) > 0 {
+		err := f.results[0]
+		f.results = f.results[1:]
+		if errors.Is(err, errRejected) {
+			return &pb.PostOrderResponse{
+				OrderId:               in.GetOrderId(),
+				ExecutionReportStatus: pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED,
+				Message:               "not enough margin",
+			}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pb.PostOrderResponse{
+		OrderId:               in.GetOrderId(),
+		ExecutionReportStatus: pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL,
+		LotsExecuted:          in.GetQuantity(),
+	}, nil
+}
+
+func newTestRollManager(t *testing.T, orders *fakeRollOrders, onRoll func(r *FuturesRoll)) *FuturesRollManager {
+	return &FuturesRollManager{
+		conf:    FuturesRollConfig{AccountId: "account", OnRoll: onRoll},
+		orders:  &OrdersServiceClient{ctx: context.Background(), pbClient: orders},
+		logger:  testLogger{t},
+		pending: make(map[string]*FuturesRoll),
+		rolled:  make(map[string]*FuturesRoll),
+	}
+}
+
+func testRoll(quantity int64) *FuturesRoll {
+	return &FuturesRoll{
+		From:     &pb.Future{Uid: "from", Ticker: "SiH4"},
+		To:       &pb.Future{Uid: "to", Ticker: "SiM4"},
+		Quantity: quantity,
+	}
+}
+
+func TestFuturesRollRetriesOpenOnly(t *testing.T) {
+	orders := &fakeRollOrders{results: []error{nil, errRejected, status.Error(codes.Unavailable, "unavailable")}}
+	attempts := 0
+	m := newTestRollManager(t, orders, func(*FuturesRoll) { attempts++ })
+	r := testRoll(-2)
+
+	// закрытие исполнено, открытие отклонено
+	m.attempt(r)
+	if !errors.Is(r.Err, ErrRollOrderRejected) || r.Close == nil || r.Open != nil {
+		t.Fatalf("err = %v, close = %v, open = %v", r.Err, r.Close, r.Open)
+	}
+	if pending := m.Pending(); len(pending) != 1 || pending[0] != r {
+		t.Fatalf("pending = %v, want the half-completed roll", pending)
+	}
+	if !m.isPending("from") {
+		t.Fatal("closed position must not be planned again")
+	}
+	// ошибка запроса, затем успешное открытие
+	m.attempt(r)
+	m.attempt(r)
+	if r.Err != nil || r.Open == nil {
+		t.Fatalf("err = %v, open = %v", r.Err, r.Open)
+	}
+	if len(m.Pending()) != 0 {
+		t.Fatalf("pending = %v, want none after open", m.Pending())
+	}
+	if attempts != 3 {
+		t.Fatalf("OnRoll calls = %v, want 3", attempts)
+	}
+
+	if len(orders.calls) != 4 {
+		t.Fatalf("orders = %v, want one close and three opens", len(orders.calls))
+	}
+	closeOrder, opens := orders.calls[0], orders.calls[1:]
+	if closeOrder.GetInstrumentId() != "from" || closeOrder.GetDirection() != pb.OrderDirection_ORDER_DIRECTION_BUY || closeOrder.GetQuantity() != 2 {
+		t.Fatalf("close order = %v", closeOrder)
+	}
+	for _, o := range opens {
+		if o.GetInstrumentId() != "to" || o.GetDirection() != pb.OrderDirection_ORDER_DIRECTION_SELL || o.GetQuantity() != 2 {
+			t.Fatalf("open order = %v", o)
+		}
+	}
+	// после отклонения выставляется новая заявка, после ошибки запроса повторяется та же
+	if opens[0].GetOrderId() == opens[1].GetOrderId() || opens[1].GetOrderId() != opens[2].GetOrderId() {
+		t.Fatalf("open order ids = %v, %v, %v", opens[0].GetOrderId(), opens[1].GetOrderId(), opens[2].GetOrderId())
+	}
+}
+
+func TestFuturesRollCloseFailed(t *testing.T) {
+	orders := &fakeRollOrders{results: []error{errRejected}}
+	m := newTestRollManager(t, orders, nil)
+	r := testRoll(3)
+	m.attempt(r)
+	if !errors.Is(r.Err, ErrRollOrderRejected) || r.Close != nil || r.Open != nil {
+		t.Fatalf("err = %v, close = %v, open = %v", r.Err, r.Close, r.Open)
+	}
+	// позиция не закрыта, переход планируется заново по позиции
+	if len(orders.calls) != 1 || len(m.Pending()) != 0 {
+		t.Fatalf("orders = %v, pending = %v", len(orders.calls), len(m.Pending()))
+	}
+}
+
+// fakeRollInstruments - Контракты SiH4 и SiM4 одного базового актива, лот from - lot
+type fakeRollInstruments struct {
+	pb.InstrumentsServiceClient
+	lot int32
+}
+
+func (f *fakeRollInstruments) futures() []*pb.Future {
+	return []*pb.Future{
+		{Uid: "to", Ticker: "SiM4", ClassCode: "SPBFUT", BasicAsset: "Si", Lot: f.lot,
+			LastTradeDate: TimeToTimestamp(timerMonday.AddDate(0, 3, 0))},
+		{Uid: "from", Ticker: "SiH4", ClassCode: "SPBFUT", BasicAsset: "Si", Lot: f.lot,
+			LastTradeDate: TimeToTimestamp(timerMonday)},
+	}
+}
+
+func (f *fakeRollInstruments) FutureBy(_ context.Context, in *pb.InstrumentRequest, _ ...grpc.CallOption) (*pb.FutureResponse, error) {
+	for _, future := range f.futures() {
+		if future.GetUid() == in.GetId() {
+			return &pb.FutureResponse{Instrument: future}, nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "future not found")
+}
+
+func (f *fakeRollInstruments) Futures(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.FuturesResponse, error) {
+	return &pb.FuturesResponse{Instruments: f.futures()}, nil
+}
+
+// fakeRollPositions - Фьючерсные позиции счета по uid
+type fakeRollPositions struct {
+	pb.OperationsServiceClient
+	balances map[string]int64
+}
+
+func (f *fakeRollPositions) GetPositions(context.Context, *pb.PositionsRequest, ...grpc.CallOption) (*pb.PositionsResponse, error) {
+	resp := &pb.PositionsResponse{}
+	for uid, balance := range f.balances {
+		resp.Futures = append(resp.Futures, &pb.PositionsFutures{InstrumentUid: uid, Balance: balance})
+	}
+	return resp, nil
+}
+
+func newTestRollPlans(t *testing.T, orders *fakeRollOrders, positions *fakeRollPositions, lot int32) *FuturesRollManager {
+	m := newTestRollManager(t, orders, nil)
+	m.conf.DaysBefore = DEFAULT_ROLL_DAYS_BEFORE
+	m.instruments = &InstrumentsServiceClient{ctx: context.Background(), pbClient: &fakeRollInstruments{lot: lot}}
+	m.operations = &OperationsServiceClient{ctx: context.Background(), pbClient: positions}
+	return m
+}
+
+func TestFuturesRollNotRepeated(t *testing.T) {
+	orders := &fakeRollOrders{}
+	positions := &fakeRollPositions{balances: map[string]int64{"from": 3}}
+	m := newTestRollPlans(t, orders, positions, 1)
+
+	plans, err := m.Plans()
+	if err != nil || len(plans) != 1 || plans[0].To.GetUid() != "to" || plans[0].Quantity != 3 ||
+		!plans[0].RollAt.Equal(timerMonday.AddDate(0, 0, -DEFAULT_ROLL_DAYS_BEFORE)) {
+		t.Fatalf("plans = %v, %v", plans, err)
+	}
+	m.attempt(plans[0])
+	if plans[0].Err != nil || len(orders.calls) != 2 {
+		t.Fatalf("err = %v, orders = %v", plans[0].Err, len(orders.calls))
+	}
+
+	// заявка закрытия исполнена, но позиция по from еще не обновилась
+	positions.balances["to"] = 3
+	if plans, err = m.Plans(); err != nil || len(plans) != 0 {
+		t.Fatalf("plans after roll = %v, %v", plans, err)
+	}
+	// позиция закрыта, новая позиция по from переносится снова
+	delete(positions.balances, "from")
+	if plans, err = m.Plans(); err != nil || len(plans) != 0 || len(m.rolled) != 0 {
+		t.Fatalf("plans = %v, %v, rolled = %v", plans, err, m.rolled)
+	}
+	positions.balances["from"] = 1
+	if plans, err = m.Plans(); err != nil || len(plans) != 1 || plans[0].Quantity != 1 {
+		t.Fatalf("plans for new position = %v, %v", plans, err)
+	}
+	if len(orders.calls) != 2 {
+		t.Fatalf("orders = %v, want one close and one open", len(orders.calls))
+	}
+}
+
+func TestFuturesRollPlansLot(t *testing.T) {
+	positions := &fakeRollPositions{balances: map[string]int64{"from": -25}}
+	m := newTestRollPlans(t, &fakeRollOrders{}, positions, 10)
+	logger := &recordingLogger{testLogger: testLogger{t}}
+	m.logger = logger
+	// переносятся только целые лоты, остаток 5 контрактов записывается в лог
+	plans, err := m.Plans()
+	if err != nil || len(plans) != 1 || plans[0].Quantity != -2 || logger.errorsCount() != 1 {
+		t.Fatalf("plans = %v, %v, errors = %v", plans, err, logger.errorsCount())
+	}
+	positions.balances["from"] = 30
+	if plans, err = m.Plans(); err != nil || len(plans) != 1 || plans[0].Quantity != 3 || logger.errorsCount() != 1 {
+		t.Fatalf("plans = %v, %v, errors = %v", plans, err, logger.errorsCount())
+	}
+	// позиция меньше лота не переносится
+	positions.balances["from"] = 7
+	if plans, err = m.Plans(); err != nil || len(plans) != 0 || logger.errorsCount() != 2 {
+		t.Fatalf("plans = %v, %v, errors = %v", plans, err, logger.errorsCount())
+	}
+}
@@ -34,3 +34,17 @@ func RemainingLimitFromHeader(md metadata.MD) int {
 	}
 	return -1
 }
+
+// ResetLimitFromHeader - Метод извлечения времени до сброса лимита запросов в секундах из заголовка,
+// возвращает -1 при ошибке
+func ResetLimitFromHeader(md metadata.MD) int {
+	resets := md.Get("x-ratelimit-reset")
+	if len(resets) > 0 {
+		sec, err := strconv.Atoi(resets[0])
+		if err != nil {
+			return -1
+		}
+		return sec
+	}
+	return -1
+}
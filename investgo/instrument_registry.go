@@ -0,0 +1,431 @@
+package investgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_REGISTRY_TTL - Время жизни справочника инструментов по умолчанию
+	DEFAULT_REGISTRY_TTL = 24 * time.Hour
+	// registryFileVersion - Версия формата файла справочника
+	registryFileVersion = 1
+)
+
+// registryTypes - Типы инструментов справочника по умолчанию
+var registryTypes = []pb.InstrumentType{
+	pb.InstrumentType_INSTRUMENT_TYPE_SHARE,
+	pb.InstrumentType_INSTRUMENT_TYPE_BOND,
+	pb.InstrumentType_INSTRUMENT_TYPE_ETF,
+	pb.InstrumentType_INSTRUMENT_TYPE_FUTURES,
+	pb.InstrumentType_INSTRUMENT_TYPE_CURRENCY,
+	pb.InstrumentType_INSTRUMENT_TYPE_OPTION,
+}
+
+// InstrumentInfo - Общие для всех типов параметры инструмента из справочника
+type InstrumentInfo struct {
+	Type              pb.InstrumentType        `json:"type"`
+	Uid               string                   `json:"uid"`
+	PositionUid       string                   `json:"position_uid"`
+	Figi              string                   `json:"figi"`
+	Ticker            string                   `json:"ticker"`
+	ClassCode         string                   `json:"class_code"`
+	Isin              string                   `json:"isin"`
+	Name              string                   `json:"name"`
+	Exchange          string                   `json:"exchange"`
+	Currency          string                   `json:"currency"`
+	Lot               int64                    `json:"lot"`
+	MinPriceIncrement decimal.Decimal          `json:"min_price_increment"`
+	TradingStatus     pb.SecurityTradingStatus `json:"trading_status"`
+	// Флаги доступности торговли
+	ApiTradeAvailable bool `json:"api_trade_available"`
+	BuyAvailable      bool `json:"buy_available"`
+	SellAvailable     bool `json:"sell_available"`
+	ShortEnabled      bool `json:"short_enabled"`
+	ForQualInvestor   bool `json:"for_qual_investor"`
+	Weekend           bool `json:"weekend"`
+	Otc               bool `json:"otc"`
+}
+
+// InstrumentRegistryConfig - Параметры справочника инструментов
+type InstrumentRegistryConfig struct {
+	// CacheFile - Файл для сохранения справочника. Если не задан, справочник хранится только в памяти
+	CacheFile string
+	// TTL - Время жизни справочника: файл старше TTL не используется, Run обновляет справочник с этим периодом.
+	// По умолчанию DEFAULT_REGISTRY_TTL
+	TTL time.Duration
+	// Status - Статус загружаемых инструментов, по умолчанию INSTRUMENT_STATUS_BASE
+	Status pb.InstrumentStatus
+	// Types - Типы загружаемых инструментов, по умолчанию акции, облигации, фонды, фьючерсы, валюты и опционы
+	Types []pb.InstrumentType
+}
+
+// InstrumentRegistry - Справочник инструментов в памяти. Загружает списки инструментов одним запросом на тип
+// и индексирует их по figi, uid, position_uid, тикеру с class_code и ISIN
+type InstrumentRegistry struct {
+	conf   InstrumentRegistryConfig
+	is     *InstrumentsServiceClient
+	logger Logger
+
+	mu      sync.RWMutex
+	updated time.Time
+	index   *registryIndex
+}
+
+type registryIndex struct {
+	all         []*InstrumentInfo
+	byFigi      map[string]*InstrumentInfo
+	byUid       map[string]*InstrumentInfo
+	byPosition  map[string][]*InstrumentInfo
+	byTicker    map[string][]*InstrumentInfo
+	byIsin      map[string][]*InstrumentInfo
+	byClassCode map[string]*InstrumentInfo
+}
+
+// registryFile - Формат файла справочника
+type registryFile struct {
+	Version     int               `json:"version"`
+	Updated     time.Time         `json:"updated"`
+	Instruments []*InstrumentInfo `json:"instruments"`
+}
+
+// Load - Загрузка справочника из CacheFile, если файл не старше TTL, иначе из API с сохранением в CacheFile
+func (r *InstrumentRegistry) Load() error {
+	if r.conf.CacheFile != "" {
+		f, err := readRegistryFile(r.conf.CacheFile)
+		switch {
+		case err == nil && r.clock().Since(f.Updated) < r.conf.TTL:
+			r.set(f.Instruments, f.Updated)
+			return nil
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			r.logger.Errorf("instrument registry cache %v error %v", r.conf.CacheFile, err.Error())
+		}
+	}
+	return r.Refresh()
+}
+
+// Refresh - Загрузка справочника из API с сохранением в CacheFile. При ошибке справочник не меняется
+func (r *InstrumentRegistry) Refresh() error {
+	instruments := make([]*InstrumentInfo, 0)
+	for _, t := range r.conf.Types {
+		loaded, err := r.load(t)
+		if err != nil {
+			return fmt.Errorf("%v loading error: %w", t, err)
+		}
+		instruments = append(instruments, loaded...)
+	}
+	now := r.clock().Now()
+	r.set(instruments, now)
+	if r.conf.CacheFile == "" {
+		return nil
+	}
+	return writeRegistryFile(r.conf.CacheFile, registryFile{
+		Version:     registryFileVersion,
+		Updated:     now,
+		Instruments: instruments,
+	})
+}
+
+// Run - Фоновое обновление справочника каждые TTL до завершения ctx. Ошибки обновления логируются,
+// справочник остается прежним до следующей успешной загрузки
+func (r *InstrumentRegistry) Run(ctx context.Context) {
+	clock := r.clock()
+	for {
+		r.mu.RLock()
+		wait := r.conf.TTL - clock.Since(r.updated)
+		r.mu.RUnlock()
+		if wait < 0 {
+			wait = 0
+		}
+		timer := clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			if err := r.Refresh(); err != nil {
+				r.logger.Errorf("instrument registry refresh error %v", err.Error())
+				// повторяем не раньше, чем через минуту
+				select {
+				case <-ctx.Done():
+					return
+				case <-clock.After(time.Minute):
+				}
+			}
+		}
+	}
+}
+
+// clock - Часы клиента, по умолчанию RealClock
+func (r *InstrumentRegistry) clock() Clock {
+	return r.is.config.clock()
+}
+
+// Updated - Время загрузки справочника из API
+func (r *InstrumentRegistry) Updated() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.updated
+}
+
+// All - Все инструменты справочника
+func (r *InstrumentRegistry) All() []*InstrumentInfo {
+	idx := r.current()
+	res := make([]*InstrumentInfo, len(idx.all))
+	copy(res, idx.all)
+	return res
+}
+
+// ByFigi - Инструмент по figi
+func (r *InstrumentRegistry) ByFigi(figi string) (*InstrumentInfo, bool) {
+	i, ok := r.current().byFigi[strings.ToUpper(figi)]
+	return i, ok
+}
+
+// ByUid - Инструмент по uid
+func (r *InstrumentRegistry) ByUid(uid string) (*InstrumentInfo, bool) {
+	i, ok := r.current().byUid[strings.ToLower(uid)]
+	return i, ok
+}
+
+// ByPositionUid - Инструменты по position_uid
+func (r *InstrumentRegistry) ByPositionUid(positionUid string) []*InstrumentInfo {
+	return r.current().byPosition[strings.ToLower(positionUid)]
+}
+
+// ByTicker - Инструмент по тикеру и class_code
+func (r *InstrumentRegistry) ByTicker(ticker, classCode string) (*InstrumentInfo, bool) {
+	i, ok := r.current().byClassCode[tickerKey(ticker, classCode)]
+	return i, ok
+}
+
+// FindByTicker - Инструменты с тикером ticker во всех режимах торгов
+func (r *InstrumentRegistry) FindByTicker(ticker string) []*InstrumentInfo {
+	return r.current().byTicker[strings.ToUpper(ticker)]
+}
+
+// ByIsin - Инструменты по ISIN, один ISIN может торговаться в нескольких режимах торгов
+func (r *InstrumentRegistry) ByIsin(isin string) []*InstrumentInfo {
+	return r.current().byIsin[strings.ToUpper(isin)]
+}
+
+// Lot - Лотность инструмента по uid или figi
+func (r *InstrumentRegistry) Lot(id string) (int64, error) {
+	if i, ok := r.ByUid(id); ok {
+		return i.Lot, nil
+	}
+	if i, ok := r.ByFigi(id); ok {
+		return i.Lot, nil
+	}
+	return 0, fmt.Errorf("instrument %v not found in registry", id)
+}
+
+func (r *InstrumentRegistry) current() *registryIndex {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.index
+}
+
+// set - Замена справочника, индексы строятся заново
+func (r *InstrumentRegistry) set(instruments []*InstrumentInfo, updated time.Time) {
+	idx := newRegistryIndex(instruments)
+	r.mu.Lock()
+	r.index = idx
+	r.updated = updated
+	r.mu.Unlock()
+}
+
+func newRegistryIndex(instruments []*InstrumentInfo) *registryIndex {
+	idx := &registryIndex{
+		all:         instruments,
+		byFigi:      make(map[string]*InstrumentInfo, len(instruments)),
+		byUid:       make(map[string]*InstrumentInfo, len(instruments)),
+		byPosition:  make(map[string][]*InstrumentInfo),
+		byTicker:    make(map[string][]*InstrumentInfo),
+		byIsin:      make(map[string][]*InstrumentInfo),
+		byClassCode: make(map[string]*InstrumentInfo, len(instruments)),
+	}
+	for _, i := range instruments {
+		if i.Figi != "" {
+			idx.byFigi[strings.ToUpper(i.Figi)] = i
+		}
+		if i.Uid != "" {
+			idx.byUid[strings.ToLower(i.Uid)] = i
+		}
+		if i.PositionUid != "" {
+			key := strings.ToLower(i.PositionUid)
+			idx.byPosition[key] = append(idx.byPosition[key], i)
+		}
+		if i.Ticker != "" {
+			key := strings.ToUpper(i.Ticker)
+			idx.byTicker[key] = append(idx.byTicker[key], i)
+			idx.byClassCode[tickerKey(i.Ticker, i.ClassCode)] = i
+		}
+		if i.Isin != "" {
+			key := strings.ToUpper(i.Isin)
+			idx.byIsin[key] = append(idx.byIsin[key], i)
+		}
+	}
+	return idx
+}
+
+func tickerKey(ticker, classCode string) string {
+	return strings.ToUpper(classCode) + ":" + strings.ToUpper(ticker)
+}
+
+// registryInstrument - Общие методы акций, облигаций, фондов, фьючерсов, валют и опционов
+type registryInstrument interface {
+	GetUid() string
+	GetPositionUid() string
+	GetTicker() string
+	GetClassCode() string
+	GetName() string
+	GetExchange() string
+	GetCurrency() string
+	GetLot() int32
+	GetMinPriceIncrement() *pb.Quotation
+	GetTradingStatus() pb.SecurityTradingStatus
+	GetApiTradeAvailableFlag() bool
+	GetBuyAvailableFlag() bool
+	GetSellAvailableFlag() bool
+	GetShortEnabledFlag() bool
+	GetForQualInvestorFlag() bool
+	GetWeekendFlag() bool
+	GetOtcFlag() bool
+}
+
+func newInstrumentInfo(t pb.InstrumentType, i registryInstrument) *InstrumentInfo {
+	info := &InstrumentInfo{
+		Type:              t,
+		Uid:               i.GetUid(),
+		PositionUid:       i.GetPositionUid(),
+		Ticker:            i.GetTicker(),
+		ClassCode:         i.GetClassCode(),
+		Name:              i.GetName(),
+		Exchange:          i.GetExchange(),
+		Currency:          i.GetCurrency(),
+		Lot:               int64(i.GetLot()),
+		MinPriceIncrement: QuotationToDecimal(i.GetMinPriceIncrement()),
+		TradingStatus:     i.GetTradingStatus(),
+		ApiTradeAvailable: i.GetApiTradeAvailableFlag(),
+		BuyAvailable:      i.GetBuyAvailableFlag(),
+		SellAvailable:     i.GetSellAvailableFlag(),
+		ShortEnabled:      i.GetShortEnabledFlag(),
+		ForQualInvestor:   i.GetForQualInvestorFlag(),
+		Weekend:           i.GetWeekendFlag(),
+		Otc:               i.GetOtcFlag(),
+	}
+	// у опционов нет figi, у фьючерсов и опционов - ISIN
+	if f, ok := i.(interface{ GetFigi() string }); ok {
+		info.Figi = f.GetFigi()
+	}
+	if f, ok := i.(interface{ GetIsin() string }); ok {
+		info.Isin = f.GetIsin()
+	}
+	return info
+}
+
+// load - Загрузка инструментов одного типа
+func (r *InstrumentRegistry) load(t pb.InstrumentType) ([]*InstrumentInfo, error) {
+	instruments := make([]registryInstrument, 0)
+	switch t {
+	case pb.InstrumentType_INSTRUMENT_TYPE_SHARE:
+		resp, err := r.is.Shares(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	case pb.InstrumentType_INSTRUMENT_TYPE_BOND:
+		resp, err := r.is.Bonds(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	case pb.InstrumentType_INSTRUMENT_TYPE_ETF:
+		resp, err := r.is.Etfs(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	case pb.InstrumentType_INSTRUMENT_TYPE_FUTURES:
+		resp, err := r.is.Futures(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	case pb.InstrumentType_INSTRUMENT_TYPE_CURRENCY:
+		resp, err := r.is.Currencies(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	case pb.InstrumentType_INSTRUMENT_TYPE_OPTION:
+		resp, err := r.is.Options(r.conf.Status)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range resp.GetInstruments() {
+			instruments = append(instruments, i)
+		}
+	default:
+		return nil, fmt.Errorf("instrument type %v is not supported by registry", t)
+	}
+	res := make([]*InstrumentInfo, 0, len(instruments))
+	for _, i := range instruments {
+		res = append(res, newInstrumentInfo(t, i))
+	}
+	return res, nil
+}
+
+func readRegistryFile(path string) (registryFile, error) {
+	var f registryFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, err
+	}
+	if f.Version != registryFileVersion {
+		return f, fmt.Errorf("unsupported registry file version %v", f.Version)
+	}
+	return f, nil
+}
+
+// writeRegistryFile - Запись справочника через временный файл, чтобы не повредить кэш при сбое
+func writeRegistryFile(path string, f registryFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,258 @@
+package investgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var registryNow = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+// fakeInstruments - Списки инструментов по типам, fail - ошибка всех запросов
+type fakeInstruments struct {
+	pb.InstrumentsServiceClient
+
+	mu    sync.Mutex
+	calls map[string]int
+	fail  bool
+}
+
+func (f *fakeInstruments) call(method string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[method]++
+	if f.fail {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	return nil
+}
+
+func (f *fakeInstruments) totalCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	total := 0
+	for _, n := range f.calls {
+		total += n
+	}
+	return total
+}
+
+func (f *fakeInstruments) Shares(_ context.Context, in *pb.InstrumentsRequest, _ ...grpc.CallOption) (*pb.SharesResponse, error) {
+	if err := f.call("Shares"); err != nil {
+		return nil, err
+	}
+	if in.GetInstrumentStatus() != pb.InstrumentStatus_INSTRUMENT_STATUS_BASE {
+		return nil, status.Error(codes.InvalidArgument, "unexpected status")
+	}
+	return &pb.SharesResponse{Instruments: []*pb.Share{
+		{Figi: "BBG004730N88", Ticker: "SBER", ClassCode: "TQBR", Isin: "RU0009029540", Uid: "E6123145-9665-43E0-8413-CD61B8AA9B13",
+			PositionUid: "41eb2102-5333-4713-bf15-72b204c4bf7b", Lot: 10, MinPriceIncrement: &pb.Quotation{Nano: 10000000},
+			Name: "Сбер Банк", Exchange: "MOEX", Currency: "rub", ApiTradeAvailableFlag: true, BuyAvailableFlag: true},
+		// та же бумага в другом режиме торгов
+		{Figi: "BBG004730N89", Ticker: "SBER", ClassCode: "SMAL", Isin: "RU0009029540", Uid: "uid-sber-smal",
+			PositionUid: "41eb2102-5333-4713-bf15-72b204c4bf7b", Lot: 1, MinPriceIncrement: &pb.Quotation{Nano: 10000000}},
+	}}, nil
+}
+
+func (f *fakeInstruments) Futures(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.FuturesResponse, error) {
+	if err := f.call("Futures"); err != nil {
+		return nil, err
+	}
+	return &pb.FuturesResponse{Instruments: []*pb.Future{
+		{Figi: "FUTSI0324000", Ticker: "SiH4", ClassCode: "SPBFUT", Uid: "uid-si", PositionUid: "pos-si", Lot: 1,
+			MinPriceIncrement: &pb.Quotation{Units: 1}},
+	}}, nil
+}
+
+func (f *fakeInstruments) Options(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.OptionsResponse, error) {
+	if err := f.call("Options"); err != nil {
+		return nil, err
+	}
+	return &pb.OptionsResponse{Instruments: []*pb.Option{
+		{Ticker: "Si90000BC4", ClassCode: "SPBOPT", Uid: "uid-option", PositionUid: "pos-option", Lot: 1},
+	}}, nil
+}
+
+var registryTestTypes = []pb.InstrumentType{
+	pb.InstrumentType_INSTRUMENT_TYPE_SHARE,
+	pb.InstrumentType_INSTRUMENT_TYPE_FUTURES,
+	pb.InstrumentType_INSTRUMENT_TYPE_OPTION,
+}
+
+func newTestRegistry(t *testing.T, fake *fakeInstruments, clock Clock, conf InstrumentRegistryConfig) *InstrumentRegistry {
+	if conf.Types == nil {
+		conf.Types = registryTestTypes
+	}
+	client := &Client{Config: Config{Clock: clock}, Logger: testLogger{t}, ctx: context.Background()}
+	r := client.NewInstrumentRegistry(conf)
+	r.is.pbClient = fake
+	return r
+}
+
+func TestInstrumentRegistryIndex(t *testing.T) {
+	r := newTestRegistry(t, &fakeInstruments{}, NewSimulatedClock(registryNow), InstrumentRegistryConfig{})
+	if err := r.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(r.All()) != 4 || !r.Updated().Equal(registryNow) {
+		t.Fatalf("all = %v, updated = %v", len(r.All()), r.Updated())
+	}
+
+	// поиск не зависит от регистра
+	sber, ok := r.ByFigi("bbg004730n88")
+	if !ok || sber.Ticker != "SBER" || sber.ClassCode != "TQBR" || sber.Type != pb.InstrumentType_INSTRUMENT_TYPE_SHARE ||
+		sber.Lot != 10 || sber.MinPriceIncrement.String() != "0.01" || sber.Name != "Сбер Банк" || !sber.ApiTradeAvailable || sber.SellAvailable {
+		t.Fatalf("ByFigi = %+v, %v", sber, ok)
+	}
+	if i, ok := r.ByUid("e6123145-9665-43e0-8413-cd61b8aa9b13"); !ok || i != sber {
+		t.Fatalf("ByUid = %+v, %v", i, ok)
+	}
+	if i, ok := r.ByTicker("sber", "tqbr"); !ok || i != sber {
+		t.Fatalf("ByTicker = %+v, %v", i, ok)
+	}
+	if i, ok := r.ByTicker("SBER", "SMAL"); !ok || i.Uid != "uid-sber-smal" {
+		t.Fatalf("ByTicker SMAL = %+v, %v", i, ok)
+	}
+	if _, ok := r.ByTicker("SBER", "SPBFUT"); ok {
+		t.Fatal("ByTicker must match class code")
+	}
+	if got := r.FindByTicker("sber"); len(got) != 2 {
+		t.Fatalf("FindByTicker = %v", got)
+	}
+	if got := r.ByIsin("ru0009029540"); len(got) != 2 || got[0] != sber {
+		t.Fatalf("ByIsin = %v", got)
+	}
+	if got := r.ByPositionUid("41EB2102-5333-4713-BF15-72B204C4BF7B"); len(got) != 2 {
+		t.Fatalf("ByPositionUid = %v", got)
+	}
+
+	// у опциона нет figi, у фьючерса - ISIN
+	option, ok := r.ByUid("uid-option")
+	if !ok || option.Figi != "" || option.Type != pb.InstrumentType_INSTRUMENT_TYPE_OPTION {
+		t.Fatalf("option = %+v, %v", option, ok)
+	}
+	if _, ok := r.ByFigi(""); ok {
+		t.Fatal("empty figi must not be indexed")
+	}
+	if got := r.ByIsin(""); len(got) != 0 {
+		t.Fatalf("empty ISIN = %v", got)
+	}
+
+	if lot, err := r.Lot("FUTSI0324000"); err != nil || lot != 1 {
+		t.Fatalf("Lot by figi = %v, %v", lot, err)
+	}
+	if lot, err := r.Lot("uid-sber-smal"); err != nil || lot != 1 {
+		t.Fatalf("Lot by uid = %v, %v", lot, err)
+	}
+	if _, err := r.Lot("unknown"); err == nil {
+		t.Fatal("Lot of unknown instrument must fail")
+	}
+}
+
+func TestInstrumentRegistryCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "registry.json")
+	clock := NewSimulatedClock(registryNow)
+	conf := InstrumentRegistryConfig{CacheFile: path, TTL: 2 * time.Hour}
+	fake := &fakeInstruments{}
+	loaded := newTestRegistry(t, fake, clock, conf)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if fake.totalCalls() != len(registryTestTypes) {
+		t.Fatalf("calls = %v", fake.calls)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary cache file is left")
+	}
+
+	// файл моложе TTL используется без запросов
+	clock.Advance(time.Hour)
+	cached := newTestRegistry(t, fake, clock, conf)
+	if err := cached.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if fake.totalCalls() != len(registryTestTypes) || !cached.Updated().Equal(registryNow) {
+		t.Fatalf("calls = %v, updated = %v", fake.calls, cached.Updated())
+	}
+	want, err := json.Marshal(loaded.All())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got, err := json.Marshal(cached.All())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("cached instruments = %s, want %s", got, want)
+	}
+	if i, ok := cached.ByTicker("SBER", "TQBR"); !ok || i.MinPriceIncrement.String() != "0.01" || i.Lot != 10 {
+		t.Fatalf("cached ByTicker = %+v, %v", i, ok)
+	}
+
+	// файл старше TTL обновляется
+	clock.Advance(time.Hour)
+	expired := newTestRegistry(t, fake, clock, conf)
+	if err := expired.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if fake.totalCalls() != 2*len(registryTestTypes) || !expired.Updated().Equal(clock.Now()) {
+		t.Fatalf("calls = %v, updated = %v", fake.calls, expired.Updated())
+	}
+	f, err := readRegistryFile(path)
+	if err != nil || !f.Updated.Equal(clock.Now()) || len(f.Instruments) != 4 {
+		t.Fatalf("cache file = %+v, %v", f, err)
+	}
+
+	// поврежденный файл и файл другой версии не используются
+	for _, data := range []string{"{", `{"version": 2, "updated": "2024-03-04T12:00:00Z"}`} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("write cache: %v", err)
+		}
+		calls := fake.totalCalls()
+		r := newTestRegistry(t, fake, clock, conf)
+		if err := r.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if fake.totalCalls() != calls+len(registryTestTypes) || len(r.All()) != 4 {
+			t.Fatalf("cache %q: calls = %v, all = %v", data, fake.calls, len(r.All()))
+		}
+	}
+}
+
+func TestInstrumentRegistryRefreshError(t *testing.T) {
+	fake := &fakeInstruments{}
+	clock := NewSimulatedClock(registryNow)
+	r := newTestRegistry(t, fake, clock, InstrumentRegistryConfig{})
+	if err := r.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	fake.fail = true
+	clock.Advance(time.Hour)
+	err := r.Refresh()
+	if status.Code(errors.Unwrap(err)) != codes.Unavailable {
+		t.Fatalf("err = %v", err)
+	}
+	// при ошибке справочник не меняется
+	if len(r.All()) != 4 || !r.Updated().Equal(registryNow) {
+		t.Fatalf("all = %v, updated = %v", len(r.All()), r.Updated())
+	}
+	unsupported := newTestRegistry(t, &fakeInstruments{}, clock, InstrumentRegistryConfig{
+		Types: []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SP},
+	})
+	if err := unsupported.Refresh(); err == nil {
+		t.Fatal("unsupported type must fail")
+	}
+}
@@ -17,6 +17,11 @@ type InstrumentsServiceClient struct {
 	pbClient pb.InstrumentsServiceClient
 }
 
+// Clock - Часы клиента из Config.Clock, по умолчанию RealClock
+func (is *InstrumentsServiceClient) Clock() Clock {
+	return is.config.clock()
+}
+
 // TradingSchedules - Метод получения расписания торгов торговых площадок
 func (is *InstrumentsServiceClient) TradingSchedules(exchange string, from, to time.Time) (*TradingSchedulesResponse, error) {
 	var header, trailer metadata.MD
@@ -255,6 +260,11 @@ func (is *InstrumentsServiceClient) Futures(status pb.InstrumentStatus) (*Future
 	}, err
 }
 
+// OptionByFigi - Метод получения опциона по Figi
+func (is *InstrumentsServiceClient) OptionByFigi(id string) (*OptionResponse, error) {
+	return is.optionBy(id, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_FIGI, "")
+}
+
 // OptionByTicker - Метод получения опциона по Ticker
 func (is *InstrumentsServiceClient) OptionByTicker(id string, classCode string) (*OptionResponse, error) {
 	return is.optionBy(id, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_TICKER, classCode)
@@ -303,6 +313,22 @@ func (is *InstrumentsServiceClient) Options(status pb.InstrumentStatus) (*Option
 	}, err
 }
 
+// OptionsBy - Метод получения списка опционов по базовому активу, basicAssetUid - обязательный параметр
+func (is *InstrumentsServiceClient) OptionsBy(basicAssetUid, basicAssetPositionUid string) (*OptionsResponse, error) {
+	var header, trailer metadata.MD
+	resp, err := is.pbClient.OptionsBy(is.ctx, &pb.FilterOptionsRequest{
+		BasicAssetUid:         basicAssetUid,
+		BasicAssetPositionUid: basicAssetPositionUid,
+	}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		header = trailer
+	}
+	return &OptionsResponse{
+		OptionsResponse: resp,
+		Header:          header,
+	}, err
+}
+
 // ShareByFigi - Метод получения акции по Figi
 func (is *InstrumentsServiceClient) ShareByFigi(id string) (*ShareResponse, error) {
 	return is.shareBy(id, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_FIGI, "")
@@ -0,0 +1,406 @@
+package investgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// ErrKillSwitchTripped - Ошибка, которую возвращают методы выставления заявок после срабатывания KillSwitch.
+// Проверять можно через errors.Is(err, investgo.ErrKillSwitchTripped)
+var ErrKillSwitchTripped = errors.New("kill switch is tripped")
+
+// KillSwitchError - Ошибка выставления заявки при сработавшем KillSwitch
+type KillSwitchError struct {
+	// Reason - Причина срабатывания
+	Reason string
+	// TrippedAt - Время срабатывания
+	TrippedAt time.Time
+}
+
+func (e *KillSwitchError) Error() string {
+	return fmt.Sprintf("kill switch is tripped at %v, reason: %v", e.TrippedAt.Format(time.RFC3339), e.Reason)
+}
+
+// Is - Совместимость с errors.Is(err, ErrKillSwitchTripped)
+func (e *KillSwitchError) Is(target error) bool {
+	return target == ErrKillSwitchTripped
+}
+
+// killSwitchState - Состояние KillSwitch, которое сохраняется в файл
+type killSwitchState struct {
+	Tripped   bool      `json:"Tripped"`
+	Reason    string    `json:"Reason"`
+	TrippedAt time.Time `json:"TrippedAt"`
+	// Day, DayStartAmount - Торговый день и стоимость портфеля в начале этого дня, для расчета дневного убытка
+	Day            string  `json:"Day"`
+	DayStartAmount float64 `json:"DayStartAmount"`
+	// DayCashFlow - Пополнения за вычетом выводов денег со счета с начала дня
+	DayCashFlow float64 `json:"DayCashFlow"`
+}
+
+// killSwitchCashFlowRefresh - Период обновления пополнений и выводов за день при слежении за убытком
+const killSwitchCashFlowRefresh = time.Minute
+
+// killSwitchCashFlows - Операции ввода и вывода денег, которые меняют стоимость портфеля, но не являются
+// результатом торговли. Штрафы за вывод (OUTPUT_PENALTY) - убыток и в этот список не входят
+var killSwitchCashFlows = map[pb.OperationType]bool{
+	pb.OperationType_OPERATION_TYPE_INPUT:            true,
+	pb.OperationType_OPERATION_TYPE_OUTPUT:           true,
+	pb.OperationType_OPERATION_TYPE_INPUT_SWIFT:      true,
+	pb.OperationType_OPERATION_TYPE_OUTPUT_SWIFT:     true,
+	pb.OperationType_OPERATION_TYPE_INPUT_ACQUIRING:  true,
+	pb.OperationType_OPERATION_TYPE_OUTPUT_ACQUIRING: true,
+}
+
+// KillSwitch - Глобальный выключатель торговли. Один KillSwitch разделяют все сервисы, созданные одним клиентом.
+// После срабатывания все методы выставления заявок сервисов Orders, StopOrders и Sandbox возвращают *KillSwitchError,
+// отмена заявок и остальные методы продолжают работать. Состояние сохраняется в Config.KillSwitchFile и
+// переживает перезапуск, пока не будет явно вызван Reset().
+type KillSwitch struct {
+	client *Client
+	path   string
+	logger Logger
+
+	mu    sync.RWMutex
+	state killSwitchState
+}
+
+// newKillSwitch - Создание KillSwitch, если path != "" состояние загружается из файла
+func newKillSwitch(c *Client, path string) (*KillSwitch, error) {
+	k := &KillSwitch{
+		client: c,
+		path:   path,
+		logger: c.Logger,
+	}
+	if path == "" {
+		return k, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return k, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &k.state); err != nil {
+		return nil, err
+	}
+	if k.state.Tripped {
+		k.logger.Errorf("kill switch is tripped at %v, reason: %v", k.state.TrippedAt, k.state.Reason)
+	}
+	return k, nil
+}
+
+// Trip - Срабатывание выключателя. Если Config.KillSwitchFlatten = true, то после срабатывания
+// отменяются все заявки и закрываются все позиции по счету Config.AccountId
+func (k *KillSwitch) Trip(reason string) error {
+	k.mu.Lock()
+	if k.state.Tripped {
+		k.mu.Unlock()
+		return nil
+	}
+	k.state.Tripped = true
+	k.state.Reason = reason
+	k.state.TrippedAt = k.client.Config.clock().Now()
+	err := k.save()
+	k.mu.Unlock()
+
+	k.logger.Errorf("kill switch tripped, reason: %v", reason)
+	if err != nil {
+		return err
+	}
+	if k.client.Config.KillSwitchFlatten {
+		return k.Flatten(k.client.Config.AccountId)
+	}
+	return nil
+}
+
+// Reset - Сброс выключателя, после сброса выставление заявок снова доступно
+func (k *KillSwitch) Reset() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.state.Tripped = false
+	k.state.Reason = ""
+	k.state.TrippedAt = time.Time{}
+	k.logger.Infof("kill switch reset")
+	return k.save()
+}
+
+// Tripped - Возвращает true, если выключатель сработал
+func (k *KillSwitch) Tripped() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.state.Tripped
+}
+
+// Err - Возвращает *KillSwitchError, если выключатель сработал, иначе nil
+func (k *KillSwitch) Err() error {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if !k.state.Tripped {
+		return nil
+	}
+	return &KillSwitchError{
+		Reason:    k.state.Reason,
+		TrippedAt: k.state.TrippedAt,
+	}
+}
+
+// TripOnSignal - Срабатывание выключателя при получении одного из сигналов sigs. Неблокирующий метод,
+// ожидание сигнала прекращается по завершению контекста
+func (k *KillSwitch) TripOnSignal(ctx context.Context, sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			if err := k.Trip(fmt.Sprintf("signal %v", sig)); err != nil {
+				k.logger.Errorf("kill switch trip on signal: %v", err)
+			}
+		}
+	}()
+}
+
+// WatchDailyLoss - Слежение за дневным убытком по счету через PortfolioStream. Убыток - это изменение стоимости
+// портфеля с начала торгового дня по Москве за вычетом пополнений и выводов денег, то есть зафиксированный
+// и текущий результат по позициям вместе с комиссиями. Пополнения и выводы берутся из GetOperations не чаще раза
+// в минуту и перед каждым срабатыванием. Переводы ценных бумаг не учитываются. Когда убыток превышает maxLoss
+// (положительное число в валюте портфеля), выключатель срабатывает.
+// Блокирующий метод, завершается по завершению контекста или после срабатывания.
+func (k *KillSwitch) WatchDailyLoss(ctx context.Context, accountId string, maxLoss float64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := k.client.NewOperationsStreamClient().PortfolioStream([]string{accountId})
+	if err != nil {
+		return err
+	}
+	portfolios := stream.Portfolios()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- stream.Listen()
+	}()
+	defer stream.Stop()
+
+	operations := k.client.NewOperationsServiceClient()
+	var refreshed time.Time
+	refresh := func(currency string, now time.Time) {
+		flow, err := k.cashFlow(operations, accountId, currency, now)
+		if err != nil {
+			k.logger.Errorf("kill switch cash flow: %v", err)
+			return
+		}
+		refreshed = now
+		k.setCashFlow(flow)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errCh:
+			return err
+		case p, ok := <-portfolios:
+			if !ok {
+				return nil
+			}
+			now := k.client.Config.clock().Now()
+			total := p.GetTotalAmountPortfolio()
+			if k.startDay(total.ToFloat(), now) || now.Sub(refreshed) >= killSwitchCashFlowRefresh {
+				refresh(total.GetCurrency(), now)
+			}
+			loss := k.dailyLoss(total.ToFloat())
+			if loss > maxLoss && !refreshed.Equal(now) {
+				// вывод денег мог произойти после последнего обновления
+				refresh(total.GetCurrency(), now)
+				loss = k.dailyLoss(total.ToFloat())
+			}
+			if loss > maxLoss {
+				return k.Trip(fmt.Sprintf("daily loss %.2f exceeds limit %.2f, account %v", loss, maxLoss, accountId))
+			}
+		}
+	}
+}
+
+// tradingDayStart - Начало торгового дня по Москве, в который попадает t
+func tradingDayStart(t time.Time) time.Time {
+	t = t.In(MoscowLocation)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, MoscowLocation)
+}
+
+// startDay - Запоминает стоимость портфеля на начало нового торгового дня, возвращает true, если день сменился
+func (k *KillSwitch) startDay(amount float64, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	day := tradingDayStart(now).Format(time.DateOnly)
+	if k.state.Day == day {
+		return false
+	}
+	k.state.Day = day
+	k.state.DayStartAmount = amount
+	k.state.DayCashFlow = 0
+	if err := k.save(); err != nil {
+		k.logger.Errorf("kill switch save: %v", err)
+	}
+	return true
+}
+
+// setCashFlow - Обновление суммы пополнений и выводов за день
+func (k *KillSwitch) setCashFlow(flow float64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.state.DayCashFlow == flow {
+		return
+	}
+	k.state.DayCashFlow = flow
+	if err := k.save(); err != nil {
+		k.logger.Errorf("kill switch save: %v", err)
+	}
+}
+
+// dailyLoss - Текущий дневной убыток при стоимости портфеля amount
+func (k *KillSwitch) dailyLoss(amount float64) float64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.state.DayStartAmount + k.state.DayCashFlow - amount
+}
+
+// cashFlow - Пополнения за вычетом выводов в валюте currency с начала торгового дня до now
+func (k *KillSwitch) cashFlow(operations *OperationsServiceClient, accountId, currency string, now time.Time) (float64, error) {
+	resp, err := operations.GetOperations(&GetOperationsRequest{
+		AccountId: accountId,
+		State:     pb.OperationState_OPERATION_STATE_EXECUTED,
+		From:      tradingDayStart(now),
+		To:        now,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sumCashFlow(resp.GetOperations(), currency), nil
+}
+
+// sumCashFlow - Сумма операций ввода и вывода денег в валюте currency, выводы отрицательные
+func sumCashFlow(operations []*pb.Operation, currency string) float64 {
+	var flow float64
+	for _, op := range operations {
+		if !killSwitchCashFlows[op.GetOperationType()] {
+			continue
+		}
+		if !strings.EqualFold(op.GetPayment().GetCurrency(), currency) {
+			continue
+		}
+		flow += op.GetPayment().ToFloat()
+	}
+	return flow
+}
+
+// Flatten - Отмена всех заявок и стоп-заявок и закрытие всех позиций по счету рыночными заявками.
+// Работает в обход выключателя
+func (k *KillSwitch) Flatten(accountId string) error {
+	orders := pb.NewOrdersServiceClient(k.client.conn)
+	stopOrders := pb.NewStopOrdersServiceClient(k.client.conn)
+	operations := k.client.NewOperationsServiceClient()
+	instruments := k.client.NewInstrumentsServiceClient()
+
+	ctx := k.client.ctx
+	k.logger.Infof("flatten account %v", accountId)
+
+	activeOrders, err := orders.GetOrders(ctx, &pb.GetOrdersRequest{AccountId: accountId})
+	if err != nil {
+		return err
+	}
+	for _, o := range activeOrders.GetOrders() {
+		_, err := orders.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: accountId, OrderId: o.GetOrderId()})
+		if err != nil {
+			k.logger.Errorf("cancel order %v: %v", o.GetOrderId(), err.Error())
+		}
+	}
+
+	activeStopOrders, err := stopOrders.GetStopOrders(ctx, &pb.GetStopOrdersRequest{AccountId: accountId})
+	if err != nil {
+		return err
+	}
+	for _, so := range activeStopOrders.GetStopOrders() {
+		_, err := stopOrders.CancelStopOrder(ctx, &pb.CancelStopOrderRequest{AccountId: accountId, StopOrderId: so.GetStopOrderId()})
+		if err != nil {
+			k.logger.Errorf("cancel stop order %v: %v", so.GetStopOrderId(), err.Error())
+		}
+	}
+
+	portfolio, err := operations.GetPortfolio(accountId, pb.PortfolioRequest_RUB)
+	if err != nil {
+		return err
+	}
+	for _, position := range portfolio.GetPositions() {
+		if position.GetInstrumentType() == "currency" {
+			continue
+		}
+		quantity := int64(position.GetQuantity().ToFloat())
+		if quantity == 0 {
+			continue
+		}
+		lot, err := instruments.LotByUid(position.GetInstrumentUid())
+		if err != nil {
+			return err
+		}
+		direction := pb.OrderDirection_ORDER_DIRECTION_SELL
+		if quantity < 0 {
+			direction = pb.OrderDirection_ORDER_DIRECTION_BUY
+			quantity = -quantity
+		}
+		if lot > 0 {
+			quantity = quantity / lot
+		}
+		if quantity == 0 {
+			continue
+		}
+		_, err = orders.PostOrder(ctx, &pb.PostOrderRequest{
+			Quantity:     quantity,
+			Direction:    direction,
+			AccountId:    accountId,
+			OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+			OrderId:      CreateUid(),
+			InstrumentId: position.GetInstrumentUid(),
+		})
+		if err != nil {
+			k.logger.Errorf("close position %v: %v", position.GetInstrumentUid(), err.Error())
+		}
+	}
+	return nil
+}
+
+// save - Сохранение состояния в файл, вызывается под мьютексом
+func (k *KillSwitch) save() error {
+	if k.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(k.state)
+	if err != nil {
+		return err
+	}
+	// запись через временный файл, чтобы прерванная запись не оставила битое состояние
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,184 @@
+package investgo
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Infof(template string, args ...any) {
+	l.t.Logf(template, args...)
+}
+
+func (l testLogger) Errorf(template string, args ...any) {
+	l.t.Logf("ERROR "+template, args...)
+}
+
+func (l testLogger) Fatalf(template string, args ...any) {
+	l.t.Fatalf(template, args...)
+}
+
+func newTestKillSwitch(t *testing.T, path string, clock Clock) *KillSwitch {
+	t.Helper()
+	c := &Client{Config: Config{Clock: clock}, Logger: testLogger{t}}
+	k, err := newKillSwitch(c, path)
+	if err != nil {
+		t.Fatalf("newKillSwitch: %v", err)
+	}
+	c.KillSwitch = k
+	return k
+}
+
+func TestKillSwitchTripPersistReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kill_switch.json")
+	clock := NewSimulatedClock(time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC))
+
+	k := newTestKillSwitch(t, path, clock)
+	if k.Tripped() || k.Err() != nil {
+		t.Fatal("new kill switch must not be tripped")
+	}
+	if err := k.Trip("manual"); err != nil {
+		t.Fatalf("Trip: %v", err)
+	}
+	clock.Advance(time.Hour)
+	// повторное срабатывание не меняет причину и время
+	if err := k.Trip("second"); err != nil {
+		t.Fatalf("Trip: %v", err)
+	}
+
+	restored := newTestKillSwitch(t, path, clock)
+	if !restored.Tripped() {
+		t.Fatal("tripped state must survive restart")
+	}
+	var ksErr *KillSwitchError
+	if err := restored.Err(); !errors.As(err, &ksErr) || !errors.Is(err, ErrKillSwitchTripped) {
+		t.Fatalf("Err() = %v, want *KillSwitchError", err)
+	}
+	if ksErr.Reason != "manual" || !ksErr.TrippedAt.Equal(time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("restored state = %v at %v", ksErr.Reason, ksErr.TrippedAt)
+	}
+
+	if err := restored.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if restored.Tripped() {
+		t.Fatal("kill switch must be reset")
+	}
+	if newTestKillSwitch(t, path, clock).Tripped() {
+		t.Fatal("reset state must survive restart")
+	}
+	// состояние записывается через временный файл
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary state file is left: %v", err)
+	}
+}
+
+func TestKillSwitchOrderGuards(t *testing.T) {
+	k := newTestKillSwitch(t, "", nil)
+	if err := k.Trip("test"); err != nil {
+		t.Fatalf("Trip: %v", err)
+	}
+	// pbClient не задан: после срабатывания методы не должны обращаться к API
+	orders := &OrdersServiceClient{killSwitch: k}
+	stopOrders := &StopOrdersServiceClient{killSwitch: k}
+	sandbox := &SandboxServiceClient{killSwitch: k}
+
+	calls := map[string]func() error{
+		"PostOrder": func() error {
+			_, err := orders.PostOrder(&PostOrderRequest{})
+			return err
+		},
+		"Buy": func() error {
+			_, err := orders.Buy(&PostOrderRequestShort{})
+			return err
+		},
+		"Sell": func() error {
+			_, err := orders.Sell(&PostOrderRequestShort{})
+			return err
+		},
+		"ReplaceOrder": func() error {
+			_, err := orders.ReplaceOrder(&ReplaceOrderRequest{})
+			return err
+		},
+		"PostStopOrder": func() error {
+			_, err := stopOrders.PostStopOrder(&PostStopOrderRequest{})
+			return err
+		},
+		"PostSandboxOrder": func() error {
+			_, err := sandbox.PostSandboxOrder(&PostOrderRequest{})
+			return err
+		},
+		"ReplaceSandboxOrder": func() error {
+			_, err := sandbox.ReplaceSandboxOrder(&ReplaceOrderRequest{})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, ErrKillSwitchTripped) {
+			t.Errorf("%v: err = %v, want ErrKillSwitchTripped", name, err)
+		}
+	}
+}
+
+func TestKillSwitchNil(t *testing.T) {
+	var k *KillSwitch
+	if k.Tripped() || k.Err() != nil {
+		t.Fatal("nil kill switch must not block orders")
+	}
+}
+
+func TestKillSwitchDailyLoss(t *testing.T) {
+	k := newTestKillSwitch(t, "", nil)
+
+	if !k.startDay(1000, time.Date(2024, 3, 4, 20, 0, 0, 0, time.UTC)) {
+		t.Fatal("first update must start a day")
+	}
+	if k.startDay(900, time.Date(2024, 3, 4, 20, 59, 0, 0, time.UTC)) {
+		t.Fatal("same Moscow day must not restart")
+	}
+	// 21:30 UTC 4 марта - это уже 5 марта по Москве
+	if !k.startDay(800, time.Date(2024, 3, 4, 21, 30, 0, 0, time.UTC)) {
+		t.Fatal("Moscow midnight must start a new day")
+	}
+	if got := k.dailyLoss(750); got != 50 {
+		t.Fatalf("loss = %v, want 50", got)
+	}
+
+	// вывод 500 уменьшает стоимость портфеля, но не является убытком
+	k.setCashFlow(-500)
+	if got := k.dailyLoss(300); got != 0 {
+		t.Fatalf("loss after withdrawal = %v, want 0", got)
+	}
+	// пополнение не скрывает убыток
+	k.setCashFlow(-500 + 1000)
+	if got := k.dailyLoss(1200); got != 100 {
+		t.Fatalf("loss after deposit = %v, want 100", got)
+	}
+}
+
+func TestSumCashFlow(t *testing.T) {
+	money := func(units int64, currency string) *pb.MoneyValue {
+		return &pb.MoneyValue{Units: units, Currency: currency}
+	}
+	ops := []*pb.Operation{
+		{OperationType: pb.OperationType_OPERATION_TYPE_INPUT, Payment: money(1000, "rub")},
+		{OperationType: pb.OperationType_OPERATION_TYPE_OUTPUT, Payment: money(-300, "RUB")},
+		{OperationType: pb.OperationType_OPERATION_TYPE_INPUT, Payment: money(100, "usd")},
+		{OperationType: pb.OperationType_OPERATION_TYPE_BUY, Payment: money(-200, "rub")},
+		{OperationType: pb.OperationType_OPERATION_TYPE_BROKER_FEE, Payment: money(-1, "rub")},
+		// штраф за вывод - убыток, а не вывод денег
+		{OperationType: pb.OperationType_OPERATION_TYPE_OUTPUT_PENALTY, Payment: money(-50, "rub")},
+	}
+	if got := sumCashFlow(ops, "rub"); math.Abs(got-700) > 1e-9 {
+		t.Fatalf("cash flow = %v, want 700", got)
+	}
+}
@@ -3,7 +3,6 @@ package investgo
 import (
 	"context"
 	"fmt"
-	"os"
 	"time"
 
 	pb "github.com/tinkoff/invest-api-go-sdk/proto"
@@ -19,15 +18,25 @@ type MarketDataServiceClient struct {
 	pbClient pb.MarketDataServiceClient
 }
 
+// Clock - Часы клиента из Config.Clock, по умолчанию RealClock
+func (md *MarketDataServiceClient) Clock() Clock {
+	return md.config.clock()
+}
+
 // GetCandles - Метод запроса исторических свечей по инструменту
 func (md *MarketDataServiceClient) GetCandles(instrumentId string, interval pb.CandleInterval, from, to time.Time) (*GetCandlesResponse, error) {
+	return md.getCandles(instrumentId, interval, from, to)
+}
+
+// getCandles - GetCandles с дополнительными опциями вызова, например retry.WithoutResourceExhausted
+func (md *MarketDataServiceClient) getCandles(instrumentId string, interval pb.CandleInterval, from, to time.Time, opts ...grpc.CallOption) (*GetCandlesResponse, error) {
 	var header, trailer metadata.MD
 	resp, err := md.pbClient.GetCandles(md.ctx, &pb.GetCandlesRequest{
 		From:         TimeToTimestamp(from),
 		To:           TimeToTimestamp(to),
 		Interval:     interval,
 		InstrumentId: instrumentId,
-	}, grpc.Header(&header), grpc.Trailer(&trailer))
+	}, append(opts, grpc.Header(&header), grpc.Trailer(&trailer))...)
 	if err != nil {
 		header = trailer
 	}
@@ -137,13 +146,15 @@ func (md *MarketDataServiceClient) GetClosePrices(instrumentIds []string) (*GetC
 // GetHistoricCandles - Метод загрузки исторических свечей.
 // Если указать File = true, то создастся .csv файл с записями
 // свечей в формате: instrumentId;time;open;close;high;low;volume.
-// Имя файла по умолчанию: "candles hh:mm:ss"
+// Имя файла по умолчанию: "<instrumentId>_<interval>_<from>-<to>", время в UTC в виде 20060102T150405Z
 func (md *MarketDataServiceClient) GetHistoricCandles(req *GetHistoricCandlesRequest) ([]*pb.HistoricCandle, error) {
+	instrument := refId(req.Instrument, req.InstrumentRef)
+	interval := req.Interval
 	// by default 1 hour
-	if req.Interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
-		req.Interval = pb.CandleInterval_CANDLE_INTERVAL_HOUR
+	if interval == pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		interval = pb.CandleInterval_CANDLE_INTERVAL_HOUR
 	}
-	duration := selectDuration(req.Interval)
+	duration := selectDuration(interval)
 	// если запрашиваемый интервал больше чем возможный, то нужно разделить его на несколько
 	intervals := make([]time.Time, 0)
 	if req.To.Sub(req.From) > duration {
@@ -165,7 +176,7 @@ func (md *MarketDataServiceClient) GetHistoricCandles(req *GetHistoricCandlesReq
 		// from - i элемент
 		// to - i-1 элемент
 		requests++
-		resp, err := md.GetCandles(req.Instrument, req.Interval, intervals[i], intervals[i-1])
+		resp, err := md.GetCandles(instrument, interval, intervals[i], intervals[i-1])
 		if err != nil {
 			return nil, err
 		}
@@ -175,14 +186,17 @@ func (md *MarketDataServiceClient) GetHistoricCandles(req *GetHistoricCandlesReq
 		candles = append(candles, resp.GetCandles()[1:]...)
 		if requests == 299 {
 			if md.config.DisableResourceExhaustedRetry {
-				time.Sleep(time.Minute)
+				md.config.clock().Sleep(time.Minute)
 			}
 			requests = 0
 		}
 	}
 
 	if req.File {
-		err := md.writeCandlesToFile(candles, req.Instrument, req.FileName)
+		// имя файла строится по идентификатору из InstrumentRef, запрос вызывающего не меняется
+		fileReq := *req
+		fileReq.Instrument, fileReq.Interval = instrument, interval
+		err := md.writeCandlesToFile(candles, &fileReq)
 		if err != nil {
 			return candles, err
 		}
@@ -201,13 +215,14 @@ func (md *MarketDataServiceClient) GetAllHistoricCandles(req *GetHistoricCandles
 		pbClient: pb.NewInstrumentsServiceClient(md.conn),
 	}
 
-	resp, err := instrumentsService.FindInstrument(req.Instrument)
+	instrument := refId(req.Instrument, req.InstrumentRef)
+	resp, err := instrumentsService.FindInstrument(instrument)
 	if err != nil {
 		return nil, err
 	}
 	instruments := resp.GetInstruments()
 	if len(instruments) < 1 {
-		return nil, fmt.Errorf("instrument %v not found", req.Instrument)
+		return nil, fmt.Errorf("instrument %v not found", instrument)
 	}
 
 	var from time.Time
@@ -219,12 +234,13 @@ func (md *MarketDataServiceClient) GetAllHistoricCandles(req *GetHistoricCandles
 	}
 
 	return md.GetHistoricCandles(&GetHistoricCandlesRequest{
-		Instrument: req.Instrument,
-		Interval:   req.Interval,
-		From:       from,
-		To:         time.Now(),
-		File:       req.File,
-		FileName:   req.FileName,
+		Instrument:  instrument,
+		Interval:    req.Interval,
+		From:        from,
+		To:          md.config.clock().Now(),
+		File:        req.File,
+		FileName:    req.FileName,
+		FileOptions: req.FileOptions,
 	})
 }
 
@@ -251,28 +267,50 @@ func selectDuration(interval pb.CandleInterval) time.Duration {
 	return duration
 }
 
-// Метод записи в .csv файл исторических свечей в формате instrumentId;time;open;close;high;low;volume
-func (md *MarketDataServiceClient) writeCandlesToFile(candles []*pb.HistoricCandle, id string, filename string) error {
-	h, m, s := time.Now().Clock()
-	if filename == "" {
-		filename = fmt.Sprintf("candles %v:%v:%v", h, m, s)
+// CandleIntervalDuration - Длительность свечи интервала interval. Для месячных свечей и неизвестных интервалов
+// возвращает 0, так как их длительность не фиксирована
+func CandleIntervalDuration(interval pb.CandleInterval) time.Duration {
+	switch interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_1_MIN:
+		return time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_2_MIN:
+		return 2 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_3_MIN:
+		return 3 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_5_MIN:
+		return 5 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_10_MIN:
+		return 10 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_15_MIN:
+		return 15 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_30_MIN:
+		return 30 * time.Minute
+	case pb.CandleInterval_CANDLE_INTERVAL_HOUR:
+		return time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_2_HOUR:
+		return 2 * time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_4_HOUR:
+		return 4 * time.Hour
+	case pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		return DAY
+	case pb.CandleInterval_CANDLE_INTERVAL_WEEK:
+		return DAY * 7
 	}
+	return 0
+}
 
-	file, err := os.Create(fmt.Sprintf("%v.csv", filename))
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = file.Close()
-		if err != nil {
-			md.logger.Errorf(err.Error())
-		}
-	}()
-	for _, candle := range candles {
-		_, err = fmt.Fprintf(file, "%v;%v\n", id, candle.ToCSV())
-		if err != nil {
-			return err
-		}
+// Метод записи в файл исторических свечей в формате req.FileOptions
+func (md *MarketDataServiceClient) writeCandlesToFile(candles []*pb.HistoricCandle, req *GetHistoricCandlesRequest) error {
+	filename := req.FileName
+	if filename == "" {
+		filename = candlesFileName(req.Instrument, req.Interval, req.From, req.To)
 	}
-	return nil
+	return WriteCandlesFile(filename+req.FileOptions.Format.Extension(), req.Instrument, req.Interval, candles, req.FileOptions)
+}
+
+// candlesFileName - Имя файла свечей по умолчанию, без расширения и без символов, недопустимых в именах файлов
+func candlesFileName(instrumentId string, interval pb.CandleInterval, from, to time.Time) string {
+	const layout = "20060102T150405Z"
+	return fmt.Sprintf("%v_%v_%v-%v", safeFileName(instrumentId), interval.String(),
+		from.UTC().Format(layout), to.UTC().Format(layout))
 }
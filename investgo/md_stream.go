@@ -28,6 +28,8 @@ type MarketDataStream struct {
 	tradingStatus chan *pb.TradingStatus
 
 	subs subscriptions
+
+	onRestart func()
 }
 
 type candleSub struct {
@@ -375,6 +377,15 @@ func (mds *MarketDataStream) UnSubscribeAll() error {
 	return nil
 }
 
+// OnRestart - Установка функции, которая вызывается при каждой попытке переподключения стрима,
+// например, чтобы догрузить пропущенные данные. Устанавливается до вызова Listen
+func (mds *MarketDataStream) OnRestart(f func()) {
+	mds.onRestart = f
+}
+
 func (mds *MarketDataStream) restart(_ context.Context, attempt uint, err error) {
 	mds.mdsClient.logger.Infof("try to restart md stream err = %v, attempt = %v", err.Error(), attempt)
+	if mds.onRestart != nil {
+		mds.onRestart()
+	}
 }
@@ -16,6 +16,11 @@ type MarketDataStreamClient struct {
 	pbClient pb.MarketDataStreamServiceClient
 }
 
+// Logger - Логгер клиента, которым создан сервис
+func (c *MarketDataStreamClient) Logger() Logger {
+	return c.logger
+}
+
 // MarketDataStream - метод возвращает стрим биржевой информации
 func (c *MarketDataStreamClient) MarketDataStream() (*MarketDataStream, error) {
 	ctx, cancel := context.WithCancel(c.ctx)
@@ -17,6 +17,8 @@ type PostOrderRequest struct {
 	AccountId    string
 	OrderType    pb.OrderType
 	OrderId      string
+	// InstrumentRef - Инструмент, найденный InstrumentResolver, если задан, то используется вместо InstrumentId
+	InstrumentRef InstrumentRef
 }
 
 type PostOrderRequestShort struct {
@@ -26,6 +28,8 @@ type PostOrderRequestShort struct {
 	AccountId    string
 	OrderType    pb.OrderType
 	OrderId      string
+	// InstrumentRef - Инструмент, найденный InstrumentResolver, если задан, то используется вместо InstrumentId
+	InstrumentRef InstrumentRef
 }
 
 type ReplaceOrderRequest struct {
@@ -566,6 +570,8 @@ type GetOperationsByCursorRequest struct {
 	WithoutCommissions bool
 	WithoutTrades      bool
 	WithoutOvernights  bool
+	// InstrumentRef - Инструмент, найденный InstrumentResolver, если задан, то используется вместо InstrumentId
+	InstrumentRef InstrumentRef
 }
 
 type PostStopOrderRequest struct {
@@ -578,6 +584,8 @@ type PostStopOrderRequest struct {
 	ExpirationType pb.StopOrderExpirationType
 	StopOrderType  pb.StopOrderType
 	ExpireDate     time.Time
+	// InstrumentRef - Инструмент, найденный InstrumentResolver, если задан, то используется вместо InstrumentId
+	InstrumentRef InstrumentRef
 }
 
 type SandboxPayInRequest struct {
@@ -594,4 +602,8 @@ type GetHistoricCandlesRequest struct {
 	To         time.Time
 	File       bool
 	FileName   string
+	// FileOptions - Формат файла, по умолчанию CANDLES_FORMAT_LEGACY. Расширение добавляется к FileName по формату
+	FileOptions CandlesFileOptions
+	// InstrumentRef - Инструмент, найденный InstrumentResolver, если задан, то используется вместо Instrument
+	InstrumentRef InstrumentRef
 }
@@ -176,7 +176,7 @@ func (os *OperationsServiceClient) GetOperationsByCursor(req *GetOperationsByCur
 	var header, trailer metadata.MD
 	resp, err := os.pbClient.GetOperationsByCursor(os.ctx, &pb.GetOperationsByCursorRequest{
 		AccountId:          req.AccountId,
-		InstrumentId:       req.InstrumentId,
+		InstrumentId:       refId(req.InstrumentId, req.InstrumentRef),
 		From:               TimeToTimestamp(req.From),
 		To:                 TimeToTimestamp(req.To),
 		Cursor:             req.Cursor,
@@ -0,0 +1,217 @@
+package investgo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// lastPricesBatch - Количество инструментов в одном запросе GetLastPrices при загрузке котировок цепочки
+const lastPricesBatch = 100
+
+// OptionContract - Опцион цепочки с котировками
+type OptionContract struct {
+	Option *pb.Option
+	Strike decimal.Decimal
+	// LastPrice - Цена последней сделки, LastPriceTime - ее время. Нулевые, если сделок не было или котировки не загружены
+	LastPrice     decimal.Decimal
+	LastPriceTime time.Time
+	// Bid, Ask - Лучшие цены в стакане, BidQuantity, AskQuantity - количество в лотах на лучших ценах.
+	// Нулевые, если стакан пуст или не загружен
+	Bid         decimal.Decimal
+	Ask         decimal.Decimal
+	BidQuantity int64
+	AskQuantity int64
+	// OrderBook - Стакан опциона, если он был загружен
+	OrderBook *pb.GetOrderBookResponse
+}
+
+// OptionStrike - Опционы колл и пут одной даты экспирации и страйка, отсутствующий опцион - nil.
+// Если опционов одного направления несколько, например с разным стилем или способом расчетов, то Call и Put -
+// первые по тикеру, а все опционы - в Calls и Puts
+type OptionStrike struct {
+	Strike decimal.Decimal
+	Call   *OptionContract
+	Put    *OptionContract
+	Calls  []*OptionContract
+	Puts   []*OptionContract
+}
+
+// OptionExpiration - Опционы одной даты экспирации по возрастанию страйка
+type OptionExpiration struct {
+	Expiration time.Time
+	Strikes    []*OptionStrike
+}
+
+// OptionChain - Опционная цепочка базового актива: опционы сгруппированы по дате экспирации и страйку
+type OptionChain struct {
+	BasicAssetUid string
+	// Expirations - Даты экспирации по возрастанию
+	Expirations []*OptionExpiration
+	contracts   map[string]*OptionContract
+}
+
+// OptionChain - Метод получения опционной цепочки по uid базового актива (uid актива из GetAssets)
+func (is *InstrumentsServiceClient) OptionChain(basicAssetUid string) (*OptionChain, error) {
+	resp, err := is.OptionsBy(basicAssetUid, "")
+	if err != nil {
+		return nil, err
+	}
+	chain := NewOptionChain(resp.GetInstruments())
+	chain.BasicAssetUid = basicAssetUid
+	return chain, nil
+}
+
+// NewOptionChain - Построение опционной цепочки из списка опционов
+func NewOptionChain(options []*pb.Option) *OptionChain {
+	chain := &OptionChain{
+		Expirations: make([]*OptionExpiration, 0),
+		contracts:   make(map[string]*OptionContract, len(options)),
+	}
+	expirations := make(map[int64]*OptionExpiration)
+	strikes := make(map[int64]map[string]*OptionStrike)
+	for _, o := range options {
+		expiration := o.GetExpirationDate().AsTime()
+		e, ok := expirations[expiration.UnixNano()]
+		if !ok {
+			e = &OptionExpiration{Expiration: expiration, Strikes: make([]*OptionStrike, 0)}
+			expirations[expiration.UnixNano()] = e
+			strikes[expiration.UnixNano()] = make(map[string]*OptionStrike)
+			chain.Expirations = append(chain.Expirations, e)
+		}
+		contract := &OptionContract{Option: o, Strike: MoneyValueToDecimal(o.GetStrikePrice())}
+		chain.contracts[o.GetUid()] = contract
+		// decimal нельзя использовать как ключ map, поэтому страйки группируются по строковому представлению
+		key := contract.Strike.String()
+		s, ok := strikes[expiration.UnixNano()][key]
+		if !ok {
+			s = &OptionStrike{Strike: contract.Strike}
+			strikes[expiration.UnixNano()][key] = s
+			e.Strikes = append(e.Strikes, s)
+		}
+		switch o.GetDirection() {
+		case pb.OptionDirection_OPTION_DIRECTION_CALL:
+			s.Calls = append(s.Calls, contract)
+		case pb.OptionDirection_OPTION_DIRECTION_PUT:
+			s.Puts = append(s.Puts, contract)
+		}
+	}
+	sort.Slice(chain.Expirations, func(i, j int) bool {
+		return chain.Expirations[i].Expiration.Before(chain.Expirations[j].Expiration)
+	})
+	for _, e := range chain.Expirations {
+		sort.Slice(e.Strikes, func(i, j int) bool {
+			return e.Strikes[i].Strike.LessThan(e.Strikes[j].Strike)
+		})
+		for _, s := range e.Strikes {
+			sortContracts(s.Calls)
+			sortContracts(s.Puts)
+			if len(s.Calls) > 0 {
+				s.Call = s.Calls[0]
+			}
+			if len(s.Puts) > 0 {
+				s.Put = s.Puts[0]
+			}
+		}
+	}
+	return chain
+}
+
+// sortContracts - Сортировка опционов по тикеру, чтобы выбор Call и Put не зависел от порядка ответа API
+func sortContracts(contracts []*OptionContract) {
+	sort.Slice(contracts, func(i, j int) bool {
+		return contracts[i].Option.GetTicker() < contracts[j].Option.GetTicker()
+	})
+}
+
+// Contract - Опцион цепочки по uid
+func (c *OptionChain) Contract(uid string) (*OptionContract, bool) {
+	contract, ok := c.contracts[uid]
+	return contract, ok
+}
+
+// Contracts - Все опционы цепочки по возрастанию даты экспирации и страйка, коллы перед путами
+func (c *OptionChain) Contracts() []*OptionContract {
+	res := make([]*OptionContract, 0, len(c.contracts))
+	for _, e := range c.Expirations {
+		for _, s := range e.Strikes {
+			res = append(res, s.Calls...)
+			res = append(res, s.Puts...)
+		}
+	}
+	return res
+}
+
+// Expiration - Опционы с датой экспирации в тот же день, что и t (по UTC)
+func (c *OptionChain) Expiration(t time.Time) (*OptionExpiration, bool) {
+	day := t.UTC().Truncate(DAY)
+	for _, e := range c.Expirations {
+		if e.Expiration.UTC().Truncate(DAY).Equal(day) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Strike - Колл и пут с ближайшим к price страйком
+func (e *OptionExpiration) Strike(price decimal.Decimal) (*OptionStrike, bool) {
+	if len(e.Strikes) == 0 {
+		return nil, false
+	}
+	best := e.Strikes[0]
+	for _, s := range e.Strikes[1:] {
+		if s.Strike.Sub(price).Abs().LessThan(best.Strike.Sub(price).Abs()) {
+			best = s
+		}
+	}
+	return best, true
+}
+
+// LoadOptionQuotes - Загрузка цен последних сделок по всем опционам цепочки и, если depth > 0,
+// стаканов глубиной depth. Стакан запрашивается отдельно для каждого опциона
+func (md *MarketDataServiceClient) LoadOptionQuotes(chain *OptionChain, depth int32) error {
+	contracts := chain.Contracts()
+	for start := 0; start < len(contracts); start += lastPricesBatch {
+		end := start + lastPricesBatch
+		if end > len(contracts) {
+			end = len(contracts)
+		}
+		ids := make([]string, 0, end-start)
+		for _, c := range contracts[start:end] {
+			ids = append(ids, c.Option.GetUid())
+		}
+		resp, err := md.GetLastPrices(ids)
+		if err != nil {
+			return err
+		}
+		for _, lp := range resp.GetLastPrices() {
+			c, ok := chain.Contract(lp.GetInstrumentUid())
+			if !ok || lp.GetTime() == nil {
+				continue
+			}
+			c.LastPrice = QuotationToDecimal(lp.GetPrice())
+			c.LastPriceTime = lp.GetTime().AsTime()
+		}
+	}
+	if depth <= 0 {
+		return nil
+	}
+	for _, c := range contracts {
+		resp, err := md.GetOrderBook(c.Option.GetUid(), depth)
+		if err != nil {
+			return fmt.Errorf("%v order book: %w", c.Option.GetTicker(), err)
+		}
+		c.OrderBook = resp.GetOrderBookResponse
+		c.Bid, c.BidQuantity, c.Ask, c.AskQuantity = decimal.Zero, 0, decimal.Zero, 0
+		if bids := resp.GetBids(); len(bids) > 0 {
+			c.Bid, c.BidQuantity = QuotationToDecimal(bids[0].GetPrice()), bids[0].GetQuantity()
+		}
+		if asks := resp.GetAsks(); len(asks) > 0 {
+			c.Ask, c.AskQuantity = QuotationToDecimal(asks[0].GetPrice()), asks[0].GetQuantity()
+		}
+	}
+	return nil
+}
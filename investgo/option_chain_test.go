@@ -0,0 +1,168 @@
+package investgo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+var (
+	juneExpiration  = time.Date(2024, 6, 20, 18, 50, 0, 0, time.UTC)
+	marchExpiration = time.Date(2024, 3, 21, 18, 50, 0, 0, time.UTC)
+)
+
+func testOption(ticker string, expiration time.Time, strike float64, direction pb.OptionDirection) *pb.Option {
+	return &pb.Option{
+		Uid:            "uid-" + ticker,
+		Ticker:         ticker,
+		ExpirationDate: TimeToTimestamp(expiration),
+		StrikePrice:    DecimalToMoneyValue(decimal.NewFromFloat(strike), "rub"),
+		Direction:      direction,
+	}
+}
+
+// testChainOptions - Опционы двух дат экспирации в произвольном порядке, на страйке 100 в марте два колла
+func testChainOptions() []*pb.Option {
+	call, put := pb.OptionDirection_OPTION_DIRECTION_CALL, pb.OptionDirection_OPTION_DIRECTION_PUT
+	return []*pb.Option{
+		testOption("JUN110C", juneExpiration, 110, call),
+		testOption("MAR105P", marchExpiration, 100.5, put),
+		testOption("MAR100CW", marchExpiration, 100, call),
+		testOption("MAR100P", marchExpiration, 100, put),
+		testOption("MAR90C", marchExpiration, 90, call),
+		testOption("MAR100C", marchExpiration, 100, call),
+	}
+}
+
+func contractTickers(contracts []*OptionContract) []string {
+	res := make([]string, 0, len(contracts))
+	for _, c := range contracts {
+		res = append(res, c.Option.GetTicker())
+	}
+	return res
+}
+
+func TestNewOptionChain(t *testing.T) {
+	chain := NewOptionChain(testChainOptions())
+	if len(chain.Expirations) != 2 || !chain.Expirations[0].Expiration.Equal(marchExpiration) ||
+		!chain.Expirations[1].Expiration.Equal(juneExpiration) {
+		t.Fatalf("expirations = %v", chain.Expirations)
+	}
+	march := chain.Expirations[0]
+	strikes := make([]string, 0, len(march.Strikes))
+	for _, s := range march.Strikes {
+		strikes = append(strikes, s.Strike.String())
+	}
+	if !reflect.DeepEqual(strikes, []string{"90", "100", "100.5"}) {
+		t.Fatalf("strikes = %v", strikes)
+	}
+	if s := march.Strikes[0]; s.Call == nil || s.Put != nil || len(s.Puts) != 0 {
+		t.Fatalf("strike 90 = %+v", s)
+	}
+	// оба колла одного страйка сохраняются, Call - первый по тикеру
+	s := march.Strikes[1]
+	if got := contractTickers(s.Calls); !reflect.DeepEqual(got, []string{"MAR100C", "MAR100CW"}) {
+		t.Fatalf("calls = %v", got)
+	}
+	if s.Call != s.Calls[0] || s.Put == nil || s.Put.Option.GetTicker() != "MAR100P" || !s.Call.Strike.Equal(decimal.NewFromInt(100)) {
+		t.Fatalf("strike 100 = %+v", s)
+	}
+
+	want := []string{"MAR90C", "MAR100C", "MAR100CW", "MAR100P", "MAR105P", "JUN110C"}
+	if got := contractTickers(chain.Contracts()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("contracts = %v, want %v", got, want)
+	}
+	if c, ok := chain.Contract("uid-MAR100CW"); !ok || c != s.Calls[1] {
+		t.Fatalf("Contract = %v, %v", c, ok)
+	}
+	if _, ok := chain.Contract("unknown"); ok {
+		t.Fatal("unknown contract found")
+	}
+	if len(NewOptionChain(nil).Contracts()) != 0 {
+		t.Fatal("empty chain has contracts")
+	}
+}
+
+func TestOptionChainLookup(t *testing.T) {
+	chain := NewOptionChain(testChainOptions())
+	// дата экспирации ищется по дню без учета времени
+	e, ok := chain.Expiration(time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC))
+	if !ok || !e.Expiration.Equal(marchExpiration) {
+		t.Fatalf("Expiration = %v, %v", e, ok)
+	}
+	if _, ok := chain.Expiration(time.Date(2024, 3, 22, 0, 0, 0, 0, time.UTC)); ok {
+		t.Fatal("expiration on another day found")
+	}
+
+	tests := []struct {
+		price float64
+		want  string
+	}{
+		{0, "90"},
+		{94.9, "90"},
+		// при равном расстоянии выбирается меньший страйк
+		{95, "90"},
+		{95.1, "100"},
+		{100.3, "100.5"},
+		{1000, "100.5"},
+	}
+	for _, tt := range tests {
+		s, ok := e.Strike(decimal.NewFromFloat(tt.price))
+		if !ok || s.Strike.String() != tt.want {
+			t.Errorf("Strike(%v) = %v, want %v", tt.price, s.Strike, tt.want)
+		}
+	}
+	if _, ok := (&OptionExpiration{}).Strike(decimal.NewFromInt(100)); ok {
+		t.Fatal("empty expiration has strikes")
+	}
+}
+
+// fakeOptionQuotes - Цены последних сделок и стаканы опционов: цена равна длине тикера
+type fakeOptionQuotes struct {
+	pb.MarketDataServiceClient
+	orderBooks []string
+}
+
+func (f *fakeOptionQuotes) GetLastPrices(_ context.Context, in *pb.GetLastPricesRequest, _ ...grpc.CallOption) (*pb.GetLastPricesResponse, error) {
+	resp := &pb.GetLastPricesResponse{}
+	for _, id := range in.GetInstrumentId() {
+		resp.LastPrices = append(resp.LastPrices, &pb.LastPrice{
+			InstrumentUid: id,
+			Price:         &pb.Quotation{Units: int64(len(id))},
+			Time:          TimeToTimestamp(marchExpiration.Add(-time.Hour)),
+		})
+	}
+	return resp, nil
+}
+
+func (f *fakeOptionQuotes) GetOrderBook(_ context.Context, in *pb.GetOrderBookRequest, _ ...grpc.CallOption) (*pb.GetOrderBookResponse, error) {
+	f.orderBooks = append(f.orderBooks, in.GetInstrumentId())
+	return &pb.GetOrderBookResponse{
+		Bids: []*pb.Order{{Price: &pb.Quotation{Units: 1}, Quantity: 5}},
+		Asks: []*pb.Order{{Price: &pb.Quotation{Units: 2}, Quantity: 7}},
+	}, nil
+}
+
+func TestLoadOptionQuotes(t *testing.T) {
+	chain := NewOptionChain(testChainOptions())
+	fake := &fakeOptionQuotes{}
+	md := &MarketDataServiceClient{ctx: context.Background(), pbClient: fake}
+	if err := md.LoadOptionQuotes(chain, 1); err != nil {
+		t.Fatalf("LoadOptionQuotes: %v", err)
+	}
+	// котировки загружаются для всех опционов, включая второй колл страйка
+	if len(fake.orderBooks) != len(chain.Contracts()) {
+		t.Fatalf("order books = %v", fake.orderBooks)
+	}
+	for _, c := range chain.Contracts() {
+		if !c.LastPrice.Equal(decimal.NewFromInt(int64(len(c.Option.GetUid())))) || c.LastPriceTime.IsZero() ||
+			!c.Bid.Equal(decimal.NewFromInt(1)) || c.BidQuantity != 5 || !c.Ask.Equal(decimal.NewFromInt(2)) || c.AskQuantity != 7 {
+			t.Fatalf("%v quotes = %+v", c.Option.GetTicker(), c)
+		}
+	}
+}
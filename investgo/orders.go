@@ -9,15 +9,19 @@ import (
 )
 
 type OrdersServiceClient struct {
-	conn     *grpc.ClientConn
-	config   Config
-	logger   Logger
-	ctx      context.Context
-	pbClient pb.OrdersServiceClient
+	conn       *grpc.ClientConn
+	config     Config
+	logger     Logger
+	ctx        context.Context
+	pbClient   pb.OrdersServiceClient
+	killSwitch *KillSwitch
 }
 
 // PostOrder - Метод выставления биржевой заявки
 func (os *OrdersServiceClient) PostOrder(req *PostOrderRequest) (*PostOrderResponse, error) {
+	if err := os.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := os.pbClient.PostOrder(os.ctx, &pb.PostOrderRequest{
 		Quantity:     req.Quantity,
@@ -26,7 +30,7 @@ func (os *OrdersServiceClient) PostOrder(req *PostOrderRequest) (*PostOrderRespo
 		AccountId:    req.AccountId,
 		OrderType:    req.OrderType,
 		OrderId:      req.OrderId,
-		InstrumentId: req.InstrumentId,
+		InstrumentId: refId(req.InstrumentId, req.InstrumentRef),
 	}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
 		header = trailer
@@ -39,6 +43,9 @@ func (os *OrdersServiceClient) PostOrder(req *PostOrderRequest) (*PostOrderRespo
 
 // Buy - Метод выставления поручения на покупку инструмента
 func (os *OrdersServiceClient) Buy(req *PostOrderRequestShort) (*PostOrderResponse, error) {
+	if err := os.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := os.pbClient.PostOrder(os.ctx, &pb.PostOrderRequest{
 		Quantity:     req.Quantity,
@@ -47,7 +54,7 @@ func (os *OrdersServiceClient) Buy(req *PostOrderRequestShort) (*PostOrderRespon
 		AccountId:    req.AccountId,
 		OrderType:    req.OrderType,
 		OrderId:      req.OrderId,
-		InstrumentId: req.InstrumentId,
+		InstrumentId: refId(req.InstrumentId, req.InstrumentRef),
 	}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
 		header = trailer
@@ -60,6 +67,9 @@ func (os *OrdersServiceClient) Buy(req *PostOrderRequestShort) (*PostOrderRespon
 
 // Sell - Метод выставления поручения на продажу инструмента
 func (os *OrdersServiceClient) Sell(req *PostOrderRequestShort) (*PostOrderResponse, error) {
+	if err := os.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := os.pbClient.PostOrder(os.ctx, &pb.PostOrderRequest{
 		Quantity:     req.Quantity,
@@ -68,7 +78,7 @@ func (os *OrdersServiceClient) Sell(req *PostOrderRequestShort) (*PostOrderRespo
 		AccountId:    req.AccountId,
 		OrderType:    req.OrderType,
 		OrderId:      req.OrderId,
-		InstrumentId: req.InstrumentId,
+		InstrumentId: refId(req.InstrumentId, req.InstrumentRef),
 	}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
 		header = trailer
@@ -128,6 +138,9 @@ func (os *OrdersServiceClient) GetOrders(accountId string) (*GetOrdersResponse,
 
 // ReplaceOrder - Метод изменения выставленной заявки
 func (os *OrdersServiceClient) ReplaceOrder(req *ReplaceOrderRequest) (*PostOrderResponse, error) {
+	if err := os.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := os.pbClient.ReplaceOrder(os.ctx, &pb.ReplaceOrderRequest{
 		AccountId:      req.AccountId,
@@ -0,0 +1,313 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// InstrumentIdKind - Тип идентификатора инструмента в запросе Resolve
+type InstrumentIdKind int
+
+const (
+	// ID_KIND_TICKER - Тикер без режима торгов, например SBER
+	ID_KIND_TICKER InstrumentIdKind = iota
+	// ID_KIND_CLASS_TICKER - Режим торгов и тикер через двоеточие, например TQBR:SBER
+	ID_KIND_CLASS_TICKER
+	// ID_KIND_FIGI - FIGI, например BBG004730N88
+	ID_KIND_FIGI
+	// ID_KIND_UID - uid или position_uid инструмента
+	ID_KIND_UID
+	// ID_KIND_ISIN - ISIN, например RU0009029540
+	ID_KIND_ISIN
+)
+
+func (k InstrumentIdKind) String() string {
+	switch k {
+	case ID_KIND_TICKER:
+		return "ticker"
+	case ID_KIND_CLASS_TICKER:
+		return "class_code:ticker"
+	case ID_KIND_FIGI:
+		return "figi"
+	case ID_KIND_UID:
+		return "uid"
+	case ID_KIND_ISIN:
+		return "isin"
+	}
+	return fmt.Sprintf("InstrumentIdKind(%d)", int(k))
+}
+
+// DEFAULT_CLASS_CODES - Предпочтительные режимы торгов для тикеров без class_code по умолчанию:
+// основные режимы Московской биржи для акций, фондов и облигаций, фьючерсы, валюта и СПБ биржа
+var DEFAULT_CLASS_CODES = []string{"TQBR", "TQTF", "TQCB", "TQOB", "SPBFUT", "CETS", "SPBXM", "SPBRU"}
+
+var (
+	// ErrInstrumentNotFound - Инструмент по запросу не найден
+	ErrInstrumentNotFound = errors.New("instrument not found")
+	// ErrAmbiguousInstrument - Тикер торгуется в нескольких режимах, ни один из которых не входит в ResolverConfig.ClassCodes
+	ErrAmbiguousInstrument = errors.New("ambiguous instrument")
+
+	uidRegexp  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	figiRegexp = regexp.MustCompile(`^(BBG|TCS)[0-9A-Z]{9}$`)
+	isinRegexp = regexp.MustCompile(`^[A-Z]{2}[0-9A-Z]{9}[0-9]$`)
+)
+
+// ResolverConfig - Параметры поиска инструментов
+type ResolverConfig struct {
+	// ClassCodes - Предпочтительные режимы торгов по убыванию приоритета для тикеров и ISIN, которые торгуются
+	// в нескольких режимах. По умолчанию DEFAULT_CLASS_CODES
+	ClassCodes []string
+	// Registry - Справочник инструментов, если задан, то инструмент сначала ищется в нем без запросов к API
+	Registry *InstrumentRegistry
+}
+
+// InstrumentResolver - Поиск инструмента по любому идентификатору: тикеру, class_code:тикеру, FIGI, uid или ISIN.
+// Найденные инструменты кэшируются по запросу
+type InstrumentResolver struct {
+	conf ResolverConfig
+	is   *InstrumentsServiceClient
+
+	mu    sync.RWMutex
+	cache map[string]*InstrumentInfo
+}
+
+// InstrumentRef - Ссылка на инструмент, например *InstrumentInfo из InstrumentResolver или InstrumentRegistry.
+// Поле InstrumentRef запросов PostOrderRequest, PostOrderRequestShort, PostStopOrderRequest,
+// GetOperationsByCursorRequest и GetHistoricCandlesRequest, если задано и Id() не пустой, используется вместо
+// строкового идентификатора. Остальные методы, например GetCandles, GetLastPrices, GetOrderBook и подписки
+// стримов, принимают только строковые идентификаторы: в методы с параметром instrumentId передается
+// InstrumentRef.Id(), в методы со списком идентификаторов - InstrumentIds
+type InstrumentRef interface {
+	// Id - Идентификатор инструмента, который принимает API
+	Id() string
+}
+
+// Id - Идентификатор инструмента (uid), который принимают все методы SDK с параметром instrumentId.
+// Для nil возвращает пустую строку
+func (i *InstrumentInfo) Id() string {
+	if i == nil {
+		return ""
+	}
+	return i.Uid
+}
+
+// InstrumentIds - Идентификаторы инструментов для методов со списком instrumentIds
+func InstrumentIds[T InstrumentRef](refs []T) []string {
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, ref.Id())
+	}
+	return ids
+}
+
+// refId - Идентификатор из ref, если он задан и не пустой, иначе id. Типизированный nil, например
+// (*InstrumentInfo)(nil), не равен nil интерфейса, поэтому проверяется результат Id()
+func refId(id string, ref InstrumentRef) string {
+	if ref != nil {
+		if refId := ref.Id(); refId != "" {
+			return refId
+		}
+	}
+	return id
+}
+
+// DetectIdKind - Определение типа идентификатора по его виду
+func DetectIdKind(query string) InstrumentIdKind {
+	query = strings.TrimSpace(query)
+	upper := strings.ToUpper(query)
+	switch {
+	case uidRegexp.MatchString(query):
+		return ID_KIND_UID
+	case strings.Contains(query, ":"):
+		return ID_KIND_CLASS_TICKER
+	case figiRegexp.MatchString(upper):
+		return ID_KIND_FIGI
+	case isinRegexp.MatchString(upper):
+		return ID_KIND_ISIN
+	}
+	return ID_KIND_TICKER
+}
+
+// Resolve - Поиск инструмента по идентификатору любого типа. Тикер без режима торгов ищется через FindInstrument,
+// при нескольких совпадениях выбирается режим торгов из ResolverConfig.ClassCodes
+func (r *InstrumentResolver) Resolve(ctx context.Context, query string) (*InstrumentInfo, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("%w: empty query", ErrInstrumentNotFound)
+	}
+	key := strings.ToUpper(query)
+	r.mu.RLock()
+	cached, ok := r.cache[key]
+	r.mu.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	info, err := r.resolve(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[key] = info
+	r.mu.Unlock()
+	return info, nil
+}
+
+// ResolveAll - Поиск нескольких инструментов, ошибка возвращается для первого ненайденного
+func (r *InstrumentResolver) ResolveAll(ctx context.Context, queries []string) ([]*InstrumentInfo, error) {
+	res := make([]*InstrumentInfo, 0, len(queries))
+	for _, q := range queries {
+		info, err := r.Resolve(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (r *InstrumentResolver) resolve(ctx context.Context, query string) (*InstrumentInfo, error) {
+	kind := DetectIdKind(query)
+	registry := r.conf.Registry
+	switch kind {
+	case ID_KIND_UID:
+		if registry != nil {
+			if info, ok := registry.ByUid(query); ok {
+				return info, nil
+			}
+			if infos := registry.ByPositionUid(query); len(infos) > 0 {
+				return r.choose(query, infos)
+			}
+		}
+		info, err := r.instrumentBy(ctx, query, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_UID, "")
+		if errors.Is(err, ErrInstrumentNotFound) {
+			return r.instrumentBy(ctx, query, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_POSITION_UID, "")
+		}
+		return info, err
+	case ID_KIND_CLASS_TICKER:
+		classCode, ticker, _ := strings.Cut(query, ":")
+		classCode, ticker = strings.TrimSpace(classCode), strings.TrimSpace(ticker)
+		if registry != nil {
+			if info, ok := registry.ByTicker(ticker, classCode); ok {
+				return info, nil
+			}
+		}
+		return r.instrumentBy(ctx, strings.ToUpper(ticker), pb.InstrumentIdType_INSTRUMENT_ID_TYPE_TICKER, strings.ToUpper(classCode))
+	case ID_KIND_FIGI:
+		if registry != nil {
+			if info, ok := registry.ByFigi(query); ok {
+				return info, nil
+			}
+		}
+		info, err := r.instrumentBy(ctx, strings.ToUpper(query), pb.InstrumentIdType_INSTRUMENT_ID_TYPE_FIGI, "")
+		if !errors.Is(err, ErrInstrumentNotFound) {
+			return info, err
+		}
+		// тикер может совпасть по виду с FIGI
+	case ID_KIND_ISIN:
+		if registry != nil {
+			if infos := registry.ByIsin(query); len(infos) > 0 {
+				return r.choose(query, infos)
+			}
+		}
+	}
+
+	if registry != nil {
+		if infos := registry.FindByTicker(query); len(infos) > 0 {
+			return r.choose(query, infos)
+		}
+	}
+	return r.find(ctx, query, kind)
+}
+
+// find - Поиск через FindInstrument по точному совпадению тикера или ISIN
+func (r *InstrumentResolver) find(ctx context.Context, query string, kind InstrumentIdKind) (*InstrumentInfo, error) {
+	resp, err := r.is.pbClient.FindInstrument(r.outgoing(ctx), &pb.FindInstrumentRequest{Query: query})
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*InstrumentInfo, 0)
+	for _, i := range resp.GetInstruments() {
+		if !strings.EqualFold(i.GetTicker(), query) && !(kind == ID_KIND_ISIN && strings.EqualFold(i.GetIsin(), query)) {
+			continue
+		}
+		candidates = append(candidates, &InstrumentInfo{
+			Type:              i.GetInstrumentKind(),
+			Uid:               i.GetUid(),
+			PositionUid:       i.GetPositionUid(),
+			Figi:              i.GetFigi(),
+			Ticker:            i.GetTicker(),
+			ClassCode:         i.GetClassCode(),
+			Isin:              i.GetIsin(),
+			Name:              i.GetName(),
+			ApiTradeAvailable: i.GetApiTradeAvailableFlag(),
+		})
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInstrumentNotFound, query)
+	}
+	short, err := r.choose(query, candidates)
+	if err != nil {
+		return nil, err
+	}
+	// FindInstrument не возвращает лотность и шаг цены, догружаем полную информацию
+	return r.instrumentBy(ctx, short.Uid, pb.InstrumentIdType_INSTRUMENT_ID_TYPE_UID, "")
+}
+
+// choose - Выбор инструмента из нескольких режимов торгов по ResolverConfig.ClassCodes
+func (r *InstrumentResolver) choose(query string, candidates []*InstrumentInfo) (*InstrumentInfo, error) {
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	for _, classCode := range r.conf.ClassCodes {
+		for _, c := range candidates {
+			if strings.EqualFold(c.ClassCode, classCode) {
+				return c, nil
+			}
+		}
+	}
+	available := make([]*InstrumentInfo, 0, len(candidates))
+	classCodes := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if c.ApiTradeAvailable {
+			available = append(available, c)
+		}
+		classCodes = append(classCodes, c.ClassCode+":"+c.Ticker)
+	}
+	if len(available) == 1 {
+		return available[0], nil
+	}
+	return nil, fmt.Errorf("%w: %v matches %v", ErrAmbiguousInstrument, query, strings.Join(classCodes, ", "))
+}
+
+// instrumentBy - Запрос GetInstrumentBy с контекстом ctx, NotFound превращается в ErrInstrumentNotFound
+func (r *InstrumentResolver) instrumentBy(ctx context.Context, id string, idType pb.InstrumentIdType, classCode string) (*InstrumentInfo, error) {
+	resp, err := r.is.pbClient.GetInstrumentBy(r.outgoing(ctx), &pb.InstrumentRequest{
+		IdType:    idType,
+		ClassCode: classCode,
+		Id:        id,
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("%w: %v %v", ErrInstrumentNotFound, idType, id)
+		}
+		return nil, err
+	}
+	i := resp.GetInstrument()
+	return newInstrumentInfo(i.GetInstrumentKind(), i), nil
+}
+
+// outgoing - Контекст вызова с метаданными клиента (токен, имя приложения)
+func (r *InstrumentResolver) outgoing(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(r.is.ctx)
+	return metadata.NewOutgoingContext(ctx, md)
+}
@@ -0,0 +1,90 @@
+package investgo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+type fakeOrders struct {
+	pb.OrdersServiceClient
+	instrumentIds []string
+}
+
+func (f *fakeOrders) PostOrder(_ context.Context, in *pb.PostOrderRequest, _ ...grpc.CallOption) (*pb.PostOrderResponse, error) {
+	f.instrumentIds = append(f.instrumentIds, in.GetInstrumentId())
+	return &pb.PostOrderResponse{}, nil
+}
+
+func TestInstrumentRef(t *testing.T) {
+	info := &InstrumentInfo{Uid: "e6123145-9665-43e0-8413-cd61b8aa9b13", Figi: "BBG004730N88", Ticker: "SBER"}
+	fake := &fakeOrders{}
+	orders := &OrdersServiceClient{ctx: context.Background(), pbClient: fake}
+	requests := []func() (*PostOrderResponse, error){
+		func() (*PostOrderResponse, error) {
+			return orders.PostOrder(&PostOrderRequest{InstrumentRef: info, Quantity: 1})
+		},
+		func() (*PostOrderResponse, error) {
+			return orders.Buy(&PostOrderRequestShort{InstrumentRef: info, Quantity: 1})
+		},
+		// InstrumentRef приоритетнее строкового идентификатора
+		func() (*PostOrderResponse, error) {
+			return orders.Sell(&PostOrderRequestShort{InstrumentId: "BBG004730N88", InstrumentRef: info, Quantity: 1})
+		},
+		func() (*PostOrderResponse, error) {
+			return orders.PostOrder(&PostOrderRequest{InstrumentId: info.Id(), Quantity: 1})
+		},
+		// типизированный nil и инструмент без uid не заменяют строковый идентификатор
+		func() (*PostOrderResponse, error) {
+			var none *InstrumentInfo
+			return orders.PostOrder(&PostOrderRequest{InstrumentId: info.Uid, InstrumentRef: none, Quantity: 1})
+		},
+		func() (*PostOrderResponse, error) {
+			return orders.Buy(&PostOrderRequestShort{InstrumentId: info.Uid, InstrumentRef: &InstrumentInfo{Figi: "figi"}, Quantity: 1})
+		},
+	}
+	for i, req := range requests {
+		if _, err := req(); err != nil {
+			t.Fatalf("request %v: %v", i, err)
+		}
+		if got := fake.instrumentIds[i]; got != info.Uid {
+			t.Errorf("request %v instrument id = %v, want %v", i, got, info.Uid)
+		}
+	}
+
+	ids := InstrumentIds([]*InstrumentInfo{info, {Uid: "uid"}})
+	if len(ids) != 2 || ids[0] != info.Uid || ids[1] != "uid" {
+		t.Fatalf("InstrumentIds = %v", ids)
+	}
+}
+
+func TestHistoricCandlesRef(t *testing.T) {
+	info := &InstrumentInfo{Uid: "e6123145-9665-43e0-8413-cd61b8aa9b13"}
+	fake := &fakeMarketData{}
+	md := &MarketDataServiceClient{ctx: context.Background(), pbClient: fake, logger: testLogger{t}}
+	req := &GetHistoricCandlesRequest{InstrumentRef: info, From: downloadStart, To: downloadStart.Add(3 * time.Hour)}
+	candles, err := md.GetHistoricCandles(req)
+	if err != nil {
+		t.Fatalf("GetHistoricCandles: %v", err)
+	}
+	if len(candles) == 0 || len(fake.calls) != 1 {
+		t.Fatalf("candles = %v, calls = %v", len(candles), len(fake.calls))
+	}
+	if call := fake.calls[0]; call.GetInstrumentId() != info.Uid || call.GetInterval() != pb.CandleInterval_CANDLE_INTERVAL_HOUR {
+		t.Fatalf("request = %v", call)
+	}
+	// запрос вызывающего не меняется и может быть переиспользован с другим InstrumentRef
+	if req.Instrument != "" || req.Interval != pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		t.Fatalf("request changed: %+v", req)
+	}
+	req.InstrumentRef = &InstrumentInfo{Uid: "other"}
+	if _, err := md.GetHistoricCandles(req); err != nil {
+		t.Fatalf("GetHistoricCandles: %v", err)
+	}
+	if got := fake.calls[1].GetInstrumentId(); got != "other" {
+		t.Fatalf("second request instrument id = %v", got)
+	}
+}
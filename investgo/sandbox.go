@@ -9,11 +9,12 @@ import (
 )
 
 type SandboxServiceClient struct {
-	conn     *grpc.ClientConn
-	config   Config
-	logger   Logger
-	ctx      context.Context
-	pbClient pb.SandboxServiceClient
+	conn       *grpc.ClientConn
+	config     Config
+	logger     Logger
+	ctx        context.Context
+	pbClient   pb.SandboxServiceClient
+	killSwitch *KillSwitch
 }
 
 // OpenSandboxAccount - Метод регистрации счёта в песочнице
@@ -59,6 +60,9 @@ func (s *SandboxServiceClient) CloseSandboxAccount(accountId string) (*CloseSand
 
 // PostSandboxOrder - Метод выставления торгового поручения в песочнице
 func (s *SandboxServiceClient) PostSandboxOrder(req *PostOrderRequest) (*PostOrderResponse, error) {
+	if err := s.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := s.pbClient.PostSandboxOrder(s.ctx, &pb.PostOrderRequest{
 		Quantity:     req.Quantity,
@@ -67,7 +71,7 @@ func (s *SandboxServiceClient) PostSandboxOrder(req *PostOrderRequest) (*PostOrd
 		AccountId:    req.AccountId,
 		OrderType:    req.OrderType,
 		OrderId:      req.OrderId,
-		InstrumentId: req.InstrumentId,
+		InstrumentId: refId(req.InstrumentId, req.InstrumentRef),
 	}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
 		header = trailer
@@ -80,6 +84,9 @@ func (s *SandboxServiceClient) PostSandboxOrder(req *PostOrderRequest) (*PostOrd
 
 // ReplaceSandboxOrder - Метод изменения выставленной заявки
 func (s *SandboxServiceClient) ReplaceSandboxOrder(req *ReplaceOrderRequest) (*PostOrderResponse, error) {
+	if err := s.killSwitch.Err(); err != nil {
+		return &PostOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := s.pbClient.ReplaceSandboxOrder(s.ctx, &pb.ReplaceOrderRequest{
 		AccountId:      req.AccountId,
@@ -184,7 +191,7 @@ func (s *SandboxServiceClient) GetSandboxOperationsByCursor(req *GetOperationsBy
 	var header, trailer metadata.MD
 	resp, err := s.pbClient.GetSandboxOperationsByCursor(s.ctx, &pb.GetOperationsByCursorRequest{
 		AccountId:          req.AccountId,
-		InstrumentId:       req.InstrumentId,
+		InstrumentId:       refId(req.InstrumentId, req.InstrumentRef),
 		From:               TimeToTimestamp(req.From),
 		To:                 TimeToTimestamp(req.To),
 		Cursor:             req.Cursor,
@@ -0,0 +1,568 @@
+package investgo
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// DEFAULT_SCREENER_CANDLE_DAYS - Количество дней дневных свечей для расчета оборота и волатильности
+	DEFAULT_SCREENER_CANDLE_DAYS = 30
+	// tradingDaysInYear - Количество торговых дней в году для перевода дневной волатильности в годовую
+	tradingDaysInYear = 252
+)
+
+// screenerData - Рыночные данные, которые нужны фильтру
+type screenerData int
+
+const (
+	screenerStatic    screenerData = 0
+	screenerLastPrice screenerData = 1
+	screenerCandles   screenerData = 2
+)
+
+// ScreenerItem - Инструмент, прошедший отбор, с рыночными данными
+type ScreenerItem struct {
+	Info          *InstrumentInfo
+	CountryOfRisk string
+	Sector        string
+	// LastPrice - Цена последней сделки, LotPrice - стоимость лота в валюте. Заполняются, если их использует хотя бы
+	// один фильтр. Для облигаций цена указана в процентах от номинала, для фьючерсов - в пунктах
+	LastPrice decimal.Decimal
+	LotPrice  decimal.Decimal
+	// PointValue - Стоимость единицы цены одного инструмента в валюте: 1 для акций и фондов, номинал / 100
+	// для облигаций, стоимость шага цены / шаг цены для фьючерсов. Для фьючерсов заполняется вместе с LotPrice
+	// или Turnover, 0 - стоимость шага цены неизвестна
+	PointValue decimal.Decimal
+	// Turnover - Средний дневной оборот в валюте, Volatility - годовая волатильность дневных доходностей, 0.3 = 30%.
+	// Заполняются, если их использует хотя бы один фильтр
+	Turnover   decimal.Decimal
+	Volatility float64
+}
+
+// ScreenerFilter - Условие отбора инструментов. Фильтры объединяются через FilterAnd, FilterOr и FilterNot
+type ScreenerFilter struct {
+	name  string
+	needs screenerData
+	match func(item *ScreenerItem) bool
+}
+
+func (f ScreenerFilter) String() string {
+	return f.name
+}
+
+// ScreenRequest - Запрос отбора инструментов
+type ScreenRequest struct {
+	// Types - Типы инструментов: акции, облигации, фонды, фьючерсы. По умолчанию акции
+	Types []pb.InstrumentType
+	// Status - Статус запрашиваемых инструментов, по умолчанию INSTRUMENT_STATUS_BASE
+	Status pb.InstrumentStatus
+	// Filters - Условия, которым должен соответствовать инструмент
+	Filters []ScreenerFilter
+	// CandleDays - Период для оборота и волатильности, по умолчанию DEFAULT_SCREENER_CANDLE_DAYS
+	CandleDays int
+	// Limit - Максимальное количество инструментов в результате, 0 - без ограничения
+	Limit int
+}
+
+// ScreenerRange - Диапазон значения, 0 - граница не задана
+type ScreenerRange struct {
+	Min float64 `yaml:"Min"`
+	Max float64 `yaml:"Max"`
+}
+
+// ScreenerConfig - Описание отбора инструментов в .yaml файле
+type ScreenerConfig struct {
+	// Types - Типы инструментов: share, bond, etf, futures
+	Types             []string      `yaml:"Types"`
+	Exchanges         []string      `yaml:"Exchanges"`
+	ClassCodes        []string      `yaml:"ClassCodes"`
+	Currencies        []string      `yaml:"Currencies"`
+	Countries         []string      `yaml:"Countries"`
+	Sectors           []string      `yaml:"Sectors"`
+	ApiTradeAvailable *bool         `yaml:"ApiTradeAvailable"`
+	ShortEnabled      *bool         `yaml:"ShortEnabled"`
+	ForQualInvestor   *bool         `yaml:"ForQualInvestor"`
+	LotPrice          ScreenerRange `yaml:"LotPrice"`
+	Turnover          ScreenerRange `yaml:"Turnover"`
+	Volatility        ScreenerRange `yaml:"Volatility"`
+	CandleDays        int           `yaml:"CandleDays"`
+	Limit             int           `yaml:"Limit"`
+}
+
+// Screener - Отбор инструментов по параметрам и рыночным данным
+type Screener struct {
+	is *InstrumentsServiceClient
+	md *MarketDataServiceClient
+}
+
+// NewScreener - создание отбора инструментов
+func (c *Client) NewScreener() *Screener {
+	return &Screener{
+		is: c.NewInstrumentsServiceClient(),
+		md: c.NewMarketDataServiceClient(),
+	}
+}
+
+// LoadScreenerConfig - загрузка описания отбора инструментов из .yaml файла
+func LoadScreenerConfig(filename string) (ScreenerConfig, error) {
+	var c ScreenerConfig
+	input, err := os.ReadFile(filename)
+	if err != nil {
+		return ScreenerConfig{}, err
+	}
+	if err := yaml.Unmarshal(input, &c); err != nil {
+		return ScreenerConfig{}, fmt.Errorf("%v: %w", filename, err)
+	}
+	return c, nil
+}
+
+// Request - Запрос отбора по описанию из .yaml файла
+func (c ScreenerConfig) Request() (ScreenRequest, error) {
+	req := ScreenRequest{
+		Types:      make([]pb.InstrumentType, 0, len(c.Types)),
+		Filters:    make([]ScreenerFilter, 0),
+		CandleDays: c.CandleDays,
+		Limit:      c.Limit,
+	}
+	for _, t := range c.Types {
+		switch strings.ToLower(t) {
+		case "share", "shares":
+			req.Types = append(req.Types, pb.InstrumentType_INSTRUMENT_TYPE_SHARE)
+		case "bond", "bonds":
+			req.Types = append(req.Types, pb.InstrumentType_INSTRUMENT_TYPE_BOND)
+		case "etf", "etfs":
+			req.Types = append(req.Types, pb.InstrumentType_INSTRUMENT_TYPE_ETF)
+		case "future", "futures":
+			req.Types = append(req.Types, pb.InstrumentType_INSTRUMENT_TYPE_FUTURES)
+		default:
+			return ScreenRequest{}, fmt.Errorf("unknown screener instrument type %q", t)
+		}
+	}
+	if len(c.Exchanges) > 0 {
+		req.Filters = append(req.Filters, FilterExchange(c.Exchanges...))
+	}
+	if len(c.ClassCodes) > 0 {
+		req.Filters = append(req.Filters, FilterClassCode(c.ClassCodes...))
+	}
+	if len(c.Currencies) > 0 {
+		req.Filters = append(req.Filters, FilterCurrency(c.Currencies...))
+	}
+	if len(c.Countries) > 0 {
+		req.Filters = append(req.Filters, FilterCountry(c.Countries...))
+	}
+	if len(c.Sectors) > 0 {
+		req.Filters = append(req.Filters, FilterSector(c.Sectors...))
+	}
+	if c.ApiTradeAvailable != nil {
+		req.Filters = append(req.Filters, FilterApiTradeAvailable(*c.ApiTradeAvailable))
+	}
+	if c.ShortEnabled != nil {
+		req.Filters = append(req.Filters, FilterShortEnabled(*c.ShortEnabled))
+	}
+	if c.ForQualInvestor != nil {
+		req.Filters = append(req.Filters, FilterForQualInvestor(*c.ForQualInvestor))
+	}
+	if c.LotPrice != (ScreenerRange{}) {
+		req.Filters = append(req.Filters, FilterLotPrice(c.LotPrice.Min, c.LotPrice.Max))
+	}
+	if c.Turnover != (ScreenerRange{}) {
+		req.Filters = append(req.Filters, FilterTurnover(c.Turnover.Min, c.Turnover.Max))
+	}
+	if c.Volatility != (ScreenerRange{}) {
+		req.Filters = append(req.Filters, FilterVolatility(c.Volatility.Min, c.Volatility.Max))
+	}
+	return req, nil
+}
+
+// FilterExchange - Инструменты, торгуемые на одной из бирж
+func FilterExchange(exchanges ...string) ScreenerFilter {
+	return filterIn("exchange", exchanges, func(item *ScreenerItem) string { return item.Info.Exchange })
+}
+
+// FilterClassCode - Инструменты одного из режимов торгов
+func FilterClassCode(classCodes ...string) ScreenerFilter {
+	return filterIn("class_code", classCodes, func(item *ScreenerItem) string { return item.Info.ClassCode })
+}
+
+// FilterCurrency - Инструменты в одной из валют
+func FilterCurrency(currencies ...string) ScreenerFilter {
+	return filterIn("currency", currencies, func(item *ScreenerItem) string { return item.Info.Currency })
+}
+
+// FilterCountry - Инструменты с одной из стран риска, например RU
+func FilterCountry(countries ...string) ScreenerFilter {
+	return filterIn("country", countries, func(item *ScreenerItem) string { return item.CountryOfRisk })
+}
+
+// FilterSector - Инструменты одного из секторов экономики
+func FilterSector(sectors ...string) ScreenerFilter {
+	return filterIn("sector", sectors, func(item *ScreenerItem) string { return item.Sector })
+}
+
+// FilterApiTradeAvailable - Инструменты, торговля которыми через API доступна (flag = true) или недоступна
+func FilterApiTradeAvailable(flag bool) ScreenerFilter {
+	return filterFlag("api_trade_available", flag, func(item *ScreenerItem) bool { return item.Info.ApiTradeAvailable })
+}
+
+// FilterShortEnabled - Инструменты, по которым доступны (flag = true) или недоступны короткие позиции
+func FilterShortEnabled(flag bool) ScreenerFilter {
+	return filterFlag("short_enabled", flag, func(item *ScreenerItem) bool { return item.Info.ShortEnabled })
+}
+
+// FilterForQualInvestor - Инструменты только для квалифицированных инвесторов (flag = true) или для всех
+func FilterForQualInvestor(flag bool) ScreenerFilter {
+	return filterFlag("for_qual_investor", flag, func(item *ScreenerItem) bool { return item.Info.ForQualInvestor })
+}
+
+// FilterLotPrice - Инструменты со стоимостью лота по цене последней сделки от min до max, 0 - граница не задана
+func FilterLotPrice(min, max float64) ScreenerFilter {
+	return ScreenerFilter{
+		name:  fmt.Sprintf("lot_price[%v, %v]", min, max),
+		needs: screenerLastPrice,
+		match: func(item *ScreenerItem) bool {
+			return item.LotPrice.IsPositive() && inRange(item.LotPrice.InexactFloat64(), min, max)
+		},
+	}
+}
+
+// FilterTurnover - Инструменты со средним дневным оборотом от min до max в валюте инструмента
+func FilterTurnover(min, max float64) ScreenerFilter {
+	return ScreenerFilter{
+		name:  fmt.Sprintf("turnover[%v, %v]", min, max),
+		needs: screenerCandles,
+		match: func(item *ScreenerItem) bool {
+			return inRange(item.Turnover.InexactFloat64(), min, max)
+		},
+	}
+}
+
+// FilterVolatility - Инструменты с годовой волатильностью дневных доходностей от min до max, 0.3 = 30%
+func FilterVolatility(min, max float64) ScreenerFilter {
+	return ScreenerFilter{
+		name:  fmt.Sprintf("volatility[%v, %v]", min, max),
+		needs: screenerCandles,
+		match: func(item *ScreenerItem) bool {
+			return item.Volatility > 0 && inRange(item.Volatility, min, max)
+		},
+	}
+}
+
+// FilterFunc - Произвольное условие по параметрам инструмента без рыночных данных
+func FilterFunc(name string, match func(item *ScreenerItem) bool) ScreenerFilter {
+	return ScreenerFilter{name: name, match: match}
+}
+
+// FilterAnd - Инструменты, соответствующие всем фильтрам
+func FilterAnd(filters ...ScreenerFilter) ScreenerFilter {
+	return combineFilters("and", filters, func(item *ScreenerItem) bool {
+		for _, f := range filters {
+			if !f.match(item) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// FilterOr - Инструменты, соответствующие хотя бы одному фильтру
+func FilterOr(filters ...ScreenerFilter) ScreenerFilter {
+	return combineFilters("or", filters, func(item *ScreenerItem) bool {
+		for _, f := range filters {
+			if f.match(item) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FilterNot - Инструменты, не соответствующие фильтру
+func FilterNot(filter ScreenerFilter) ScreenerFilter {
+	return ScreenerFilter{
+		name:  "not(" + filter.name + ")",
+		needs: filter.needs,
+		match: func(item *ScreenerItem) bool { return !filter.match(item) },
+	}
+}
+
+// Screen - Отбор инструментов. Сначала применяются фильтры по параметрам инструментов, затем для оставшихся
+// загружаются цены последних сделок и дневные свечи, если их используют фильтры. Результат отсортирован
+// по убыванию оборота, если он рассчитан, иначе по тикеру
+func (s *Screener) Screen(req ScreenRequest) ([]*ScreenerItem, error) {
+	if len(req.Types) == 0 {
+		req.Types = []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SHARE}
+	}
+	if req.Status == pb.InstrumentStatus_INSTRUMENT_STATUS_UNSPECIFIED {
+		req.Status = pb.InstrumentStatus_INSTRUMENT_STATUS_BASE
+	}
+	if req.CandleDays <= 0 {
+		req.CandleDays = DEFAULT_SCREENER_CANDLE_DAYS
+	}
+	items, err := s.load(req.Types, req.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	// фильтры по параметрам инструментов отсекают большую часть до запросов рыночных данных
+	var needs screenerData
+	rest := make([]ScreenerFilter, 0, len(req.Filters))
+	for _, f := range req.Filters {
+		if f.needs == screenerStatic {
+			items = applyFilter(items, f)
+			continue
+		}
+		needs |= f.needs
+		rest = append(rest, f)
+	}
+	if needs != screenerStatic && len(items) > 0 {
+		if err := s.loadPointValues(items); err != nil {
+			return nil, err
+		}
+	}
+	if needs&screenerLastPrice != 0 && len(items) > 0 {
+		if err := s.loadLastPrices(items); err != nil {
+			return nil, err
+		}
+	}
+	if needs&screenerCandles != 0 && len(items) > 0 {
+		if err := s.loadCandles(items, req.CandleDays); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range rest {
+		items = applyFilter(items, f)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].Turnover.Equal(items[j].Turnover) {
+			return items[i].Turnover.GreaterThan(items[j].Turnover)
+		}
+		return items[i].Info.Ticker < items[j].Info.Ticker
+	})
+	if req.Limit > 0 && len(items) > req.Limit {
+		items = items[:req.Limit]
+	}
+	return items, nil
+}
+
+// screenerInstrument - Общие методы акций, облигаций, фондов и фьючерсов для отбора
+type screenerInstrument interface {
+	registryInstrument
+	GetCountryOfRisk() string
+	GetSector() string
+}
+
+func (s *Screener) load(types []pb.InstrumentType, status pb.InstrumentStatus) ([]*ScreenerItem, error) {
+	items := make([]*ScreenerItem, 0)
+	add := func(t pb.InstrumentType, i screenerInstrument, pointValue decimal.Decimal) {
+		items = append(items, &ScreenerItem{
+			Info:          newInstrumentInfo(t, i),
+			CountryOfRisk: i.GetCountryOfRisk(),
+			Sector:        i.GetSector(),
+			PointValue:    pointValue,
+		})
+	}
+	one := decimal.NewFromInt(1)
+	for _, t := range types {
+		switch t {
+		case pb.InstrumentType_INSTRUMENT_TYPE_SHARE:
+			resp, err := s.is.Shares(status)
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range resp.GetInstruments() {
+				add(t, i, one)
+			}
+		case pb.InstrumentType_INSTRUMENT_TYPE_BOND:
+			resp, err := s.is.Bonds(status)
+			if err != nil {
+				return nil, err
+			}
+			// цена облигации указана в процентах от номинала
+			for _, i := range resp.GetInstruments() {
+				add(t, i, MoneyValueToDecimal(i.GetNominal()).Div(decimal.NewFromInt(100)))
+			}
+		case pb.InstrumentType_INSTRUMENT_TYPE_ETF:
+			resp, err := s.is.Etfs(status)
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range resp.GetInstruments() {
+				add(t, i, one)
+			}
+		case pb.InstrumentType_INSTRUMENT_TYPE_FUTURES:
+			resp, err := s.is.Futures(status)
+			if err != nil {
+				return nil, err
+			}
+			// стоимость шага цены фьючерса загружается в loadPointValues только для оставшихся после фильтров
+			for _, i := range resp.GetInstruments() {
+				add(t, i, decimal.Zero)
+			}
+		default:
+			return nil, fmt.Errorf("screener does not support instrument type %v", t)
+		}
+	}
+	return items, nil
+}
+
+// loadPointValues - Загрузка стоимости шага цены фьючерсов из GetFuturesMargin
+func (s *Screener) loadPointValues(items []*ScreenerItem) error {
+	for _, item := range items {
+		if item.Info.Type != pb.InstrumentType_INSTRUMENT_TYPE_FUTURES || !item.PointValue.IsZero() {
+			continue
+		}
+		resp, err := s.is.GetFuturesMargin(item.Info.Figi)
+		if err != nil {
+			return fmt.Errorf("%v futures margin: %w", item.Info.Ticker, err)
+		}
+		increment := QuotationToDecimal(resp.GetMinPriceIncrement())
+		if increment.IsZero() {
+			increment = item.Info.MinPriceIncrement
+		}
+		amount := QuotationToDecimal(resp.GetMinPriceIncrementAmount())
+		if increment.IsPositive() && amount.IsPositive() {
+			item.PointValue = amount.Div(increment)
+		}
+	}
+	return nil
+}
+
+func (s *Screener) loadLastPrices(items []*ScreenerItem) error {
+	byUid := make(map[string]*ScreenerItem, len(items))
+	for _, item := range items {
+		byUid[item.Info.Uid] = item
+	}
+	for start := 0; start < len(items); start += lastPricesBatch {
+		end := start + lastPricesBatch
+		if end > len(items) {
+			end = len(items)
+		}
+		ids := make([]string, 0, end-start)
+		for _, item := range items[start:end] {
+			ids = append(ids, item.Info.Uid)
+		}
+		resp, err := s.md.GetLastPrices(ids)
+		if err != nil {
+			return err
+		}
+		for _, lp := range resp.GetLastPrices() {
+			item, ok := byUid[lp.GetInstrumentUid()]
+			if !ok || lp.GetTime() == nil {
+				continue
+			}
+			item.LastPrice = QuotationToDecimal(lp.GetPrice())
+			item.LotPrice = item.LastPrice.Mul(item.PointValue).Mul(decimal.NewFromInt(item.Info.Lot))
+		}
+	}
+	return nil
+}
+
+// loadCandles - Расчет среднего дневного оборота и волатильности по дневным свечам. Инструменты без свечей
+// получают нулевой оборот и волатильность. Оборот переводится в валюту по PointValue
+func (s *Screener) loadCandles(items []*ScreenerItem, days int) error {
+	to := s.md.config.clock().Now()
+	from := to.AddDate(0, 0, -days)
+	for _, item := range items {
+		resp, err := s.md.GetCandles(item.Info.Uid, pb.CandleInterval_CANDLE_INTERVAL_DAY, from, to)
+		if err != nil {
+			return fmt.Errorf("%v candles: %w", item.Info.Ticker, err)
+		}
+		candles := resp.GetCandles()
+		if len(candles) == 0 {
+			continue
+		}
+		lot := decimal.NewFromInt(item.Info.Lot).Mul(item.PointValue)
+		turnover := decimal.Zero
+		returns := make([]float64, 0, len(candles))
+		for i, c := range candles {
+			closePrice := QuotationToDecimal(c.GetClose())
+			turnover = turnover.Add(closePrice.Mul(decimal.NewFromInt(c.GetVolume())).Mul(lot))
+			if i > 0 {
+				prev := candles[i-1].GetClose().ToFloat()
+				if prev > 0 && closePrice.IsPositive() {
+					returns = append(returns, math.Log(closePrice.InexactFloat64()/prev))
+				}
+			}
+		}
+		item.Turnover = turnover.Div(decimal.NewFromInt(int64(len(candles))))
+		item.Volatility = annualVolatility(returns)
+	}
+	return nil
+}
+
+func applyFilter(items []*ScreenerItem, f ScreenerFilter) []*ScreenerItem {
+	res := items[:0]
+	for _, item := range items {
+		if f.match(item) {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func filterIn(name string, values []string, field func(item *ScreenerItem) string) ScreenerFilter {
+	return ScreenerFilter{
+		name: fmt.Sprintf("%v in %v", name, values),
+		match: func(item *ScreenerItem) bool {
+			v := field(item)
+			for _, value := range values {
+				if strings.EqualFold(v, value) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+func filterFlag(name string, flag bool, field func(item *ScreenerItem) bool) ScreenerFilter {
+	return ScreenerFilter{
+		name:  fmt.Sprintf("%v = %v", name, flag),
+		match: func(item *ScreenerItem) bool { return field(item) == flag },
+	}
+}
+
+func combineFilters(op string, filters []ScreenerFilter, match func(item *ScreenerItem) bool) ScreenerFilter {
+	names := make([]string, 0, len(filters))
+	var needs screenerData
+	for _, f := range filters {
+		names = append(names, f.name)
+		needs |= f.needs
+	}
+	return ScreenerFilter{
+		name:  op + "(" + strings.Join(names, ", ") + ")",
+		needs: needs,
+		match: match,
+	}
+}
+
+func inRange(v, min, max float64) bool {
+	return (min == 0 || v >= min) && (max == 0 || v <= max)
+}
+
+// annualVolatility - Годовая волатильность по дневным логарифмическим доходностям
+func annualVolatility(returns []float64) float64 {
+	if len(returns) < 2 {
+		return 0
+	}
+	var mean float64
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	var variance float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	variance /= float64(len(returns) - 1)
+	return math.Sqrt(variance * tradingDaysInYear)
+}
@@ -0,0 +1,292 @@
+package investgo
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+var screenerNow = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+// fakeScreenerInstruments - Акция, облигация и два фьючерса, стоимость шага цены фьючерсов по figi
+type fakeScreenerInstruments struct {
+	pb.InstrumentsServiceClient
+	margins []string
+}
+
+func (f *fakeScreenerInstruments) Shares(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.SharesResponse, error) {
+	return &pb.SharesResponse{Instruments: []*pb.Share{
+		{Uid: "uid-sber", Figi: "BBG004730N88", Ticker: "SBER", ClassCode: "TQBR", Exchange: "MOEX", Currency: "rub", Lot: 10,
+			CountryOfRisk: "RU", Sector: "financial", ApiTradeAvailableFlag: true, ShortEnabledFlag: true},
+	}}, nil
+}
+
+func (f *fakeScreenerInstruments) Bonds(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.BondsResponse, error) {
+	return &pb.BondsResponse{Instruments: []*pb.Bond{
+		{Uid: "uid-ofz", Figi: "SU26238RMFS4", Ticker: "SU26238RMFS4", ClassCode: "TQOB", Exchange: "MOEX", Currency: "rub", Lot: 1,
+			CountryOfRisk: "RU", Sector: "government", ApiTradeAvailableFlag: true, Nominal: &pb.MoneyValue{Currency: "rub", Units: 1000}},
+	}}, nil
+}
+
+func (f *fakeScreenerInstruments) Futures(context.Context, *pb.InstrumentsRequest, ...grpc.CallOption) (*pb.FuturesResponse, error) {
+	return &pb.FuturesResponse{Instruments: []*pb.Future{
+		{Uid: "uid-si", Figi: "FUTSI0324000", Ticker: "SiH4", ClassCode: "SPBFUT", Exchange: "FORTS", Currency: "rub", Lot: 1,
+			MinPriceIncrement: &pb.Quotation{Units: 1}, ApiTradeAvailableFlag: true},
+		{Uid: "uid-rts", Figi: "FUTRTS032400", Ticker: "RIH4", ClassCode: "SPBFUT", Exchange: "FORTS", Currency: "usd", Lot: 1,
+			MinPriceIncrement: &pb.Quotation{Units: 10}, ApiTradeAvailableFlag: true},
+	}}, nil
+}
+
+// GetFuturesMargin - Шаг цены Si 1 пункт стоимостью 1 рубль, RTS - 10 пунктов стоимостью 14.1234 рубля,
+// шаг цены RTS берется из фьючерса
+func (f *fakeScreenerInstruments) GetFuturesMargin(_ context.Context, in *pb.GetFuturesMarginRequest, _ ...grpc.CallOption) (*pb.GetFuturesMarginResponse, error) {
+	f.margins = append(f.margins, in.GetFigi())
+	if in.GetFigi() == "FUTSI0324000" {
+		return &pb.GetFuturesMarginResponse{MinPriceIncrement: &pb.Quotation{Units: 1}, MinPriceIncrementAmount: &pb.Quotation{Units: 1}}, nil
+	}
+	return &pb.GetFuturesMarginResponse{MinPriceIncrementAmount: DecimalToQuotation(decimal.RequireFromString("14.1234"))}, nil
+}
+
+// fakeScreenerMarketData - Цены последних сделок и дневные свечи с закрытиями closes и объемом 10 лотов
+type fakeScreenerMarketData struct {
+	pb.MarketDataServiceClient
+	prices map[string]float64
+	closes map[string][]float64
+}
+
+func (f *fakeScreenerMarketData) GetLastPrices(_ context.Context, in *pb.GetLastPricesRequest, _ ...grpc.CallOption) (*pb.GetLastPricesResponse, error) {
+	resp := &pb.GetLastPricesResponse{}
+	for _, id := range in.GetInstrumentId() {
+		if price, ok := f.prices[id]; ok {
+			resp.LastPrices = append(resp.LastPrices, &pb.LastPrice{
+				InstrumentUid: id,
+				Price:         DecimalToQuotation(decimal.NewFromFloat(price)),
+				Time:          TimeToTimestamp(screenerNow),
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeScreenerMarketData) GetCandles(_ context.Context, in *pb.GetCandlesRequest, _ ...grpc.CallOption) (*pb.GetCandlesResponse, error) {
+	resp := &pb.GetCandlesResponse{}
+	for i, c := range f.closes[in.GetInstrumentId()] {
+		resp.Candles = append(resp.Candles, &pb.HistoricCandle{
+			Time:   TimeToTimestamp(in.GetFrom().AsTime().Add(time.Duration(i) * DAY)),
+			Close:  DecimalToQuotation(decimal.NewFromFloat(c)),
+			Volume: 10,
+		})
+	}
+	return resp, nil
+}
+
+func newTestScreener(instruments *fakeScreenerInstruments, md *fakeScreenerMarketData) *Screener {
+	return &Screener{
+		is: &InstrumentsServiceClient{ctx: context.Background(), pbClient: instruments},
+		md: &MarketDataServiceClient{ctx: context.Background(), pbClient: md, config: Config{Clock: NewSimulatedClock(screenerNow)}},
+	}
+}
+
+func screenerTickers(items []*ScreenerItem) []string {
+	res := make([]string, 0, len(items))
+	for _, item := range items {
+		res = append(res, item.Info.Ticker)
+	}
+	return res
+}
+
+func TestScreen(t *testing.T) {
+	instruments := &fakeScreenerInstruments{}
+	md := &fakeScreenerMarketData{
+		prices: map[string]float64{"uid-sber": 300, "uid-ofz": 98.5, "uid-si": 90000, "uid-rts": 110000},
+		closes: map[string][]float64{"uid-sber": {290, 300}, "uid-ofz": {98, 99}, "uid-si": {89000, 91000}, "uid-rts": {100000, 120000}},
+	}
+	s := newTestScreener(instruments, md)
+	allTypes := []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SHARE, pb.InstrumentType_INSTRUMENT_TYPE_BOND,
+		pb.InstrumentType_INSTRUMENT_TYPE_FUTURES}
+
+	// без рыночных фильтров стоимость шага цены фьючерсов не загружается
+	items, err := s.Screen(ScreenRequest{Types: allTypes, Filters: []ScreenerFilter{FilterCountry("ru")}})
+	if err != nil {
+		t.Fatalf("Screen: %v", err)
+	}
+	if got := screenerTickers(items); !reflect.DeepEqual(got, []string{"SBER", "SU26238RMFS4"}) || len(instruments.margins) != 0 {
+		t.Fatalf("items = %v, margins = %v", got, instruments.margins)
+	}
+
+	items, err = s.Screen(ScreenRequest{Types: allTypes, Filters: []ScreenerFilter{FilterLotPrice(900, 0), FilterTurnover(0, 0)}})
+	if err != nil {
+		t.Fatalf("Screen: %v", err)
+	}
+	// стоимость лота и оборот в валюте: облигация по номиналу, фьючерсы по стоимости шага цены
+	want := []struct {
+		ticker, lotPrice, turnover string
+	}{
+		{"RIH4", "155357.4", "1553574"},
+		{"SiH4", "90000", "900000"},
+		{"SBER", "3000", "29500"},
+		{"SU26238RMFS4", "985", "9850"},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("items = %v", screenerTickers(items))
+	}
+	for i, w := range want {
+		item := items[i]
+		if item.Info.Ticker != w.ticker || !item.LotPrice.Equal(decimal.RequireFromString(w.lotPrice)) ||
+			!item.Turnover.Equal(decimal.RequireFromString(w.turnover)) {
+			t.Errorf("item %v = %v lot price %v turnover %v, want %+v", i, item.Info.Ticker, item.LotPrice, item.Turnover, w)
+		}
+	}
+	if len(instruments.margins) != 2 {
+		t.Fatalf("margins = %v", instruments.margins)
+	}
+
+	items, err = s.Screen(ScreenRequest{Types: allTypes, Filters: []ScreenerFilter{FilterLotPrice(1000, 100000)}, Limit: 1})
+	if err != nil || !reflect.DeepEqual(screenerTickers(items), []string{"SBER"}) {
+		t.Fatalf("items = %v, %v", screenerTickers(items), err)
+	}
+}
+
+func TestScreenerFilters(t *testing.T) {
+	item := &ScreenerItem{
+		Info: &InstrumentInfo{Ticker: "SBER", ClassCode: "TQBR", Exchange: "MOEX", Currency: "rub",
+			ApiTradeAvailable: true, ShortEnabled: true},
+		CountryOfRisk: "RU",
+		Sector:        "financial",
+		LastPrice:     decimal.NewFromInt(300),
+		LotPrice:      decimal.NewFromInt(3000),
+		Turnover:      decimal.NewFromInt(1000000),
+		Volatility:    0.25,
+	}
+	tests := []struct {
+		filter ScreenerFilter
+		match  bool
+	}{
+		{FilterExchange("moex", "spb"), true},
+		{FilterExchange("spb"), false},
+		{FilterClassCode("TQBR"), true},
+		{FilterCurrency("usd"), false},
+		{FilterCountry("ru"), true},
+		{FilterSector("it", "FINANCIAL"), true},
+		{FilterApiTradeAvailable(true), true},
+		{FilterShortEnabled(false), false},
+		{FilterForQualInvestor(false), true},
+		{FilterLotPrice(1000, 3000), true},
+		{FilterLotPrice(3001, 0), false},
+		{FilterTurnover(0, 999999), false},
+		{FilterTurnover(1000000, 0), true},
+		{FilterVolatility(0.2, 0.3), true},
+		{FilterVolatility(0, 0.2), false},
+		{FilterFunc("ticker", func(item *ScreenerItem) bool { return strings.HasPrefix(item.Info.Ticker, "SB") }), true},
+		{FilterAnd(FilterCountry("ru"), FilterTurnover(1, 0)), true},
+		{FilterAnd(FilterCountry("ru"), FilterCurrency("usd")), false},
+		{FilterAnd(), true},
+		{FilterOr(FilterCurrency("usd"), FilterSector("financial")), true},
+		{FilterOr(FilterCurrency("usd"), FilterSector("it")), false},
+		{FilterOr(), false},
+		{FilterNot(FilterCurrency("usd")), true},
+		{FilterNot(FilterOr(FilterCurrency("usd"), FilterVolatility(0.2, 0))), false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(item); got != tt.match {
+			t.Errorf("%v = %v, want %v", tt.filter, got, tt.match)
+		}
+	}
+
+	// без рыночных данных фильтры по ним не пропускают инструмент
+	empty := &ScreenerItem{Info: &InstrumentInfo{}}
+	for _, f := range []ScreenerFilter{FilterLotPrice(0, 1000), FilterVolatility(0, 1)} {
+		if f.match(empty) {
+			t.Errorf("%v matches item without market data", f)
+		}
+	}
+
+	// составной фильтр требует данные всех вложенных
+	combined := FilterOr(FilterCountry("ru"), FilterNot(FilterAnd(FilterLotPrice(1, 0), FilterVolatility(0, 1))))
+	if combined.needs != screenerLastPrice|screenerCandles {
+		t.Fatalf("needs = %v", combined.needs)
+	}
+	if combined.String() != "or(country in [ru], not(and(lot_price[1, 0], volatility[0, 1])))" {
+		t.Fatalf("name = %v", combined)
+	}
+}
+
+func TestScreenerConfigRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screener.yaml")
+	config := `Types: [shares, Bond, futures]
+Exchanges: [MOEX]
+Countries: [RU]
+ApiTradeAvailable: true
+ShortEnabled: false
+LotPrice:
+  Max: 5000
+Volatility:
+  Min: 0.1
+  Max: 0.5
+CandleDays: 60
+Limit: 20
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	c, err := LoadScreenerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadScreenerConfig: %v", err)
+	}
+	req, err := c.Request()
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	wantTypes := []pb.InstrumentType{pb.InstrumentType_INSTRUMENT_TYPE_SHARE, pb.InstrumentType_INSTRUMENT_TYPE_BOND,
+		pb.InstrumentType_INSTRUMENT_TYPE_FUTURES}
+	if !reflect.DeepEqual(req.Types, wantTypes) || req.CandleDays != 60 || req.Limit != 20 {
+		t.Fatalf("request = %+v", req)
+	}
+	names := make([]string, 0, len(req.Filters))
+	for _, f := range req.Filters {
+		names = append(names, f.String())
+	}
+	wantNames := []string{"exchange in [MOEX]", "country in [RU]", "api_trade_available = true", "short_enabled = false",
+		"lot_price[0, 5000]", "volatility[0.1, 0.5]"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("filters = %v, want %v", names, wantNames)
+	}
+
+	if _, err := (ScreenerConfig{Types: []string{"option"}}).Request(); err == nil {
+		t.Fatal("unknown type must fail")
+	}
+	if err := os.WriteFile(path, []byte("Types: ["), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadScreenerConfig(path); err == nil {
+		t.Fatal("invalid yaml must fail")
+	}
+}
+
+func TestAnnualVolatility(t *testing.T) {
+	tests := []struct {
+		returns []float64
+		want    float64
+	}{
+		{nil, 0},
+		{[]float64{0.01}, 0},
+		{[]float64{0.01, 0.01, 0.01}, 0},
+		// среднее 0, выборочная дисперсия 0.0002
+		{[]float64{0.01, -0.01}, math.Sqrt(0.0002 * 252)},
+		{[]float64{0.02, 0, 0.01, -0.01}, math.Sqrt(0.0005 / 3 * 252)},
+	}
+	for _, tt := range tests {
+		if got := annualVolatility(tt.returns); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("annualVolatility(%v) = %v, want %v", tt.returns, got, tt.want)
+		}
+	}
+}
@@ -9,15 +9,19 @@ import (
 )
 
 type StopOrdersServiceClient struct {
-	conn     *grpc.ClientConn
-	config   Config
-	logger   Logger
-	ctx      context.Context
-	pbClient pb.StopOrdersServiceClient
+	conn       *grpc.ClientConn
+	config     Config
+	logger     Logger
+	ctx        context.Context
+	pbClient   pb.StopOrdersServiceClient
+	killSwitch *KillSwitch
 }
 
 // PostStopOrder - Метод выставления стоп-заявки
 func (s *StopOrdersServiceClient) PostStopOrder(req *PostStopOrderRequest) (*PostStopOrderResponse, error) {
+	if err := s.killSwitch.Err(); err != nil {
+		return &PostStopOrderResponse{}, err
+	}
 	var header, trailer metadata.MD
 	resp, err := s.pbClient.PostStopOrder(s.ctx, &pb.PostStopOrderRequest{
 		Quantity:       req.Quantity,
@@ -28,7 +32,7 @@ func (s *StopOrdersServiceClient) PostStopOrder(req *PostStopOrderRequest) (*Pos
 		ExpirationType: req.ExpirationType,
 		StopOrderType:  req.StopOrderType,
 		ExpireDate:     TimeToTimestamp(req.ExpireDate),
-		InstrumentId:   req.InstrumentId,
+		InstrumentId:   refId(req.InstrumentId, req.InstrumentRef),
 	}, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
 		header = trailer
@@ -2,11 +2,13 @@ package investgo
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	pb "github.com/tinkoff/invest-api-go-sdk/proto"
 )
 
 // Event - события, START - сигнал к запуску, STOP - сигнал к остановке
@@ -18,146 +20,388 @@ const (
 	STOP
 )
 
+const (
+	// DEFAULT_TIMER_BUFFER - Размер канала событий таймера по умолчанию
+	DEFAULT_TIMER_BUFFER = 16
+	// timerReplanInterval - Максимальное время ожидания до повторного чтения расписания
+	timerReplanInterval = time.Hour
+	// timerHorizon - Период, на который вперед планируются события
+	timerHorizon = 2 * DAY
+)
+
+// DEFAULT_TIMER_PHASES - Этапы торгов по умолчанию: основная сессия с клирингом и аукционом закрытия как одно окно
+// торгов, START в начале основной сессии после аукциона открытия, STOP в конце торгового дня, как у NewTimer
+// прежних версий. Основная сессия в выходные дни - PHASE_WEEKEND_SESSION
+var DEFAULT_TIMER_PHASES = []TradingPhase{
+	PHASE_MAIN_SESSION,
+	PHASE_CLEARING,
+	PHASE_CLOSING_AUCTION,
+	PHASE_WEEKEND_SESSION,
+}
+
+func (e Event) String() string {
+	switch e {
+	case START:
+		return "START"
+	case STOP:
+		return "STOP"
+	}
+	return fmt.Sprintf("Event(%d)", int(e))
+}
+
+// TimerEvent - Событие таймера
+type TimerEvent struct {
+	Event    Event
+	Exchange string
+	// Phase - Этап торгов, с которого начинается (START) или которым заканчивается (STOP) окно торгов
+	Phase TradingPhase
+	// Scheduled - Время начала или окончания окна торгов по расписанию
+	Scheduled time.Time
+	// Time - Время события с учетом смещения TimerOffsets
+	Time time.Time
+}
+
+func (e TimerEvent) String() string {
+	return fmt.Sprintf("%v %v %v at %v", e.Event, e.Exchange, e.Phase, e.Scheduled.Format(time.RFC3339))
+}
+
+// TimerOffsets - Смещения событий относительно расписания
+type TimerOffsets struct {
+	// Start - Задержка события START после начала окна торгов, отрицательное значение - событие раньше начала
+	Start time.Duration
+	// Stop - Опережение события STOP до конца окна торгов, отрицательное значение - событие после конца
+	Stop time.Duration
+}
+
+// TimerConfig - Параметры таймера
+type TimerConfig struct {
+	// Exchanges - Биржи, расписание которых отслеживает таймер
+	Exchanges []string
+	// Calendars - Готовые календари торгов, используются вместо Exchanges, например календари без подключения к API
+	Calendars []*TradingCalendar
+	// Phases - Этапы торгов, о которых сообщает таймер. Идущие подряд этапы из Phases объединяются в одно окно
+	// торгов с событиями START в начале и STOP в конце. По умолчанию DEFAULT_TIMER_PHASES, для аукциона открытия
+	// нужно добавить PHASE_OPENING_AUCTION, для вечерней сессии - PHASE_EVENING_AUCTION и PHASE_EVENING_SESSION
+	Phases []TradingPhase
+	// Offsets - Смещения событий по этапу, с которого начинается или которым заканчивается окно торгов
+	Offsets map[TradingPhase]TimerOffsets
+	// DefaultOffsets - Смещения для этапов, которых нет в Offsets
+	DefaultOffsets TimerOffsets
+	// CalendarCacheDir - Директория для кэша расписания бирж, файл <exchange>.json. Если не указана, кэш не сохраняется
+	CalendarCacheDir string
+	// BufferSize - Размер каналов событий, по умолчанию DEFAULT_TIMER_BUFFER. Таймер не ждет чтения событий:
+	// если канал заполнен, самое старое событие в нем вытесняется новым с записью в лог
+	BufferSize int
+}
+
+// Timer - Таймер сигнализирует о начале и окончании торгов на одной или нескольких биржах
 type Timer struct {
-	client             *Client
-	instrumentsService *InstrumentsServiceClient
-	exchange           string
-	// cancelAhead - Событие STOP будет отправлено в канал за cancelAhead до конца торгов
-	cancelAhead time.Duration
-	cancel      context.CancelFunc
+	logger    Logger
+	clock     Clock
+	conf      TimerConfig
+	calendars []*TradingCalendar
+	phases    map[TradingPhase]bool
+
 	events      chan Event
+	timerEvents chan TimerEvent
+	// eventsUsed, timerEventsUsed - Каналы, полученные через Events и TimerEvents. Переполнение канала, который
+	// никто не читает, не записывается в лог
+	eventsUsed      atomic.Bool
+	timerEventsUsed atomic.Bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	// active - Начатые окна торгов по биржам, для них при остановке таймера отправляется STOP
+	active map[string]TimerEvent
 }
 
-// NewTimer - Таймер сигнализирует о начале/завершении основной торговой сессии на конкретной бирже
+// NewTimer - Таймер сигнализирует о начале/завершении основной торговой сессии на конкретной бирже,
+// событие STOP отправляется за cancelAhead до конца торгов
 func NewTimer(c *Client, exchange string, cancelAhead time.Duration) *Timer {
+	t, err := c.NewTimerWithConfig(TimerConfig{
+		Exchanges:      []string{exchange},
+		DefaultOffsets: TimerOffsets{Stop: cancelAhead},
+	})
+	if err != nil {
+		c.Logger.Errorf("timer creating error %v", err.Error())
+		return newTimer(c.Logger, c.Config.clock(), TimerConfig{}, nil)
+	}
+	return t
+}
+
+// NewTimerWithConfig - создание таймера для нескольких бирж и этапов торгов
+func (c *Client) NewTimerWithConfig(conf TimerConfig) (*Timer, error) {
+	calendars := make([]*TradingCalendar, 0, len(conf.Exchanges)+len(conf.Calendars))
+	calendars = append(calendars, conf.Calendars...)
+	if len(conf.Calendars) == 0 {
+		for _, exchange := range conf.Exchanges {
+			calendarConf := TradingCalendarConfig{Exchange: exchange}
+			if conf.CalendarCacheDir != "" {
+				calendarConf.CacheFile = filepath.Join(conf.CalendarCacheDir, strings.ToLower(exchange)+".json")
+			}
+			cal, err := c.NewTradingCalendar(calendarConf)
+			if err != nil {
+				return nil, err
+			}
+			calendars = append(calendars, cal)
+		}
+	}
+	if len(calendars) == 0 {
+		return nil, fmt.Errorf("timer requires at least one exchange")
+	}
+	return newTimer(c.Logger, c.Config.clock(), conf, calendars), nil
+}
+
+func newTimer(logger Logger, clock Clock, conf TimerConfig, calendars []*TradingCalendar) *Timer {
+	if len(conf.Phases) == 0 {
+		conf.Phases = DEFAULT_TIMER_PHASES
+	}
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = DEFAULT_TIMER_BUFFER
+	}
+	phases := make(map[TradingPhase]bool, len(conf.Phases))
+	for _, p := range conf.Phases {
+		phases[p] = true
+	}
 	return &Timer{
-		client:             c,
-		instrumentsService: c.NewInstrumentsServiceClient(),
-		exchange:           exchange,
-		cancelAhead:        cancelAhead,
-		events:             make(chan Event, 1),
+		logger:      logger,
+		clock:       clock,
+		conf:        conf,
+		calendars:   calendars,
+		phases:      phases,
+		events:      make(chan Event, conf.BufferSize),
+		timerEvents: make(chan TimerEvent, conf.BufferSize),
+		stop:        make(chan struct{}),
+		active:      make(map[string]TimerEvent),
 	}
 }
 
-// Events - Канал событий об открытии/закрытии торгов
+// Events - Канал событий START/STOP об открытии/закрытии торгов. Канал закрывается после завершения Start.
+// Биржа, этап торгов и время события по расписанию передаются в TimerEvents
 func (t *Timer) Events() chan Event {
+	t.eventsUsed.Store(true)
 	return t.events
 }
 
-// Start - Запуск таймера
+// TimerEvents - Канал событий таймера с биржей, этапом торгов и временем по расписанию. Канал закрывается
+// после завершения Start
+func (t *Timer) TimerEvents() <-chan TimerEvent {
+	t.timerEventsUsed.Store(true)
+	return t.timerEvents
+}
+
+// Start - Запуск таймера, блокирует до отмены ctx или вызова Stop. Если окно торгов уже идет, то событие START
+// отправляется сразу. При остановке для начатых окон торгов отправляется STOP
 func (t *Timer) Start(ctx context.Context) error {
-	defer t.shutdown()
-	ctxTimer, cancel := context.WithCancel(ctx)
-	t.cancel = cancel
-	for {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
 		select {
-		case <-ctxTimer.Done():
-			return nil
-		default:
-			// получаем текущее время
-			from := time.Now()
-			to := from.Add(DAY)
-
-			// получаем ближайшие два торговых дня
-			resp, err := t.instrumentsService.TradingSchedules(t.exchange, from, to)
-			if err != nil {
-				return err
-			}
+		case <-t.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	defer t.shutdown()
 
-			exchanges := resp.GetExchanges()
-			days := make([]*pb.TradingDay, 0)
-			for _, ex := range exchanges {
-				if strings.EqualFold(ex.GetExchange(), t.exchange) {
-					days = ex.GetDays()
-				}
+	if len(t.calendars) == 0 {
+		return fmt.Errorf("timer has no exchanges")
+	}
+	now := t.clock.Now()
+	// окна торгов, которые уже идут
+	for _, cal := range t.calendars {
+		windows, err := t.windows(cal, now, now)
+		if err != nil {
+			return err
+		}
+		for _, w := range windows {
+			start, stop := t.windowEvents(cal.Exchange(), w)
+			if !start.Time.After(now) && stop.Time.After(now) {
+				start.Time = now
+				t.send(start)
 			}
+		}
+	}
 
-			var today *pb.TradingDay
-			if len(days) > 1 {
-				today = days[0]
-			}
+	last := now
+	for {
+		next := last.Add(timerReplanInterval)
+		events, err := t.plan(last, last.Add(timerHorizon))
+		if err != nil {
+			return err
+		}
+		if len(events) > 0 && events[0].Time.Before(next) {
+			next = events[0].Time
+		}
+		wait := t.clock.NewTimer(t.clock.Until(next))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return nil
+		case <-wait.C():
+		}
+		now := t.clock.Now()
+		events, err = t.plan(last, now)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			t.send(ev)
+		}
+		last = now
+	}
+}
 
-			// если этот день оказался неторговым, то находим ближайший торговый и ждем до старта торгов в этот день
-			if !today.GetIsTradingDay() {
-				today, err = t.findTradingDay(from)
-				if err != nil {
-					return err
-				}
-			}
+// Stop - Завершение работы таймера, можно вызывать несколько раз
+func (t *Timer) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
 
-			switch {
-			// если торги еще не начались
-			case time.Now().Before(today.GetStartTime().AsTime()):
-				t.client.Logger.Infof("%v is closed yet, wait for start %v", t.exchange, time.Until(today.GetStartTime().AsTime().Local()))
-				if stop := t.wait(ctxTimer, time.Until(today.GetStartTime().AsTime().Local())); stop {
-					return nil
-				}
-				t.events <- START
-				t.client.Logger.Infof("start trading session, remaining time = %v", time.Until(today.GetEndTime().AsTime().Local()))
-				if stop := t.wait(ctxTimer, time.Until(today.GetEndTime().AsTime().Local())-t.cancelAhead); stop {
-					return nil
-				}
-				t.events <- STOP
-				// если сегодня торги уже идут
-			case time.Now().After(today.GetStartTime().AsTime()) && time.Now().Before(today.GetEndTime().AsTime().Local().Add(-t.cancelAhead)):
-				t.client.Logger.Infof("start trading session, remaining time = %v", time.Until(today.GetEndTime().AsTime().Local()))
-				t.events <- START
-				if stop := t.wait(ctxTimer, time.Until(today.GetEndTime().AsTime().Local())-t.cancelAhead); stop {
-					return nil
-				}
-				t.events <- STOP
-				// если на сегодня торги уже окончены
-			case time.Now().After(today.GetEndTime().AsTime().Local().Add(-t.cancelAhead)):
-				// спать час, пока не дождемся следующего дня
-				t.client.Logger.Infof("%v is already closed, wait next day for 1 hour", t.exchange)
-				if stop := t.wait(ctxTimer, time.Hour); stop {
-					return nil
-				}
-			}
+// send - Отправка события в каналы Events и TimerEvents без блокировки
+func (t *Timer) send(ev TimerEvent) {
+	switch ev.Event {
+	case START:
+		if _, ok := t.active[ev.Exchange]; ok {
+			return
+		}
+		t.active[ev.Exchange] = ev
+	case STOP:
+		if _, ok := t.active[ev.Exchange]; !ok {
+			return
 		}
+		delete(t.active, ev.Exchange)
 	}
+	t.logger.Infof("timer event %v", ev)
+	t.publish(ev)
 }
 
-// Stop - Завершение работы таймера
-func (t *Timer) Stop() {
-	t.events <- STOP
-	t.cancel()
+// publish - Запись события в оба канала. Если канал заполнен, самое старое событие вытесняется, так как
+// для получателя важнее последнее состояние торгов, чем пропущенные переходы
+func (t *Timer) publish(ev TimerEvent) {
+	if !offer(t.timerEvents, ev) && t.timerEventsUsed.Load() {
+		t.logger.Errorf("timer events channel is full, the oldest event is dropped before %v", ev)
+	}
+	if !offer(t.events, ev.Event) && t.eventsUsed.Load() {
+		t.logger.Errorf("timer START/STOP channel is full, the oldest event is dropped before %v", ev)
+	}
 }
 
+// shutdown - STOP для начатых окон торгов и закрытие каналов событий
 func (t *Timer) shutdown() {
-	t.client.Logger.Infof("stop %v timer", t.exchange)
+	now := t.clock.Now()
+	exchanges := make([]string, 0, len(t.active))
+	for exchange := range t.active {
+		exchanges = append(exchanges, exchange)
+	}
+	sort.Strings(exchanges)
+	for _, exchange := range exchanges {
+		t.send(TimerEvent{Event: STOP, Exchange: exchange, Phase: t.active[exchange].Phase, Scheduled: now, Time: now})
+	}
+	for _, cal := range t.calendars {
+		t.logger.Infof("stop %v timer", cal.Exchange())
+	}
+	close(t.timerEvents)
 	close(t.events)
 }
 
-// wait - Ожидание, с возможностью отмены по контексту
-func (t *Timer) wait(ctx context.Context, dur time.Duration) bool {
-	tim := time.NewTimer(dur)
-	for {
-		select {
-		case <-ctx.Done():
-			return true
-		case <-tim.C:
-			return false
+// offer - Запись в канал без блокировки, при заполненном канале самое старое значение вытесняется.
+// Возвращает false, если значение пришлось вытеснить
+func offer[T any](ch chan T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	default:
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- v:
+	default:
+	}
+	return false
+}
+
+// plan - События всех бирж со временем в (from, to] по возрастанию времени
+func (t *Timer) plan(from, to time.Time) ([]TimerEvent, error) {
+	events := make([]TimerEvent, 0)
+	for _, cal := range t.calendars {
+		windows, err := t.windows(cal, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range windows {
+			start, stop := t.windowEvents(cal.Exchange(), w)
+			if !stop.Time.After(start.Time) {
+				continue
+			}
+			for _, ev := range []TimerEvent{start, stop} {
+				if ev.Time.After(from) && !ev.Time.After(to) {
+					events = append(events, ev)
+				}
+			}
 		}
 	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
 }
 
-// findTradingDay - Поиск ближайшего торгового дня
-func (t *Timer) findTradingDay(start time.Time) (*pb.TradingDay, error) {
-	resp, err := t.instrumentsService.TradingSchedules(t.exchange, start, start.Add(DAY*7))
+// windows - Окна торгов из идущих подряд этапов Phases, которые могут дать события в [from, to]
+func (t *Timer) windows(cal *TradingCalendar, from, to time.Time) ([][]PhaseInterval, error) {
+	intervals, err := cal.Phases(from.Add(-DAY), to.Add(DAY))
 	if err != nil {
 		return nil, err
 	}
-	for _, ex := range resp.GetExchanges() {
-		if strings.EqualFold(ex.GetExchange(), t.exchange) {
-			for _, day := range ex.GetDays() {
-				if day.GetIsTradingDay() {
-					return day, nil
-				}
+	windows := make([][]PhaseInterval, 0)
+	var current []PhaseInterval
+	for _, p := range intervals {
+		if !t.phases[p.Phase] {
+			if len(current) > 0 {
+				windows = append(windows, current)
+				current = nil
 			}
-			// если не нашлось дня, запросим еще на неделю расписание
-			return t.findTradingDay(start.Add(DAY * 7))
+			continue
 		}
+		if n := len(current); n > 0 && p.Start.After(current[n-1].End) {
+			windows = append(windows, current)
+			current = nil
+		}
+		current = append(current, p)
+	}
+	if len(current) > 0 {
+		windows = append(windows, current)
+	}
+	return windows, nil
+}
+
+// windowEvents - События START и STOP окна торгов со смещениями
+func (t *Timer) windowEvents(exchange string, w []PhaseInterval) (TimerEvent, TimerEvent) {
+	first, last := w[0], w[len(w)-1]
+	start := TimerEvent{
+		Event:     START,
+		Exchange:  exchange,
+		Phase:     first.Phase,
+		Scheduled: first.Start,
+		Time:      first.Start.Add(t.offsets(first.Phase).Start),
+	}
+	stop := TimerEvent{
+		Event:     STOP,
+		Exchange:  exchange,
+		Phase:     last.Phase,
+		Scheduled: last.End,
+		Time:      last.End.Add(-t.offsets(last.Phase).Stop),
+	}
+	return start, stop
+}
+
+func (t *Timer) offsets(phase TradingPhase) TimerOffsets {
+	if o, ok := t.conf.Offsets[phase]; ok {
+		return o
 	}
-	return nil, errors.New("trading day not found")
+	return t.conf.DefaultOffsets
 }
@@ -0,0 +1,209 @@
+package investgo
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// timerMonday - Понедельник, расписание testSchedule: аукцион открытия 06:50-07:00 UTC, основная сессия
+// до 15:50 с клирингом 11:00-11:05 и аукционом закрытия 15:40-15:50, вечерняя сессия 16:05-20:50
+var timerMonday = time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+func testSchedule() []*pb.TradingDay {
+	at := func(day time.Time, h, m int) *timestamppb.Timestamp {
+		return TimeToTimestamp(day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute))
+	}
+	days := make([]*pb.TradingDay, 0)
+	for d := timerMonday.Add(-3 * DAY); d.Before(timerMonday.Add(14 * DAY)); d = d.Add(DAY) {
+		day := &pb.TradingDay{Date: TimeToTimestamp(d)}
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			day.IsTradingDay = true
+			day.OpeningAuctionStartTime, day.OpeningAuctionEndTime = at(d, 6, 50), at(d, 7, 0)
+			day.StartTime, day.EndTime = at(d, 7, 0), at(d, 15, 50)
+			day.ClearingStartTime, day.ClearingEndTime = at(d, 11, 0), at(d, 11, 5)
+			day.ClosingAuctionStartTime, day.ClosingAuctionEndTime = at(d, 15, 40), at(d, 15, 50)
+			day.EveningOpeningAuctionStartTime, day.EveningStartTime, day.EveningEndTime = at(d, 16, 0), at(d, 16, 5), at(d, 20, 50)
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+// recordingLogger - Логгер, который считает ошибки
+type recordingLogger struct {
+	testLogger
+	mu     sync.Mutex
+	errors int
+}
+
+func (l *recordingLogger) Errorf(template string, args ...any) {
+	l.mu.Lock()
+	l.errors++
+	l.mu.Unlock()
+	l.testLogger.Errorf(template, args...)
+}
+
+func (l *recordingLogger) errorsCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errors
+}
+
+// startTestTimer - Запуск таймера в отдельной горутине, возвращает канал с результатом Start
+func startTestTimer(t *testing.T, timer *Timer) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- timer.Start(context.Background())
+	}()
+	t.Cleanup(timer.Stop)
+	return done
+}
+
+// waitTimer - Ожидание, пока таймер начнет ждать следующего события
+func waitTimer(t *testing.T, clock *SimulatedClock) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timer is not waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timer event")
+	}
+	var zero T
+	return zero
+}
+
+func checkTimerEvent(t *testing.T, ev TimerEvent, event Event, phase TradingPhase, scheduled time.Time) {
+	t.Helper()
+	if ev.Event != event || ev.Phase != phase || !ev.Scheduled.Equal(scheduled) || ev.Exchange != "MOEX" {
+		t.Fatalf("event = %v, want %v %v at %v", ev, event, phase, scheduled.Format(time.RFC3339))
+	}
+}
+
+func TestTimerDefaultPhases(t *testing.T) {
+	clock := NewSimulatedClock(timerMonday.Add(6 * time.Hour))
+	timer := newTimer(testLogger{t}, clock, TimerConfig{}, []*TradingCalendar{NewTradingCalendarFromSchedule("MOEX", testSchedule())})
+	events, timerEvents := timer.Events(), timer.TimerEvents()
+	startTestTimer(t, timer)
+
+	waitTimer(t, clock)
+	clock.Set(timerMonday.Add(23 * time.Hour))
+	// START в начале основной сессии, а не аукциона открытия, клиринг и аукцион закрытия не прерывают окно торгов,
+	// вечерняя сессия по умолчанию не отслеживается
+	checkTimerEvent(t, receive(t, timerEvents), START, PHASE_MAIN_SESSION, timerMonday.Add(7*time.Hour))
+	checkTimerEvent(t, receive(t, timerEvents), STOP, PHASE_CLOSING_AUCTION, timerMonday.Add(15*time.Hour+50*time.Minute))
+	if e := receive(t, events); e != START {
+		t.Fatalf("event = %v, want START", e)
+	}
+	if e := receive(t, events); e != STOP {
+		t.Fatalf("event = %v, want STOP", e)
+	}
+	waitTimer(t, clock)
+	select {
+	case ev := <-timerEvents:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+}
+
+func TestTimerPhasesAndOffsets(t *testing.T) {
+	clock := NewSimulatedClock(timerMonday.Add(6 * time.Hour))
+	timer := newTimer(testLogger{t}, clock, TimerConfig{
+		Phases:         []TradingPhase{PHASE_OPENING_AUCTION, PHASE_MAIN_SESSION, PHASE_CLOSING_AUCTION, PHASE_EVENING_SESSION},
+		Offsets:        map[TradingPhase]TimerOffsets{PHASE_EVENING_SESSION: {Start: time.Minute, Stop: 10 * time.Minute}},
+		DefaultOffsets: TimerOffsets{Start: -5 * time.Minute},
+	}, []*TradingCalendar{NewTradingCalendarFromSchedule("MOEX", testSchedule())})
+	timerEvents := timer.TimerEvents()
+	startTestTimer(t, timer)
+
+	waitTimer(t, clock)
+	clock.Set(timerMonday.Add(23 * time.Hour))
+	want := []struct {
+		event     Event
+		phase     TradingPhase
+		scheduled time.Duration
+		time      time.Duration
+	}{
+		{START, PHASE_OPENING_AUCTION, 6*time.Hour + 50*time.Minute, 6*time.Hour + 45*time.Minute},
+		// клиринг не входит в Phases и разделяет окна торгов
+		{STOP, PHASE_MAIN_SESSION, 11 * time.Hour, 11 * time.Hour},
+		{START, PHASE_MAIN_SESSION, 11*time.Hour + 5*time.Minute, 11 * time.Hour},
+		{STOP, PHASE_CLOSING_AUCTION, 15*time.Hour + 50*time.Minute, 15*time.Hour + 50*time.Minute},
+		{START, PHASE_EVENING_SESSION, 16*time.Hour + 5*time.Minute, 16*time.Hour + 6*time.Minute},
+		{STOP, PHASE_EVENING_SESSION, 20*time.Hour + 50*time.Minute, 20*time.Hour + 40*time.Minute},
+	}
+	for _, w := range want {
+		ev := receive(t, timerEvents)
+		checkTimerEvent(t, ev, w.event, w.phase, timerMonday.Add(w.scheduled))
+		if !ev.Time.Equal(timerMonday.Add(w.time)) {
+			t.Fatalf("%v time = %v, want %v", ev, ev.Time, timerMonday.Add(w.time))
+		}
+	}
+}
+
+func TestTimerDoesNotBlock(t *testing.T) {
+	clock := NewSimulatedClock(timerMonday.Add(6 * time.Hour))
+	logger := &recordingLogger{testLogger: testLogger{t}}
+	timer := newTimer(logger, clock, TimerConfig{BufferSize: 1}, []*TradingCalendar{NewTradingCalendarFromSchedule("MOEX", testSchedule())})
+	timerEvents := timer.TimerEvents()
+	startTestTimer(t, timer)
+
+	// события трех дней без чтения канала
+	for day := 0; day < 3; day++ {
+		waitTimer(t, clock)
+		clock.Set(timerMonday.Add(time.Duration(day)*DAY + 23*time.Hour))
+	}
+	waitTimer(t, clock)
+	// в канале остается последнее событие, вытесненные записаны в лог
+	checkTimerEvent(t, receive(t, timerEvents), STOP, PHASE_CLOSING_AUCTION, timerMonday.Add(2*DAY+15*time.Hour+50*time.Minute))
+	if n := logger.errorsCount(); n != 5 {
+		t.Fatalf("logged drops = %v, want 5", n)
+	}
+}
+
+func TestTimerStop(t *testing.T) {
+	// торги уже идут
+	clock := NewSimulatedClock(timerMonday.Add(10 * time.Hour))
+	timer := newTimer(testLogger{t}, clock, TimerConfig{}, []*TradingCalendar{NewTradingCalendarFromSchedule("MOEX", testSchedule())})
+	events, timerEvents := timer.Events(), timer.TimerEvents()
+	done := startTestTimer(t, timer)
+
+	ev := receive(t, timerEvents)
+	checkTimerEvent(t, ev, START, PHASE_MAIN_SESSION, timerMonday.Add(7*time.Hour))
+	if !ev.Time.Equal(clock.Now()) {
+		t.Fatalf("START time = %v, want now", ev.Time)
+	}
+	waitTimer(t, clock)
+	timer.Stop()
+	timer.Stop()
+	if err := receive(t, done); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	checkTimerEvent(t, receive(t, timerEvents), STOP, PHASE_MAIN_SESSION, clock.Now())
+	if _, ok := <-timerEvents; ok {
+		t.Fatal("timer events channel is not closed")
+	}
+	for _, want := range []Event{START, STOP} {
+		if e := receive(t, events); e != want {
+			t.Fatalf("event = %v, want %v", e, want)
+		}
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("events channel is not closed")
+	}
+}
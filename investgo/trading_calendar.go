@@ -0,0 +1,479 @@
+package investgo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DEFAULT_CALENDAR_DAYS - На сколько дней вперед загружается расписание при обращении к незагруженному дню
+	DEFAULT_CALENDAR_DAYS = 14
+	// calendarSearchLimit - Максимальный период поиска следующего открытия или закрытия торгов
+	calendarSearchLimit = 60 * DAY
+	// calendarRequestDays - Максимальный период одного запроса TradingSchedules
+	calendarRequestDays = 7
+)
+
+// ErrNoSchedule - Расписание на запрошенную дату не загружено, а календарь работает без подключения к API
+var ErrNoSchedule = errors.New("trading schedule is not loaded")
+
+// TradingPhase - Этап торгового дня
+type TradingPhase int
+
+const (
+	// PHASE_CLOSED - Торги не проводятся
+	PHASE_CLOSED TradingPhase = iota
+	// PHASE_PREMARKET - Утренняя сессия
+	PHASE_PREMARKET
+	// PHASE_OPENING_AUCTION - Аукцион открытия
+	PHASE_OPENING_AUCTION
+	// PHASE_MAIN_SESSION - Основная сессия
+	PHASE_MAIN_SESSION
+	// PHASE_CLEARING - Промежуточный клиринг
+	PHASE_CLEARING
+	// PHASE_CLOSING_AUCTION - Аукцион закрытия
+	PHASE_CLOSING_AUCTION
+	// PHASE_EVENING_AUCTION - Аукцион открытия вечерней сессии
+	PHASE_EVENING_AUCTION
+	// PHASE_EVENING_SESSION - Вечерняя сессия
+	PHASE_EVENING_SESSION
+	// PHASE_WEEKEND_SESSION - Торги выходного дня
+	PHASE_WEEKEND_SESSION
+)
+
+func (p TradingPhase) String() string {
+	switch p {
+	case PHASE_CLOSED:
+		return "closed"
+	case PHASE_PREMARKET:
+		return "premarket"
+	case PHASE_OPENING_AUCTION:
+		return "opening_auction"
+	case PHASE_MAIN_SESSION:
+		return "main_session"
+	case PHASE_CLEARING:
+		return "clearing"
+	case PHASE_CLOSING_AUCTION:
+		return "closing_auction"
+	case PHASE_EVENING_AUCTION:
+		return "evening_auction"
+	case PHASE_EVENING_SESSION:
+		return "evening_session"
+	case PHASE_WEEKEND_SESSION:
+		return "weekend_session"
+	}
+	return fmt.Sprintf("TradingPhase(%d)", int(p))
+}
+
+// IsOpen - На этапе можно выставлять заявки: любой этап, кроме PHASE_CLOSED и PHASE_CLEARING
+func (p TradingPhase) IsOpen() bool {
+	return p != PHASE_CLOSED && p != PHASE_CLEARING
+}
+
+// PhaseInterval - Этап торгов [Start, End)
+type PhaseInterval struct {
+	Phase TradingPhase
+	Start time.Time
+	End   time.Time
+}
+
+// TradingCalendarConfig - Параметры календаря торгов
+type TradingCalendarConfig struct {
+	// Exchange - Биржа, например MOEX
+	Exchange string
+	// CacheFile - Файл, в котором сохраняется загруженное расписание. Если не указан, то расписание хранится только в памяти
+	CacheFile string
+	// Days - На сколько дней вперед загружается расписание, по умолчанию DEFAULT_CALENDAR_DAYS
+	Days int
+}
+
+// TradingCalendar - Календарь торгов биржи по расписанию TradingSchedules. Расписание загружается при первом
+// обращении к дню и кэшируется в памяти и в CacheFile. Календарь без клиента (LoadTradingCalendar,
+// NewTradingCalendarFromSchedule) работает только с уже загруженным расписанием, например в бэктестах
+type TradingCalendar struct {
+	conf TradingCalendarConfig
+	is   *InstrumentsServiceClient
+
+	mu sync.Mutex
+	// days - Расписание по дате в формате time.DateOnly
+	days map[string]*pb.TradingDay
+	// intervals - Этапы торгов всех загруженных дней по возрастанию времени
+	intervals []PhaseInterval
+	// from, to - Период [from, to), за который загружено расписание
+	from time.Time
+	to   time.Time
+}
+
+// NewTradingCalendar - создание календаря торгов, если CacheFile существует, то расписание загружается из него
+func (c *Client) NewTradingCalendar(conf TradingCalendarConfig) (*TradingCalendar, error) {
+	if conf.Exchange == "" {
+		return nil, fmt.Errorf("exchange is required for trading calendar")
+	}
+	if conf.Days <= 0 {
+		conf.Days = DEFAULT_CALENDAR_DAYS
+	}
+	cal := &TradingCalendar{
+		conf: conf,
+		is:   c.NewInstrumentsServiceClient(),
+		days: make(map[string]*pb.TradingDay),
+	}
+	if conf.CacheFile == "" {
+		return cal, nil
+	}
+	schedule, err := readCalendarFile(conf.CacheFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cal, nil
+		}
+		return nil, err
+	}
+	if strings.EqualFold(schedule.GetExchange(), conf.Exchange) {
+		cal.add(schedule.GetDays())
+	}
+	return cal, nil
+}
+
+// LoadTradingCalendar - Календарь без подключения к API из файла, сохраненного календарем с CacheFile
+func LoadTradingCalendar(filename string) (*TradingCalendar, error) {
+	schedule, err := readCalendarFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewTradingCalendarFromSchedule(schedule.GetExchange(), schedule.GetDays()), nil
+}
+
+// NewTradingCalendarFromSchedule - Календарь без подключения к API из расписания TradingSchedules
+func NewTradingCalendarFromSchedule(exchange string, days []*pb.TradingDay) *TradingCalendar {
+	cal := &TradingCalendar{
+		conf: TradingCalendarConfig{Exchange: exchange, Days: DEFAULT_CALENDAR_DAYS},
+		days: make(map[string]*pb.TradingDay),
+	}
+	cal.add(days)
+	return cal
+}
+
+// Exchange - Биржа календаря
+func (c *TradingCalendar) Exchange() string {
+	return c.conf.Exchange
+}
+
+// Day - Расписание на день date (дата в часовом поясе date), в нем доступны время премаркета, аукционов,
+// клиринга и вечерней сессии
+func (c *TradingCalendar) Day(date time.Time) (*pb.TradingDay, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ensure(date.Add(-DAY), date.Add(DAY)); err != nil {
+		return nil, err
+	}
+	day, ok := c.days[date.Format(time.DateOnly)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v %v", ErrNoSchedule, c.conf.Exchange, date.Format(time.DateOnly))
+	}
+	return day, nil
+}
+
+// Phase - Этап торгов в момент t
+func (c *TradingCalendar) Phase(t time.Time) (TradingPhase, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ensure(t.Add(-DAY), t.Add(DAY)); err != nil {
+		return PHASE_CLOSED, err
+	}
+	i := c.search(t)
+	if i < len(c.intervals) && !t.Before(c.intervals[i].Start) {
+		return c.intervals[i].Phase, nil
+	}
+	return PHASE_CLOSED, nil
+}
+
+// IsOpen - Можно ли выставлять заявки в момент t
+func (c *TradingCalendar) IsOpen(t time.Time) (bool, error) {
+	phase, err := c.Phase(t)
+	return phase.IsOpen(), err
+}
+
+// NextOpen - Начало торгов: t, если торги в момент t идут, иначе начало ближайшего следующего этапа торгов
+func (c *TradingCalendar) NextOpen(t time.Time) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for end := t.Add(time.Duration(c.conf.Days) * DAY); ; end = end.Add(time.Duration(c.conf.Days) * DAY) {
+		if err := c.ensure(t.Add(-DAY), end); err != nil {
+			return time.Time{}, err
+		}
+		for i := c.search(t); i < len(c.intervals); i++ {
+			p := c.intervals[i]
+			if p.Phase.IsOpen() {
+				if p.Start.Before(t) {
+					return t, nil
+				}
+				return p.Start, nil
+			}
+		}
+		if end.Sub(t) >= calendarSearchLimit {
+			return time.Time{}, fmt.Errorf("%w: no trading on %v until %v", ErrNoSchedule, c.conf.Exchange, end.Format(time.DateOnly))
+		}
+	}
+}
+
+// NextClose - Конец торгов, идущих в момент t, или, если торги не идут, конец ближайших следующих торгов.
+// Промежуточный клиринг считается закрытием торгов
+func (c *TradingCalendar) NextClose(t time.Time) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for end := t.Add(time.Duration(c.conf.Days) * DAY); ; end = end.Add(time.Duration(c.conf.Days) * DAY) {
+		if err := c.ensure(t.Add(-DAY), end); err != nil {
+			return time.Time{}, err
+		}
+		open := false
+		for i := c.search(t); i < len(c.intervals); i++ {
+			p := c.intervals[i]
+			// этапы торгов подряд без перерыва составляют одни торги
+			if open && (!p.Phase.IsOpen() || p.Start.After(c.intervals[i-1].End)) {
+				return c.intervals[i-1].End, nil
+			}
+			open = open || p.Phase.IsOpen()
+		}
+		// последний загруженный этап может продолжаться в незагруженных днях
+		if end.Sub(t) >= calendarSearchLimit {
+			return time.Time{}, fmt.Errorf("%w: no trading end on %v until %v", ErrNoSchedule, c.conf.Exchange, end.Format(time.DateOnly))
+		}
+	}
+}
+
+// Phases - Этапы торгов, пересекающиеся с периодом [from, to), кроме PHASE_CLOSED
+func (c *TradingCalendar) Phases(from, to time.Time) ([]PhaseInterval, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ensure(from.Add(-DAY), to); err != nil {
+		return nil, err
+	}
+	res := make([]PhaseInterval, 0)
+	for i := c.search(from); i < len(c.intervals) && c.intervals[i].Start.Before(to); i++ {
+		res = append(res, c.intervals[i])
+	}
+	return res, nil
+}
+
+// Refresh - Повторная загрузка расписания за период, например после изменения расписания биржей
+func (c *TradingCalendar) Refresh(from, to time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.is == nil {
+		return fmt.Errorf("%w: trading calendar is offline", ErrNoSchedule)
+	}
+	return c.fetch(from, to)
+}
+
+// search - Индекс первого этапа, который заканчивается после t
+func (c *TradingCalendar) search(t time.Time) int {
+	return sort.Search(len(c.intervals), func(i int) bool {
+		return c.intervals[i].End.After(t)
+	})
+}
+
+// ensure - Загрузка недостающего расписания за период [from, to), вызывается под мьютексом
+func (c *TradingCalendar) ensure(from, to time.Time) error {
+	from, to = from.UTC().Truncate(DAY), to.UTC().Truncate(DAY).Add(DAY)
+	if !c.from.IsZero() && !from.Before(c.from) && !to.After(c.to) {
+		return nil
+	}
+	if c.is == nil {
+		// без клиента отсутствие расписания означает закрытые торги, если период пересекается с загруженным
+		if c.from.IsZero() || !from.Before(c.to) || !to.After(c.from) {
+			return fmt.Errorf("%w: %v %v - %v", ErrNoSchedule, c.conf.Exchange, from.Format(time.DateOnly), to.Format(time.DateOnly))
+		}
+		return nil
+	}
+	if !c.from.IsZero() {
+		// догружаем только недостающие дни по краям загруженного периода
+		if from.Before(c.from) && to.After(c.from) && !to.After(c.to) {
+			to = c.from
+		} else if !from.Before(c.from) && from.Before(c.to) && to.After(c.to) {
+			from = c.to
+		}
+	}
+	if days := time.Duration(c.conf.Days) * DAY; to.Sub(from) < days {
+		to = from.Add(days)
+	}
+	return c.fetch(from, to)
+}
+
+// fetch - Загрузка расписания за период с сохранением в CacheFile, вызывается под мьютексом
+func (c *TradingCalendar) fetch(from, to time.Time) error {
+	days := make([]*pb.TradingDay, 0)
+	for start := from; start.Before(to); start = start.Add(calendarRequestDays * DAY) {
+		end := start.Add(calendarRequestDays * DAY)
+		if end.After(to) {
+			end = to
+		}
+		resp, err := c.is.TradingSchedules(c.conf.Exchange, start, end)
+		if err != nil {
+			return err
+		}
+		for _, schedule := range resp.GetExchanges() {
+			if strings.EqualFold(schedule.GetExchange(), c.conf.Exchange) {
+				days = append(days, schedule.GetDays()...)
+			}
+		}
+	}
+	c.add(days)
+	if c.from.IsZero() || from.Before(c.from) {
+		c.from = from
+	}
+	if to.After(c.to) {
+		c.to = to
+	}
+	if c.conf.CacheFile == "" {
+		return nil
+	}
+	return c.save()
+}
+
+// add - Добавление дней расписания и пересчет этапов торгов
+func (c *TradingCalendar) add(days []*pb.TradingDay) {
+	for _, day := range days {
+		if day.GetDate() == nil {
+			continue
+		}
+		date := calendarDate(day)
+		c.days[date.Format(time.DateOnly)] = day
+		if c.from.IsZero() || date.Before(c.from) {
+			c.from = date
+		}
+		if end := date.Add(DAY); end.After(c.to) {
+			c.to = end
+		}
+	}
+	intervals := make([]PhaseInterval, 0, len(c.days)*4)
+	for _, day := range c.days {
+		intervals = append(intervals, dayPhases(day)...)
+	}
+	sort.SliceStable(intervals, func(i, j int) bool {
+		return intervals[i].Start.Before(intervals[j].Start)
+	})
+	c.intervals = intervals
+}
+
+func (c *TradingCalendar) save() error {
+	days := make([]*pb.TradingDay, 0, len(c.days))
+	for _, day := range c.days {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].GetDate().AsTime().Before(days[j].GetDate().AsTime())
+	})
+	data, err := protojson.Marshal(&pb.TradingSchedule{Exchange: c.conf.Exchange, Days: days})
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.conf.CacheFile); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := c.conf.CacheFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.conf.CacheFile)
+}
+
+func readCalendarFile(filename string) (*pb.TradingSchedule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	schedule := &pb.TradingSchedule{}
+	if err := protojson.Unmarshal(data, schedule); err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	return schedule, nil
+}
+
+// calendarDate - Дата дня расписания по UTC. Дата может быть указана как полночь по UTC или по Москве,
+// поэтому берется дата середины дня
+func calendarDate(day *pb.TradingDay) time.Time {
+	return day.GetDate().AsTime().Add(12 * time.Hour).UTC().Truncate(DAY)
+}
+
+// dayPhases - Этапы торгов дня без пересечений. Аукционы и клиринг имеют приоритет над сессиями,
+// в которые они попадают
+func dayPhases(day *pb.TradingDay) []PhaseInterval {
+	if !day.GetIsTradingDay() {
+		return nil
+	}
+	main := PHASE_MAIN_SESSION
+	if weekday := calendarDate(day).Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		main = PHASE_WEEKEND_SESSION
+	}
+	start, end := day.GetStartTime(), day.GetEndTime()
+	openingAuctionEnd := day.GetOpeningAuctionEndTime()
+	if openingAuctionEnd == nil {
+		openingAuctionEnd = start
+	}
+	closingAuctionStart, closingAuctionEnd := day.GetClosingAuctionStartTime(), day.GetClosingAuctionEndTime()
+	if closingAuctionStart == nil {
+		closingAuctionStart = end
+	}
+	// по убыванию приоритета
+	candidates := []struct {
+		phase      TradingPhase
+		start, end *timestamppb.Timestamp
+	}{
+		{PHASE_CLEARING, day.GetClearingStartTime(), day.GetClearingEndTime()},
+		{PHASE_OPENING_AUCTION, day.GetOpeningAuctionStartTime(), openingAuctionEnd},
+		{PHASE_CLOSING_AUCTION, closingAuctionStart, closingAuctionEnd},
+		{PHASE_EVENING_AUCTION, day.GetEveningOpeningAuctionStartTime(), day.GetEveningStartTime()},
+		{PHASE_PREMARKET, day.GetPremarketStartTime(), day.GetPremarketEndTime()},
+		{main, start, end},
+		{PHASE_EVENING_SESSION, day.GetEveningStartTime(), day.GetEveningEndTime()},
+	}
+	ranges := make([]PhaseInterval, 0, len(candidates))
+	bounds := make([]time.Time, 0, 2*len(candidates))
+	for _, c := range candidates {
+		if c.start == nil || c.end == nil {
+			continue
+		}
+		s, e := c.start.AsTime(), c.end.AsTime()
+		if s.Unix() <= 0 || !e.After(s) {
+			continue
+		}
+		ranges = append(ranges, PhaseInterval{Phase: c.phase, Start: s, End: e})
+		bounds = append(bounds, s, e)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	res := make([]PhaseInterval, 0, len(bounds))
+	for i := 0; i+1 < len(bounds); i++ {
+		s, e := bounds[i], bounds[i+1]
+		if !e.After(s) {
+			continue
+		}
+		phase := PHASE_CLOSED
+		for _, r := range ranges {
+			if !s.Before(r.Start) && s.Before(r.End) {
+				phase = r.Phase
+				break
+			}
+		}
+		if phase == PHASE_CLOSED {
+			continue
+		}
+		if n := len(res); n > 0 && res[n-1].Phase == phase && res[n-1].End.Equal(s) {
+			res[n-1].End = e
+			continue
+		}
+		res = append(res, PhaseInterval{Phase: phase, Start: s, End: e})
+	}
+	return res
+}
@@ -0,0 +1,307 @@
+package investgo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+// calendarAt - Время дня timerMonday + days в UTC
+func calendarAt(days, h, m int) time.Time {
+	return timerMonday.Add(time.Duration(days)*DAY + time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+}
+
+func phaseStrings(phases []PhaseInterval) []string {
+	res := make([]string, 0, len(phases))
+	for _, p := range phases {
+		res = append(res, p.Phase.String()+" "+p.Start.Format("01-02 15:04")+"-"+p.End.Format("15:04"))
+	}
+	return res
+}
+
+func TestDayPhases(t *testing.T) {
+	monday := testSchedule()[3]
+	want := []string{
+		"opening_auction 03-04 06:50-07:00",
+		"main_session 03-04 07:00-11:00",
+		"clearing 03-04 11:00-11:05",
+		"main_session 03-04 11:05-15:40",
+		"closing_auction 03-04 15:40-15:50",
+		"evening_auction 03-04 16:00-16:05",
+		"evening_session 03-04 16:05-20:50",
+	}
+	if got := phaseStrings(dayPhases(monday)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("phases = %v, want %v", got, want)
+	}
+
+	// неторговый день
+	if got := dayPhases(testSchedule()[1]); len(got) != 0 {
+		t.Fatalf("saturday phases = %v", phaseStrings(got))
+	}
+
+	// торги выходного дня с датой по Москве, премаркет до аукциона открытия, незаданные времена пропускаются
+	saturday := calendarAt(5, 0, 0)
+	weekend := &pb.TradingDay{
+		Date:                    TimeToTimestamp(saturday.Add(-3 * time.Hour)),
+		IsTradingDay:            true,
+		PremarketStartTime:      TimeToTimestamp(calendarAt(5, 6, 0)),
+		PremarketEndTime:        TimeToTimestamp(calendarAt(5, 7, 0)),
+		OpeningAuctionStartTime: TimeToTimestamp(calendarAt(5, 6, 50)),
+		StartTime:               TimeToTimestamp(calendarAt(5, 7, 0)),
+		EndTime:                 TimeToTimestamp(calendarAt(5, 15, 0)),
+		ClearingStartTime:       TimeToTimestamp(time.Unix(0, 0)),
+		ClearingEndTime:         TimeToTimestamp(time.Unix(0, 0)),
+	}
+	want = []string{
+		"premarket 03-09 06:00-06:50",
+		"opening_auction 03-09 06:50-07:00",
+		"weekend_session 03-09 07:00-15:00",
+	}
+	if got := phaseStrings(dayPhases(weekend)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("weekend phases = %v, want %v", got, want)
+	}
+}
+
+func TestTradingCalendarPhase(t *testing.T) {
+	cal := NewTradingCalendarFromSchedule("MOEX", testSchedule())
+	tests := []struct {
+		t     time.Time
+		phase TradingPhase
+	}{
+		{calendarAt(0, 6, 0), PHASE_CLOSED},
+		{calendarAt(0, 6, 50), PHASE_OPENING_AUCTION},
+		{calendarAt(0, 11, 2), PHASE_CLEARING},
+		{calendarAt(0, 11, 5), PHASE_MAIN_SESSION},
+		{calendarAt(0, 15, 50), PHASE_CLOSED},
+		{calendarAt(0, 16, 30), PHASE_EVENING_SESSION},
+		{calendarAt(5, 12, 0), PHASE_CLOSED},
+	}
+	for _, tt := range tests {
+		phase, err := cal.Phase(tt.t)
+		if err != nil || phase != tt.phase {
+			t.Errorf("Phase(%v) = %v, %v, want %v", tt.t, phase, err, tt.phase)
+		}
+	}
+	if open, err := cal.IsOpen(calendarAt(0, 11, 2)); err != nil || open {
+		t.Fatalf("IsOpen during clearing = %v, %v", open, err)
+	}
+
+	phases, err := cal.Phases(calendarAt(0, 12, 0), calendarAt(0, 16, 3))
+	if err != nil {
+		t.Fatalf("Phases: %v", err)
+	}
+	want := []string{"main_session 03-04 11:05-15:40", "closing_auction 03-04 15:40-15:50", "evening_auction 03-04 16:00-16:05"}
+	if got := phaseStrings(phases); !reflect.DeepEqual(got, want) {
+		t.Fatalf("phases = %v, want %v", got, want)
+	}
+	if day, err := cal.Day(calendarAt(2, 12, 0)); err != nil || !calendarDate(day).Equal(calendarAt(2, 0, 0)) {
+		t.Fatalf("Day = %v, %v", day, err)
+	}
+}
+
+func TestTradingCalendarNextOpenClose(t *testing.T) {
+	cal := NewTradingCalendarFromSchedule("MOEX", testSchedule())
+	tests := []struct {
+		name        string
+		t           time.Time
+		open, close time.Time
+	}{
+		{"before opening auction", calendarAt(0, 3, 0), calendarAt(0, 6, 50), calendarAt(0, 11, 0)},
+		{"main session", calendarAt(0, 8, 0), calendarAt(0, 8, 0), calendarAt(0, 11, 0)},
+		// клиринг закрывает торги, следующие торги идут до аукциона закрытия включительно
+		{"clearing", calendarAt(0, 11, 2), calendarAt(0, 11, 5), calendarAt(0, 15, 50)},
+		{"between sessions", calendarAt(0, 15, 55), calendarAt(0, 16, 0), calendarAt(0, 20, 50)},
+		// после пятницы торги открываются в понедельник
+		{"friday night", calendarAt(4, 21, 0), calendarAt(7, 6, 50), calendarAt(7, 11, 0)},
+		{"saturday", calendarAt(5, 12, 0), calendarAt(7, 6, 50), calendarAt(7, 11, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := cal.NextOpen(tt.t); err != nil || !got.Equal(tt.open) {
+				t.Errorf("NextOpen = %v, %v, want %v", got, err, tt.open)
+			}
+			if got, err := cal.NextClose(tt.t); err != nil || !got.Equal(tt.close) {
+				t.Errorf("NextClose = %v, %v, want %v", got, err, tt.close)
+			}
+		})
+	}
+}
+
+func TestTradingCalendarOffline(t *testing.T) {
+	cal := NewTradingCalendarFromSchedule("MOEX", testSchedule())
+	// расписание загружено с 1 по 17 марта
+	if _, err := cal.Phase(calendarAt(28, 12, 0)); !errors.Is(err, ErrNoSchedule) {
+		t.Fatalf("Phase outside schedule: err = %v", err)
+	}
+	if _, err := cal.Day(calendarAt(-10, 12, 0)); !errors.Is(err, ErrNoSchedule) {
+		t.Fatalf("Day outside schedule: err = %v", err)
+	}
+	// период, пересекающийся с загруженным, считается закрытым, но следующих торгов в нем нет
+	if _, err := cal.NextOpen(calendarAt(11, 21, 0)); !errors.Is(err, ErrNoSchedule) {
+		t.Fatalf("NextOpen after last trading day: err = %v", err)
+	}
+	if _, err := cal.NextClose(calendarAt(11, 21, 0)); !errors.Is(err, ErrNoSchedule) {
+		t.Fatalf("NextClose after last trading day: err = %v", err)
+	}
+	if err := cal.Refresh(calendarAt(0, 0, 0), calendarAt(1, 0, 0)); !errors.Is(err, ErrNoSchedule) {
+		t.Fatalf("Refresh offline: err = %v", err)
+	}
+	if got, err := cal.NextOpen(calendarAt(11, 12, 0)); err != nil || !got.Equal(calendarAt(11, 12, 0)) {
+		t.Fatalf("NextOpen on last trading day = %v, %v", got, err)
+	}
+	if cal.Exchange() != "MOEX" {
+		t.Fatalf("exchange = %v", cal.Exchange())
+	}
+}
+
+// fakeSchedules - TradingSchedules по testSchedule, запоминает запрошенные периоды
+type fakeSchedules struct {
+	pb.InstrumentsServiceClient
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeSchedules) TradingSchedules(_ context.Context, in *pb.TradingSchedulesRequest, _ ...grpc.CallOption) (*pb.TradingSchedulesResponse, error) {
+	from, to := in.GetFrom().AsTime(), in.GetTo().AsTime()
+	f.mu.Lock()
+	f.requests = append(f.requests, from.Format("01-02")+" "+to.Format("01-02"))
+	f.mu.Unlock()
+	schedule := &pb.TradingSchedule{Exchange: in.GetExchange()}
+	for _, day := range testSchedule() {
+		if date := calendarDate(day); !date.Before(from) && date.Before(to) {
+			schedule.Days = append(schedule.Days, day)
+		}
+	}
+	return &pb.TradingSchedulesResponse{Exchanges: []*pb.TradingSchedule{schedule}}, nil
+}
+
+func (f *fakeSchedules) takeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := f.requests
+	f.requests = nil
+	return res
+}
+
+func newTestCalendar(t *testing.T, fake *fakeSchedules, conf TradingCalendarConfig) *TradingCalendar {
+	client := &Client{Logger: testLogger{t}, ctx: context.Background()}
+	cal, err := client.NewTradingCalendar(conf)
+	if err != nil {
+		t.Fatalf("NewTradingCalendar: %v", err)
+	}
+	cal.is.pbClient = fake
+	return cal
+}
+
+func TestTradingCalendarEnsure(t *testing.T) {
+	fake := &fakeSchedules{}
+	cal := newTestCalendar(t, fake, TradingCalendarConfig{Exchange: "MOEX", Days: 3})
+	steps := []struct {
+		name     string
+		t        time.Time
+		phase    TradingPhase
+		requests []string
+	}{
+		{"first request", calendarAt(2, 12, 0), PHASE_MAIN_SESSION, []string{"03-05 03-08"}},
+		{"loaded day", calendarAt(2, 16, 30), PHASE_EVENING_SESSION, nil},
+		// догружается только правый край, не короче Days
+		{"right edge", calendarAt(4, 12, 0), PHASE_MAIN_SESSION, []string{"03-08 03-11"}},
+		// левый край догружается до начала загруженного периода, не короче Days
+		{"left edge", calendarAt(0, 12, 0), PHASE_MAIN_SESSION, []string{"03-03 03-06"}},
+		{"inside", calendarAt(3, 12, 0), PHASE_MAIN_SESSION, nil},
+	}
+	for _, s := range steps {
+		phase, err := cal.Phase(s.t)
+		if err != nil || phase != s.phase {
+			t.Fatalf("%v: Phase = %v, %v, want %v", s.name, phase, err, s.phase)
+		}
+		if got := fake.takeRequests(); !reflect.DeepEqual(got, s.requests) {
+			t.Fatalf("%v: requests = %v, want %v", s.name, got, s.requests)
+		}
+	}
+
+	// длинный период запрашивается частями по calendarRequestDays дней
+	if err := cal.Refresh(calendarAt(-3, 0, 0), calendarAt(13, 0, 0)); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if got, want := fake.takeRequests(), []string{"03-01 03-08", "03-08 03-15", "03-15 03-17"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("refresh requests = %v, want %v", got, want)
+	}
+	// поиск следующих торгов через выходные не запрашивает загруженные дни
+	if got, err := cal.NextOpen(calendarAt(5, 12, 0)); err != nil || !got.Equal(calendarAt(7, 6, 50)) {
+		t.Fatalf("NextOpen = %v, %v", got, err)
+	}
+	if got := fake.takeRequests(); len(got) != 0 {
+		t.Fatalf("NextOpen requests = %v", got)
+	}
+}
+
+func TestTradingCalendarCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendar", "moex.json")
+	fake := &fakeSchedules{}
+	cal := newTestCalendar(t, fake, TradingCalendarConfig{Exchange: "MOEX", Days: 7, CacheFile: path})
+	if _, err := cal.Phase(calendarAt(0, 12, 0)); err != nil {
+		t.Fatalf("Phase: %v", err)
+	}
+	if len(fake.takeRequests()) != 1 {
+		t.Fatal("schedule is not requested")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary cache file is left")
+	}
+
+	// календарь с тем же файлом не запрашивает загруженные дни
+	cached := newTestCalendar(t, fake, TradingCalendarConfig{Exchange: "moex", Days: 7, CacheFile: path})
+	if phase, err := cached.Phase(calendarAt(2, 11, 2)); err != nil || phase != PHASE_CLEARING {
+		t.Fatalf("cached Phase = %v, %v", phase, err)
+	}
+	if got := fake.takeRequests(); len(got) != 0 {
+		t.Fatalf("cached requests = %v", got)
+	}
+
+	// файл читается без подключения к API
+	offline, err := LoadTradingCalendar(path)
+	if err != nil {
+		t.Fatalf("LoadTradingCalendar: %v", err)
+	}
+	if offline.Exchange() != "MOEX" {
+		t.Fatalf("exchange = %v", offline.Exchange())
+	}
+	want, err := cal.Phases(calendarAt(-1, 0, 0), calendarAt(5, 0, 0))
+	if err != nil {
+		t.Fatalf("Phases: %v", err)
+	}
+	got, err := offline.Phases(calendarAt(-1, 0, 0), calendarAt(5, 0, 0))
+	if err != nil || !reflect.DeepEqual(phaseStrings(got), phaseStrings(want)) {
+		t.Fatalf("offline phases = %v, %v, want %v", phaseStrings(got), err, phaseStrings(want))
+	}
+
+	fake.takeRequests()
+	// расписание другой биржи из файла не используется
+	other := newTestCalendar(t, fake, TradingCalendarConfig{Exchange: "SPB", Days: 7, CacheFile: path})
+	if _, err := other.Phase(calendarAt(0, 12, 0)); err != nil {
+		t.Fatalf("Phase: %v", err)
+	}
+	if got := fake.takeRequests(); len(got) != 1 {
+		t.Fatalf("other exchange requests = %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+	if _, err := (&Client{Logger: testLogger{t}, ctx: context.Background()}).NewTradingCalendar(TradingCalendarConfig{
+		Exchange: "MOEX", CacheFile: path}); err == nil {
+		t.Fatal("corrupted cache must fail")
+	}
+	if _, err := LoadTradingCalendar(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+}
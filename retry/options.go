@@ -55,6 +55,14 @@ func WithMax(maxRetries uint) CallOption {
 	}}
 }
 
+// WithoutResourceExhausted disables the ResourceExhausted retry of UnaryClientInterceptorRE on this call,
+// other interceptors keep retrying their codes. Use it when the caller waits for the rate limit reset itself.
+func WithoutResourceExhausted() CallOption {
+	return CallOption{applyFunc: func(o *options) {
+		o.skipResourceExhausted = true
+	}}
+}
+
 // WithBackoff sets the `BackoffFunc` used to control time between retries.
 func WithBackoff(bf BackoffFunc) CallOption {
 	return CallOption{applyFunc: func(o *options) {
@@ -101,12 +109,13 @@ func WithPerRetryTimeout(timeout time.Duration) CallOption {
 }
 
 type options struct {
-	max             uint
-	perCallTimeout  time.Duration
-	includeHeader   bool
-	codes           []codes.Code
-	backoffFunc     BackoffFunc
-	onRetryCallback OnRetryCallback
+	max                   uint
+	perCallTimeout        time.Duration
+	includeHeader         bool
+	codes                 []codes.Code
+	backoffFunc           BackoffFunc
+	onRetryCallback       OnRetryCallback
+	skipResourceExhausted bool
 }
 
 // CallOption is a grpc.CallOption that is local to grpc_retry.
@@ -31,11 +31,13 @@ const (
 func UnaryClientInterceptor(optFuncs ...CallOption) grpc.UnaryClientInterceptor {
 	intOpts := reuseOrNewWithCallOptions(defaultOptions, optFuncs)
 	return func(parentCtx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		grpcOpts, retryOpts := filterCallOptions(opts)
+		_, retryOpts := filterCallOptions(opts)
 		callOpts := reuseOrNewWithCallOptions(intOpts, retryOpts)
+		// retry options are passed through to the next interceptor in the chain (e.g. UnaryClientInterceptorRE),
+		// grpc ignores them as they are EmptyCallOption
 		// short circuit for simplicity, and avoiding allocations.
 		if callOpts.max == 0 {
-			return invoker(parentCtx, method, req, reply, cc, grpcOpts...)
+			return invoker(parentCtx, method, req, reply, cc, opts...)
 		}
 		var lastErr error
 		for attempt := uint(0); attempt < callOpts.max; attempt++ {
@@ -44,7 +46,7 @@ func UnaryClientInterceptor(optFuncs ...CallOption) grpc.UnaryClientInterceptor
 			}
 			callCtx, cancel := perCallContext(parentCtx, callOpts, attempt)
 			defer cancel() // Clean up potential resources.
-			lastErr = invoker(callCtx, method, req, reply, cc, grpcOpts...)
+			lastErr = invoker(callCtx, method, req, reply, cc, opts...)
 			if lastErr == nil {
 				return nil
 			}
@@ -87,7 +89,7 @@ func UnaryClientInterceptorRE(optFuncs ...CallOption) grpc.UnaryClientIntercepto
 		grpcOpts, retryOpts := filterCallOptions(opts)
 		callOpts := reuseOrNewWithCallOptions(intOpts, retryOpts)
 		// short circuit for simplicity, and avoiding allocations.
-		if callOpts.max == 0 {
+		if callOpts.max == 0 || callOpts.skipResourceExhausted {
 			return invoker(parentCtx, method, req, reply, cc, grpcOpts...)
 		}
 		var lastErr error
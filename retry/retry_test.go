@@ -0,0 +1,57 @@
+package retry
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// chain - Цепочка интерцепторов как в investgo.NewClient: повтор Unavailable, затем повтор ResourceExhausted
+func chain(invoker grpc.UnaryInvoker) func(opts ...grpc.CallOption) error {
+	first := UnaryClientInterceptor(WithCodes(codes.Unavailable), WithMax(3))
+	second := UnaryClientInterceptorRE(WithMax(3))
+	return func(opts ...grpc.CallOption) error {
+		return first(context.Background(), "/method", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return second(ctx, method, req, reply, cc, invoker, opts...)
+			}, opts...)
+	}
+}
+
+func TestWithoutResourceExhausted(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  codes.Code
+		opts  []grpc.CallOption
+		calls int
+	}{
+		{name: "resource exhausted is retried", code: codes.ResourceExhausted, calls: 3},
+		{name: "resource exhausted retry disabled", code: codes.ResourceExhausted, opts: []grpc.CallOption{WithoutResourceExhausted()}, calls: 1},
+		{name: "unavailable is still retried", code: codes.Unavailable, opts: []grpc.CallOption{WithoutResourceExhausted()}, calls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			invoker := func(_ context.Context, _ string, _, _ any, _ *grpc.ClientConn, opts ...grpc.CallOption) error {
+				calls++
+				for _, o := range opts {
+					if tr, ok := o.(grpc.TrailerCallOption); ok {
+						*tr.TrailerAddr = metadata.Pairs("x-ratelimit-reset", "0")
+					}
+				}
+				return status.Error(tt.code, "error")
+			}
+			err := chain(invoker)(tt.opts...)
+			if status.Code(err) != tt.code {
+				t.Fatalf("err = %v, want %v", err, tt.code)
+			}
+			if calls != tt.calls {
+				t.Fatalf("calls = %v, want %v", calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package simulator
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/internal/matching"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+var (
+	// ErrNotEnoughMoney - Недостаточно денежных средств для исполнения заявки
+	ErrNotEnoughMoney = matching.ErrNotEnoughMoney
+	// ErrNotEnoughAssets - Недостаточно бумаг для продажи
+	ErrNotEnoughAssets = matching.ErrNotEnoughAssets
+)
+
+// position - Позиция по инструменту, Quantity отрицательное для коротких позиций
+type position struct {
+	instrument *Instrument
+	matching.Position
+}
+
+// account - Счет симулятора
+type account struct {
+	id         string
+	currency   string
+	money      map[string]decimal.Decimal
+	positions  map[string]*position
+	operations []*pb.Operation
+}
+
+func newAccount(id, currency string, balance decimal.Decimal) *account {
+	a := &account{
+		id:        id,
+		currency:  currency,
+		money:     map[string]decimal.Decimal{currency: balance},
+		positions: make(map[string]*position),
+	}
+	if balance.IsPositive() {
+		a.operations = append(a.operations, &pb.Operation{
+			Id:            investgo.CreateUid(),
+			Currency:      currency,
+			Payment:       investgo.DecimalToMoneyValue(balance, currency),
+			State:         pb.OperationState_OPERATION_STATE_EXECUTED,
+			Type:          "Пополнение брокерского счёта",
+			OperationType: pb.OperationType_OPERATION_TYPE_INPUT,
+		})
+	}
+	return a
+}
+
+// apply - Изменение денежной позиции и позиции по инструменту после сделки
+func (a *account) apply(inst *Instrument, direction pb.OrderDirection, price decimal.Decimal, pieces int64, commission decimal.Decimal, allowShort bool) error {
+	p, ok := a.positions[inst.Uid]
+	if !ok {
+		p = &position{instrument: inst}
+	}
+	cash, _, _, err := matching.Settle(a.money[inst.Currency], &p.Position, direction, price, pieces, commission, allowShort)
+	if err != nil {
+		return err
+	}
+	a.money[inst.Currency] = cash
+	if p.Quantity == 0 {
+		delete(a.positions, inst.Uid)
+	} else {
+		a.positions[inst.Uid] = p
+	}
+	return nil
+}
+
+// sortedPositions - Позиции по инструментам в детерминированном порядке
+func (a *account) sortedPositions() []*position {
+	res := make([]*position, 0, len(a.positions))
+	for _, p := range a.positions {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].instrument.Uid < res[j].instrument.Uid
+	})
+	return res
+}
+
+// sortedCurrencies - Валюты счета в детерминированном порядке
+func (a *account) sortedCurrencies() []string {
+	res := make([]string, 0, len(a.money))
+	for c := range a.money {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,37 @@
+/*
+Package simulator предоставляет локальный симулятор биржи для тестирования роботов без сети и счета в песочнице.
+
+# Exchange
+
+simulator.Exchange реализует gRPC сервисы OrdersService, StopOrdersService, OperationsService и OrdersStreamService.
+Заявки исполняются по воспроизводимой ленте рыночных данных: свечам, обезличенным сделкам или стаканам.
+Учитываются лотность инструментов, шаг цены и комиссия брокера, по исполнению заявок в стрим сделок
+отправляются события OrderTrades, а в список операций записываются операции покупки/продажи и удержания комиссии.
+При выставлении заявки проверяется, что денег или бумаг хватает на весь объем заявки, средства при этом не резервируются.
+ReplaceOrder проверяет новую заявку до отмены старой, поэтому при ошибке старая заявка остается активной.
+
+Обычный investgo.Client подключается к симулятору так же, как к настоящему API:
+
+	ex := simulator.NewExchange(simulator.Config{...})
+	go ex.ListenAndServe(ctx, "localhost:8080")
+
+	client, err := investgo.NewClient(ctx, investgo.Config{
+		EndPoint:   "localhost:8080",
+		DisableTLS: true,
+		AccountId:  ex.AccountId(),
+	}, logger)
+
+	// воспроизведение истории
+	err = ex.Replay(ctx, simulator.CandleEvents(uid, candles), 0)
+
+# Время бэктеста
+
+Если передать один и тот же investgo.SimulatedClock в Config.Clock симулятора и в investgo.Config.Clock клиента,
+то часы переводятся на время каждого события ленты, и investgo.Timer, GetAllHistoricCandles и другие
+компоненты сдк работают по историческому времени:
+
+	clock := investgo.NewSimulatedClock(candles[0].GetTime().AsTime())
+	ex := simulator.NewExchange(simulator.Config{Clock: clock, ...})
+	client, err := investgo.NewClient(ctx, investgo.Config{Clock: clock, ...}, logger)
+*/
+package simulator
@@ -0,0 +1,416 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+// DEFAULT_ACCOUNT_ID - Идентификатор счета симулятора по умолчанию
+const DEFAULT_ACCOUNT_ID = "simulator"
+
+// Instrument - Торговый инструмент симулятора
+type Instrument struct {
+	// Uid, Figi - Идентификаторы инструмента, в запросах InstrumentId может быть любым из них
+	Uid  string
+	Figi string
+	// Ticker - Тикер, используется для логов
+	Ticker string
+	// InstrumentType - Тип инструмента: share, bond, etf, futures...
+	InstrumentType string
+	// Lot - Лотность инструмента
+	Lot int64
+	// MinPriceIncrement - Шаг цены
+	MinPriceIncrement *pb.Quotation
+	// Currency - Валюта инструмента, если не указана, то валюта счета
+	Currency string
+}
+
+// Config - Конфигурация симулятора
+type Config struct {
+	// AccountId - Идентификатор счета, по умолчанию = DEFAULT_ACCOUNT_ID
+	AccountId string
+	// Currency - Валюта счета, по умолчанию = rub
+	Currency string
+	// InitialBalance - Начальный баланс денежных средств
+	InitialBalance float64
+	// Commission - Комиссия за сделку в процентах от объема сделки
+	Commission float64
+	// AllowShort - Разрешение на открытие коротких позиций
+	AllowShort bool
+	// Instruments - Инструменты, которыми можно торговать
+	Instruments []Instrument
+	// Logger - Логгер, может быть nil
+	Logger investgo.Logger
+	// Clock - Часы, которые переводятся на время каждого обработанного события. Если передать их же
+	// в investgo.Config.Clock, то таймер и другие компоненты сдк работают по времени бэктеста. Может быть nil
+	Clock *investgo.SimulatedClock
+}
+
+// Event - Событие ленты рыночных данных, должно быть заполнено одно из полей Candle, Trade или OrderBook
+type Event struct {
+	// InstrumentId - Идентификатор инструмента для свечи, для сделок и стаканов берется из самого события
+	InstrumentId string
+	Candle       *pb.HistoricCandle
+	Trade        *pb.Trade
+	OrderBook    *pb.OrderBook
+}
+
+// Time - Время события
+func (e Event) Time() time.Time {
+	switch {
+	case e.Candle != nil:
+		return e.Candle.GetTime().AsTime()
+	case e.Trade != nil:
+		return e.Trade.GetTime().AsTime()
+	case e.OrderBook != nil:
+		return e.OrderBook.GetTime().AsTime()
+	}
+	return time.Time{}
+}
+
+// CandleEvents - Преобразование исторических свечей инструмента в события для воспроизведения
+func CandleEvents(instrumentId string, candles []*pb.HistoricCandle) []Event {
+	events := make([]Event, 0, len(candles))
+	for _, c := range candles {
+		events = append(events, Event{InstrumentId: instrumentId, Candle: c})
+	}
+	return events
+}
+
+// SortEvents - Сортировка событий нескольких инструментов по времени
+func SortEvents(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time().Before(events[j].Time())
+	})
+}
+
+// level - Уровень стакана
+type level struct {
+	price    decimal.Decimal
+	quantity int64
+}
+
+// market - Текущее состояние рынка по инструменту
+type market struct {
+	lastPrice decimal.Decimal
+	hasPrice  bool
+	bids      []level
+	asks      []level
+}
+
+// Exchange - Симулятор биржи
+type Exchange struct {
+	config     Config
+	commission decimal.Decimal
+
+	mu          sync.Mutex
+	now         time.Time
+	instruments map[string]*Instrument
+	markets     map[string]*market
+	account     *account
+	orders      map[string]*order
+	requests    map[string]*order
+	stopOrders  map[string]*stopOrder
+	tradeSeq    int64
+
+	subsMu sync.Mutex
+	subs   map[chan *pb.OrderTrades]struct{}
+}
+
+// NewExchange - Создание симулятора биржи
+func NewExchange(conf Config) *Exchange {
+	if conf.AccountId == "" {
+		conf.AccountId = DEFAULT_ACCOUNT_ID
+	}
+	if conf.Currency == "" {
+		conf.Currency = "rub"
+	}
+	e := &Exchange{
+		config:      conf,
+		commission:  decimal.NewFromFloat(conf.Commission).Div(decimal.NewFromInt(100)),
+		instruments: make(map[string]*Instrument, len(conf.Instruments)*2),
+		markets:     make(map[string]*market, len(conf.Instruments)),
+		orders:      make(map[string]*order),
+		requests:    make(map[string]*order),
+		stopOrders:  make(map[string]*stopOrder),
+		subs:        make(map[chan *pb.OrderTrades]struct{}),
+	}
+	for i := range conf.Instruments {
+		inst := conf.Instruments[i]
+		if inst.Lot < 1 {
+			inst.Lot = 1
+		}
+		if inst.Currency == "" {
+			inst.Currency = conf.Currency
+		}
+		if inst.Uid != "" {
+			e.instruments[inst.Uid] = &inst
+		}
+		if inst.Figi != "" {
+			e.instruments[inst.Figi] = &inst
+		}
+		e.markets[inst.Uid] = &market{}
+	}
+	e.account = newAccount(conf.AccountId, conf.Currency, decimal.NewFromFloat(conf.InitialBalance))
+	return e
+}
+
+// AccountId - Идентификатор счета симулятора, его нужно указать в investgo.Config
+func (e *Exchange) AccountId() string {
+	return e.config.AccountId
+}
+
+// Now - Текущее время симулятора, это время последнего обработанного события
+func (e *Exchange) Now() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.time()
+}
+
+func (e *Exchange) time() time.Time {
+	if e.now.IsZero() {
+		if e.config.Clock != nil {
+			return e.config.Clock.Now()
+		}
+		return time.Now()
+	}
+	return e.now
+}
+
+// Register - Регистрация сервисов симулятора на grpc сервере
+func (e *Exchange) Register(s *grpc.Server) {
+	pb.RegisterOrdersServiceServer(s, &ordersServer{e: e})
+	pb.RegisterStopOrdersServiceServer(s, &stopOrdersServer{e: e})
+	pb.RegisterOperationsServiceServer(s, &operationsServer{e: e})
+	pb.RegisterOrdersStreamServiceServer(s, &ordersStreamServer{e: e})
+}
+
+// ListenAndServe - Запуск grpc сервера симулятора на addr, блокирующий метод, завершается по завершению контекста
+func (e *Exchange) ListenAndServe(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	e.Register(s)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	e.infof("simulator listening on %v", lis.Addr())
+	return s.Serve(lis)
+}
+
+// Replay - Воспроизведение ленты событий. Если speed > 0, то между событиями выдерживаются паузы,
+// пропорциональные разнице их времени (speed = 1 - реальное время, speed = 60 - минута за секунду),
+// если speed = 0, события обрабатываются без пауз
+func (e *Exchange) Replay(ctx context.Context, events []Event, speed float64) error {
+	var prev time.Time
+	for _, ev := range events {
+		if speed > 0 && !prev.IsZero() {
+			pause := time.Duration(float64(ev.Time().Sub(prev)) / speed)
+			if pause > 0 {
+				t := time.NewTimer(pause)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return nil
+				case <-t.C:
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err := e.Process(ev); err != nil {
+			return err
+		}
+		prev = ev.Time()
+	}
+	return nil
+}
+
+// Process - Обработка одного события: обновление рынка, срабатывание стоп-заявок и исполнение заявок
+func (e *Exchange) Process(ev Event) error {
+	e.mu.Lock()
+	var (
+		trades []*pb.OrderTrades
+		err    error
+	)
+	switch {
+	case ev.Candle != nil:
+		trades, err = e.processCandle(ev.InstrumentId, ev.Candle)
+	case ev.Trade != nil:
+		trades, err = e.processTrade(ev.Trade)
+	case ev.OrderBook != nil:
+		trades, err = e.processOrderBook(ev.OrderBook)
+	default:
+		err = fmt.Errorf("empty event")
+	}
+	now := e.now
+	e.mu.Unlock()
+	if e.config.Clock != nil && now.After(e.config.Clock.Now()) {
+		e.config.Clock.Set(now)
+	}
+	e.publish(trades)
+	return err
+}
+
+// instrument - Поиск инструмента по uid или figi
+func (e *Exchange) instrument(id string) (*Instrument, error) {
+	inst, ok := e.instruments[id]
+	if !ok {
+		return nil, fmt.Errorf("instrument %v not found", id)
+	}
+	return inst, nil
+}
+
+func (e *Exchange) processCandle(id string, c *pb.HistoricCandle) ([]*pb.OrderTrades, error) {
+	inst, err := e.instrument(id)
+	if err != nil {
+		return nil, err
+	}
+	e.advance(c.GetTime().AsTime())
+	open := investgo.QuotationToDecimal(c.GetOpen())
+	high := investgo.QuotationToDecimal(c.GetHigh())
+	low := investgo.QuotationToDecimal(c.GetLow())
+	m := e.markets[inst.Uid]
+	m.bids, m.asks = nil, nil
+	m.lastPrice, m.hasPrice = open, true
+
+	trades := e.triggerStopOrders(inst, low, high, open)
+	trades = append(trades, e.matchRange(inst, low, high, open, 0)...)
+	m.lastPrice = investgo.QuotationToDecimal(c.GetClose())
+	return trades, nil
+}
+
+func (e *Exchange) processTrade(t *pb.Trade) ([]*pb.OrderTrades, error) {
+	id := t.GetInstrumentUid()
+	if id == "" {
+		id = t.GetFigi()
+	}
+	inst, err := e.instrument(id)
+	if err != nil {
+		return nil, err
+	}
+	e.advance(t.GetTime().AsTime())
+	price := investgo.QuotationToDecimal(t.GetPrice())
+	m := e.markets[inst.Uid]
+	m.lastPrice, m.hasPrice = price, true
+
+	trades := e.triggerStopOrders(inst, price, price, price)
+	trades = append(trades, e.matchRange(inst, price, price, price, t.GetQuantity())...)
+	return trades, nil
+}
+
+func (e *Exchange) processOrderBook(ob *pb.OrderBook) ([]*pb.OrderTrades, error) {
+	id := ob.GetInstrumentUid()
+	if id == "" {
+		id = ob.GetFigi()
+	}
+	inst, err := e.instrument(id)
+	if err != nil {
+		return nil, err
+	}
+	e.advance(ob.GetTime().AsTime())
+	m := e.markets[inst.Uid]
+	m.bids = levels(ob.GetBids())
+	m.asks = levels(ob.GetAsks())
+	if len(m.bids) == 0 || len(m.asks) == 0 {
+		return nil, nil
+	}
+	bid, ask := m.bids[0].price, m.asks[0].price
+	m.lastPrice, m.hasPrice = bid.Add(ask).Div(decimal.NewFromInt(2)), true
+
+	trades := e.triggerStopOrders(inst, bid, ask, m.lastPrice)
+	trades = append(trades, e.matchBook(inst)...)
+	return trades, nil
+}
+
+// advance - Сдвиг времени симулятора и снятие просроченных стоп-заявок
+func (e *Exchange) advance(t time.Time) {
+	if t.After(e.now) {
+		e.now = t
+	}
+	for id, so := range e.stopOrders {
+		if !so.expireDate.IsZero() && e.now.After(so.expireDate) {
+			e.infof("stop order %v expired", id)
+			delete(e.stopOrders, id)
+		}
+	}
+}
+
+func levels(orders []*pb.Order) []level {
+	res := make([]level, 0, len(orders))
+	for _, o := range orders {
+		res = append(res, level{
+			price:    investgo.QuotationToDecimal(o.GetPrice()),
+			quantity: o.GetQuantity(),
+		})
+	}
+	return res
+}
+
+// subscribe - Подписка на события исполнения заявок
+func (e *Exchange) subscribe() chan *pb.OrderTrades {
+	ch := make(chan *pb.OrderTrades, 100)
+	e.subsMu.Lock()
+	e.subs[ch] = struct{}{}
+	e.subsMu.Unlock()
+	return ch
+}
+
+func (e *Exchange) unsubscribe(ch chan *pb.OrderTrades) {
+	e.subsMu.Lock()
+	delete(e.subs, ch)
+	e.subsMu.Unlock()
+}
+
+// publish - Отправка событий исполнения подписчикам, при переполнении буфера подписчика событие отбрасывается
+func (e *Exchange) publish(trades []*pb.OrderTrades) {
+	if len(trades) == 0 {
+		return
+	}
+	e.subsMu.Lock()
+	defer e.subsMu.Unlock()
+	for ch := range e.subs {
+		for _, t := range trades {
+			select {
+			case ch <- t:
+			default:
+				e.errorf("trades stream subscriber is too slow, order trades %v dropped", t.GetOrderId())
+			}
+		}
+	}
+}
+
+func (e *Exchange) checkAccount(accountId string) error {
+	if !strings.EqualFold(accountId, e.config.AccountId) {
+		return fmt.Errorf("account %v not found", accountId)
+	}
+	return nil
+}
+
+func (e *Exchange) infof(template string, args ...any) {
+	if e.config.Logger != nil {
+		e.config.Logger.Infof(template, args...)
+	}
+}
+
+func (e *Exchange) errorf(template string, args ...any) {
+	if e.config.Logger != nil {
+		e.config.Logger.Errorf(template, args...)
+	}
+}
@@ -0,0 +1,628 @@
+package simulator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const testUid = "uid"
+
+var testStart = time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+func newTestExchange(balance float64, allowShort bool) *Exchange {
+	return NewExchange(Config{
+		InitialBalance: balance,
+		AllowShort:     allowShort,
+		Instruments: []Instrument{{
+			Uid:               testUid,
+			Figi:              "figi",
+			Lot:               10,
+			MinPriceIncrement: &pb.Quotation{Nano: 10000000},
+		}},
+	})
+}
+
+func quotation(v float64) *pb.Quotation {
+	return investgo.DecimalToQuotation(decimal.NewFromFloat(v))
+}
+
+func candle(minute int, open, high, low, close float64) Event {
+	return Event{InstrumentId: testUid, Candle: &pb.HistoricCandle{
+		Open:  quotation(open),
+		High:  quotation(high),
+		Low:   quotation(low),
+		Close: quotation(close),
+		Time:  investgo.TimeToTimestamp(testStart.Add(time.Duration(minute) * time.Minute)),
+	}}
+}
+
+func trade(minute int, price float64, lots int64) Event {
+	return Event{Trade: &pb.Trade{
+		InstrumentUid: testUid,
+		Price:         quotation(price),
+		Quantity:      lots,
+		Time:          investgo.TimeToTimestamp(testStart.Add(time.Duration(minute) * time.Minute)),
+	}}
+}
+
+func book(minute int, bid, ask float64, lots int64) Event {
+	return Event{OrderBook: &pb.OrderBook{
+		InstrumentUid: testUid,
+		Bids:          []*pb.Order{{Price: quotation(bid), Quantity: lots}},
+		Asks:          []*pb.Order{{Price: quotation(ask), Quantity: lots}},
+		Time:          investgo.TimeToTimestamp(testStart.Add(time.Duration(minute) * time.Minute)),
+	}}
+}
+
+func limitOrder(direction pb.OrderDirection, lots int64, price float64) *pb.PostOrderRequest {
+	return &pb.PostOrderRequest{
+		InstrumentId: testUid,
+		AccountId:    DEFAULT_ACCOUNT_ID,
+		Quantity:     lots,
+		Price:        quotation(price),
+		Direction:    direction,
+		OrderType:    pb.OrderType_ORDER_TYPE_LIMIT,
+	}
+}
+
+func marketOrder(direction pb.OrderDirection, lots int64) *pb.PostOrderRequest {
+	return &pb.PostOrderRequest{
+		InstrumentId: testUid,
+		AccountId:    DEFAULT_ACCOUNT_ID,
+		Quantity:     lots,
+		Direction:    direction,
+		OrderType:    pb.OrderType_ORDER_TYPE_MARKET,
+	}
+}
+
+func process(t *testing.T, e *Exchange, events ...Event) {
+	t.Helper()
+	for _, ev := range events {
+		if err := e.Process(ev); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+}
+
+func (e *Exchange) testPosition() int64 {
+	if p, ok := e.account.positions[testUid]; ok {
+		return p.Quantity
+	}
+	return 0
+}
+
+func (e *Exchange) testMoney() float64 {
+	return e.account.money["rub"].InexactFloat64()
+}
+
+const (
+	orderBuy  = pb.OrderDirection_ORDER_DIRECTION_BUY
+	orderSell = pb.OrderDirection_ORDER_DIRECTION_SELL
+
+	statusNew       = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW
+	statusFill      = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL
+	statusPartial   = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL
+	statusCancelled = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+)
+
+func TestOrderMatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []Event
+		order    *pb.PostOrderRequest
+		after    []Event
+		status   pb.OrderExecutionReportStatus
+		executed int64
+		// price - Средняя цена исполнения за штуку
+		price    float64
+		position int64
+	}{
+		{
+			name:   "limit buy rests below market",
+			before: []Event{candle(0, 100, 101, 99, 100)},
+			order:  limitOrder(orderBuy, 1, 95),
+			after:  []Event{candle(1, 100, 101, 96, 98)},
+			status: statusNew,
+		},
+		{
+			name:     "limit buy fills when candle reaches price",
+			before:   []Event{candle(0, 100, 101, 99, 100)},
+			order:    limitOrder(orderBuy, 2, 95),
+			after:    []Event{candle(1, 97, 98, 94, 96)},
+			status:   statusFill,
+			executed: 2,
+			price:    95,
+			position: 20,
+		},
+		{
+			name:     "limit buy fills at open after gap down",
+			before:   []Event{candle(0, 100, 101, 99, 100)},
+			order:    limitOrder(orderBuy, 1, 95),
+			after:    []Event{candle(1, 90, 92, 89, 91)},
+			status:   statusFill,
+			executed: 1,
+			price:    90,
+			position: 10,
+		},
+		{
+			name:     "marketable limit fills immediately at last price",
+			before:   []Event{candle(0, 100, 101, 99, 100)},
+			order:    limitOrder(orderBuy, 1, 105),
+			status:   statusFill,
+			executed: 1,
+			price:    100,
+			position: 10,
+		},
+		{
+			name:     "market buy fills at last price",
+			before:   []Event{candle(0, 100, 101, 99, 102)},
+			order:    marketOrder(orderBuy, 3),
+			status:   statusFill,
+			executed: 3,
+			price:    102,
+			position: 30,
+		},
+		{
+			name:     "market buy walks the order book",
+			before:   []Event{book(0, 99, 100, 2)},
+			order:    marketOrder(orderBuy, 3),
+			status:   statusCancelled,
+			executed: 2,
+			price:    100,
+			position: 20,
+		},
+		{
+			name:     "limit partially filled by trade volume",
+			before:   []Event{trade(0, 100, 1)},
+			order:    limitOrder(orderBuy, 5, 98),
+			after:    []Event{trade(1, 98, 2), trade(2, 99, 10)},
+			status:   statusPartial,
+			executed: 2,
+			price:    98,
+			position: 20,
+		},
+		{
+			name:     "limit partially filled by order book liquidity",
+			before:   []Event{book(0, 100, 101, 1)},
+			order:    limitOrder(orderBuy, 3, 101),
+			status:   statusPartial,
+			executed: 1,
+			price:    101,
+			position: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExchange(10000, false)
+			process(t, e, tt.before...)
+			o, _, err := e.postOrder(tt.order)
+			if err != nil {
+				t.Fatalf("postOrder: %v", err)
+			}
+			process(t, e, tt.after...)
+			if o.status != tt.status {
+				t.Errorf("status = %v, want %v", o.status, tt.status)
+			}
+			if o.lotsExecuted != tt.executed {
+				t.Errorf("executed = %v, want %v", o.lotsExecuted, tt.executed)
+			}
+			if tt.executed > 0 {
+				avg := o.executedAmount.Div(decimal.NewFromInt(o.lotsExecuted * o.instrument.Lot)).InexactFloat64()
+				if avg != tt.price {
+					t.Errorf("price = %v, want %v", avg, tt.price)
+				}
+			}
+			if got := e.testPosition(); got != tt.position {
+				t.Errorf("position = %v, want %v", got, tt.position)
+			}
+			if spent := 10000 - e.testMoney(); spent != o.executedAmount.InexactFloat64() {
+				t.Errorf("spent = %v, want %v", spent, o.executedAmount)
+			}
+		})
+	}
+}
+
+func TestStopOrders(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction pb.StopOrderDirection
+		orderType pb.StopOrderType
+		stop      float64
+		price     float64
+		next      Event
+		triggered bool
+		// fillPrice - Цена исполнения, 0 - заявка не исполнена
+		fillPrice float64
+	}{
+		{
+			name:      "stop loss sell triggers on fall",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_STOP_LOSS,
+			stop:      95,
+			next:      candle(1, 99, 100, 94, 96),
+			triggered: true,
+			fillPrice: 95,
+		},
+		{
+			name:      "stop loss sell fills at open after gap",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_STOP_LOSS,
+			stop:      95,
+			next:      candle(1, 90, 91, 89, 90),
+			triggered: true,
+			fillPrice: 90,
+		},
+		{
+			name:      "stop loss sell waits above stop price",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_STOP_LOSS,
+			stop:      95,
+			next:      candle(1, 99, 100, 96, 97),
+		},
+		{
+			name:      "take profit sell triggers on rise",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT,
+			stop:      105,
+			next:      candle(1, 101, 106, 100, 104),
+			triggered: true,
+			fillPrice: 105,
+		},
+		{
+			name:      "take profit sell fills at open after gap",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT,
+			stop:      105,
+			next:      candle(1, 108, 109, 107, 108),
+			triggered: true,
+			fillPrice: 108,
+		},
+		{
+			name:      "take profit sell waits below target",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT,
+			stop:      105,
+			next:      candle(1, 99, 100, 94, 96),
+		},
+		{
+			name:      "stop limit places limit order",
+			direction: pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL,
+			orderType: pb.StopOrderType_STOP_ORDER_TYPE_STOP_LIMIT,
+			stop:      95,
+			price:     100,
+			next:      candle(1, 98, 99, 94, 96),
+			triggered: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExchange(10000, false)
+			process(t, e, candle(0, 100, 101, 99, 100))
+			if _, _, err := e.postOrder(marketOrder(orderBuy, 1)); err != nil {
+				t.Fatalf("postOrder: %v", err)
+			}
+			so, err := e.postStopOrder(&pb.PostStopOrderRequest{
+				InstrumentId:  testUid,
+				AccountId:     DEFAULT_ACCOUNT_ID,
+				Quantity:      1,
+				Price:         quotation(tt.price),
+				StopPrice:     quotation(tt.stop),
+				Direction:     tt.direction,
+				StopOrderType: tt.orderType,
+			})
+			if err != nil {
+				t.Fatalf("postStopOrder: %v", err)
+			}
+			process(t, e, tt.next)
+			if _, active := e.stopOrders[so.id]; active == tt.triggered {
+				t.Fatalf("stop order active = %v, want %v", active, !tt.triggered)
+			}
+			o, placed := e.orders[so.id]
+			if placed != tt.triggered {
+				t.Fatalf("order placed = %v, want %v", placed, tt.triggered)
+			}
+			if !placed {
+				return
+			}
+			if tt.fillPrice == 0 {
+				if o.status != statusNew || o.price.InexactFloat64() != tt.price {
+					t.Fatalf("order = %v at %v, want active limit at %v", o.status, o.price, tt.price)
+				}
+				return
+			}
+			if o.status != statusFill {
+				t.Fatalf("status = %v, want FILL", o.status)
+			}
+			if got := o.executedAmount.InexactFloat64() / 10; got != tt.fillPrice {
+				t.Errorf("fill price = %v, want %v", got, tt.fillPrice)
+			}
+			if e.testPosition() != 0 {
+				t.Errorf("position = %v, want 0", e.testPosition())
+			}
+		})
+	}
+}
+
+func TestStopOrderExpiration(t *testing.T) {
+	e := newTestExchange(10000, false)
+	process(t, e, candle(0, 100, 101, 99, 100))
+	so, err := e.postStopOrder(&pb.PostStopOrderRequest{
+		InstrumentId:   testUid,
+		AccountId:      DEFAULT_ACCOUNT_ID,
+		Quantity:       1,
+		StopPrice:      quotation(110),
+		Direction:      pb.StopOrderDirection_STOP_ORDER_DIRECTION_BUY,
+		StopOrderType:  pb.StopOrderType_STOP_ORDER_TYPE_STOP_LOSS,
+		ExpirationType: pb.StopOrderExpirationType_STOP_ORDER_EXPIRATION_TYPE_GOOD_TILL_DATE,
+		ExpireDate:     investgo.TimeToTimestamp(testStart.Add(5 * time.Minute)),
+	})
+	if err != nil {
+		t.Fatalf("postStopOrder: %v", err)
+	}
+	process(t, e, candle(10, 100, 120, 99, 115))
+	if _, ok := e.stopOrders[so.id]; ok {
+		t.Fatal("expired stop order must be removed")
+	}
+	if _, ok := e.orders[so.id]; ok {
+		t.Fatal("expired stop order must not be triggered")
+	}
+}
+
+func TestPostOrderValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		short bool
+		req   *pb.PostOrderRequest
+		code  codes.Code
+		err   error
+	}{
+		{name: "unknown instrument", req: &pb.PostOrderRequest{InstrumentId: "x", AccountId: DEFAULT_ACCOUNT_ID, Quantity: 1, Direction: orderBuy, OrderType: pb.OrderType_ORDER_TYPE_MARKET}, code: codes.NotFound},
+		{name: "unknown account", req: &pb.PostOrderRequest{InstrumentId: testUid, AccountId: "x", Quantity: 1, Direction: orderBuy, OrderType: pb.OrderType_ORDER_TYPE_MARKET}, code: codes.NotFound},
+		{name: "zero quantity", req: limitOrder(orderBuy, 0, 100), code: codes.InvalidArgument},
+		{name: "price step", req: limitOrder(orderBuy, 1, 100.005), code: codes.InvalidArgument},
+		{name: "not enough money", req: limitOrder(orderBuy, 20, 100), code: codes.InvalidArgument, err: ErrNotEnoughMoney},
+		{name: "not enough money for market", req: marketOrder(orderBuy, 20), code: codes.InvalidArgument, err: ErrNotEnoughMoney},
+		{name: "not enough assets", req: limitOrder(orderSell, 1, 100), code: codes.InvalidArgument, err: ErrNotEnoughAssets},
+		{name: "short allowed", short: true, req: limitOrder(orderSell, 1, 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExchange(10000, tt.short)
+			process(t, e, candle(0, 100, 101, 99, 100))
+			o, _, err := e.postOrder(tt.req)
+			if tt.code == codes.OK {
+				if err != nil {
+					t.Fatalf("postOrder: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != tt.code {
+				t.Fatalf("err = %v, want code %v", err, tt.code)
+			}
+			if tt.err != nil && !strings.Contains(status.Convert(err).Message(), tt.err.Error()) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if o != nil || len(e.orders) != 0 {
+				t.Fatal("rejected order must not be registered")
+			}
+		})
+	}
+}
+
+func TestFillRejectedWhenBalanceChanged(t *testing.T) {
+	e := newTestExchange(1500, false)
+	process(t, e, candle(0, 100, 101, 99, 100))
+	first, _, err := e.postOrder(limitOrder(orderBuy, 1, 95))
+	if err != nil {
+		t.Fatalf("postOrder: %v", err)
+	}
+	second, _, err := e.postOrder(limitOrder(orderBuy, 1, 95))
+	if err != nil {
+		t.Fatalf("postOrder: %v", err)
+	}
+	// средства не резервируются: на обе заявки денег не хватает, одна из них отклоняется при исполнении
+	process(t, e, candle(1, 96, 97, 94, 95))
+	statuses := map[pb.OrderExecutionReportStatus]int{first.status: 1}
+	statuses[second.status]++
+	if statuses[statusFill] != 1 || statuses[pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED] != 1 {
+		t.Errorf("statuses = %v, %v, want one FILL and one REJECTED", first.status, second.status)
+	}
+	if got := e.testMoney(); got != 550 {
+		t.Errorf("money = %v, want 550", got)
+	}
+}
+
+func TestCancelAndReplaceOrder(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// replace - Новая цена и количество
+		price float64
+		lots  int64
+		code  codes.Code
+	}{
+		{name: "replace", price: 96, lots: 2},
+		{name: "bad price step keeps old order", price: 96.005, lots: 2, code: codes.InvalidArgument},
+		{name: "not enough money keeps old order", price: 96, lots: 50, code: codes.InvalidArgument},
+		{name: "zero quantity keeps old order", price: 96, code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExchange(10000, false)
+			s := &ordersServer{e: e}
+			process(t, e, candle(0, 100, 101, 99, 100))
+			posted, err := s.PostOrder(ctx, limitOrder(orderBuy, 1, 95))
+			if err != nil {
+				t.Fatalf("PostOrder: %v", err)
+			}
+			resp, err := s.ReplaceOrder(ctx, &pb.ReplaceOrderRequest{
+				AccountId:      DEFAULT_ACCOUNT_ID,
+				OrderId:        posted.GetOrderId(),
+				IdempotencyKey: "key",
+				Quantity:       tt.lots,
+				Price:          quotation(tt.price),
+			})
+			old := e.orders[posted.GetOrderId()]
+			if tt.code != codes.OK {
+				if status.Code(err) != tt.code {
+					t.Fatalf("err = %v, want code %v", err, tt.code)
+				}
+				if old.status != statusNew {
+					t.Fatalf("old order status = %v, want NEW", old.status)
+				}
+				if len(e.orders) != 1 || len(e.requests) != 0 {
+					t.Fatalf("orders = %v, requests = %v, want only the old order", len(e.orders), len(e.requests))
+				}
+				// старая заявка продолжает исполняться
+				process(t, e, candle(1, 96, 97, 94, 95))
+				if old.status != statusFill || e.testPosition() != 10 {
+					t.Fatalf("old order status = %v, position = %v", old.status, e.testPosition())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReplaceOrder: %v", err)
+			}
+			if old.status != statusCancelled {
+				t.Fatalf("old order status = %v, want CANCELLED", old.status)
+			}
+			again, err := s.ReplaceOrder(ctx, &pb.ReplaceOrderRequest{
+				AccountId:      DEFAULT_ACCOUNT_ID,
+				OrderId:        posted.GetOrderId(),
+				IdempotencyKey: "key",
+				Quantity:       tt.lots,
+				Price:          quotation(tt.price),
+			})
+			if err != nil || again.GetOrderId() != resp.GetOrderId() {
+				t.Fatalf("idempotent replace = %v, %v", again.GetOrderId(), err)
+			}
+			process(t, e, candle(1, 97, 98, 95.5, 96))
+			if got := e.orders[resp.GetOrderId()]; got.status != statusFill || got.lotsExecuted != tt.lots {
+				t.Fatalf("new order = %v %v", got.status, got.lotsExecuted)
+			}
+			if e.testPosition() != tt.lots*10 {
+				t.Fatalf("position = %v", e.testPosition())
+			}
+
+			if _, err := s.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: DEFAULT_ACCOUNT_ID, OrderId: resp.GetOrderId()}); status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("cancel of filled order err = %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	e := newTestExchange(10000, false)
+	s := &ordersServer{e: e}
+	process(t, e, candle(0, 100, 101, 99, 100))
+	posted, err := s.PostOrder(ctx, limitOrder(orderBuy, 1, 95))
+	if err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+	if _, err := s.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: DEFAULT_ACCOUNT_ID, OrderId: posted.GetOrderId()}); err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+	process(t, e, candle(1, 96, 97, 90, 95))
+	if got := e.orders[posted.GetOrderId()].status; got != statusCancelled {
+		t.Fatalf("status = %v, want CANCELLED", got)
+	}
+	if e.testPosition() != 0 || e.testMoney() != 10000 {
+		t.Fatalf("cancelled order must not be executed")
+	}
+	if _, err := s.CancelOrder(ctx, &pb.CancelOrderRequest{AccountId: DEFAULT_ACCOUNT_ID, OrderId: "x"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("cancel of unknown order err = %v", err)
+	}
+}
+
+func TestSellAndShort(t *testing.T) {
+	e := newTestExchange(10000, true)
+	process(t, e, candle(0, 100, 101, 99, 100))
+	if _, _, err := e.postOrder(marketOrder(orderSell, 2)); err != nil {
+		t.Fatalf("postOrder: %v", err)
+	}
+	if got := e.testPosition(); got != -20 {
+		t.Fatalf("position = %v, want -20", got)
+	}
+	if got := e.testMoney(); got != 12000 {
+		t.Fatalf("money = %v, want 12000", got)
+	}
+	process(t, e, candle(1, 90, 91, 89, 90))
+	if _, _, err := e.postOrder(marketOrder(orderBuy, 2)); err != nil {
+		t.Fatalf("postOrder: %v", err)
+	}
+	if got := e.testPosition(); got != 0 {
+		t.Fatalf("position = %v, want 0", got)
+	}
+	if got := e.testMoney(); got != 10200 {
+		t.Fatalf("money = %v, want 10200", got)
+	}
+}
+
+// TestConcurrentQueries - Ответы сервисов сериализуются без мьютекса биржи, пока Process исполняет заявку
+func TestConcurrentQueries(t *testing.T) {
+	ctx := context.Background()
+	e := newTestExchange(1e9, false)
+	orders, operations := &ordersServer{e: e}, &operationsServer{e: e}
+	process(t, e, candle(0, 100, 101, 99, 100))
+	posted, err := orders.PostOrder(ctx, limitOrder(orderBuy, 1000, 98))
+	if err != nil {
+		t.Fatalf("PostOrder: %v", err)
+	}
+
+	stop := make(chan struct{})
+	queried := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				queried <- nil
+				return
+			default:
+			}
+			ops, err := operations.GetOperations(ctx, &pb.OperationsRequest{AccountId: DEFAULT_ACCOUNT_ID, Figi: testUid})
+			if err != nil {
+				queried <- err
+				return
+			}
+			items, err := operations.GetOperationsByCursor(ctx, &pb.GetOperationsByCursorRequest{AccountId: DEFAULT_ACCOUNT_ID})
+			if err != nil {
+				queried <- err
+				return
+			}
+			state, err := orders.GetOrderState(ctx, &pb.GetOrderStateRequest{AccountId: DEFAULT_ACCOUNT_ID, OrderId: posted.GetOrderId()})
+			if err != nil {
+				queried <- err
+				return
+			}
+			// сериализация, как в gRPC после возврата из обработчика
+			for _, m := range []proto.Message{ops, items, state} {
+				if _, err := proto.Marshal(m); err != nil {
+					queried <- err
+					return
+				}
+			}
+		}
+	}()
+	// заявка исполняется по одному лоту, операция и сделки заявки меняются на каждом шаге
+	for i := 1; i <= 500; i++ {
+		process(t, e, trade(i, 98, 1))
+	}
+	close(stop)
+	if err := <-queried; err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	state, err := orders.GetOrderState(ctx, &pb.GetOrderStateRequest{AccountId: DEFAULT_ACCOUNT_ID, OrderId: posted.GetOrderId()})
+	if err != nil || state.GetLotsExecuted() != 500 {
+		t.Fatalf("order state = %v, %v", state, err)
+	}
+}
@@ -0,0 +1,680 @@
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/internal/matching"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// order - Биржевая заявка
+type order struct {
+	id         string
+	requestId  string
+	instrument *Instrument
+	direction  pb.OrderDirection
+	orderType  pb.OrderType
+	price      decimal.Decimal
+	created    time.Time
+
+	lotsRequested int64
+	lotsExecuted  int64
+	status        pb.OrderExecutionReportStatus
+	stages        []*pb.OrderStage
+	// executedAmount - Сумма исполненных сделок без комиссии
+	executedAmount decimal.Decimal
+	commission     decimal.Decimal
+
+	operation    *pb.Operation
+	feeOperation *pb.Operation
+}
+
+func (o *order) active() bool {
+	return o.status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW ||
+		o.status == pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL
+}
+
+func (o *order) remaining() int64 {
+	return o.lotsRequested - o.lotsExecuted
+}
+
+// stopOrder - Стоп-заявка
+type stopOrder struct {
+	id         string
+	instrument *Instrument
+	direction  pb.StopOrderDirection
+	orderType  pb.StopOrderType
+	lots       int64
+	price      decimal.Decimal
+	stopPrice  decimal.Decimal
+	created    time.Time
+	expireDate time.Time
+}
+
+// triggersUp - Стоп-заявка срабатывает при росте цены до стоп-цены, иначе при падении
+func (so *stopOrder) triggersUp() bool {
+	buy := so.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_BUY
+	if so.orderType == pb.StopOrderType_STOP_ORDER_TYPE_TAKE_PROFIT {
+		// тейк-профит на продажу срабатывает при росте цены, на покупку при падении
+		return !buy
+	}
+	// стоп-лосс и стоп-лимит на покупку срабатывают при росте цены, на продажу при падении
+	return buy
+}
+
+// postOrder - Выставление заявки, вызывается под мьютексом
+func (e *Exchange) postOrder(req *pb.PostOrderRequest) (*order, []*pb.OrderTrades, error) {
+	if o, ok := e.requests[req.GetOrderId()]; ok && req.GetOrderId() != "" {
+		if err := e.checkAccount(req.GetAccountId()); err != nil {
+			return nil, nil, status.Error(codes.NotFound, err.Error())
+		}
+		// повторный запрос с тем же ключом идемпотентности
+		return o, nil, nil
+	}
+	o, err := e.newOrder(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	trades, err := e.submit(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.requestId != "" {
+		e.requests[o.requestId] = o
+	}
+	return o, trades, nil
+}
+
+// newOrder - Проверка запроса и создание заявки без выставления, вызывается под мьютексом
+func (e *Exchange) newOrder(req *pb.PostOrderRequest) (*order, error) {
+	if err := e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	id := req.GetInstrumentId()
+	if id == "" {
+		id = req.GetFigi()
+	}
+	inst, err := e.instrument(id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if req.GetQuantity() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must be positive")
+	}
+	if req.GetDirection() == pb.OrderDirection_ORDER_DIRECTION_UNSPECIFIED {
+		return nil, status.Error(codes.InvalidArgument, "direction is unspecified")
+	}
+	o := &order{
+		id:            investgo.CreateUid(),
+		requestId:     req.GetOrderId(),
+		instrument:    inst,
+		direction:     req.GetDirection(),
+		orderType:     req.GetOrderType(),
+		created:       e.time(),
+		lotsRequested: req.GetQuantity(),
+		status:        pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW,
+	}
+	switch o.orderType {
+	case pb.OrderType_ORDER_TYPE_LIMIT:
+		o.price = investgo.QuotationToDecimal(req.GetPrice())
+		if err := checkPriceStep(inst, o.price); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	case pb.OrderType_ORDER_TYPE_MARKET, pb.OrderType_ORDER_TYPE_BESTPRICE:
+		if !e.markets[inst.Uid].hasPrice {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("no market data for %v", inst.Uid))
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "order type is unspecified")
+	}
+	if err := e.checkFunds(o); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return o, nil
+}
+
+// checkFunds - Проверка, что на счете достаточно денег для покупки или бумаг для продажи всей заявки.
+// Рыночная заявка оценивается по цене последней сделки. Проверка при выставлении не резервирует средства,
+// при исполнении баланс проверяется снова
+func (e *Exchange) checkFunds(o *order) error {
+	inst := o.instrument
+	pieces := o.lotsRequested * inst.Lot
+	price := o.price
+	if o.orderType != pb.OrderType_ORDER_TYPE_LIMIT {
+		price = e.markets[inst.Uid].lastPrice
+	}
+	var held int64
+	if p, ok := e.account.positions[inst.Uid]; ok {
+		held = p.Quantity
+	}
+	commission := price.Mul(decimal.NewFromInt(pieces)).Mul(e.commission).Round(2)
+	return matching.Check(e.account.money[inst.Currency], held, o.direction, price, pieces, commission, e.config.AllowShort)
+}
+
+// submit - Регистрация заявки и попытка немедленного исполнения
+func (e *Exchange) submit(o *order) ([]*pb.OrderTrades, error) {
+	m := e.markets[o.instrument.Uid]
+	if o.orderType != pb.OrderType_ORDER_TYPE_LIMIT {
+		e.orders[o.id] = o
+		trades := e.fillMarket(o, m.lastPrice)
+		if o.active() {
+			// неисполненный остаток рыночной заявки снимается
+			o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+		}
+		if o.lotsExecuted == 0 {
+			o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED
+		}
+		return trades, nil
+	}
+	e.orders[o.id] = o
+	if len(m.bids) > 0 || len(m.asks) > 0 {
+		return e.matchOrderWithBook(o, m), nil
+	}
+	if m.hasPrice {
+		buy := o.direction == pb.OrderDirection_ORDER_DIRECTION_BUY
+		if (buy && m.lastPrice.LessThanOrEqual(o.price)) || (!buy && m.lastPrice.GreaterThanOrEqual(o.price)) {
+			if t := e.fill(o, m.lastPrice, o.remaining()); t != nil {
+				return []*pb.OrderTrades{t}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// fillMarket - Исполнение рыночной заявки по стакану, а если стакана нет, то по цене price
+func (e *Exchange) fillMarket(o *order, price decimal.Decimal) []*pb.OrderTrades {
+	m := e.markets[o.instrument.Uid]
+	book := m.asks
+	if o.direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		book = m.bids
+	}
+	if len(book) == 0 {
+		if t := e.fill(o, price, o.remaining()); t != nil {
+			return []*pb.OrderTrades{t}
+		}
+		return nil
+	}
+	return e.walkBook(o, book, func(decimal.Decimal) bool { return true })
+}
+
+// matchOrderWithBook - Исполнение лимитной заявки по стакану
+func (e *Exchange) matchOrderWithBook(o *order, m *market) []*pb.OrderTrades {
+	if o.direction == pb.OrderDirection_ORDER_DIRECTION_BUY {
+		return e.walkBook(o, m.asks, func(p decimal.Decimal) bool { return p.LessThanOrEqual(o.price) })
+	}
+	return e.walkBook(o, m.bids, func(p decimal.Decimal) bool { return p.GreaterThanOrEqual(o.price) })
+}
+
+// walkBook - Исполнение заявки по уровням стакана, пока цена уровня подходит, ликвидность уровней уменьшается
+func (e *Exchange) walkBook(o *order, book []level, ok func(decimal.Decimal) bool) []*pb.OrderTrades {
+	trades := make([]*pb.OrderTrades, 0)
+	for i := range book {
+		if o.remaining() == 0 || !ok(book[i].price) {
+			break
+		}
+		lots := book[i].quantity
+		if lots > o.remaining() {
+			lots = o.remaining()
+		}
+		if lots == 0 {
+			continue
+		}
+		t := e.fill(o, book[i].price, lots)
+		if t == nil {
+			break
+		}
+		book[i].quantity -= lots
+		trades = append(trades, t)
+	}
+	return trades
+}
+
+// matchRange - Исполнение активных лимитных заявок инструмента по диапазону цен low-high, open - цена начала диапазона.
+// Если maxLots > 0, то суммарно исполняется не больше maxLots лотов
+func (e *Exchange) matchRange(inst *Instrument, low, high, open decimal.Decimal, maxLots int64) []*pb.OrderTrades {
+	trades := make([]*pb.OrderTrades, 0)
+	for _, o := range e.activeOrders(inst) {
+		if o.orderType != pb.OrderType_ORDER_TYPE_LIMIT {
+			continue
+		}
+		price, ok := matching.LimitPrice(o.direction, o.price, low, high, open)
+		if !ok {
+			continue
+		}
+		lots := o.remaining()
+		if maxLots > 0 && lots > maxLots {
+			lots = maxLots
+		}
+		if t := e.fill(o, price, lots); t != nil {
+			trades = append(trades, t)
+			if maxLots > 0 {
+				maxLots -= lots
+				if maxLots == 0 {
+					break
+				}
+			}
+		}
+	}
+	return trades
+}
+
+// matchBook - Исполнение активных лимитных заявок инструмента по новому стакану
+func (e *Exchange) matchBook(inst *Instrument) []*pb.OrderTrades {
+	m := e.markets[inst.Uid]
+	trades := make([]*pb.OrderTrades, 0)
+	for _, o := range e.activeOrders(inst) {
+		if o.orderType != pb.OrderType_ORDER_TYPE_LIMIT {
+			continue
+		}
+		trades = append(trades, e.matchOrderWithBook(o, m)...)
+	}
+	return trades
+}
+
+// triggerStopOrders - Активация стоп-заявок инструмента по диапазону цен low-high, open - цена начала диапазона
+func (e *Exchange) triggerStopOrders(inst *Instrument, low, high, open decimal.Decimal) []*pb.OrderTrades {
+	triggered := make([]*stopOrder, 0)
+	for _, so := range e.stopOrders {
+		if so.instrument.Uid != inst.Uid {
+			continue
+		}
+		if (so.triggersUp() && high.GreaterThanOrEqual(so.stopPrice)) || (!so.triggersUp() && low.LessThanOrEqual(so.stopPrice)) {
+			triggered = append(triggered, so)
+		}
+	}
+	sort.Slice(triggered, func(i, j int) bool {
+		return triggered[i].created.Before(triggered[j].created)
+	})
+
+	trades := make([]*pb.OrderTrades, 0)
+	for _, so := range triggered {
+		delete(e.stopOrders, so.id)
+		direction := pb.OrderDirection_ORDER_DIRECTION_BUY
+		if so.direction == pb.StopOrderDirection_STOP_ORDER_DIRECTION_SELL {
+			direction = pb.OrderDirection_ORDER_DIRECTION_SELL
+		}
+		o := &order{
+			id:            so.id,
+			instrument:    inst,
+			direction:     direction,
+			orderType:     pb.OrderType_ORDER_TYPE_MARKET,
+			created:       e.time(),
+			lotsRequested: so.lots,
+			status:        pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_NEW,
+		}
+		e.infof("stop order %v activated", so.id)
+		if so.orderType == pb.StopOrderType_STOP_ORDER_TYPE_STOP_LIMIT {
+			// стоп-лимит выставляет лимитную заявку, она исполнится при сопоставлении заявок
+			o.orderType = pb.OrderType_ORDER_TYPE_LIMIT
+			o.price = so.price
+			e.orders[o.id] = o
+			continue
+		}
+		// если цена открылась за стоп-ценой, исполняем по цене открытия
+		price := decimal.Min(so.stopPrice, open)
+		if so.triggersUp() {
+			price = decimal.Max(so.stopPrice, open)
+		}
+		e.orders[o.id] = o
+		trades = append(trades, e.fillMarket(o, price)...)
+		if o.active() {
+			o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+		}
+	}
+	return trades
+}
+
+// activeOrders - Активные заявки по инструменту в порядке выставления
+func (e *Exchange) activeOrders(inst *Instrument) []*order {
+	res := make([]*order, 0)
+	for _, o := range e.orders {
+		if o.instrument.Uid == inst.Uid && o.active() {
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].created.Before(res[j].created)
+	})
+	return res
+}
+
+// fill - Исполнение lots лотов заявки по цене price, возвращает nil, если сделка невозможна
+func (e *Exchange) fill(o *order, price decimal.Decimal, lots int64) *pb.OrderTrades {
+	if lots <= 0 {
+		return nil
+	}
+	inst := o.instrument
+	pieces := lots * inst.Lot
+	amount := price.Mul(decimal.NewFromInt(pieces))
+	commission := amount.Mul(e.commission).Round(2)
+
+	err := e.account.apply(inst, o.direction, price, pieces, commission, e.config.AllowShort)
+	if err != nil {
+		e.errorf("order %v: %v", o.id, err.Error())
+		if o.lotsExecuted == 0 {
+			o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_REJECTED
+		} else {
+			o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+		}
+		return nil
+	}
+
+	now := e.time()
+	e.tradeSeq++
+	tradeId := fmt.Sprintf("%v", e.tradeSeq)
+
+	o.lotsExecuted += lots
+	o.executedAmount = o.executedAmount.Add(amount)
+	o.commission = o.commission.Add(commission)
+	o.stages = append(o.stages, &pb.OrderStage{
+		Price:    investgo.DecimalToMoneyValue(price, inst.Currency),
+		Quantity: lots,
+		TradeId:  tradeId,
+	})
+	if o.remaining() == 0 {
+		o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_FILL
+	} else {
+		o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_PARTIALLYFILL
+	}
+	e.recordOperations(o, price, pieces, commission, tradeId, now)
+
+	return &pb.OrderTrades{
+		OrderId:   o.id,
+		CreatedAt: investgo.TimeToTimestamp(now),
+		Direction: o.direction,
+		Figi:      inst.Figi,
+		Trades: []*pb.OrderTrade{{
+			DateTime: investgo.TimeToTimestamp(now),
+			Price:    investgo.DecimalToQuotation(price),
+			Quantity: pieces,
+			TradeId:  tradeId,
+		}},
+		AccountId:     e.config.AccountId,
+		InstrumentUid: inst.Uid,
+	}
+}
+
+// recordOperations - Запись операций покупки/продажи и удержания комиссии по заявке
+func (e *Exchange) recordOperations(o *order, price decimal.Decimal, pieces int64, commission decimal.Decimal, tradeId string, now time.Time) {
+	inst := o.instrument
+	executedPieces := decimal.NewFromInt(o.lotsExecuted * inst.Lot)
+	payment := o.executedAmount
+	opType, typeName := pb.OperationType_OPERATION_TYPE_SELL, "Продажа ценных бумаг"
+	if o.direction == pb.OrderDirection_ORDER_DIRECTION_BUY {
+		payment = payment.Neg()
+		opType, typeName = pb.OperationType_OPERATION_TYPE_BUY, "Покупка ценных бумаг"
+	}
+	if o.operation == nil {
+		o.operation = &pb.Operation{
+			Id:             investgo.CreateUid(),
+			Currency:       inst.Currency,
+			Figi:           inst.Figi,
+			InstrumentType: inst.InstrumentType,
+			Type:           typeName,
+			OperationType:  opType,
+			PositionUid:    inst.Uid,
+			InstrumentUid:  inst.Uid,
+		}
+		e.account.operations = append(e.account.operations, o.operation)
+	}
+	op := o.operation
+	op.Date = investgo.TimeToTimestamp(now)
+	op.State = pb.OperationState_OPERATION_STATE_EXECUTED
+	op.Payment = investgo.DecimalToMoneyValue(payment, inst.Currency)
+	op.Price = investgo.DecimalToMoneyValue(o.executedAmount.Div(executedPieces), inst.Currency)
+	op.Quantity = o.lotsRequested * inst.Lot
+	op.QuantityRest = o.remaining() * inst.Lot
+	op.Trades = append(op.Trades, &pb.OperationTrade{
+		TradeId:  tradeId,
+		DateTime: investgo.TimeToTimestamp(now),
+		Quantity: pieces,
+		Price:    investgo.DecimalToMoneyValue(price, inst.Currency),
+	})
+
+	if commission.IsZero() {
+		return
+	}
+	if o.feeOperation == nil {
+		o.feeOperation = &pb.Operation{
+			Id:                investgo.CreateUid(),
+			ParentOperationId: op.GetId(),
+			Currency:          inst.Currency,
+			Figi:              inst.Figi,
+			InstrumentType:    inst.InstrumentType,
+			Type:              "Удержание комиссии за операцию",
+			OperationType:     pb.OperationType_OPERATION_TYPE_BROKER_FEE,
+			PositionUid:       inst.Uid,
+			InstrumentUid:     inst.Uid,
+			State:             pb.OperationState_OPERATION_STATE_EXECUTED,
+		}
+		e.account.operations = append(e.account.operations, o.feeOperation)
+	}
+	o.feeOperation.Date = investgo.TimeToTimestamp(now)
+	o.feeOperation.Payment = investgo.DecimalToMoneyValue(o.commission.Neg(), inst.Currency)
+}
+
+// cancelOrder - Отмена заявки, вызывается под мьютексом
+func (e *Exchange) cancelOrder(accountId, orderId string) error {
+	if err := e.checkAccount(accountId); err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	o, ok := e.orders[orderId]
+	if !ok {
+		return status.Error(codes.NotFound, fmt.Sprintf("order %v not found", orderId))
+	}
+	if !o.active() {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("order %v is not active", orderId))
+	}
+	o.status = pb.OrderExecutionReportStatus_EXECUTION_REPORT_STATUS_CANCELLED
+	if o.operation != nil {
+		o.operation.QuantityRest = 0
+	}
+	return nil
+}
+
+// replaceOrder - Замена заявки, вызывается под мьютексом. Новая заявка проверяется до отмены старой,
+// и если она не может быть выставлена, старая заявка остается активной
+func (e *Exchange) replaceOrder(req *pb.ReplaceOrderRequest) (*order, []*pb.OrderTrades, error) {
+	if err := e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, nil, status.Error(codes.NotFound, err.Error())
+	}
+	if o, ok := e.requests[req.GetIdempotencyKey()]; ok && req.GetIdempotencyKey() != "" {
+		// повторный запрос с тем же ключом идемпотентности
+		return o, nil, nil
+	}
+	old, ok := e.orders[req.GetOrderId()]
+	if !ok {
+		return nil, nil, status.Error(codes.NotFound, fmt.Sprintf("order %v not found", req.GetOrderId()))
+	}
+	if !old.active() {
+		return nil, nil, status.Error(codes.InvalidArgument, fmt.Sprintf("order %v is not active", req.GetOrderId()))
+	}
+	o, err := e.newOrder(&pb.PostOrderRequest{
+		Quantity:     req.GetQuantity(),
+		Price:        req.GetPrice(),
+		Direction:    old.direction,
+		AccountId:    req.GetAccountId(),
+		OrderType:    pb.OrderType_ORDER_TYPE_LIMIT,
+		OrderId:      req.GetIdempotencyKey(),
+		InstrumentId: old.instrument.Uid,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldStatus := old.status
+	var oldRest int64
+	if old.operation != nil {
+		oldRest = old.operation.QuantityRest
+	}
+	if err := e.cancelOrder(req.GetAccountId(), old.id); err != nil {
+		return nil, nil, err
+	}
+	trades, err := e.submit(o)
+	if err != nil {
+		// возвращаем старую заявку
+		delete(e.orders, o.id)
+		old.status = oldStatus
+		if old.operation != nil {
+			old.operation.QuantityRest = oldRest
+		}
+		return nil, nil, err
+	}
+	if o.requestId != "" {
+		e.requests[o.requestId] = o
+	}
+	return o, trades, nil
+}
+
+// postStopOrder - Выставление стоп-заявки, вызывается под мьютексом
+func (e *Exchange) postStopOrder(req *pb.PostStopOrderRequest) (*stopOrder, error) {
+	if err := e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	id := req.GetInstrumentId()
+	if id == "" {
+		id = req.GetFigi()
+	}
+	inst, err := e.instrument(id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if req.GetQuantity() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must be positive")
+	}
+	if req.GetDirection() == pb.StopOrderDirection_STOP_ORDER_DIRECTION_UNSPECIFIED {
+		return nil, status.Error(codes.InvalidArgument, "direction is unspecified")
+	}
+	if req.GetStopOrderType() == pb.StopOrderType_STOP_ORDER_TYPE_UNSPECIFIED {
+		return nil, status.Error(codes.InvalidArgument, "stop order type is unspecified")
+	}
+	so := &stopOrder{
+		id:         investgo.CreateUid(),
+		instrument: inst,
+		direction:  req.GetDirection(),
+		orderType:  req.GetStopOrderType(),
+		lots:       req.GetQuantity(),
+		price:      investgo.QuotationToDecimal(req.GetPrice()),
+		stopPrice:  investgo.QuotationToDecimal(req.GetStopPrice()),
+		created:    e.time(),
+	}
+	if err := checkPriceStep(inst, so.stopPrice); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if so.orderType == pb.StopOrderType_STOP_ORDER_TYPE_STOP_LIMIT {
+		if err := checkPriceStep(inst, so.price); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if req.GetExpirationType() == pb.StopOrderExpirationType_STOP_ORDER_EXPIRATION_TYPE_GOOD_TILL_DATE {
+		if req.GetExpireDate() == nil {
+			return nil, status.Error(codes.InvalidArgument, "expire date is required for good till date stop order")
+		}
+		so.expireDate = req.GetExpireDate().AsTime()
+	}
+	e.stopOrders[so.id] = so
+	return so, nil
+}
+
+// checkPriceStep - Проверка кратности цены шагу цены инструмента
+func checkPriceStep(inst *Instrument, price decimal.Decimal) error {
+	return matching.CheckPriceStep(price, investgo.QuotationToDecimal(inst.MinPriceIncrement))
+}
+
+// orderState - Текущее состояние заявки
+func (e *Exchange) orderState(o *order) *pb.OrderState {
+	cur := o.instrument.Currency
+	lotSize := decimal.NewFromInt(o.instrument.Lot)
+	var avg decimal.Decimal
+	if o.lotsExecuted > 0 {
+		avg = o.executedAmount.Div(decimal.NewFromInt(o.lotsExecuted).Mul(lotSize))
+	}
+	total := o.executedAmount.Add(o.commission)
+	if o.direction == pb.OrderDirection_ORDER_DIRECTION_SELL {
+		total = o.executedAmount.Sub(o.commission)
+	}
+	return &pb.OrderState{
+		OrderId:               o.id,
+		ExecutionReportStatus: o.status,
+		LotsRequested:         o.lotsRequested,
+		LotsExecuted:          o.lotsExecuted,
+		InitialOrderPrice:     investgo.DecimalToMoneyValue(o.price.Mul(lotSize).Mul(decimal.NewFromInt(o.lotsRequested)), cur),
+		ExecutedOrderPrice:    investgo.DecimalToMoneyValue(o.executedAmount, cur),
+		TotalOrderAmount:      investgo.DecimalToMoneyValue(total, cur),
+		AveragePositionPrice:  investgo.DecimalToMoneyValue(avg, cur),
+		InitialCommission:     investgo.DecimalToMoneyValue(o.price.Mul(lotSize).Mul(decimal.NewFromInt(o.lotsRequested)).Mul(e.commission).Round(2), cur),
+		ExecutedCommission:    investgo.DecimalToMoneyValue(o.commission, cur),
+		Figi:                  o.instrument.Figi,
+		Direction:             o.direction,
+		InitialSecurityPrice:  investgo.DecimalToMoneyValue(o.price, cur),
+		Stages:                cloneStages(o.stages),
+		ServiceCommission:     investgo.DecimalToMoneyValue(decimal.Zero, cur),
+		Currency:              cur,
+		OrderType:             o.orderType,
+		OrderDate:             investgo.TimeToTimestamp(o.created),
+		InstrumentUid:         o.instrument.Uid,
+		OrderRequestId:        o.requestId,
+	}
+}
+
+// cloneStages - Копия сделок заявки, ответ сериализуется уже после освобождения мьютекса
+func cloneStages(stages []*pb.OrderStage) []*pb.OrderStage {
+	res := make([]*pb.OrderStage, 0, len(stages))
+	for _, s := range stages {
+		res = append(res, proto.Clone(s).(*pb.OrderStage))
+	}
+	return res
+}
+
+// postOrderResponse - Ответ на выставление заявки
+func (e *Exchange) postOrderResponse(o *order) *pb.PostOrderResponse {
+	st := e.orderState(o)
+	var executedPrice *pb.MoneyValue
+	if o.lotsExecuted > 0 {
+		executedPrice = st.GetAveragePositionPrice()
+	}
+	return &pb.PostOrderResponse{
+		OrderId:               o.id,
+		ExecutionReportStatus: o.status,
+		LotsRequested:         o.lotsRequested,
+		LotsExecuted:          o.lotsExecuted,
+		InitialOrderPrice:     st.GetInitialOrderPrice(),
+		ExecutedOrderPrice:    executedPrice,
+		TotalOrderAmount:      st.GetTotalOrderAmount(),
+		InitialCommission:     st.GetInitialCommission(),
+		ExecutedCommission:    st.GetExecutedCommission(),
+		Figi:                  o.instrument.Figi,
+		Direction:             o.direction,
+		InitialSecurityPrice:  st.GetInitialSecurityPrice(),
+		OrderType:             o.orderType,
+		InstrumentUid:         o.instrument.Uid,
+	}
+}
+
+// stopOrderState - Текущее состояние стоп-заявки
+func stopOrderState(so *stopOrder) *pb.StopOrder {
+	cur := so.instrument.Currency
+	res := &pb.StopOrder{
+		StopOrderId:   so.id,
+		LotsRequested: so.lots,
+		Figi:          so.instrument.Figi,
+		Direction:     so.direction,
+		Currency:      cur,
+		OrderType:     so.orderType,
+		CreateDate:    investgo.TimeToTimestamp(so.created),
+		Price:         investgo.DecimalToMoneyValue(so.price, cur),
+		StopPrice:     investgo.DecimalToMoneyValue(so.stopPrice, cur),
+		InstrumentUid: so.instrument.Uid,
+	}
+	if !so.expireDate.IsZero() {
+		res.ExpirationTime = investgo.TimeToTimestamp(so.expireDate)
+	}
+	return res
+}
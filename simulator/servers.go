@@ -0,0 +1,443 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ordersServer - Реализация OrdersService
+type ordersServer struct {
+	pb.UnimplementedOrdersServiceServer
+	e *Exchange
+}
+
+func (s *ordersServer) PostOrder(_ context.Context, req *pb.PostOrderRequest) (*pb.PostOrderResponse, error) {
+	s.e.mu.Lock()
+	o, trades, err := s.e.postOrder(req)
+	var resp *pb.PostOrderResponse
+	if err == nil {
+		resp = s.e.postOrderResponse(o)
+	}
+	s.e.mu.Unlock()
+	s.e.publish(trades)
+	return resp, err
+}
+
+func (s *ordersServer) CancelOrder(_ context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.cancelOrder(req.GetAccountId(), req.GetOrderId()); err != nil {
+		return nil, err
+	}
+	return &pb.CancelOrderResponse{Time: investgo.TimeToTimestamp(s.e.time())}, nil
+}
+
+func (s *ordersServer) GetOrderState(_ context.Context, req *pb.GetOrderStateRequest) (*pb.OrderState, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	o, ok := s.e.orders[req.GetOrderId()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("order %v not found", req.GetOrderId()))
+	}
+	return s.e.orderState(o), nil
+}
+
+func (s *ordersServer) GetOrders(_ context.Context, req *pb.GetOrdersRequest) (*pb.GetOrdersResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	active := make([]*order, 0)
+	for _, o := range s.e.orders {
+		if o.active() {
+			active = append(active, o)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].created.Before(active[j].created)
+	})
+	orders := make([]*pb.OrderState, 0, len(active))
+	for _, o := range active {
+		orders = append(orders, s.e.orderState(o))
+	}
+	return &pb.GetOrdersResponse{Orders: orders}, nil
+}
+
+func (s *ordersServer) ReplaceOrder(_ context.Context, req *pb.ReplaceOrderRequest) (*pb.PostOrderResponse, error) {
+	s.e.mu.Lock()
+	o, trades, err := s.e.replaceOrder(req)
+	var resp *pb.PostOrderResponse
+	if err == nil {
+		resp = s.e.postOrderResponse(o)
+	}
+	s.e.mu.Unlock()
+	s.e.publish(trades)
+	return resp, err
+}
+
+// stopOrdersServer - Реализация StopOrdersService
+type stopOrdersServer struct {
+	pb.UnimplementedStopOrdersServiceServer
+	e *Exchange
+}
+
+func (s *stopOrdersServer) PostStopOrder(_ context.Context, req *pb.PostStopOrderRequest) (*pb.PostStopOrderResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	so, err := s.e.postStopOrder(req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PostStopOrderResponse{StopOrderId: so.id}, nil
+}
+
+func (s *stopOrdersServer) GetStopOrders(_ context.Context, req *pb.GetStopOrdersRequest) (*pb.GetStopOrdersResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	list := make([]*stopOrder, 0, len(s.e.stopOrders))
+	for _, so := range s.e.stopOrders {
+		list = append(list, so)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].created.Before(list[j].created)
+	})
+	orders := make([]*pb.StopOrder, 0, len(list))
+	for _, so := range list {
+		orders = append(orders, stopOrderState(so))
+	}
+	return &pb.GetStopOrdersResponse{StopOrders: orders}, nil
+}
+
+func (s *stopOrdersServer) CancelStopOrder(_ context.Context, req *pb.CancelStopOrderRequest) (*pb.CancelStopOrderResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if _, ok := s.e.stopOrders[req.GetStopOrderId()]; !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("stop order %v not found", req.GetStopOrderId()))
+	}
+	delete(s.e.stopOrders, req.GetStopOrderId())
+	return &pb.CancelStopOrderResponse{Time: investgo.TimeToTimestamp(s.e.time())}, nil
+}
+
+// operationsServer - Реализация OperationsService
+type operationsServer struct {
+	pb.UnimplementedOperationsServiceServer
+	e *Exchange
+}
+
+func (s *operationsServer) GetOperations(_ context.Context, req *pb.OperationsRequest) (*pb.OperationsResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	ops := s.e.filterOperations(req.GetFrom().AsTime(), req.GetTo(), req.GetFigi())
+	res := make([]*pb.Operation, 0, len(ops))
+	for _, op := range ops {
+		if req.GetState() != pb.OperationState_OPERATION_STATE_UNSPECIFIED && op.GetState() != req.GetState() {
+			continue
+		}
+		// операции меняются при исполнении заявок, ответ сериализуется уже после освобождения мьютекса
+		res = append(res, proto.Clone(op).(*pb.Operation))
+	}
+	return &pb.OperationsResponse{Operations: res}, nil
+}
+
+func (s *operationsServer) GetOperationsByCursor(_ context.Context, req *pb.GetOperationsByCursorRequest) (*pb.GetOperationsByCursorResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	types := make(map[pb.OperationType]struct{}, len(req.GetOperationTypes()))
+	for _, t := range req.GetOperationTypes() {
+		types[t] = struct{}{}
+	}
+	ops := make([]*pb.Operation, 0)
+	for _, op := range s.e.filterOperations(req.GetFrom().AsTime(), req.GetTo(), req.GetInstrumentId()) {
+		if _, ok := types[op.GetOperationType()]; len(types) > 0 && !ok {
+			continue
+		}
+		if req.GetWithoutCommissions() && op.GetOperationType() == pb.OperationType_OPERATION_TYPE_BROKER_FEE {
+			continue
+		}
+		if req.GetState() != pb.OperationState_OPERATION_STATE_UNSPECIFIED && op.GetState() != req.GetState() {
+			continue
+		}
+		ops = append(ops, proto.Clone(op).(*pb.Operation))
+	}
+
+	start := 0
+	if req.GetCursor() != "" {
+		n, err := strconv.Atoi(req.GetCursor())
+		if err != nil || n < 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid cursor %v", req.GetCursor()))
+		}
+		start = n
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = 100
+	}
+	resp := &pb.GetOperationsByCursorResponse{Items: make([]*pb.OperationItem, 0, limit)}
+	for i := start; i < len(ops) && i < start+limit; i++ {
+		resp.Items = append(resp.Items, operationItem(ops[i], strconv.Itoa(i), s.e.config.AccountId, req.GetWithoutTrades()))
+	}
+	if start+limit < len(ops) {
+		resp.HasNext = true
+		resp.NextCursor = strconv.Itoa(start + limit)
+	}
+	return resp, nil
+}
+
+func (s *operationsServer) GetPortfolio(_ context.Context, req *pb.PortfolioRequest) (*pb.PortfolioResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	cur := s.e.config.Currency
+	totals := make(map[string]decimal.Decimal)
+	positions := make([]*pb.PortfolioPosition, 0, len(s.e.account.positions)+len(s.e.account.money))
+	var yield, invested decimal.Decimal
+
+	for _, c := range s.e.account.sortedCurrencies() {
+		amount := s.e.account.money[c]
+		// портфель считается в валюте счета, другие валюты учитываются без конвертации
+		totals["currency"] = totals["currency"].Add(amount)
+		positions = append(positions, &pb.PortfolioPosition{
+			InstrumentType:       "currency",
+			Quantity:             investgo.DecimalToQuotation(amount),
+			AveragePositionPrice: investgo.DecimalToMoneyValue(decimal.NewFromInt(1), c),
+			CurrentPrice:         investgo.DecimalToMoneyValue(decimal.NewFromInt(1), c),
+			ExpectedYield:        investgo.DecimalToQuotation(decimal.Zero),
+			QuantityLots:         investgo.DecimalToQuotation(amount),
+		})
+	}
+	for _, p := range s.e.account.sortedPositions() {
+		inst := p.instrument
+		price := p.AvgPrice
+		if m := s.e.markets[inst.Uid]; m.hasPrice {
+			price = m.lastPrice
+		}
+		qty := decimal.NewFromInt(p.Quantity)
+		value := price.Mul(qty)
+		positionYield := price.Sub(p.AvgPrice).Mul(qty)
+		totals[inst.InstrumentType] = totals[inst.InstrumentType].Add(value)
+		yield = yield.Add(positionYield)
+		invested = invested.Add(p.AvgPrice.Mul(qty).Abs())
+		positions = append(positions, &pb.PortfolioPosition{
+			Figi:                 inst.Figi,
+			InstrumentType:       inst.InstrumentType,
+			Quantity:             investgo.DecimalToQuotation(qty),
+			AveragePositionPrice: investgo.DecimalToMoneyValue(p.AvgPrice, inst.Currency),
+			ExpectedYield:        investgo.DecimalToQuotation(positionYield),
+			CurrentPrice:         investgo.DecimalToMoneyValue(price, inst.Currency),
+			QuantityLots:         investgo.DecimalToQuotation(qty.Div(decimal.NewFromInt(inst.Lot))),
+			PositionUid:          inst.Uid,
+			InstrumentUid:        inst.Uid,
+		})
+	}
+
+	var total decimal.Decimal
+	for _, v := range totals {
+		total = total.Add(v)
+	}
+	var yieldPct decimal.Decimal
+	if invested.IsPositive() {
+		yieldPct = yield.Div(invested).Mul(decimal.NewFromInt(100)).Round(2)
+	}
+	return &pb.PortfolioResponse{
+		TotalAmountShares:     investgo.DecimalToMoneyValue(totals["share"], cur),
+		TotalAmountBonds:      investgo.DecimalToMoneyValue(totals["bond"], cur),
+		TotalAmountEtf:        investgo.DecimalToMoneyValue(totals["etf"], cur),
+		TotalAmountCurrencies: investgo.DecimalToMoneyValue(totals["currency"], cur),
+		TotalAmountFutures:    investgo.DecimalToMoneyValue(totals["futures"], cur),
+		TotalAmountOptions:    investgo.DecimalToMoneyValue(totals["option"], cur),
+		TotalAmountSp:         investgo.DecimalToMoneyValue(totals["sp"], cur),
+		TotalAmountPortfolio:  investgo.DecimalToMoneyValue(total, cur),
+		ExpectedYield:         investgo.DecimalToQuotation(yieldPct),
+		Positions:             positions,
+		AccountId:             s.e.config.AccountId,
+	}, nil
+}
+
+func (s *operationsServer) GetPositions(_ context.Context, req *pb.PositionsRequest) (*pb.PositionsResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	resp := &pb.PositionsResponse{
+		Money:      s.e.moneyValues(),
+		Blocked:    make([]*pb.MoneyValue, 0),
+		Securities: make([]*pb.PositionsSecurities, 0),
+		Futures:    make([]*pb.PositionsFutures, 0),
+	}
+	for _, p := range s.e.account.sortedPositions() {
+		inst := p.instrument
+		if inst.InstrumentType == "futures" {
+			resp.Futures = append(resp.Futures, &pb.PositionsFutures{
+				Figi:          inst.Figi,
+				Balance:       p.Quantity,
+				PositionUid:   inst.Uid,
+				InstrumentUid: inst.Uid,
+			})
+			continue
+		}
+		resp.Securities = append(resp.Securities, &pb.PositionsSecurities{
+			Figi:           inst.Figi,
+			Balance:        p.Quantity,
+			PositionUid:    inst.Uid,
+			InstrumentUid:  inst.Uid,
+			InstrumentType: inst.InstrumentType,
+		})
+	}
+	return resp, nil
+}
+
+func (s *operationsServer) GetWithdrawLimits(_ context.Context, req *pb.WithdrawLimitsRequest) (*pb.WithdrawLimitsResponse, error) {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if err := s.e.checkAccount(req.GetAccountId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &pb.WithdrawLimitsResponse{
+		Money:            s.e.moneyValues(),
+		Blocked:          make([]*pb.MoneyValue, 0),
+		BlockedGuarantee: make([]*pb.MoneyValue, 0),
+	}, nil
+}
+
+// moneyValues - Денежные позиции счета
+func (e *Exchange) moneyValues() []*pb.MoneyValue {
+	res := make([]*pb.MoneyValue, 0, len(e.account.money))
+	for _, c := range e.account.sortedCurrencies() {
+		res = append(res, investgo.DecimalToMoneyValue(e.account.money[c], c))
+	}
+	return res
+}
+
+// filterOperations - Операции счета за период from-to по инструменту, если to не задано или не позже from - без ограничения сверху
+func (e *Exchange) filterOperations(from time.Time, to *timestamppb.Timestamp, instrumentId string) []*pb.Operation {
+	unbounded := to == nil || !to.AsTime().After(from)
+	var uid string
+	if instrumentId != "" {
+		if inst, err := e.instrument(instrumentId); err == nil {
+			uid = inst.Uid
+		} else {
+			uid = instrumentId
+		}
+	}
+	res := make([]*pb.Operation, 0, len(e.account.operations))
+	for _, op := range e.account.operations {
+		date := op.GetDate().AsTime()
+		if op.GetDate() != nil && (date.Before(from) || (!unbounded && date.After(to.AsTime()))) {
+			continue
+		}
+		if uid != "" && op.GetInstrumentUid() != uid {
+			continue
+		}
+		res = append(res, op)
+	}
+	return res
+}
+
+// operationItem - Преобразование операции в формат GetOperationsByCursor
+func operationItem(op *pb.Operation, cursor, accountId string, withoutTrades bool) *pb.OperationItem {
+	item := &pb.OperationItem{
+		Cursor:            cursor,
+		BrokerAccountId:   accountId,
+		Id:                op.GetId(),
+		ParentOperationId: op.GetParentOperationId(),
+		Name:              op.GetType(),
+		Date:              op.GetDate(),
+		Type:              op.GetOperationType(),
+		Description:       op.GetType(),
+		State:             op.GetState(),
+		InstrumentUid:     op.GetInstrumentUid(),
+		Figi:              op.GetFigi(),
+		InstrumentType:    op.GetInstrumentType(),
+		PositionUid:       op.GetPositionUid(),
+		Payment:           op.GetPayment(),
+		Price:             op.GetPrice(),
+		Quantity:          op.GetQuantity(),
+		QuantityRest:      op.GetQuantityRest(),
+		QuantityDone:      op.GetQuantity() - op.GetQuantityRest(),
+	}
+	if !withoutTrades && len(op.GetTrades()) > 0 {
+		trades := make([]*pb.OperationItemTrade, 0, len(op.GetTrades()))
+		for _, t := range op.GetTrades() {
+			trades = append(trades, &pb.OperationItemTrade{
+				Num:      t.GetTradeId(),
+				Date:     t.GetDateTime(),
+				Quantity: t.GetQuantity(),
+				Price:    t.GetPrice(),
+			})
+		}
+		item.TradesInfo = &pb.OperationItemTrades{Trades: trades}
+	}
+	return item
+}
+
+// ordersStreamServer - Реализация OrdersStreamService
+type ordersStreamServer struct {
+	pb.UnimplementedOrdersStreamServiceServer
+	e *Exchange
+}
+
+func (s *ordersStreamServer) TradesStream(req *pb.TradesStreamRequest, stream pb.OrdersStreamService_TradesStreamServer) error {
+	if len(req.GetAccounts()) == 0 {
+		return status.Error(codes.InvalidArgument, "accounts are required")
+	}
+	for _, id := range req.GetAccounts() {
+		if err := s.e.checkAccount(id); err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+	}
+	ch := s.e.subscribe()
+	defer s.e.unsubscribe(ch)
+
+	ping := time.NewTicker(2 * time.Minute)
+	defer ping.Stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case t := <-ch:
+			err := stream.Send(&pb.TradesStreamResponse{
+				Payload: &pb.TradesStreamResponse_OrderTrades{OrderTrades: t},
+			})
+			if err != nil {
+				return err
+			}
+		case <-ping.C:
+			err := stream.Send(&pb.TradesStreamResponse{
+				Payload: &pb.TradesStreamResponse_Ping{Ping: &pb.Ping{Time: investgo.TimeToTimestamp(time.Now())}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// CashEventKind - Тип выплаты
+type CashEventKind int
+
+const (
+	// CASH_EVENT_DIVIDEND - Дивиденд
+	CASH_EVENT_DIVIDEND CashEventKind = iota
+	// CASH_EVENT_COUPON - Купон облигации
+	CASH_EVENT_COUPON
+)
+
+func (k CashEventKind) String() string {
+	switch k {
+	case CASH_EVENT_DIVIDEND:
+		return "dividend"
+	case CASH_EVENT_COUPON:
+		return "coupon"
+	}
+	return fmt.Sprintf("CashEventKind(%d)", int(k))
+}
+
+// AdjustMethod - Способ корректировки цен
+type AdjustMethod int
+
+const (
+	// ADJUST_RATIO - Цены до выплаты умножаются на (Close - выплата) / Close, доходности сохраняются
+	ADJUST_RATIO AdjustMethod = iota
+	// ADJUST_DIFFERENCE - Из цен до выплаты вычитается выплата, абсолютные изменения цен сохраняются
+	ADJUST_DIFFERENCE
+)
+
+// CashEvent - Выплата по инструменту
+type CashEvent struct {
+	Kind CashEventKind
+	// ExDate - Первый день, когда цена уже не включает выплату
+	ExDate time.Time
+	// Amount - Размер выплаты в единицах цены инструмента: в валюте для акций, в процентах номинала для облигаций
+	Amount decimal.Decimal
+}
+
+// AdjustmentFactor - Коэффициент корректировки цен для одной выплаты
+type AdjustmentFactor struct {
+	Kind   CashEventKind
+	ExDate time.Time
+	Amount decimal.Decimal
+	// PrevClose - Цена закрытия последней свечи до ExDate
+	PrevClose decimal.Decimal
+	// Ratio, Difference - Корректировка цен до ExDate для этой выплаты
+	Ratio      decimal.Decimal
+	Difference decimal.Decimal
+	// CumulativeRatio, CumulativeDifference - Итоговая корректировка цен до ExDate с учетом всех более поздних выплат
+	CumulativeRatio      decimal.Decimal
+	CumulativeDifference decimal.Decimal
+}
+
+// TotalReturnPoint - Значение индекса полной доходности с реинвестированием выплат
+type TotalReturnPoint struct {
+	Time  time.Time
+	Value decimal.Decimal
+}
+
+// DividendEvents - Дивиденды инструмента за период. Датой отсечки считается день после LastBuyDate,
+// а если она не задана, то RecordDate. API может передавать незаданную дату как нулевой timestamp
+func DividendEvents(is *investgo.InstrumentsServiceClient, figi string, from, to time.Time) ([]CashEvent, error) {
+	resp, err := is.GetDividents(figi, from, to)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]CashEvent, 0, len(resp.GetDividends()))
+	for _, d := range resp.GetDividends() {
+		var exDate time.Time
+		switch {
+		case d.GetLastBuyDate().GetSeconds() > 0:
+			exDate = startOfDay(d.GetLastBuyDate().AsTime()).Add(investgo.DAY)
+		case d.GetRecordDate().GetSeconds() > 0:
+			exDate = startOfDay(d.GetRecordDate().AsTime())
+		default:
+			continue
+		}
+		events = append(events, CashEvent{
+			Kind:   CASH_EVENT_DIVIDEND,
+			ExDate: exDate,
+			Amount: investgo.MoneyValueToDecimal(d.GetDividendNet()),
+		})
+	}
+	sortCashEvents(events)
+	return events, nil
+}
+
+// CouponEvents - Купоны облигации за период в процентах номинала, датой отсечки считается FixDate.
+// Цены облигаций в свечах чистые, поэтому корректировка на купон имеет смысл в основном для полной доходности
+func CouponEvents(is *investgo.InstrumentsServiceClient, figi string, from, to time.Time) ([]CashEvent, error) {
+	bond, err := is.BondByFigi(figi)
+	if err != nil {
+		return nil, err
+	}
+	nominal := investgo.MoneyValueToDecimal(bond.GetInstrument().GetNominal())
+	if nominal.IsZero() {
+		return nil, fmt.Errorf("%v nominal is zero", figi)
+	}
+	resp, err := is.GetBondCoupons(figi, from, to)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]CashEvent, 0, len(resp.GetEvents()))
+	for _, c := range resp.GetEvents() {
+		if c.GetFixDate() == nil || c.GetPayOneBond() == nil {
+			continue
+		}
+		events = append(events, CashEvent{
+			Kind:   CASH_EVENT_COUPON,
+			ExDate: startOfDay(c.GetFixDate().AsTime()),
+			Amount: investgo.MoneyValueToDecimal(c.GetPayOneBond()).Div(nominal).Mul(decimal.NewFromInt(100)),
+		})
+	}
+	sortCashEvents(events)
+	return events, nil
+}
+
+// AdjustCandles - Обратная корректировка свечей на выплаты: последние цены не меняются, цены свечей до
+// каждой даты отсечки корректируются методом method. Объемы не меняются. Выплаты без свечей до и после
+// даты отсечки пропускаются. Возвращает новые свечи и коэффициенты корректировки по возрастанию ExDate
+func AdjustCandles(candles []*pb.HistoricCandle, events []CashEvent, method AdjustMethod) ([]*pb.HistoricCandle, []AdjustmentFactor, error) {
+	sorted := make([]*pb.HistoricCandle, len(candles))
+	copy(sorted, candles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetTime().AsTime().Before(sorted[j].GetTime().AsTime())
+	})
+	factors, err := adjustmentFactors(sorted, events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := make([]*pb.HistoricCandle, 0, len(sorted))
+	f := 0
+	for _, c := range sorted {
+		t := c.GetTime().AsTime()
+		// первая выплата с отсечкой позже свечи содержит итоговую корректировку для нее
+		for f < len(factors) && !factors[f].ExDate.After(t) {
+			f++
+		}
+		if f == len(factors) {
+			res = append(res, c)
+			continue
+		}
+		adjust := func(q *pb.Quotation) *pb.Quotation {
+			price := investgo.QuotationToDecimal(q)
+			if method == ADJUST_DIFFERENCE {
+				return investgo.DecimalToQuotation(price.Sub(factors[f].CumulativeDifference))
+			}
+			return investgo.DecimalToQuotation(price.Mul(factors[f].CumulativeRatio).Round(9))
+		}
+		res = append(res, &pb.HistoricCandle{
+			Open:       adjust(c.GetOpen()),
+			High:       adjust(c.GetHigh()),
+			Low:        adjust(c.GetLow()),
+			Close:      adjust(c.GetClose()),
+			Volume:     c.GetVolume(),
+			Time:       c.GetTime(),
+			IsComplete: c.GetIsComplete(),
+		})
+	}
+	return res, factors, nil
+}
+
+// TotalReturn - Индекс полной доходности по ценам закрытия с реинвестированием выплат в день отсечки.
+// Начальное значение равно цене закрытия первой свечи
+func TotalReturn(candles []*pb.HistoricCandle, events []CashEvent) []TotalReturnPoint {
+	sorted := make([]*pb.HistoricCandle, len(candles))
+	copy(sorted, candles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetTime().AsTime().Before(sorted[j].GetTime().AsTime())
+	})
+	events = append([]CashEvent(nil), events...)
+	sortCashEvents(events)
+
+	points := make([]TotalReturnPoint, 0, len(sorted))
+	e := 0
+	var value, prevClose decimal.Decimal
+	for i, c := range sorted {
+		t := c.GetTime().AsTime()
+		closePrice := investgo.QuotationToDecimal(c.GetClose())
+		income := decimal.Zero
+		for e < len(events) && !events[e].ExDate.After(t) {
+			// выплаты до первой свечи не учитываются
+			if i > 0 {
+				income = income.Add(events[e].Amount)
+			}
+			e++
+		}
+		if i == 0 {
+			value = closePrice
+		} else if !prevClose.IsZero() {
+			value = value.Mul(closePrice.Add(income)).Div(prevClose)
+		}
+		prevClose = closePrice
+		points = append(points, TotalReturnPoint{Time: t, Value: value})
+	}
+	return points
+}
+
+// WriteAdjustmentFactors - Запись коэффициентов корректировки в CSV с заголовком
+// ex_date,kind,amount,prev_close,ratio,difference,cumulative_ratio,cumulative_difference
+func WriteAdjustmentFactors(w io.Writer, factors []AdjustmentFactor) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"ex_date", "kind", "amount", "prev_close", "ratio", "difference", "cumulative_ratio", "cumulative_difference"})
+	if err != nil {
+		return err
+	}
+	for _, f := range factors {
+		err := cw.Write([]string{
+			f.ExDate.Format(time.DateOnly),
+			f.Kind.String(),
+			f.Amount.String(),
+			f.PrevClose.String(),
+			f.Ratio.String(),
+			f.Difference.String(),
+			f.CumulativeRatio.String(),
+			f.CumulativeDifference.String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// adjustmentFactors - Коэффициенты по отсортированным свечам, накопление идет от последней выплаты к первой
+func adjustmentFactors(sorted []*pb.HistoricCandle, events []CashEvent) ([]AdjustmentFactor, error) {
+	events = append([]CashEvent(nil), events...)
+	sortCashEvents(events)
+	factors := make([]AdjustmentFactor, 0, len(events))
+	for _, e := range events {
+		// последняя свеча до отсечки
+		i := sort.Search(len(sorted), func(i int) bool {
+			return !sorted[i].GetTime().AsTime().Before(e.ExDate)
+		})
+		if i == 0 || i == len(sorted) {
+			continue
+		}
+		prevClose := investgo.QuotationToDecimal(sorted[i-1].GetClose())
+		if !prevClose.IsPositive() {
+			return nil, fmt.Errorf("non-positive close %v before %v %v", prevClose, e.Kind, e.ExDate.Format(time.DateOnly))
+		}
+		if e.Amount.GreaterThanOrEqual(prevClose) {
+			return nil, fmt.Errorf("%v %v on %v is not less than close %v", e.Kind, e.Amount, e.ExDate.Format(time.DateOnly), prevClose)
+		}
+		factors = append(factors, AdjustmentFactor{
+			Kind:       e.Kind,
+			ExDate:     e.ExDate,
+			Amount:     e.Amount,
+			PrevClose:  prevClose,
+			Ratio:      prevClose.Sub(e.Amount).DivRound(prevClose, 16),
+			Difference: e.Amount,
+		})
+	}
+	ratio, diff := decimal.NewFromInt(1), decimal.Zero
+	for i := len(factors) - 1; i >= 0; i-- {
+		ratio = ratio.Mul(factors[i].Ratio).Round(16)
+		diff = diff.Add(factors[i].Difference)
+		factors[i].CumulativeRatio = ratio
+		factors[i].CumulativeDifference = diff
+	}
+	return factors, nil
+}
+
+func sortCashEvents(events []CashEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ExDate.Before(events[j].ExDate)
+	})
+}
+
+// startOfDay - Начало дня даты из API, даты выплат передаются как полночь UTC
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(investgo.DAY)
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func marchDay(d int) time.Time {
+	return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC)
+}
+
+// dayCandle - Дневная свеча с high и low на рубль от close
+func dayCandle(d int, close float64) *pb.HistoricCandle {
+	c := decimal.NewFromFloat(close)
+	return &pb.HistoricCandle{
+		Time:       investgo.TimeToTimestamp(marchDay(d)),
+		Open:       investgo.DecimalToQuotation(c),
+		High:       investgo.DecimalToQuotation(c.Add(decimal.NewFromInt(1))),
+		Low:        investgo.DecimalToQuotation(c.Sub(decimal.NewFromInt(1))),
+		Close:      investgo.DecimalToQuotation(c),
+		Volume:     10,
+		IsComplete: true,
+	}
+}
+
+// adjustCandles - Закрытия 100, 100, 96, 100, 90 со 2 по 6 марта
+func adjustCandles() []*pb.HistoricCandle {
+	return []*pb.HistoricCandle{dayCandle(6, 90), dayCandle(2, 100), dayCandle(3, 100), dayCandle(4, 96), dayCandle(5, 100)}
+}
+
+// adjustEvents - Дивиденды 4 с отсечкой 4 марта и 10 с отсечкой 6 марта, выплаты вне свечей пропускаются
+func adjustEvents() []CashEvent {
+	return []CashEvent{
+		{Kind: CASH_EVENT_DIVIDEND, ExDate: marchDay(6), Amount: decimal.NewFromInt(10)},
+		{Kind: CASH_EVENT_DIVIDEND, ExDate: marchDay(4), Amount: decimal.NewFromInt(4)},
+		{Kind: CASH_EVENT_COUPON, ExDate: marchDay(1), Amount: decimal.NewFromInt(1)},
+		{Kind: CASH_EVENT_COUPON, ExDate: marchDay(10), Amount: decimal.NewFromInt(1)},
+	}
+}
+
+func quotationString(q *pb.Quotation) string {
+	return investgo.QuotationToDecimal(q).String()
+}
+
+func TestAdjustmentFactors(t *testing.T) {
+	_, factors, err := AdjustCandles(adjustCandles(), adjustEvents(), ADJUST_RATIO)
+	if err != nil {
+		t.Fatalf("AdjustCandles: %v", err)
+	}
+	want := []struct {
+		exDate                             time.Time
+		prevClose, ratio, cumRatio, cumDif string
+	}{
+		{marchDay(4), "100", "0.96", "0.864", "14"},
+		{marchDay(6), "100", "0.9", "0.9", "10"},
+	}
+	if len(factors) != len(want) {
+		t.Fatalf("factors = %+v", factors)
+	}
+	for i, w := range want {
+		f := factors[i]
+		if !f.ExDate.Equal(w.exDate) || f.PrevClose.String() != w.prevClose || f.Ratio.String() != w.ratio ||
+			f.CumulativeRatio.String() != w.cumRatio || f.CumulativeDifference.String() != w.cumDif || !f.Difference.Equal(f.Amount) {
+			t.Errorf("factor %v = %+v", i, f)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteAdjustmentFactors(&buf, factors); err != nil {
+		t.Fatalf("WriteAdjustmentFactors: %v", err)
+	}
+	wantCSV := "ex_date,kind,amount,prev_close,ratio,difference,cumulative_ratio,cumulative_difference\n" +
+		"2024-03-04,dividend,4,100,0.96,4,0.864,14\n" +
+		"2024-03-06,dividend,10,100,0.9,10,0.9,10\n"
+	if buf.String() != wantCSV {
+		t.Fatalf("CSV = %q", buf.String())
+	}
+
+	tests := []struct {
+		name   string
+		events []CashEvent
+		err    string
+	}{
+		{"amount above close", []CashEvent{{ExDate: marchDay(4), Amount: decimal.NewFromInt(100)}}, "is not less than close"},
+		{"non-positive close", []CashEvent{{ExDate: marchDay(3), Amount: decimal.NewFromInt(1)}}, "non-positive close"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candles := adjustCandles()
+			candles[1] = dayCandle(2, 0)
+			if _, _, err := AdjustCandles(candles, tt.events, ADJUST_RATIO); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAdjustCandles(t *testing.T) {
+	tests := []struct {
+		name   string
+		method AdjustMethod
+		// want - open, high, low, close скорректированных свечей со 2 по 6 марта
+		want [][4]string
+	}{
+		{"ratio", ADJUST_RATIO, [][4]string{
+			{"86.4", "87.264", "85.536", "86.4"},
+			{"86.4", "87.264", "85.536", "86.4"},
+			{"86.4", "87.3", "85.5", "86.4"},
+			{"90", "90.9", "89.1", "90"},
+			{"90", "91", "89", "90"},
+		}},
+		{"difference", ADJUST_DIFFERENCE, [][4]string{
+			{"86", "87", "85", "86"},
+			{"86", "87", "85", "86"},
+			{"86", "87", "85", "86"},
+			{"90", "91", "89", "90"},
+			{"90", "91", "89", "90"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candles := adjustCandles()
+			adjusted, _, err := AdjustCandles(candles, adjustEvents(), tt.method)
+			if err != nil {
+				t.Fatalf("AdjustCandles: %v", err)
+			}
+			if len(adjusted) != len(tt.want) {
+				t.Fatalf("candles = %v", adjusted)
+			}
+			for i, w := range tt.want {
+				c := adjusted[i]
+				got := [4]string{quotationString(c.GetOpen()), quotationString(c.GetHigh()), quotationString(c.GetLow()), quotationString(c.GetClose())}
+				if got != w || !c.GetTime().AsTime().Equal(marchDay(i+2)) || c.GetVolume() != 10 || !c.GetIsComplete() {
+					t.Errorf("candle %v = %v, want %v", i, got, w)
+				}
+			}
+			// исходные свечи не меняются
+			if quotationString(candles[1].GetClose()) != "100" {
+				t.Fatalf("source candle changed: %v", candles[1])
+			}
+		})
+	}
+}
+
+func TestTotalReturn(t *testing.T) {
+	points := TotalReturn(adjustCandles(), adjustEvents())
+	want := []string{"100", "100", "100", "104.166667", "104.166667"}
+	if len(points) != len(want) {
+		t.Fatalf("points = %v", points)
+	}
+	for i, w := range want {
+		if got := points[i].Value.Round(6).String(); got != w || !points[i].Time.Equal(marchDay(i+2)) {
+			t.Errorf("point %v = %v %v, want %v", i, points[i].Time, got, w)
+		}
+	}
+	// доходность индекса совпадает с доходностью цен, скорректированных методом ADJUST_RATIO
+	adjusted, _, err := AdjustCandles(adjustCandles(), adjustEvents(), ADJUST_RATIO)
+	if err != nil {
+		t.Fatalf("AdjustCandles: %v", err)
+	}
+	first, last := investgo.QuotationToDecimal(adjusted[0].GetClose()), investgo.QuotationToDecimal(adjusted[4].GetClose())
+	if !points[4].Value.Div(points[0].Value).Round(9).Equal(last.Div(first).Round(9)) {
+		t.Fatalf("total return %v, adjusted return %v", points[4].Value.Div(points[0].Value), last.Div(first))
+	}
+	if got := TotalReturn(nil, adjustEvents()); len(got) != 0 {
+		t.Fatalf("empty candles = %v", got)
+	}
+}
+
+func TestDividendEvents(t *testing.T) {
+	stamp := func(month time.Month, d, h int) *timestamppb.Timestamp {
+		return investgo.TimeToTimestamp(time.Date(2024, month, d, h, 0, 0, 0, time.UTC))
+	}
+	net := func(units int64) *pb.MoneyValue {
+		return &pb.MoneyValue{Currency: "rub", Units: units, Nano: 500000000}
+	}
+	api := &fakeApi{dividends: map[string][]*pb.Dividend{"figi": {
+		{LastBuyDate: stamp(3, 1, 0), RecordDate: stamp(3, 3, 0), DividendNet: net(4)},
+		// незаданная дата последней покупки приходит нулевым timestamp
+		{LastBuyDate: &timestamppb.Timestamp{}, RecordDate: stamp(2, 10, 0), DividendNet: net(3)},
+		{LastBuyDate: &timestamppb.Timestamp{}, RecordDate: &timestamppb.Timestamp{}, DividendNet: net(2)},
+		{RecordDate: stamp(1, 15, 10), DividendNet: net(1)},
+	}}}
+	client := newTestClient(t, api, investgo.NewSimulatedClock(marchDay(1)))
+	events, err := DividendEvents(client.NewInstrumentsServiceClient(), "figi", marchDay(1).AddDate(-1, 0, 0), marchDay(1))
+	if err != nil {
+		t.Fatalf("DividendEvents: %v", err)
+	}
+	got := make([]string, 0, len(events))
+	for _, e := range events {
+		if e.Kind != CASH_EVENT_DIVIDEND {
+			t.Fatalf("kind = %v", e.Kind)
+		}
+		got = append(got, e.ExDate.Format(time.RFC3339)+" "+e.Amount.String())
+	}
+	want := []string{"2024-01-15T00:00:00Z 1.5", "2024-02-10T00:00:00Z 3.5", "2024-03-02T00:00:00Z 4.5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
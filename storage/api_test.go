@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeApi - Сервисы котировок и инструментов со свечами, сделками и расписанием торгов из памяти
+type fakeApi struct {
+	pb.UnimplementedMarketDataServiceServer
+	pb.UnimplementedInstrumentsServiceServer
+
+	mu sync.Mutex
+	// candles - Свечи по инструменту, отдаются свечи со временем в [from, to) запроса
+	candles map[string][]*pb.HistoricCandle
+	// trades - Сделки по инструменту, отдаются сделки со временем в [from, to] запроса
+	trades        map[string][]*pb.Trade
+	days          []*pb.TradingDay
+	dividends     map[string][]*pb.Dividend
+	candleCalls   int
+	tradeRequests []*pb.GetLastTradesRequest
+}
+
+func (f *fakeApi) GetCandles(_ context.Context, in *pb.GetCandlesRequest) (*pb.GetCandlesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.candleCalls++
+	from, to := in.GetFrom().AsTime(), in.GetTo().AsTime()
+	res := make([]*pb.HistoricCandle, 0)
+	for _, c := range f.candles[in.GetInstrumentId()] {
+		if t := c.GetTime().AsTime(); !t.Before(from) && t.Before(to) {
+			res = append(res, c)
+		}
+	}
+	return &pb.GetCandlesResponse{Candles: res}, nil
+}
+
+func (f *fakeApi) GetLastTrades(_ context.Context, in *pb.GetLastTradesRequest) (*pb.GetLastTradesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tradeRequests = append(f.tradeRequests, in)
+	from, to := in.GetFrom().AsTime(), in.GetTo().AsTime()
+	res := make([]*pb.Trade, 0)
+	for _, t := range f.trades[in.GetInstrumentId()] {
+		if tt := t.GetTime().AsTime(); !tt.Before(from) && !tt.After(to) {
+			res = append(res, t)
+		}
+	}
+	return &pb.GetLastTradesResponse{Trades: res}, nil
+}
+
+func (f *fakeApi) GetDividends(_ context.Context, in *pb.GetDividendsRequest) (*pb.GetDividendsResponse, error) {
+	return &pb.GetDividendsResponse{Dividends: f.dividends[in.GetFigi()]}, nil
+}
+
+func (f *fakeApi) TradingSchedules(_ context.Context, in *pb.TradingSchedulesRequest) (*pb.TradingSchedulesResponse, error) {
+	from, to := in.GetFrom().AsTime(), in.GetTo().AsTime()
+	days := make([]*pb.TradingDay, 0)
+	for _, d := range f.days {
+		if t := d.GetDate().AsTime(); !t.Before(from.Truncate(investgo.DAY)) && t.Before(to) {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].GetDate().AsTime().Before(days[j].GetDate().AsTime())
+	})
+	return &pb.TradingSchedulesResponse{Exchanges: []*pb.TradingSchedule{{Exchange: strings.ToUpper(in.GetExchange()), Days: days}}}, nil
+}
+
+// newTestClient - Клиент сдк, подключенный к api на локальном порту
+func newTestClient(t *testing.T, api *fakeApi, clock investgo.Clock) *investgo.Client {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterMarketDataServiceServer(server, api)
+	pb.RegisterInstrumentsServiceServer(server, api)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	client, err := investgo.NewClient(context.Background(), investgo.Config{
+		EndPoint:        lis.Addr().String(),
+		AccountId:       "account",
+		DisableTLS:      true,
+		DisableAllRetry: true,
+		Clock:           clock,
+	}, testLogger{t})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+	})
+	return client
+}
+
+// at - Время дня day со смещением в часах и минутах по UTC
+func at(day time.Time, h, m int) time.Time {
+	return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// CandleStore - Хранилище исторических свечей
+type CandleStore interface {
+	// Candles - Свечи инструмента с интервалом interval в диапазоне [from, to), отсортированные по времени
+	Candles(instrumentId string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error)
+	// Store - Сохранение свечей, свечи с тем же временем перезаписываются. updatedTo - момент, до которого
+	// история ряда загружена полностью, если он позже сохраненного, то сохраняется как Series.LastUpdate
+	Store(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, updatedTo time.Time) error
+	// Series - Информация о всех рядах свечей в хранилище
+	Series() ([]Series, error)
+	// Close - Закрытие хранилища
+	Close() error
+}
+
+// Series - Ряд свечей одного инструмента и интервала
+type Series struct {
+	InstrumentId string
+	Interval     pb.CandleInterval
+	// First, Last - Время первой и последней свечи
+	First time.Time
+	Last  time.Time
+	// Count - Количество свечей
+	Count int
+	// LastUpdate - Момент, до которого история загружена полностью
+	LastUpdate time.Time
+}
+
+// FindSeries - Поиск ряда в хранилище
+func FindSeries(store CandleStore, instrumentId string, interval pb.CandleInterval) (Series, bool, error) {
+	series, err := store.Series()
+	if err != nil {
+		return Series{}, false, err
+	}
+	for _, s := range series {
+		if s.InstrumentId == instrumentId && s.Interval == interval {
+			return s, true, nil
+		}
+	}
+	return Series{}, false, nil
+}
+
+// Backfill - Загрузка в хранилище истории, которой не хватает начиная с from. Если ряда нет, то загружаются
+// свечи с from до текущего момента по часам md, если первая свеча ряда позже from, то догружаются свечи до нее.
+// Возвращает количество загруженных свечей
+func Backfill(store CandleStore, md *investgo.MarketDataServiceClient, instrumentId string, interval pb.CandleInterval, from time.Time) (int, error) {
+	s, ok, err := FindSeries(store, instrumentId, interval)
+	if err != nil {
+		return 0, err
+	}
+	exists := ok && s.Count > 0
+	if exists && !from.Before(s.First) {
+		return 0, nil
+	}
+	to := md.Clock().Now()
+	// время обновления ряда не меняется, если догружаются только старые свечи
+	updatedTo := to
+	if exists {
+		to = s.First
+		updatedTo = time.Time{}
+	}
+	candles, err := md.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
+		Instrument: instrumentId,
+		Interval:   interval,
+		From:       from,
+		To:         to,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := store.Store(instrumentId, interval, candles, updatedTo); err != nil {
+		return 0, err
+	}
+	return len(candles), nil
+}
+
+// Update - Загрузка свечей в хранилище до текущего момента. Сначала догружается история с from (см. Backfill),
+// затем загрузка продолжается с последней сохраненной свечи, чтобы обновить несформированную свечу.
+// Возвращает количество загруженных свечей
+func Update(store CandleStore, md *investgo.MarketDataServiceClient, instrumentId string, interval pb.CandleInterval, from time.Time) (int, error) {
+	s, ok, err := FindSeries(store, instrumentId, interval)
+	if err != nil {
+		return 0, err
+	}
+	loaded, err := Backfill(store, md, instrumentId, interval, from)
+	if err != nil {
+		return loaded, err
+	}
+	if !ok || s.Count == 0 {
+		// Backfill уже загрузил ряд до текущего момента
+		return loaded, nil
+	}
+
+	now := md.Clock().Now()
+	start := s.LastUpdate
+	if s.Last.Before(start) {
+		start = s.Last
+	}
+	candles, err := md.GetHistoricCandles(&investgo.GetHistoricCandlesRequest{
+		Instrument: instrumentId,
+		Interval:   interval,
+		From:       start,
+		To:         now,
+	})
+	if err != nil {
+		return loaded, err
+	}
+	if err := store.Store(instrumentId, interval, candles, now); err != nil {
+		return loaded, err
+	}
+	return loaded + len(candles), nil
+}
+
+// clockOrReal - Часы из параметров, по умолчанию системное время
+func clockOrReal(clock investgo.Clock) investgo.Clock {
+	if clock == nil {
+		return investgo.RealClock{}
+	}
+	return clock
+}
+
+// seriesKey - Ключ ряда свечей
+type seriesKey struct {
+	instrumentId string
+	interval     pb.CandleInterval
+}
+
+// upsertCandles - Объединение отсортированных свечей с новыми, новые свечи заменяют свечи с тем же временем
+func upsertCandles(existing, candles []*pb.HistoricCandle) []*pb.HistoricCandle {
+	all := make([]*pb.HistoricCandle, 0, len(existing)+len(candles))
+	all = append(all, existing...)
+	all = append(all, candles...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].GetTime().AsTime().Before(all[j].GetTime().AsTime())
+	})
+	res := all[:0]
+	for _, c := range all {
+		if n := len(res); n > 0 && res[n-1].GetTime().AsTime().Equal(c.GetTime().AsTime()) {
+			res[n-1] = c
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// candlesBetween - Свечи из отсортированного слайса в диапазоне [from, to)
+func candlesBetween(candles []*pb.HistoricCandle, from, to time.Time) []*pb.HistoricCandle {
+	start := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].GetTime().AsTime().Before(from)
+	})
+	end := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].GetTime().AsTime().Before(to)
+	})
+	if start >= end {
+		return []*pb.HistoricCandle{}
+	}
+	res := make([]*pb.HistoricCandle, end-start)
+	copy(res, candles[start:end])
+	return res
+}
+
+func seriesInfo(key seriesKey, candles []*pb.HistoricCandle, lastUpdate time.Time) Series {
+	s := Series{
+		InstrumentId: key.instrumentId,
+		Interval:     key.interval,
+		Count:        len(candles),
+		LastUpdate:   lastUpdate,
+	}
+	if len(candles) > 0 {
+		s.First = candles[0].GetTime().AsTime()
+		s.Last = candles[len(candles)-1].GetTime().AsTime()
+	}
+	return s
+}
+
+func sortSeries(series []Series) {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].InstrumentId != series[j].InstrumentId {
+			return series[i].InstrumentId < series[j].InstrumentId
+		}
+		return series[i].Interval < series[j].Interval
+	})
+}
+
+// ErrUnsupportedVersion - Версия формата хранилища новее, чем поддерживает эта версия sdk
+type ErrUnsupportedVersion struct {
+	Version   int
+	Supported int
+}
+
+func (e *ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("storage version %v is not supported, max supported version is %v", e.Version, e.Supported)
+}
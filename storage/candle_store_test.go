@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+var storeStart = time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+
+// testBackend - Хранилище для общего набора тестов. open открывает хранилище в той же директории,
+// что и предыдущий вызов, nil для хранилищ без сохранения на диск
+type testBackend struct {
+	name string
+	open func(t *testing.T, dir string) CandleStore
+}
+
+var testBackends = []testBackend{
+	{name: "memory"},
+	{name: "csv", open: func(t *testing.T, dir string) CandleStore {
+		s, err := NewCSVStore(dir)
+		if err != nil {
+			t.Fatalf("NewCSVStore: %v", err)
+		}
+		return s
+	}},
+	{name: "sqlite", open: func(t *testing.T, dir string) CandleStore {
+		s, err := NewSQLiteStore(filepath.Join(dir, "candles.db"), testLogger{t})
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		return s
+	}},
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Infof(template string, args ...any) {
+	l.t.Logf(template, args...)
+}
+
+func (l testLogger) Errorf(template string, args ...any) {
+	l.t.Logf("ERROR "+template, args...)
+}
+
+func (l testLogger) Fatalf(template string, args ...any) {
+	l.t.Fatalf(template, args...)
+}
+
+// testCandle - Минутная свеча с ценой close = open + 0.000000001 для проверки точности
+func testCandle(minute int, open int64) *pb.HistoricCandle {
+	return &pb.HistoricCandle{
+		Time:       investgo.TimeToTimestamp(storeStart.Add(time.Duration(minute) * time.Minute)),
+		Open:       &pb.Quotation{Units: open},
+		High:       &pb.Quotation{Units: open + 1},
+		Low:        &pb.Quotation{Units: open - 1, Nano: 500000000},
+		Close:      &pb.Quotation{Units: open, Nano: 1},
+		Volume:     open * 10,
+		IsComplete: minute%2 == 0,
+	}
+}
+
+func sameCandle(a, b *pb.HistoricCandle) bool {
+	q := func(a, b *pb.Quotation) bool {
+		return a.GetUnits() == b.GetUnits() && a.GetNano() == b.GetNano()
+	}
+	return a.GetTime().AsTime().Equal(b.GetTime().AsTime()) && q(a.GetOpen(), b.GetOpen()) && q(a.GetHigh(), b.GetHigh()) &&
+		q(a.GetLow(), b.GetLow()) && q(a.GetClose(), b.GetClose()) && a.GetVolume() == b.GetVolume() &&
+		a.GetIsComplete() == b.GetIsComplete()
+}
+
+func checkCandles(t *testing.T, store CandleStore, id string, interval pb.CandleInterval, from, to int, want []*pb.HistoricCandle) {
+	t.Helper()
+	got, err := store.Candles(id, interval, storeStart.Add(time.Duration(from)*time.Minute), storeStart.Add(time.Duration(to)*time.Minute))
+	if err != nil {
+		t.Fatalf("Candles: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%v candles in [%v, %v) = %v, want %v", id, from, to, len(got), len(want))
+	}
+	for i := range got {
+		if !sameCandle(got[i], want[i]) {
+			t.Fatalf("%v candle %v = %v, want %v", id, i, got[i], want[i])
+		}
+	}
+}
+
+// TestCandleStore - Общий набор тестов для всех реализаций CandleStore
+func TestCandleStore(t *testing.T) {
+	const (
+		minute = pb.CandleInterval_CANDLE_INTERVAL_1_MIN
+		hour   = pb.CandleInterval_CANDLE_INTERVAL_HOUR
+		// id с символами, которые экранируются в именах файлов
+		id = `SBER_TQBR/a:b%2F\c`
+	)
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var store CandleStore = NewMemoryStore()
+			if backend.open != nil {
+				store = backend.open(t, dir)
+			}
+			defer func() {
+				if err := store.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+			}()
+
+			if series, err := store.Series(); err != nil || len(series) != 0 {
+				t.Fatalf("Series of empty store = %v, %v", series, err)
+			}
+			checkCandles(t, store, id, minute, 0, 10, nil)
+
+			update := storeStart.Add(time.Hour)
+			// свечи сохраняются не по порядку, отдаются отсортированными
+			if err := store.Store(id, minute, []*pb.HistoricCandle{testCandle(2, 102), testCandle(0, 100), testCandle(1, 101)}, update); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := store.Store(id, hour, []*pb.HistoricCandle{testCandle(0, 200)}, time.Time{}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := store.Store("other", minute, []*pb.HistoricCandle{testCandle(5, 300)}, update); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			checkCandles(t, store, id, minute, 0, 10, []*pb.HistoricCandle{testCandle(0, 100), testCandle(1, 101), testCandle(2, 102)})
+			// правая граница не включается
+			checkCandles(t, store, id, minute, 1, 2, []*pb.HistoricCandle{testCandle(1, 101)})
+			checkCandles(t, store, id, hour, 0, 10, []*pb.HistoricCandle{testCandle(0, 200)})
+
+			// свеча с тем же временем перезаписывается, более раннее время обновления не сохраняется
+			if err := store.Store(id, minute, []*pb.HistoricCandle{testCandle(2, 112), testCandle(3, 113)}, storeStart); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			want := []*pb.HistoricCandle{testCandle(0, 100), testCandle(1, 101), testCandle(2, 112), testCandle(3, 113)}
+			checkCandles(t, store, id, minute, 0, 10, want)
+
+			checkSeries := func(store CandleStore) {
+				t.Helper()
+				series, err := store.Series()
+				if err != nil {
+					t.Fatalf("Series: %v", err)
+				}
+				wantSeries := []Series{
+					{InstrumentId: id, Interval: minute, First: storeStart, Last: storeStart.Add(3 * time.Minute), Count: 4, LastUpdate: update},
+					{InstrumentId: id, Interval: hour, First: storeStart, Last: storeStart, Count: 1},
+					{InstrumentId: "other", Interval: minute, First: storeStart.Add(5 * time.Minute), Last: storeStart.Add(5 * time.Minute), Count: 1, LastUpdate: update},
+				}
+				sortSeries(wantSeries)
+				if len(series) != len(wantSeries) {
+					t.Fatalf("series = %+v, want %+v", series, wantSeries)
+				}
+				for i, s := range series {
+					w := wantSeries[i]
+					if s.InstrumentId != w.InstrumentId || s.Interval != w.Interval || s.Count != w.Count ||
+						!s.First.Equal(w.First) || !s.Last.Equal(w.Last) || !s.LastUpdate.Equal(w.LastUpdate) {
+						t.Errorf("series %v = %+v, want %+v", i, s, w)
+					}
+				}
+				s, ok, err := FindSeries(store, id, hour)
+				if err != nil || !ok || s.Count != 1 {
+					t.Errorf("FindSeries = %+v, %v, %v", s, ok, err)
+				}
+				if _, ok, _ := FindSeries(store, id, pb.CandleInterval_CANDLE_INTERVAL_DAY); ok {
+					t.Error("FindSeries found missing series")
+				}
+			}
+			checkSeries(store)
+
+			if backend.open == nil {
+				return
+			}
+			// данные сохраняются между открытиями хранилища
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			store = backend.open(t, dir)
+			checkSeries(store)
+			checkCandles(t, store, id, minute, 0, 10, want)
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// CSV_STORE_VERSION - Текущая версия формата CSVStore
+	CSV_STORE_VERSION = 1
+	// csvMetaFile - Файл с версией формата и временем обновления рядов
+	csvMetaFile = "store.json"
+)
+
+var csvHeader = []string{"time", "open", "high", "low", "close", "volume", "is_complete"}
+
+// csvMigrations - Миграции формата CSVStore, csvMigrations[i] переводит директорию с версии i+1 на i+2
+var csvMigrations []func(dir string) error
+
+type csvMeta struct {
+	Version int             `json:"version"`
+	Series  []csvMetaSeries `json:"series"`
+}
+
+type csvMetaSeries struct {
+	InstrumentId string    `json:"instrument_id"`
+	Interval     string    `json:"interval"`
+	LastUpdate   time.Time `json:"last_update"`
+}
+
+// CSVStore - Хранилище свечей в директории с CSV файлами. На каждый инструмент и интервал создается файл
+// <instrumentId>_<interval>.csv с заголовком time,open,high,low,close,volume,is_complete, время в RFC3339 UTC,
+// цены в десятичной записи без потери точности. Недопустимые в имени файла символы instrumentId записываются как %XX.
+// Время обновления рядов и версия формата хранятся в store.json
+type CSVStore struct {
+	dir string
+
+	mu      sync.Mutex
+	cache   map[seriesKey][]*pb.HistoricCandle
+	updates map[seriesKey]time.Time
+}
+
+// NewCSVStore - Открытие или создание хранилища в директории dir
+func NewCSVStore(dir string) (*CSVStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &CSVStore{
+		dir:     dir,
+		cache:   make(map[seriesKey][]*pb.HistoricCandle),
+		updates: make(map[seriesKey]time.Time),
+	}
+	meta, err := s.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.Version > CSV_STORE_VERSION {
+		return nil, &ErrUnsupportedVersion{Version: meta.Version, Supported: CSV_STORE_VERSION}
+	}
+	for v := meta.Version; v < CSV_STORE_VERSION; v++ {
+		if err := csvMigrations[v-1](dir); err != nil {
+			return nil, fmt.Errorf("migration to version %v: %w", v+1, err)
+		}
+	}
+	for _, ms := range meta.Series {
+		interval, ok := pb.CandleInterval_value[ms.Interval]
+		if !ok {
+			return nil, fmt.Errorf("unknown interval %v in %v", ms.Interval, csvMetaFile)
+		}
+		s.updates[seriesKey{ms.InstrumentId, pb.CandleInterval(interval)}] = ms.LastUpdate
+	}
+	// ряды без записи в store.json, например скопированные вручную файлы
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]struct{}, len(s.updates))
+	for key := range s.updates {
+		known[s.fileName(key)] = struct{}{}
+	}
+	for _, f := range files {
+		if _, ok := known[filepath.Join(dir, filepath.Base(f))]; ok {
+			continue
+		}
+		if key, ok := parseCSVFileName(filepath.Base(f)); ok {
+			s.updates[key] = time.Time{}
+		}
+	}
+	return s, s.writeMeta()
+}
+
+func (s *CSVStore) Candles(instrumentId string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candles, err := s.load(seriesKey{instrumentId, interval})
+	if err != nil {
+		return nil, err
+	}
+	return candlesBetween(candles, from, to), nil
+}
+
+func (s *CSVStore) Store(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, updatedTo time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := seriesKey{instrumentId, interval}
+	existing, err := s.load(key)
+	if err != nil {
+		return err
+	}
+	merged := upsertCandles(existing, candles)
+	if err := s.writeSeries(key, merged); err != nil {
+		return err
+	}
+	s.cache[key] = merged
+	if updatedTo.After(s.updates[key]) {
+		s.updates[key] = updatedTo
+	} else if _, ok := s.updates[key]; !ok {
+		s.updates[key] = time.Time{}
+	}
+	return s.writeMeta()
+}
+
+func (s *CSVStore) Series() ([]Series, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Series, 0, len(s.updates))
+	for key, update := range s.updates {
+		candles, err := s.load(key)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, seriesInfo(key, candles, update))
+	}
+	sortSeries(res)
+	return res, nil
+}
+
+func (s *CSVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = make(map[seriesKey][]*pb.HistoricCandle)
+	return nil
+}
+
+func (s *CSVStore) fileName(key seriesKey) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%v_%v.csv", escapeFileName(key.instrumentId), key.interval.String()))
+}
+
+// load - Чтение ряда из файла или из кэша
+func (s *CSVStore) load(key seriesKey) ([]*pb.HistoricCandle, error) {
+	if candles, ok := s.cache[key]; ok {
+		return candles, nil
+	}
+	file, err := os.Open(s.fileName(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*pb.HistoricCandle{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	candles, err := readCSVCandles(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", s.fileName(key), err)
+	}
+	s.cache[key] = candles
+	return candles, nil
+}
+
+// writeSeries - Запись ряда через временный файл
+func (s *CSVStore) writeSeries(key seriesKey, candles []*pb.HistoricCandle) error {
+	path := s.fileName(key)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	if err := w.Write(csvHeader); err != nil {
+		file.Close()
+		return err
+	}
+	for _, c := range candles {
+		err := w.Write([]string{
+			c.GetTime().AsTime().UTC().Format(time.RFC3339),
+			investgo.QuotationToDecimal(c.GetOpen()).String(),
+			investgo.QuotationToDecimal(c.GetHigh()).String(),
+			investgo.QuotationToDecimal(c.GetLow()).String(),
+			investgo.QuotationToDecimal(c.GetClose()).String(),
+			strconv.FormatInt(c.GetVolume(), 10),
+			strconv.FormatBool(c.GetIsComplete()),
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readCSVCandles(r io.Reader) ([]*pb.HistoricCandle, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	candles := make([]*pb.HistoricCandle, 0, len(records))
+	for i, rec := range records {
+		if i == 0 && rec[0] == csvHeader[0] {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, rec[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		prices := make([]*pb.Quotation, 4)
+		for j := range prices {
+			d, err := decimal.NewFromString(rec[j+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", i+1, err)
+			}
+			prices[j] = investgo.DecimalToQuotation(d)
+		}
+		volume, err := strconv.ParseInt(rec[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		complete, err := strconv.ParseBool(rec[6])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		candles = append(candles, &pb.HistoricCandle{
+			Time:       investgo.TimeToTimestamp(t),
+			Open:       prices[0],
+			High:       prices[1],
+			Low:        prices[2],
+			Close:      prices[3],
+			Volume:     volume,
+			IsComplete: complete,
+		})
+	}
+	return upsertCandles(nil, candles), nil
+}
+
+func (s *CSVStore) readMeta() (csvMeta, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, csvMetaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return csvMeta{Version: CSV_STORE_VERSION}, nil
+	}
+	if err != nil {
+		return csvMeta{}, err
+	}
+	meta := csvMeta{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return csvMeta{}, err
+	}
+	if meta.Version < 1 {
+		meta.Version = 1
+	}
+	return meta, nil
+}
+
+func (s *CSVStore) writeMeta() error {
+	meta := csvMeta{Version: CSV_STORE_VERSION, Series: make([]csvMetaSeries, 0, len(s.updates))}
+	series := make([]Series, 0, len(s.updates))
+	for key, update := range s.updates {
+		series = append(series, Series{InstrumentId: key.instrumentId, Interval: key.interval, LastUpdate: update})
+	}
+	sortSeries(series)
+	for _, sr := range series {
+		meta.Series = append(meta.Series, csvMetaSeries{
+			InstrumentId: sr.InstrumentId,
+			Interval:     sr.Interval.String(),
+			LastUpdate:   sr.LastUpdate,
+		})
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, csvMetaFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// fileNameEscapes - Символы, недопустимые в имени файла, и сам символ экранирования
+const fileNameEscapes = `%/\:*?"<>|`
+
+// escapeFileName - Экранирование символов, недопустимых в имени файла, в виде %XX. Обратное преобразование -
+// unescapeFileName
+func escapeFileName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || strings.IndexByte(fileNameEscapes, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// unescapeFileName - Восстановление строки, экранированной escapeFileName
+func unescapeFileName(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), true
+}
+
+// parseCSVFileName - Ключ ряда по имени файла, обратное преобразование к CSVStore.fileName
+func parseCSVFileName(name string) (seriesKey, bool) {
+	name, ok := strings.CutSuffix(name, ".csv")
+	if !ok {
+		return seriesKey{}, false
+	}
+	i := strings.LastIndex(name, "_CANDLE_INTERVAL_")
+	if i < 0 {
+		return seriesKey{}, false
+	}
+	interval, ok := pb.CandleInterval_value[name[i+1:]]
+	if !ok {
+		return seriesKey{}, false
+	}
+	instrumentId, ok := unescapeFileName(name[:i])
+	if !ok {
+		return seriesKey{}, false
+	}
+	return seriesKey{instrumentId: instrumentId, interval: pb.CandleInterval(interval)}, true
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+func TestCSVFileName(t *testing.T) {
+	ids := []string{
+		"e6123145-9665-43e0-8413-cd61b8aa9b13",
+		"SBER_TQBR",
+		"a/b",
+		`a\b:c`,
+		// уже похожие на экранированные последовательности должны сохраняться как есть
+		"a-b%2F%",
+		"a_CANDLE_INTERVAL_HOUR",
+		`*?"<>|` + "\t",
+	}
+	s := &CSVStore{dir: "dir"}
+	for _, id := range ids {
+		key := seriesKey{instrumentId: id, interval: pb.CandleInterval_CANDLE_INTERVAL_5_MIN}
+		name := filepath.Base(s.fileName(key))
+		if filepath.Dir(s.fileName(key)) != "dir" {
+			t.Errorf("%q: file %v is outside of the store directory", id, s.fileName(key))
+		}
+		got, ok := parseCSVFileName(name)
+		if !ok || got != key {
+			t.Errorf("%q: parseCSVFileName(%v) = %+v, %v", id, name, got, ok)
+		}
+	}
+
+	for _, name := range []string{"a.csv", "a_CANDLE_INTERVAL_UNKNOWN.csv", "a%2_CANDLE_INTERVAL_HOUR.csv", "a%zz_CANDLE_INTERVAL_HOUR.csv", "a_CANDLE_INTERVAL_HOUR.txt"} {
+		if key, ok := parseCSVFileName(name); ok {
+			t.Errorf("parseCSVFileName(%v) = %+v", name, key)
+		}
+	}
+}
+
+func TestCSVStoreWithoutMeta(t *testing.T) {
+	dir := t.TempDir()
+	const id = "a/b:c"
+	s, err := NewCSVStore(dir)
+	if err != nil {
+		t.Fatalf("NewCSVStore: %v", err)
+	}
+	if err := s.Store(id, pb.CandleInterval_CANDLE_INTERVAL_1_MIN, []*pb.HistoricCandle{testCandle(0, 100)}, storeStart); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	// файлы, скопированные без store.json, находятся по имени
+	if err := os.Remove(filepath.Join(dir, csvMetaFile)); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	s, err = NewCSVStore(dir)
+	if err != nil {
+		t.Fatalf("NewCSVStore: %v", err)
+	}
+	series, err := s.Series()
+	if err != nil || len(series) != 1 || series[0].InstrumentId != id || series[0].Count != 1 {
+		t.Fatalf("series = %+v, %v", series, err)
+	}
+	if !series[0].LastUpdate.IsZero() {
+		t.Fatalf("last update = %v, want unknown", series[0].LastUpdate)
+	}
+}
+
+func TestCSVStoreUnsupportedVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, csvMetaFile), []byte(`{"version": 100}`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	_, err := NewCSVStore(dir)
+	var unsupported *ErrUnsupportedVersion
+	if !errors.As(err, &unsupported) || unsupported.Version != 100 {
+		t.Fatalf("err = %v, want ErrUnsupportedVersion", err)
+	}
+}
@@ -0,0 +1,24 @@
+/*
+Package storage предоставляет локальные хранилища исторических свечей.
+
+Все хранилища реализуют интерфейс CandleStore и хранят в одном хранилище свечи любого количества инструментов
+и интервалов. Цены хранятся без потери точности.
+
+  - MemoryStore - хранилище в памяти, удобно для тестов и бектестов
+  - CSVStore - директория с CSV файлами, по файлу на инструмент и интервал
+  - SQLiteStore - база sqlite. Драйвер go-sqlite3 является cgo пакетом, для сборки нужен gcc
+
+Функция Update догружает свечи из MarketDataService от последнего обновления до текущего момента,
+Backfill - только недостающую историю до первой сохраненной свечи:
+
+	store, err := storage.NewSQLiteStore("candles.db", logger)
+	n, err := storage.Update(store, client.NewMarketDataServiceClient(), uid, pb.CandleInterval_CANDLE_INTERVAL_1_MIN, from)
+	candles, err := store.Candles(uid, pb.CandleInterval_CANDLE_INTERVAL_1_MIN, from, time.Now())
+
+TradeRecorder и OrderBookRecorder непрерывно записывают обезличенные сделки и стаканы из стрима.
+
+Validate сверяет ряд с расписанием торгов, Resample агрегирует свечи в более крупные интервалы с учетом сессий.
+
+Формат хранилищ версионируется, при открытии хранилища старой версии выполняются миграции.
+*/
+package storage
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// MemoryStore - Хранилище свечей в памяти
+type MemoryStore struct {
+	mu      sync.RWMutex
+	candles map[seriesKey][]*pb.HistoricCandle
+	updates map[seriesKey]time.Time
+}
+
+// NewMemoryStore - Создание хранилища свечей в памяти
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		candles: make(map[seriesKey][]*pb.HistoricCandle),
+		updates: make(map[seriesKey]time.Time),
+	}
+}
+
+func (m *MemoryStore) Candles(instrumentId string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return candlesBetween(m.candles[seriesKey{instrumentId, interval}], from, to), nil
+}
+
+func (m *MemoryStore) Store(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, updatedTo time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := seriesKey{instrumentId, interval}
+	m.candles[key] = upsertCandles(m.candles[key], candles)
+	if updatedTo.After(m.updates[key]) {
+		m.updates[key] = updatedTo
+	}
+	return nil
+}
+
+func (m *MemoryStore) Series() ([]Series, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make([]Series, 0, len(m.candles))
+	for key, candles := range m.candles {
+		res = append(res, seriesInfo(key, candles, m.updates[key]))
+	}
+	sortSeries(res)
+	return res, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_ORDER_BOOK_DEPTH - Глубина стакана по умолчанию
+	DEFAULT_ORDER_BOOK_DEPTH = 20
+	// DEFAULT_INSTRUMENTS_PER_STREAM - Количество инструментов на один стрим по умолчанию
+	DEFAULT_INSTRUMENTS_PER_STREAM = 300
+)
+
+// OrderBookRecorderConfig - Параметры записи стаканов
+type OrderBookRecorderConfig struct {
+	// Instruments - uid инструментов
+	Instruments []string
+	// Depth - Глубина стакана, по умолчанию DEFAULT_ORDER_BOOK_DEPTH
+	Depth            int32
+	MarketDataStream *investgo.MarketDataStreamClient
+	// InstrumentsPerStream - Количество инструментов на один стрим, для большего числа инструментов
+	// открывается несколько стримов, по умолчанию DEFAULT_INSTRUMENTS_PER_STREAM
+	InstrumentsPerStream int
+	// Sink - Получатель снимков, например OrderBookFiles. Recorder не закрывает Sink
+	Sink OrderBookSink
+	// FlushInterval - Период сброса буферов Sink, по умолчанию DEFAULT_FLUSH_INTERVAL
+	FlushInterval time.Duration
+	// Logger - Логгер, по умолчанию логгер клиента MarketDataStream
+	Logger investgo.Logger
+	// Clock - Часы для времени получения снимков и сброса буферов, по умолчанию системное время
+	Clock investgo.Clock
+}
+
+// OrderBookRecorder - Непрерывная запись снимков стаканов из стрима с временем формирования на бирже
+// и временем получения
+type OrderBookRecorder struct {
+	conf OrderBookRecorderConfig
+}
+
+// NewOrderBookRecorder - Создание записи стаканов
+func NewOrderBookRecorder(conf OrderBookRecorderConfig) *OrderBookRecorder {
+	if conf.Depth <= 0 {
+		conf.Depth = DEFAULT_ORDER_BOOK_DEPTH
+	}
+	if conf.InstrumentsPerStream <= 0 {
+		conf.InstrumentsPerStream = DEFAULT_INSTRUMENTS_PER_STREAM
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if conf.Logger == nil && conf.MarketDataStream != nil {
+		conf.Logger = conf.MarketDataStream.Logger()
+	}
+	conf.Clock = clockOrReal(conf.Clock)
+	return &OrderBookRecorder{conf: conf}
+}
+
+// Run - Подписка на стаканы и запись до завершения ctx или ошибки одного из стримов
+func (r *OrderBookRecorder) Run(ctx context.Context) error {
+	if len(r.conf.Instruments) == 0 {
+		return errors.New("no instruments to record")
+	}
+	streams := make([]*investgo.MarketDataStream, 0)
+	stopAll := func() {
+		for _, s := range streams {
+			s.Stop()
+		}
+	}
+	channels := make([]<-chan *pb.OrderBook, 0)
+	for start := 0; start < len(r.conf.Instruments); start += r.conf.InstrumentsPerStream {
+		end := start + r.conf.InstrumentsPerStream
+		if end > len(r.conf.Instruments) {
+			end = len(r.conf.Instruments)
+		}
+		stream, err := r.conf.MarketDataStream.MarketDataStream()
+		if err != nil {
+			stopAll()
+			return err
+		}
+		streams = append(streams, stream)
+		orderBooks, err := stream.SubscribeOrderBook(r.conf.Instruments[start:end], r.conf.Depth)
+		if err != nil {
+			stopAll()
+			return err
+		}
+		channels = append(channels, orderBooks)
+	}
+
+	snapshots := make(chan OrderBookSnapshot)
+	errs := make(chan error, len(streams))
+	wg := &sync.WaitGroup{}
+	for i, stream := range streams {
+		stream, orderBooks := stream, channels[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listenErr := make(chan error, 1)
+			go func() {
+				listenErr <- stream.Listen()
+			}()
+			for ob := range orderBooks {
+				select {
+				case snapshots <- OrderBookSnapshot{OrderBook: ob, ReceivedAt: r.conf.Clock.Now()}:
+				case <-ctx.Done():
+				}
+			}
+			// канал закрывается после остановки стрима, закрытие одного стрима останавливает остальные
+			errs <- <-listenErr
+			stopAll()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(snapshots)
+	}()
+
+	flush := r.conf.Clock.NewTicker(r.conf.FlushInterval)
+	defer flush.Stop()
+	var writeErr error
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			// дожидаемся закрытия каналов стримов
+			done = nil
+			stopAll()
+		case s, ok := <-snapshots:
+			if !ok {
+				close(errs)
+				listenErrs := []error{writeErr}
+				for err := range errs {
+					listenErrs = append(listenErrs, err)
+				}
+				return errors.Join(append(listenErrs, r.conf.Sink.Flush())...)
+			}
+			if writeErr != nil {
+				continue
+			}
+			if err := r.conf.Sink.WriteOrderBook(s); err != nil {
+				writeErr = err
+				stopAll()
+			}
+		case <-flush.C():
+			if err := r.conf.Sink.Flush(); err != nil {
+				r.conf.Logger.Errorf("order books flush error %v", err.Error())
+			}
+		}
+	}
+}
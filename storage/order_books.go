@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_ORDER_BOOKS_ROTATION - Период ротации файлов стаканов по умолчанию
+	DEFAULT_ORDER_BOOKS_ROTATION = time.Hour
+	// DEFAULT_KEYFRAME_INTERVAL - Количество записей инструмента между полными снимками при дельта-сжатии по умолчанию
+	DEFAULT_KEYFRAME_INTERVAL = 100
+	orderBooksFileExt         = ".jsonl.gz"
+)
+
+// OrderBookSnapshot - Снимок стакана из стрима
+type OrderBookSnapshot struct {
+	// OrderBook - Стакан, время формирования на бирже в OrderBook.Time
+	OrderBook *pb.OrderBook
+	// ReceivedAt - Локальное время получения стакана из стрима
+	ReceivedAt time.Time
+}
+
+// OrderBookSink - Получатель снимков стаканов для OrderBookRecorder
+type OrderBookSink interface {
+	// WriteOrderBook - Сохранение снимка
+	WriteOrderBook(s OrderBookSnapshot) error
+	// Flush - Сброс буферов на диск
+	Flush() error
+	// Close - Закрытие получателя
+	Close() error
+}
+
+// OrderBookFilesConfig - Параметры хранения стаканов в файлах
+type OrderBookFilesConfig struct {
+	Dir string
+	// Rotation - Период ротации файлов, по умолчанию DEFAULT_ORDER_BOOKS_ROTATION
+	Rotation time.Duration
+	// Delta - Записывать вместо полного снимка только изменившиеся уровни относительно предыдущего снимка
+	Delta bool
+	// KeyframeInterval - Количество записей между полными снимками при Delta, по умолчанию DEFAULT_KEYFRAME_INTERVAL
+	KeyframeInterval int
+}
+
+// OrderBookFiles - Хранение снимков стаканов в сжатых gzip файлах JSON Lines. Снимки каждого инструмента пишутся
+// в директорию <dir>/<instrumentId>, файл <начало периода>.jsonl.gz содержит снимки, время формирования которых
+// попадает в период ротации. Каждая строка - объект:
+//
+//	{"time": время на бирже, RFC3339 UTC с наносекундами,
+//	 "received": время получения, RFC3339 UTC с наносекундами,
+//	 "instrument_uid", "figi", "depth", "is_consistent", "limit_up", "limit_down",
+//	 "delta": true, если строка содержит только изменения относительно предыдущей строки файла,
+//	 "bids", "asks": уровни [цена, количество в лотах], цены - десятичные числа без потери точности}
+//
+// В полном снимке bids и asks содержат все уровни стакана. В дельте - только изменившиеся уровни, количество 0
+// означает, что уровень удален. Первая строка файла и каждого дописанного gzip потока - полный снимок
+type OrderBookFiles struct {
+	conf OrderBookFilesConfig
+
+	mu      sync.Mutex
+	writers map[string]*orderBooksFile
+	latest  time.Time
+}
+
+type orderBooksFile struct {
+	period time.Time
+	file   *os.File
+	gz     *gzip.Writer
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	// prev - Предыдущий записанный снимок, sinceKeyframe - количество дельт после последнего полного снимка
+	prev          *pb.OrderBook
+	sinceKeyframe int
+}
+
+// orderBookRecord - Строка файла стаканов
+type orderBookRecord struct {
+	Time          string           `json:"time"`
+	Received      string           `json:"received"`
+	InstrumentUid string           `json:"instrument_uid"`
+	Figi          string           `json:"figi"`
+	Depth         int32            `json:"depth"`
+	IsConsistent  bool             `json:"is_consistent"`
+	LimitUp       json.Number      `json:"limit_up"`
+	LimitDown     json.Number      `json:"limit_down"`
+	Delta         bool             `json:"delta,omitempty"`
+	Bids          [][2]json.Number `json:"bids"`
+	Asks          [][2]json.Number `json:"asks"`
+}
+
+// NewOrderBookFiles - Создание хранилища стаканов
+func NewOrderBookFiles(conf OrderBookFilesConfig) (*OrderBookFiles, error) {
+	if conf.Rotation <= 0 {
+		conf.Rotation = DEFAULT_ORDER_BOOKS_ROTATION
+	}
+	if conf.KeyframeInterval <= 0 {
+		conf.KeyframeInterval = DEFAULT_KEYFRAME_INTERVAL
+	}
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &OrderBookFiles{
+		conf:    conf,
+		writers: make(map[string]*orderBooksFile),
+	}, nil
+}
+
+func (f *OrderBookFiles) WriteOrderBook(s OrderBookSnapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ob := s.OrderBook
+	obTime := ob.GetTime().AsTime().UTC()
+	period := obTime.Truncate(f.conf.Rotation)
+	w, err := f.writer(ob.GetInstrumentUid(), period)
+	if err != nil {
+		return err
+	}
+	rec := orderBookRecord{
+		Time:          obTime.Format(time.RFC3339Nano),
+		Received:      s.ReceivedAt.UTC().Format(time.RFC3339Nano),
+		InstrumentUid: ob.GetInstrumentUid(),
+		Figi:          ob.GetFigi(),
+		Depth:         ob.GetDepth(),
+		IsConsistent:  ob.GetIsConsistent(),
+		LimitUp:       json.Number(investgo.QuotationToDecimal(ob.GetLimitUp()).String()),
+		LimitDown:     json.Number(investgo.QuotationToDecimal(ob.GetLimitDown()).String()),
+	}
+	if f.conf.Delta && w.prev != nil && w.sinceKeyframe < f.conf.KeyframeInterval {
+		rec.Delta = true
+		rec.Bids = deltaLevels(w.prev.GetBids(), ob.GetBids())
+		rec.Asks = deltaLevels(w.prev.GetAsks(), ob.GetAsks())
+		w.sinceKeyframe++
+	} else {
+		rec.Bids = encodeLevels(ob.GetBids())
+		rec.Asks = encodeLevels(ob.GetAsks())
+		w.sinceKeyframe = 0
+	}
+	if err := w.enc.Encode(rec); err != nil {
+		return err
+	}
+	w.prev = ob
+	if period.After(f.latest) {
+		f.latest = period
+		// файлы прошлых периодов закрываются, предыдущий оставляем открытым для запоздавших снимков
+		for path, w := range f.writers {
+			if w.period.Before(f.latest.Add(-f.conf.Rotation)) {
+				delete(f.writers, path)
+				if err := w.close(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *OrderBookFiles) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, w := range f.writers {
+		if err := w.buf.Flush(); err != nil {
+			return err
+		}
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *OrderBookFiles) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for path, w := range f.writers {
+		delete(f.writers, path)
+		if err := w.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writer - Открытый файл инструмента за период, новые записи дописываются отдельным gzip потоком
+func (f *OrderBookFiles) writer(instrumentId string, period time.Time) (*orderBooksFile, error) {
+	dir := filepath.Join(f.conf.Dir, escapeFileName(instrumentId))
+	path := filepath.Join(dir, period.Format(periodFileLayout)+orderBooksFileExt)
+	if w, ok := f.writers[path]; ok {
+		return w, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	buf := bufio.NewWriter(gz)
+	w := &orderBooksFile{period: period, file: file, gz: gz, buf: buf, enc: json.NewEncoder(buf)}
+	f.writers[path] = w
+	return w, nil
+}
+
+func (w *orderBooksFile) close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// IterateOrderBooks - Обход снимков стаканов инструмента из директории OrderBookFiles в диапазоне [from, to)
+// по возрастанию времени формирования на бирже. Дельты восстанавливаются в полные снимки.
+// Обход прекращается, если fn возвращает ошибку, эта ошибка возвращается из IterateOrderBooks
+func IterateOrderBooks(dir, instrumentId string, from, to time.Time, fn func(s OrderBookSnapshot) error) error {
+	files, err := periodFiles(filepath.Join(dir, escapeFileName(instrumentId)), orderBooksFileExt)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		if !file.period.Before(to) {
+			break
+		}
+		// в файле нет снимков позже начала следующего периода
+		if i+1 < len(files) && !files[i+1].period.After(from) {
+			continue
+		}
+		snapshots, err := readOrderBooksFile(file.path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", file.path, err)
+		}
+		for _, s := range snapshots {
+			t := s.OrderBook.GetTime().AsTime()
+			if t.Before(from) || !t.Before(to) {
+				continue
+			}
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadOrderBooks - Снимки стаканов инструмента из директории OrderBookFiles в диапазоне [from, to)
+func ReadOrderBooks(dir, instrumentId string, from, to time.Time) ([]OrderBookSnapshot, error) {
+	snapshots := make([]OrderBookSnapshot, 0)
+	err := IterateOrderBooks(dir, instrumentId, from, to, func(s OrderBookSnapshot) error {
+		snapshots = append(snapshots, s)
+		return nil
+	})
+	return snapshots, err
+}
+
+// readOrderBooksFile - Чтение и восстановление снимков из файла с сортировкой по времени
+func readOrderBooksFile(path string) ([]OrderBookSnapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+	snapshots := make([]OrderBookSnapshot, 0)
+	var prev *pb.OrderBook
+	for line := 1; ; line++ {
+		var rec orderBookRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// последний поток мог быть не дописан при аварийном завершении
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		s, err := rec.snapshot(prev)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		prev = s.OrderBook
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].OrderBook.GetTime().AsTime().Before(snapshots[j].OrderBook.GetTime().AsTime())
+	})
+	return snapshots, nil
+}
+
+// snapshot - Полный снимок из записи, для дельты prev - предыдущий снимок файла
+func (rec orderBookRecord) snapshot(prev *pb.OrderBook) (OrderBookSnapshot, error) {
+	t, err := time.Parse(time.RFC3339Nano, rec.Time)
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	received, err := time.Parse(time.RFC3339Nano, rec.Received)
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	limitUp, err := decimal.NewFromString(rec.LimitUp.String())
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	limitDown, err := decimal.NewFromString(rec.LimitDown.String())
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	bids, err := decodeLevels(rec.Bids)
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	asks, err := decodeLevels(rec.Asks)
+	if err != nil {
+		return OrderBookSnapshot{}, err
+	}
+	if rec.Delta {
+		if prev == nil {
+			return OrderBookSnapshot{}, errors.New("delta without previous snapshot")
+		}
+		bids = applyLevels(prev.GetBids(), bids, true)
+		asks = applyLevels(prev.GetAsks(), asks, false)
+	}
+	return OrderBookSnapshot{
+		OrderBook: &pb.OrderBook{
+			Figi:          rec.Figi,
+			Depth:         rec.Depth,
+			IsConsistent:  rec.IsConsistent,
+			Bids:          bids,
+			Asks:          asks,
+			Time:          investgo.TimeToTimestamp(t),
+			LimitUp:       investgo.DecimalToQuotation(limitUp),
+			LimitDown:     investgo.DecimalToQuotation(limitDown),
+			InstrumentUid: rec.InstrumentUid,
+		},
+		ReceivedAt: received,
+	}, nil
+}
+
+func encodeLevels(orders []*pb.Order) [][2]json.Number {
+	levels := make([][2]json.Number, 0, len(orders))
+	for _, o := range orders {
+		levels = append(levels, encodeLevel(o.GetPrice(), o.GetQuantity()))
+	}
+	return levels
+}
+
+func encodeLevel(price *pb.Quotation, quantity int64) [2]json.Number {
+	return [2]json.Number{
+		json.Number(investgo.QuotationToDecimal(price).String()),
+		json.Number(fmt.Sprint(quantity)),
+	}
+}
+
+// deltaLevels - Уровни cur, отличающиеся от prev, и удаленные уровни prev с количеством 0
+func deltaLevels(prev, cur []*pb.Order) [][2]json.Number {
+	prevQuantity := make(map[string]int64, len(prev))
+	for _, o := range prev {
+		prevQuantity[investgo.QuotationToDecimal(o.GetPrice()).String()] = o.GetQuantity()
+	}
+	levels := make([][2]json.Number, 0)
+	for _, o := range cur {
+		price := investgo.QuotationToDecimal(o.GetPrice()).String()
+		q, ok := prevQuantity[price]
+		delete(prevQuantity, price)
+		if ok && q == o.GetQuantity() {
+			continue
+		}
+		levels = append(levels, encodeLevel(o.GetPrice(), o.GetQuantity()))
+	}
+	for _, o := range prev {
+		if _, removed := prevQuantity[investgo.QuotationToDecimal(o.GetPrice()).String()]; removed {
+			levels = append(levels, encodeLevel(o.GetPrice(), 0))
+		}
+	}
+	return levels
+}
+
+func decodeLevels(levels [][2]json.Number) ([]*pb.Order, error) {
+	orders := make([]*pb.Order, 0, len(levels))
+	for _, l := range levels {
+		price, err := decimal.NewFromString(l[0].String())
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := l[1].Int64()
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, &pb.Order{Price: investgo.DecimalToQuotation(price), Quantity: quantity})
+	}
+	return orders, nil
+}
+
+// applyLevels - Применение дельты к уровням prev, результат отсортирован по убыванию цены для bids
+// и по возрастанию для asks
+func applyLevels(prev, delta []*pb.Order, desc bool) []*pb.Order {
+	levels := make(map[string]*pb.Order, len(prev)+len(delta))
+	for _, o := range prev {
+		levels[investgo.QuotationToDecimal(o.GetPrice()).String()] = o
+	}
+	for _, o := range delta {
+		price := investgo.QuotationToDecimal(o.GetPrice()).String()
+		if o.GetQuantity() == 0 {
+			delete(levels, price)
+			continue
+		}
+		levels[price] = o
+	}
+	orders := make([]*pb.Order, 0, len(levels))
+	for _, o := range levels {
+		orders = append(orders, o)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		pi, pj := investgo.QuotationToDecimal(orders[i].GetPrice()), investgo.QuotationToDecimal(orders[j].GetPrice())
+		if desc {
+			return pi.GreaterThan(pj)
+		}
+		return pi.LessThan(pj)
+	})
+	return orders
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// level - Уровень стакана с ценой units + nano
+func level(units int64, nano int32, quantity int64) *pb.Order {
+	return &pb.Order{Price: &pb.Quotation{Units: units, Nano: nano}, Quantity: quantity}
+}
+
+// testBook - Стакан инструмента uid в 10:00 + offset
+func testBook(offset time.Duration, bids, asks []*pb.Order) OrderBookSnapshot {
+	t := at(tradesDay, 10, 0).Add(offset)
+	return OrderBookSnapshot{
+		OrderBook: &pb.OrderBook{
+			InstrumentUid: "uid",
+			Figi:          "figi",
+			Depth:         10,
+			IsConsistent:  true,
+			Bids:          bids,
+			Asks:          asks,
+			Time:          investgo.TimeToTimestamp(t),
+			LimitUp:       &pb.Quotation{Units: 120, Nano: 250000000},
+			LimitDown:     &pb.Quotation{Units: 80},
+		},
+		ReceivedAt: t.Add(3 * time.Millisecond),
+	}
+}
+
+// deltaBooks - Последовательность стаканов, дельты которых добавляют, изменяют и удаляют уровни
+func deltaBooks() []OrderBookSnapshot {
+	return []OrderBookSnapshot{
+		testBook(0, []*pb.Order{level(100, 0, 5), level(99, 500000000, 3)}, []*pb.Order{level(100, 250000000, 2), level(101, 0, 7)}),
+		// изменилось количество на лучшей покупке
+		testBook(time.Second, []*pb.Order{level(100, 0, 6), level(99, 500000000, 3)}, []*pb.Order{level(100, 250000000, 2), level(101, 0, 7)}),
+		// добавлен уровень покупки, удален уровень продажи
+		testBook(2*time.Second, []*pb.Order{level(100, 100000000, 1), level(100, 0, 6), level(99, 500000000, 3)}, []*pb.Order{level(101, 0, 7)}),
+		// полный снимок после KeyframeInterval дельт
+		testBook(3*time.Second, []*pb.Order{level(100, 100000000, 1), level(99, 500000000, 3)}, []*pb.Order{level(101, 0, 8)}),
+		// удалены все продажи
+		testBook(4*time.Second, []*pb.Order{level(100, 100000000, 1), level(99, 500000000, 3)}, nil),
+		// без изменений
+		testBook(5*time.Second, []*pb.Order{level(100, 100000000, 1), level(99, 500000000, 3)}, nil),
+	}
+}
+
+func checkBooks(t *testing.T, got, want []OrderBookSnapshot) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("snapshots = %v, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i].OrderBook, want[i].OrderBook) || !got[i].ReceivedAt.Equal(want[i].ReceivedAt) {
+			t.Fatalf("snapshot %v = %v at %v, want %v at %v", i, got[i].OrderBook, got[i].ReceivedAt, want[i].OrderBook, want[i].ReceivedAt)
+		}
+	}
+}
+
+func TestOrderBookFilesDelta(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewOrderBookFiles(OrderBookFilesConfig{Dir: dir, Delta: true, KeyframeInterval: 2})
+	if err != nil {
+		t.Fatalf("NewOrderBookFiles: %v", err)
+	}
+	books := deltaBooks()
+	for _, b := range books {
+		if err := f.WriteOrderBook(b); err != nil {
+			t.Fatalf("WriteOrderBook: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err := ReadOrderBooks(dir, "uid", tradesDay, tradesDay.Add(investgo.DAY))
+	if err != nil {
+		t.Fatalf("ReadOrderBooks: %v", err)
+	}
+	checkBooks(t, got, books)
+
+	lines := gunzipLines(t, filepath.Join(dir, "uid", "20240304T100000Z.jsonl.gz"))
+	records := make([]orderBookRecord, 0, len(lines))
+	for _, l := range lines {
+		var rec orderBookRecord
+		if err := json.Unmarshal([]byte(l), &rec); err != nil {
+			t.Fatalf("unmarshal %q: %v", l, err)
+		}
+		records = append(records, rec)
+	}
+	deltas := make([]bool, 0, len(records))
+	for _, rec := range records {
+		deltas = append(deltas, rec.Delta)
+	}
+	if !reflect.DeepEqual(deltas, []bool{false, true, true, false, true, true}) {
+		t.Fatalf("deltas = %v", deltas)
+	}
+	// в дельте только изменившиеся уровни, удаленный уровень с количеством 0
+	if want := [][2]json.Number{{"100.1", "1"}}; !reflect.DeepEqual(records[2].Bids, want) {
+		t.Fatalf("delta bids = %v, want %v", records[2].Bids, want)
+	}
+	if want := [][2]json.Number{{"100.25", "0"}}; !reflect.DeepEqual(records[2].Asks, want) {
+		t.Fatalf("delta asks = %v, want %v", records[2].Asks, want)
+	}
+	if len(records[5].Bids) != 0 || len(records[5].Asks) != 0 || records[5].LimitUp != "120.25" {
+		t.Fatalf("unchanged delta = %+v", records[5])
+	}
+}
+
+func TestOrderBookFilesReopen(t *testing.T) {
+	dir := t.TempDir()
+	books := deltaBooks()
+	for _, part := range [][]OrderBookSnapshot{books[:3], books[3:]} {
+		f, err := NewOrderBookFiles(OrderBookFilesConfig{Dir: dir, Delta: true})
+		if err != nil {
+			t.Fatalf("NewOrderBookFiles: %v", err)
+		}
+		for _, b := range part {
+			if err := f.WriteOrderBook(b); err != nil {
+				t.Fatalf("WriteOrderBook: %v", err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	// дописанный gzip поток начинается с полного снимка
+	lines := gunzipLines(t, filepath.Join(dir, "uid", "20240304T100000Z.jsonl.gz"))
+	var rec orderBookRecord
+	if err := json.Unmarshal([]byte(lines[3]), &rec); err != nil || rec.Delta {
+		t.Fatalf("first record of appended stream = %q, %v", lines[3], err)
+	}
+	got, err := ReadOrderBooks(dir, "uid", tradesDay, tradesDay.Add(investgo.DAY))
+	if err != nil {
+		t.Fatalf("ReadOrderBooks: %v", err)
+	}
+	checkBooks(t, got, books)
+}
+
+func TestIterateOrderBooks(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewOrderBookFiles(OrderBookFilesConfig{Dir: dir, Delta: true})
+	if err != nil {
+		t.Fatalf("NewOrderBookFiles: %v", err)
+	}
+	books := deltaBooks()
+	// снимок следующего часа пишется в новый файл полным снимком
+	next := testBook(time.Hour, books[5].OrderBook.GetBids(), nil)
+	for _, b := range append(books, next) {
+		if err := f.WriteOrderBook(b); err != nil {
+			t.Fatalf("WriteOrderBook: %v", err)
+		}
+	}
+	// после Flush снимки читаются без закрытия файлов
+	if err := f.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, err := ReadOrderBooks(dir, "uid", at(tradesDay, 10, 0).Add(2*time.Second), at(tradesDay, 11, 0).Add(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("ReadOrderBooks: %v", err)
+	}
+	checkBooks(t, got, append(books[2:], next))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	visited := 0
+	err = IterateOrderBooks(dir, "uid", tradesDay, tradesDay.Add(investgo.DAY), func(OrderBookSnapshot) error {
+		visited++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || visited != 1 {
+		t.Fatalf("err = %v, visited = %v", err, visited)
+	}
+}
+
+func TestOrderBookRecorderDefaults(t *testing.T) {
+	client := newTestClient(t, &fakeApi{}, investgo.NewSimulatedClock(tradesDay))
+	r := NewOrderBookRecorder(OrderBookRecorderConfig{MarketDataStream: client.NewMarketDataStreamClient()})
+	if r.conf.Logger != client.Logger || r.conf.Depth != DEFAULT_ORDER_BOOK_DEPTH ||
+		r.conf.InstrumentsPerStream != DEFAULT_INSTRUMENTS_PER_STREAM || r.conf.FlushInterval != DEFAULT_FLUSH_INTERVAL {
+		t.Fatalf("conf = %+v", r.conf)
+	}
+}
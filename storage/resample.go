@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// ResampleConfig - Параметры агрегации свечей
+type ResampleConfig struct {
+	// Interval - Целевой интервал
+	Interval pb.CandleInterval
+	// Period - Нестандартный внутридневной период, например 7 минут или 3 часа, используется,
+	// если Interval не задан. Должен быть кратен интервалу исходных свечей и не больше суток
+	Period time.Duration
+	// Location - Часовой пояс биржи для границ дней, недель и месяцев, по умолчанию MoscowLocation
+	Location *time.Location
+	// Sessions - Торговые сессии, например из TradingSessions. Если заданы, то свечи, не пересекающиеся
+	// с сессиями, отбрасываются
+	Sessions []Session
+	// SkipPremarket, SkipEvening - Отбросить свечи утренней и вечерней сессий, требуется Sessions
+	SkipPremarket bool
+	SkipEvening   bool
+	// SplitSessions - Внутридневные свечи не пересекают границы сессий и отсчитываются от начала сессии,
+	// а дневные свечи строятся отдельно по каждому типу сессии. Требуется Sessions
+	SplitSessions bool
+	// Clock - Часы для определения сформированных свечей, по умолчанию системное время
+	Clock investgo.Clock
+}
+
+// ErrInvalidResample - Целевой интервал не крупнее исходного или не кратен ему
+var ErrInvalidResample = errors.New("invalid resample interval")
+
+type bucket struct {
+	start, end time.Time
+	kind       SessionKind
+}
+
+// Resample - Агрегация свечей интервала source в более крупные. Open - первая цена, Close - последняя,
+// High и Low - экстремумы, Volume - сумма объемов, Time - начало новой свечи. Свеча сформирована, если
+// сформированы все исходные свечи и ее период закончился
+func Resample(candles []*pb.HistoricCandle, source pb.CandleInterval, conf ResampleConfig) ([]*pb.HistoricCandle, error) {
+	if conf.Location == nil {
+		conf.Location = MoscowLocation
+	}
+	if len(conf.Sessions) == 0 && (conf.SkipPremarket || conf.SkipEvening || conf.SplitSessions) {
+		return nil, errors.New("sessions are required to skip or split sessions")
+	}
+	if err := checkResample(source, conf); err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, len(conf.Sessions))
+	copy(sessions, conf.Sessions)
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	sorted := make([]*pb.HistoricCandle, len(candles))
+	copy(sorted, candles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetTime().AsTime().Before(sorted[j].GetTime().AsTime())
+	})
+
+	sourceDuration := investgo.CandleIntervalDuration(source)
+	now := clockOrReal(conf.Clock).Now()
+	res := make([]*pb.HistoricCandle, 0)
+	var (
+		current *pb.HistoricCandle
+		cb      bucket
+	)
+	for _, c := range sorted {
+		t := c.GetTime().AsTime()
+		session, ok := Session{}, false
+		if len(sessions) > 0 {
+			session, ok = findSession(sessions, t)
+			if !ok {
+				// крупная свеча может начинаться раньше сессии, но пересекаться с ней
+				session, ok = findSession(sessions, t.Add(sourceDuration-1))
+			}
+			if !ok ||
+				conf.SkipPremarket && session.Kind == SESSION_PREMARKET ||
+				conf.SkipEvening && session.Kind == SESSION_EVENING {
+				continue
+			}
+		}
+		b := conf.bucket(t, session, ok)
+		if current != nil && b.start.Equal(cb.start) && b.kind == cb.kind {
+			mergeCandle(current, c)
+			continue
+		}
+		if current != nil {
+			current.IsComplete = current.GetIsComplete() && !cb.end.After(now)
+			res = append(res, current)
+		}
+		cb = b
+		current = &pb.HistoricCandle{
+			Open:       c.GetOpen(),
+			High:       c.GetHigh(),
+			Low:        c.GetLow(),
+			Close:      c.GetClose(),
+			Volume:     c.GetVolume(),
+			Time:       investgo.TimeToTimestamp(b.start),
+			IsComplete: c.GetIsComplete(),
+		}
+	}
+	if current != nil {
+		current.IsComplete = current.GetIsComplete() && !cb.end.After(now)
+		res = append(res, current)
+	}
+	if conf.SplitSessions {
+		// дневные свечи разных сессий имеют одно время начала, сохраняем порядок сессий внутри дня
+		sort.SliceStable(res, func(i, j int) bool {
+			return res[i].GetTime().AsTime().Before(res[j].GetTime().AsTime())
+		})
+	}
+	return res, nil
+}
+
+// ResampleInterval - Агрегация свечей в стандартный интервал без учета сессий, границы дней по MoscowLocation
+func ResampleInterval(candles []*pb.HistoricCandle, source, target pb.CandleInterval) ([]*pb.HistoricCandle, error) {
+	return Resample(candles, source, ResampleConfig{Interval: target})
+}
+
+// bucket - Период новой свечи, в которую попадает время t
+func (conf ResampleConfig) bucket(t time.Time, session Session, inSession bool) bucket {
+	local := t.In(conf.Location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, conf.Location)
+	b := bucket{}
+	if conf.SplitSessions && inSession {
+		b.kind = session.Kind
+	}
+	switch conf.Interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		b.start, b.end = day, day.AddDate(0, 0, 1)
+	case pb.CandleInterval_CANDLE_INTERVAL_WEEK:
+		// неделя начинается с понедельника
+		offset := (int(day.Weekday()) + 6) % 7
+		b.start = day.AddDate(0, 0, -offset)
+		b.end = b.start.AddDate(0, 0, 7)
+	case pb.CandleInterval_CANDLE_INTERVAL_MONTH:
+		b.start = time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, conf.Location)
+		b.end = b.start.AddDate(0, 1, 0)
+	default:
+		period := conf.period()
+		anchor := day
+		if conf.SplitSessions && inSession {
+			anchor = session.Start
+		}
+		b.start = anchor.Add(t.Sub(anchor) / period * period)
+		b.end = b.start.Add(period)
+		if conf.SplitSessions && inSession && b.end.After(session.End) {
+			b.end = session.End
+		}
+	}
+	return b
+}
+
+// period - Длительность внутридневной целевой свечи
+func (conf ResampleConfig) period() time.Duration {
+	if conf.Interval != pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED {
+		return investgo.CandleIntervalDuration(conf.Interval)
+	}
+	return conf.Period
+}
+
+func checkResample(source pb.CandleInterval, conf ResampleConfig) error {
+	sourceDuration := investgo.CandleIntervalDuration(source)
+	if source == pb.CandleInterval_CANDLE_INTERVAL_MONTH {
+		return fmt.Errorf("%w: month candles can't be resampled", ErrInvalidResample)
+	}
+	if sourceDuration == 0 {
+		return fmt.Errorf("%w: unknown source interval %v", ErrInvalidResample, source)
+	}
+	switch conf.Interval {
+	case pb.CandleInterval_CANDLE_INTERVAL_MONTH:
+		return nil
+	case pb.CandleInterval_CANDLE_INTERVAL_WEEK, pb.CandleInterval_CANDLE_INTERVAL_DAY:
+		if sourceDuration > investgo.CandleIntervalDuration(conf.Interval) {
+			return fmt.Errorf("%w: %v to %v", ErrInvalidResample, source, conf.Interval)
+		}
+		return nil
+	}
+	period := conf.period()
+	switch {
+	case period <= 0:
+		return fmt.Errorf("%w: target interval or period is required", ErrInvalidResample)
+	case period > investgo.DAY:
+		return fmt.Errorf("%w: period %v is longer than a day", ErrInvalidResample, period)
+	case period < sourceDuration || period%sourceDuration != 0:
+		return fmt.Errorf("%w: %v is not a multiple of %v", ErrInvalidResample, period, source)
+	}
+	return nil
+}
+
+// mergeCandle - Добавление следующей по времени свечи c к агрегированной свече dst
+func mergeCandle(dst, c *pb.HistoricCandle) {
+	if investgo.QuotationToDecimal(c.GetHigh()).GreaterThan(investgo.QuotationToDecimal(dst.GetHigh())) {
+		dst.High = c.GetHigh()
+	}
+	if investgo.QuotationToDecimal(c.GetLow()).LessThan(investgo.QuotationToDecimal(dst.GetLow())) {
+		dst.Low = c.GetLow()
+	}
+	dst.Close = c.GetClose()
+	dst.Volume += c.GetVolume()
+	dst.IsComplete = dst.GetIsComplete() && c.GetIsComplete()
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// msk - Время по Москве, 4 марта 2024 - понедельник
+func msk(month time.Month, day, h, m int) time.Time {
+	return time.Date(2024, month, day, h, m, 0, 0, MoscowLocation)
+}
+
+// resampled - Ожидаемая свеча: цены open, high, low, close в рублях
+type resampled struct {
+	time                   time.Time
+	open, high, low, close int64
+	volume                 int64
+	complete               bool
+}
+
+// priced - Свечи validCandle с ценами 100, 101, ... в моменты times
+func priced(times ...time.Time) []*pb.HistoricCandle {
+	res := make([]*pb.HistoricCandle, 0, len(times))
+	for i, t := range times {
+		res = append(res, validCandle(t, int64(100+i)))
+	}
+	return res
+}
+
+// every - n моментов с шагом step, начиная с from
+func every(from time.Time, step time.Duration, n int) []time.Time {
+	res := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, from.Add(time.Duration(i)*step))
+	}
+	return res
+}
+
+func checkResampled(t *testing.T, got []*pb.HistoricCandle, want []resampled) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("candles = %v, want %v", got, len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if !g.GetTime().AsTime().Equal(w.time) || g.GetOpen().GetUnits() != w.open || g.GetHigh().GetUnits() != w.high ||
+			g.GetLow().GetUnits() != w.low || g.GetClose().GetUnits() != w.close || g.GetVolume() != w.volume ||
+			g.GetIsComplete() != w.complete {
+			t.Errorf("candle %v = %v %v, want %+v", i, g.GetTime().AsTime().In(MoscowLocation), g, w)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	future := investgo.NewSimulatedClock(msk(6, 1, 0, 0))
+	utcDay := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		candles []*pb.HistoricCandle
+		source  pb.CandleInterval
+		conf    ResampleConfig
+		want    []resampled
+	}{
+		{
+			name:    "5 min to hour",
+			candles: priced(append(every(msk(3, 4, 10, 0), 5*time.Minute, 12), msk(3, 4, 11, 0), msk(3, 4, 11, 30))...),
+			source:  fiveMinutes,
+			conf:    ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR},
+			want: []resampled{
+				{msk(3, 4, 10, 0), 100, 113, 98, 112, 1200, true},
+				{msk(3, 4, 11, 0), 112, 115, 110, 114, 200, true},
+			},
+		},
+		{
+			// 23:00 и 00:00 по Москве - разные дни, хотя по UTC это 20:00 и 21:00 одного дня
+			name:    "hour to day by Moscow time",
+			candles: priced(msk(3, 4, 22, 0), msk(3, 4, 23, 0), msk(3, 5, 0, 0)),
+			source:  pb.CandleInterval_CANDLE_INTERVAL_HOUR,
+			conf:    ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_DAY},
+			want: []resampled{
+				{msk(3, 4, 0, 0), 100, 103, 98, 102, 200, true},
+				{msk(3, 5, 0, 0), 102, 104, 100, 103, 100, true},
+			},
+		},
+		{
+			// неделя начинается с понедельника, воскресенье 3 марта относится к неделе с 26 февраля
+			name:    "day to week",
+			candles: priced(utcDay(3, 3), utcDay(3, 4), utcDay(3, 8), utcDay(3, 10), utcDay(3, 11)),
+			source:  pb.CandleInterval_CANDLE_INTERVAL_DAY,
+			conf:    ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_WEEK},
+			want: []resampled{
+				{msk(2, 26, 0, 0), 100, 102, 98, 101, 100, true},
+				{msk(3, 4, 0, 0), 101, 105, 99, 104, 300, true},
+				{msk(3, 11, 0, 0), 104, 106, 102, 105, 100, true},
+			},
+		},
+		{
+			name:    "day to month",
+			candles: priced(utcDay(2, 28), utcDay(2, 29), utcDay(3, 1), utcDay(3, 31)),
+			source:  pb.CandleInterval_CANDLE_INTERVAL_DAY,
+			conf:    ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_MONTH},
+			want: []resampled{
+				{msk(2, 1, 0, 0), 100, 103, 98, 102, 200, true},
+				{msk(3, 1, 0, 0), 102, 105, 100, 104, 200, true},
+			},
+		},
+		{
+			// 7 минут отсчитываются от полуночи по Москве: 10:00 - 600 минута, свечи начинаются в 09:55 и 10:02
+			name:    "custom period",
+			candles: priced(every(msk(3, 4, 10, 0), time.Minute, 4)...),
+			source:  pb.CandleInterval_CANDLE_INTERVAL_1_MIN,
+			conf:    ResampleConfig{Period: 7 * time.Minute},
+			want: []resampled{
+				{msk(3, 4, 9, 55), 100, 103, 98, 102, 200, true},
+				{msk(3, 4, 10, 2), 102, 105, 100, 104, 200, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Clock = future
+			got, err := Resample(tt.candles, tt.source, tt.conf)
+			if err != nil {
+				t.Fatalf("Resample: %v", err)
+			}
+			checkResampled(t, got, tt.want)
+		})
+	}
+}
+
+// resampleSessions - Премаркет 09:45-10:00, основная сессия 10:00-18:45, вечерняя сессия 18:50-23:50 по Москве
+func resampleSessions() []Session {
+	return []Session{
+		{Kind: SESSION_EVENING, Start: msk(3, 4, 18, 50), End: msk(3, 4, 23, 50)},
+		{Kind: SESSION_PREMARKET, Start: msk(3, 4, 9, 45), End: msk(3, 4, 10, 0)},
+		{Kind: SESSION_MAIN, Start: msk(3, 4, 10, 0), End: msk(3, 4, 18, 45)},
+	}
+}
+
+func TestResampleSessions(t *testing.T) {
+	future := investgo.NewSimulatedClock(msk(6, 1, 0, 0))
+	hour := pb.CandleInterval_CANDLE_INTERVAL_HOUR
+	// премаркет 09:45, 09:55, основная сессия 10:00, 18:35, вечерняя сессия 18:50, 19:00,
+	// свеча 23:55 вне сессий
+	candles := priced(msk(3, 4, 9, 45), msk(3, 4, 9, 55), msk(3, 4, 10, 0), msk(3, 4, 18, 35),
+		msk(3, 4, 18, 50), msk(3, 4, 19, 0), msk(3, 4, 23, 55))
+	tests := []struct {
+		name string
+		conf ResampleConfig
+		want []resampled
+	}{
+		{
+			name: "no sessions",
+			conf: ResampleConfig{Interval: hour},
+			want: []resampled{
+				{msk(3, 4, 9, 0), 100, 103, 98, 102, 200, true},
+				{msk(3, 4, 10, 0), 102, 104, 100, 103, 100, true},
+				{msk(3, 4, 18, 0), 103, 106, 101, 105, 200, true},
+				{msk(3, 4, 19, 0), 105, 107, 103, 106, 100, true},
+				{msk(3, 4, 23, 0), 106, 108, 104, 107, 100, true},
+			},
+		},
+		{
+			name: "sessions drop candles outside",
+			conf: ResampleConfig{Interval: hour, Sessions: resampleSessions()},
+			want: []resampled{
+				{msk(3, 4, 9, 0), 100, 103, 98, 102, 200, true},
+				{msk(3, 4, 10, 0), 102, 104, 100, 103, 100, true},
+				{msk(3, 4, 18, 0), 103, 106, 101, 105, 200, true},
+				{msk(3, 4, 19, 0), 105, 107, 103, 106, 100, true},
+			},
+		},
+		{
+			// свечи отсчитываются от начала сессии и не объединяют основную и вечернюю сессии
+			name: "split sessions",
+			conf: ResampleConfig{Interval: hour, Sessions: resampleSessions(), SplitSessions: true},
+			want: []resampled{
+				{msk(3, 4, 9, 45), 100, 103, 98, 102, 200, true},
+				{msk(3, 4, 10, 0), 102, 104, 100, 103, 100, true},
+				{msk(3, 4, 18, 0), 103, 105, 101, 104, 100, true},
+				{msk(3, 4, 18, 50), 104, 107, 102, 106, 200, true},
+			},
+		},
+		{
+			// дневные свечи по каждой сессии имеют одно время, порядок - по началу сессии
+			name: "split sessions by day",
+			conf: ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_DAY, Sessions: resampleSessions(), SplitSessions: true},
+			want: []resampled{
+				{msk(3, 4, 0, 0), 100, 103, 98, 102, 200, true},
+				{msk(3, 4, 0, 0), 102, 105, 100, 104, 200, true},
+				{msk(3, 4, 0, 0), 104, 107, 102, 106, 200, true},
+			},
+		},
+		{
+			name: "skip premarket and evening",
+			conf: ResampleConfig{Interval: hour, Sessions: resampleSessions(), SkipPremarket: true, SkipEvening: true},
+			want: []resampled{
+				{msk(3, 4, 10, 0), 102, 104, 100, 103, 100, true},
+				{msk(3, 4, 18, 0), 103, 105, 101, 104, 100, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Clock = future
+			got, err := Resample(candles, fiveMinutes, tt.conf)
+			if err != nil {
+				t.Fatalf("Resample: %v", err)
+			}
+			checkResampled(t, got, tt.want)
+		})
+	}
+}
+
+func TestResampleIsComplete(t *testing.T) {
+	candles := priced(every(msk(3, 4, 10, 0), 30*time.Minute, 4)...)
+	// последняя исходная свеча еще формируется
+	candles[3].IsComplete = false
+	clock := investgo.NewSimulatedClock(msk(3, 4, 12, 0))
+	got, err := Resample(candles, pb.CandleInterval_CANDLE_INTERVAL_30_MIN, ResampleConfig{
+		Interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR,
+		Clock:    clock,
+	})
+	if err != nil {
+		t.Fatalf("Resample: %v", err)
+	}
+	checkResampled(t, got, []resampled{
+		{msk(3, 4, 10, 0), 100, 103, 98, 102, 200, true},
+		{msk(3, 4, 11, 0), 102, 105, 100, 104, 200, false},
+	})
+
+	// период свечи еще не закончился, хотя все исходные свечи сформированы
+	candles[3].IsComplete = true
+	clock.Set(msk(3, 4, 11, 59))
+	got, err = Resample(candles, pb.CandleInterval_CANDLE_INTERVAL_30_MIN, ResampleConfig{
+		Interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR,
+		Clock:    clock,
+	})
+	if err != nil {
+		t.Fatalf("Resample: %v", err)
+	}
+	if !got[0].GetIsComplete() || got[1].GetIsComplete() {
+		t.Fatalf("complete = %v, %v", got[0].GetIsComplete(), got[1].GetIsComplete())
+	}
+}
+
+func TestResampleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source pb.CandleInterval
+		conf   ResampleConfig
+	}{
+		{"month source", pb.CandleInterval_CANDLE_INTERVAL_MONTH, ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_MONTH}},
+		{"unknown source", pb.CandleInterval_CANDLE_INTERVAL_UNSPECIFIED, ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_DAY}},
+		{"smaller target", pb.CandleInterval_CANDLE_INTERVAL_HOUR, ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_30_MIN}},
+		{"week to day", pb.CandleInterval_CANDLE_INTERVAL_WEEK, ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_DAY}},
+		{"not multiple", fiveMinutes, ResampleConfig{Period: 7 * time.Minute}},
+		{"longer than day", pb.CandleInterval_CANDLE_INTERVAL_HOUR, ResampleConfig{Period: 25 * time.Hour}},
+		{"no target", fiveMinutes, ResampleConfig{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Resample(nil, tt.source, tt.conf); !errors.Is(err, ErrInvalidResample) {
+				t.Fatalf("err = %v, want ErrInvalidResample", err)
+			}
+		})
+	}
+	_, err := Resample(nil, fiveMinutes, ResampleConfig{Interval: pb.CandleInterval_CANDLE_INTERVAL_HOUR, SplitSessions: true})
+	if err == nil {
+		t.Fatal("split without sessions must fail")
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// SessionKind - Тип торговой сессии
+type SessionKind int
+
+const (
+	// SESSION_MAIN - Основная сессия
+	SESSION_MAIN SessionKind = iota
+	// SESSION_PREMARKET - Утренняя сессия (премаркет)
+	SESSION_PREMARKET
+	// SESSION_EVENING - Вечерняя сессия
+	SESSION_EVENING
+)
+
+func (k SessionKind) String() string {
+	switch k {
+	case SESSION_MAIN:
+		return "main"
+	case SESSION_PREMARKET:
+		return "premarket"
+	case SESSION_EVENING:
+		return "evening"
+	}
+	return fmt.Sprintf("SessionKind(%d)", int(k))
+}
+
+// MoscowLocation - Часовой пояс Московской биржи
+var MoscowLocation = investgo.MoscowLocation
+
+// Session - Торговая сессия [Start, End)
+type Session struct {
+	Kind  SessionKind
+	Start time.Time
+	End   time.Time
+}
+
+// TradingSessions - Торговые сессии биржи за период по расписанию из InstrumentsService.TradingSchedules
+func TradingSessions(is *investgo.InstrumentsServiceClient, exchange string, from, to time.Time) ([]Session, error) {
+	days, err := tradingDays(is, exchange, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return SessionsFromSchedule(days), nil
+}
+
+// SessionsFromSchedule - Торговые сессии из расписания: премаркет, основная сессия без клиринга и вечерняя сессия.
+// Пересекающиеся сессии одного типа объединяются, результат отсортирован по началу сессии
+func SessionsFromSchedule(days []*pb.TradingDay) []Session {
+	sessions := make([]Session, 0, len(days))
+	add := func(kind SessionKind, start, end time.Time) {
+		if !start.IsZero() && end.After(start) {
+			sessions = append(sessions, Session{Kind: kind, Start: start, End: end})
+		}
+	}
+	for _, day := range days {
+		if !day.GetIsTradingDay() {
+			continue
+		}
+		if day.GetPremarketStartTime() != nil && day.GetPremarketEndTime() != nil {
+			add(SESSION_PREMARKET, day.GetPremarketStartTime().AsTime(), day.GetPremarketEndTime().AsTime())
+		}
+		if day.GetStartTime() != nil && day.GetEndTime() != nil {
+			start, end := day.GetStartTime().AsTime(), day.GetEndTime().AsTime()
+			if day.GetClearingStartTime() != nil && day.GetClearingEndTime() != nil {
+				clearingStart, clearingEnd := day.GetClearingStartTime().AsTime(), day.GetClearingEndTime().AsTime()
+				if clearingStart.After(start) && clearingEnd.Before(end) {
+					add(SESSION_MAIN, start, clearingStart)
+					start = clearingEnd
+				}
+			}
+			add(SESSION_MAIN, start, end)
+		}
+		if day.GetEveningStartTime() != nil && day.GetEveningEndTime() != nil {
+			add(SESSION_EVENING, day.GetEveningStartTime().AsTime(), day.GetEveningEndTime().AsTime())
+		}
+	}
+	return mergeSessions(sessions)
+}
+
+// findSession - Сессия из отсортированного слайса, в которую попадает t
+func findSession(sessions []Session, t time.Time) (Session, bool) {
+	i := sort.Search(len(sessions), func(i int) bool {
+		return sessions[i].Start.After(t)
+	})
+	// сессии разных типов могут пересекаться, поэтому проверяем все сессии, начавшиеся за сутки до t
+	for j := i - 1; j >= 0 && t.Sub(sessions[j].Start) <= investgo.DAY; j-- {
+		if t.Before(sessions[j].End) {
+			return sessions[j], true
+		}
+	}
+	return Session{}, false
+}
+
+// tradingDays - Расписание торгов биржи за период, запрашивается по неделям
+func tradingDays(is *investgo.InstrumentsServiceClient, exchange string, from, to time.Time) ([]*pb.TradingDay, error) {
+	if exchange == "" {
+		return nil, fmt.Errorf("exchange is required for trading schedule")
+	}
+	days := make([]*pb.TradingDay, 0)
+	for start := from; start.Before(to); start = start.Add(investgo.DAY * 7) {
+		end := start.Add(investgo.DAY * 7)
+		if end.After(to) {
+			end = to
+		}
+		resp, err := is.TradingSchedules(exchange, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, schedule := range resp.GetExchanges() {
+			if strings.EqualFold(schedule.GetExchange(), exchange) {
+				days = append(days, schedule.GetDays()...)
+			}
+		}
+	}
+	return days, nil
+}
+
+func mergeSessions(sessions []Session) []Session {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	res := make([]Session, 0, len(sessions))
+	last := make(map[SessionKind]int)
+	for _, s := range sessions {
+		if i, ok := last[s.Kind]; ok && !s.Start.After(res[i].End) {
+			if s.End.After(res[i].End) {
+				res[i].End = s.End
+			}
+			continue
+		}
+		last[s.Kind] = len(res)
+		res = append(res, s)
+	}
+	return res
+}
+
+// clipSessions - Сессии, обрезанные по периоду [from, to)
+func clipSessions(sessions []Session, from, to time.Time) []Session {
+	res := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.Start.Before(from) {
+			s.Start = from
+		}
+		if s.End.After(to) {
+			s.End = to
+		}
+		if s.End.After(s.Start) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// SQLITE_STORE_VERSION - Текущая версия схемы SQLiteStore, хранится в PRAGMA user_version
+	SQLITE_STORE_VERSION = 2
+	// LEGACY_CANDLE_INTERVAL - Интервал свечей, с которым переносятся данные из схемы версии 1,
+	// в которой интервал не сохранялся
+	LEGACY_CANDLE_INTERVAL = pb.CandleInterval_CANDLE_INTERVAL_1_MIN
+)
+
+// sqliteMigrations - Миграции схемы, sqliteMigrations[i] переводит базу с версии i на i+1
+var sqliteMigrations = []func(tx *sqlx.Tx) error{
+	migrateSQLiteV1,
+	migrateSQLiteV2,
+}
+
+// SQLiteStore - Хранилище свечей в базе sqlite. Драйвер go-sqlite3 использует cgo
+type SQLiteStore struct {
+	db     *sqlx.DB
+	logger investgo.Logger
+}
+
+type sqliteCandle struct {
+	Time       int64  `db:"time"`
+	Open       string `db:"open"`
+	High       string `db:"high"`
+	Low        string `db:"low"`
+	Close      string `db:"close"`
+	Volume     int64  `db:"volume"`
+	IsComplete bool   `db:"is_complete"`
+}
+
+type sqliteSeries struct {
+	InstrumentUid string        `db:"instrument_uid"`
+	Interval      int32         `db:"interval"`
+	LastUpdate    int64         `db:"last_update"`
+	First         sql.NullInt64 `db:"first"`
+	Last          sql.NullInt64 `db:"last"`
+	Count         int           `db:"count"`
+}
+
+// NewSQLiteStore - Открытие или создание базы по пути path. Если база создана старой версией sdk или
+// хранилищем свечей из examples/interval_bot, то схема обновляется до SQLITE_STORE_VERSION
+func NewSQLiteStore(path string, logger investgo.Logger) (*SQLiteStore, error) {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &SQLiteStore{
+		db:     db,
+		logger: logger,
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) Candles(instrumentId string, interval pb.CandleInterval, from, to time.Time) ([]*pb.HistoricCandle, error) {
+	rows := make([]sqliteCandle, 0)
+	err := s.db.Select(&rows, `select time, open, high, low, close, volume, is_complete from candles
+		where instrument_uid = ? and interval = ? and time >= ? and time < ? order by time`,
+		instrumentId, int32(interval), from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	candles := make([]*pb.HistoricCandle, 0, len(rows))
+	for _, r := range rows {
+		c, err := r.candle()
+		if err != nil {
+			return nil, err
+		}
+		candles = append(candles, c)
+	}
+	return candles, nil
+}
+
+func (s *SQLiteStore) Store(instrumentId string, interval pb.CandleInterval, candles []*pb.HistoricCandle, updatedTo time.Time) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// после Commit возвращает sql.ErrTxDone
+		_ = tx.Rollback()
+	}()
+	insertCandle, err := tx.Prepare(`insert or replace into candles
+		(instrument_uid, interval, time, open, high, low, close, volume, is_complete) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := insertCandle.Close(); err != nil {
+			s.logger.Errorf("candles statement closing error %v", err.Error())
+		}
+	}()
+	for _, c := range candles {
+		_, err := insertCandle.Exec(instrumentId, int32(interval),
+			c.GetTime().AsTime().Unix(),
+			investgo.QuotationToDecimal(c.GetOpen()).String(),
+			investgo.QuotationToDecimal(c.GetHigh()).String(),
+			investgo.QuotationToDecimal(c.GetLow()).String(),
+			investgo.QuotationToDecimal(c.GetClose()).String(),
+			c.GetVolume(),
+			c.GetIsComplete())
+		if err != nil {
+			return err
+		}
+	}
+	var lastUpdate int64
+	if !updatedTo.IsZero() {
+		lastUpdate = updatedTo.Unix()
+	}
+	_, err = tx.Exec(`insert into series (instrument_uid, interval, last_update) values (?, ?, ?)
+		on conflict (instrument_uid, interval) do update set last_update = max(last_update, excluded.last_update)`,
+		instrumentId, int32(interval), lastUpdate)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Series() ([]Series, error) {
+	rows := make([]sqliteSeries, 0)
+	err := s.db.Select(&rows, `select s.instrument_uid, s.interval, s.last_update,
+		min(c.time) as first, max(c.time) as last, count(c.time) as count
+		from series s left join candles c on c.instrument_uid = s.instrument_uid and c.interval = s.interval
+		group by s.instrument_uid, s.interval`)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Series, 0, len(rows))
+	for _, r := range rows {
+		sr := Series{
+			InstrumentId: r.InstrumentUid,
+			Interval:     pb.CandleInterval(r.Interval),
+			Count:        r.Count,
+		}
+		if r.LastUpdate != 0 {
+			sr.LastUpdate = time.Unix(r.LastUpdate, 0)
+		}
+		if r.First.Valid {
+			sr.First = time.Unix(r.First.Int64, 0)
+			sr.Last = time.Unix(r.Last.Int64, 0)
+		}
+		res = append(res, sr)
+	}
+	sortSeries(res)
+	return res, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate - Обновление схемы базы до SQLITE_STORE_VERSION
+func (s *SQLiteStore) migrate() error {
+	var version int
+	if err := s.db.Get(&version, `pragma user_version`); err != nil {
+		return err
+	}
+	if version > SQLITE_STORE_VERSION {
+		return &ErrUnsupportedVersion{Version: version, Supported: SQLITE_STORE_VERSION}
+	}
+	for v := version; v < SQLITE_STORE_VERSION; v++ {
+		err := func() error {
+			tx, err := s.db.Beginx()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = tx.Rollback()
+			}()
+			if err := sqliteMigrations[v](tx); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`pragma user_version = %d`, v+1)); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return fmt.Errorf("migration to version %v: %w", v+1, err)
+		}
+		s.logger.Infof("candles storage migrated to version %v", v+1)
+	}
+	return nil
+}
+
+// migrateSQLiteV1 - Схема версии 1, цены в real и свечи без интервала. Таблицы создаются, только если их нет,
+// чтобы новая база и база из examples/interval_bot дальше мигрировали одинаково
+func migrateSQLiteV1(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+create table if not exists candles (
+    id integer primary key autoincrement,
+    instrument_uid text,
+	open real,
+	close real,
+	high real,
+	low real,
+	volume integer,
+	time integer,
+	is_complete integer,
+    unique (instrument_uid, time)
+);
+
+create table if not exists updates (
+    instrument_id text unique ,
+	first_time integer,
+	last_time integer
+);
+`)
+	return err
+}
+
+// migrateSQLiteV2 - Схема версии 2, цены хранятся в десятичной записи без потери точности, в ключ свечи
+// добавлен интервал. Свечи версии 1 переносятся с интервалом LEGACY_CANDLE_INTERVAL
+func migrateSQLiteV2(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+create table candles_v2 (
+    instrument_uid text not null,
+    interval integer not null,
+    time integer not null,
+    open text not null,
+    high text not null,
+    low text not null,
+    close text not null,
+    volume integer not null,
+    is_complete integer not null,
+    primary key (instrument_uid, interval, time)
+);
+
+create table series (
+    instrument_uid text not null,
+    interval integer not null,
+    last_update integer not null,
+    primary key (instrument_uid, interval)
+);
+`)
+	if err != nil {
+		return err
+	}
+
+	type legacyCandle struct {
+		InstrumentUid string  `db:"instrument_uid"`
+		Open          float64 `db:"open"`
+		Close         float64 `db:"close"`
+		High          float64 `db:"high"`
+		Low           float64 `db:"low"`
+		Volume        int64   `db:"volume"`
+		Time          int64   `db:"time"`
+		IsComplete    bool    `db:"is_complete"`
+	}
+	rows, err := tx.Queryx(`select instrument_uid, open, close, high, low, volume, time, is_complete from candles`)
+	if err != nil {
+		return err
+	}
+	insertCandle, err := tx.Prepare(`insert or replace into candles_v2
+		(instrument_uid, interval, time, open, high, low, close, volume, is_complete) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	defer insertCandle.Close()
+	for rows.Next() {
+		c := legacyCandle{}
+		if err := rows.StructScan(&c); err != nil {
+			rows.Close()
+			return err
+		}
+		_, err := insertCandle.Exec(c.InstrumentUid, int32(LEGACY_CANDLE_INTERVAL), c.Time,
+			decimal.NewFromFloat(c.Open).String(),
+			decimal.NewFromFloat(c.High).String(),
+			decimal.NewFromFloat(c.Low).String(),
+			decimal.NewFromFloat(c.Close).String(),
+			c.Volume, c.IsComplete)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+insert into series (instrument_uid, interval, last_update)
+    select instrument_id, ?, last_time from updates;
+
+insert or ignore into series (instrument_uid, interval, last_update)
+    select distinct instrument_uid, ?, 0 from candles_v2;
+
+drop table candles;
+drop table updates;
+alter table candles_v2 rename to candles;
+`, int32(LEGACY_CANDLE_INTERVAL), int32(LEGACY_CANDLE_INTERVAL))
+	return err
+}
+
+func (c sqliteCandle) candle() (*pb.HistoricCandle, error) {
+	prices := [4]string{c.Open, c.High, c.Low, c.Close}
+	quotations := [4]*pb.Quotation{}
+	for i, p := range prices {
+		d, err := decimal.NewFromString(p)
+		if err != nil {
+			return nil, err
+		}
+		quotations[i] = investgo.DecimalToQuotation(d)
+	}
+	return &pb.HistoricCandle{
+		Time:       investgo.TimeToTimestamp(time.Unix(c.Time, 0)),
+		Open:       quotations[0],
+		High:       quotations[1],
+		Low:        quotations[2],
+		Close:      quotations[3],
+		Volume:     c.Volume,
+		IsComplete: c.IsComplete,
+	}, nil
+}
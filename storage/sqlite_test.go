@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// openSQLite - База с версией схемы version и таблицами, созданными запросом schema
+func openSQLite(t *testing.T, path string, version int, schema string, args ...any) {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schema, args...); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf(`pragma user_version = %d`, version)); err != nil {
+		t.Fatalf("user_version: %v", err)
+	}
+}
+
+const sqliteV1Schema = `
+create table candles (
+    id integer primary key autoincrement,
+    instrument_uid text,
+	open real,
+	close real,
+	high real,
+	low real,
+	volume integer,
+	time integer,
+	is_complete integer,
+    unique (instrument_uid, time)
+);
+
+create table updates (
+    instrument_id text unique ,
+	first_time integer,
+	last_time integer
+);
+
+insert into candles (instrument_uid, open, close, high, low, volume, time, is_complete) values
+    ('a', 100.1, 100.3, 100.5, 99.9, 10, ?, 1),
+    ('a', 100.3, 100.2, 100.4, 100.2, 20, ?, 0),
+    ('b', 0.0001, 0.0002, 0.0003, 0.0001, 30, ?, 1);
+
+insert into updates (instrument_id, first_time, last_time) values ('a', ?, ?);
+`
+
+func TestSQLiteMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+	}{
+		// база examples/interval_bot без версии схемы
+		{name: "interval bot database", version: 0},
+		{name: "version 1", version: 1},
+	}
+	update := storeStart.Add(time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "candles.db")
+			openSQLite(t, path, tt.version, sqliteV1Schema,
+				storeStart.Unix(), storeStart.Add(time.Minute).Unix(), storeStart.Unix(), storeStart.Unix(), update.Unix())
+			s, err := NewSQLiteStore(path, testLogger{t})
+			if err != nil {
+				t.Fatalf("NewSQLiteStore: %v", err)
+			}
+			defer s.Close()
+
+			var version int
+			if err := s.db.Get(&version, `pragma user_version`); err != nil || version != SQLITE_STORE_VERSION {
+				t.Fatalf("version = %v, %v, want %v", version, err, SQLITE_STORE_VERSION)
+			}
+			// цены переносятся в десятичной записи, интервал - LEGACY_CANDLE_INTERVAL
+			checkCandles(t, s, "a", LEGACY_CANDLE_INTERVAL, 0, 10, []*pb.HistoricCandle{
+				{
+					Time:       testCandle(0, 0).GetTime(),
+					Open:       &pb.Quotation{Units: 100, Nano: 100000000},
+					High:       &pb.Quotation{Units: 100, Nano: 500000000},
+					Low:        &pb.Quotation{Units: 99, Nano: 900000000},
+					Close:      &pb.Quotation{Units: 100, Nano: 300000000},
+					Volume:     10,
+					IsComplete: true,
+				},
+				{
+					Time:   testCandle(1, 0).GetTime(),
+					Open:   &pb.Quotation{Units: 100, Nano: 300000000},
+					High:   &pb.Quotation{Units: 100, Nano: 400000000},
+					Low:    &pb.Quotation{Units: 100, Nano: 200000000},
+					Close:  &pb.Quotation{Units: 100, Nano: 200000000},
+					Volume: 20,
+				},
+			})
+			checkCandles(t, s, "b", LEGACY_CANDLE_INTERVAL, 0, 10, []*pb.HistoricCandle{{
+				Time:       testCandle(0, 0).GetTime(),
+				Open:       &pb.Quotation{Nano: 100000},
+				High:       &pb.Quotation{Nano: 300000},
+				Low:        &pb.Quotation{Nano: 100000},
+				Close:      &pb.Quotation{Nano: 200000},
+				Volume:     30,
+				IsComplete: true,
+			}})
+
+			series, err := s.Series()
+			if err != nil || len(series) != 2 {
+				t.Fatalf("series = %+v, %v", series, err)
+			}
+			// время обновления переносится из updates, для рядов без записи оно неизвестно
+			if !series[0].LastUpdate.Equal(update) || series[0].Count != 2 || !series[1].LastUpdate.IsZero() || series[1].Count != 1 {
+				t.Fatalf("series = %+v", series)
+			}
+
+			// после миграции хранилище работает как новое
+			if err := s.Store("a", LEGACY_CANDLE_INTERVAL, []*pb.HistoricCandle{testCandle(1, 101)}, time.Time{}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			got, err := s.Candles("a", LEGACY_CANDLE_INTERVAL, storeStart, update)
+			if err != nil || len(got) != 2 || !sameCandle(got[1], testCandle(1, 101)) {
+				t.Fatalf("candles = %v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSQLiteUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "candles.db")
+	openSQLite(t, path, SQLITE_STORE_VERSION+1, `create table t (id integer)`)
+	_, err := NewSQLiteStore(path, testLogger{t})
+	var unsupported *ErrUnsupportedVersion
+	if !errors.As(err, &unsupported) || unsupported.Version != SQLITE_STORE_VERSION+1 {
+		t.Fatalf("err = %v, want ErrUnsupportedVersion", err)
+	}
+}
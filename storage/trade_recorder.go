@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_BACKFILL_DELAY - Задержка догрузки сделок после переподключения стрима по умолчанию
+	DEFAULT_BACKFILL_DELAY = 5 * time.Second
+	// DEFAULT_FLUSH_INTERVAL - Период сброса буферов получателя сделок по умолчанию
+	DEFAULT_FLUSH_INTERVAL = 5 * time.Second
+	// lastTradesDepth - Глубина истории GetLastTrades
+	lastTradesDepth = time.Hour
+)
+
+// TradeRecorderConfig - Параметры записи обезличенных сделок
+type TradeRecorderConfig struct {
+	// Instruments - uid инструментов, сделки из стрима и разрывы сопоставляются по instrument_uid
+	Instruments      []string
+	MarketData       *investgo.MarketDataServiceClient
+	MarketDataStream *investgo.MarketDataStreamClient
+	// Sink - Получатель сделок, например TradeFiles. Recorder не закрывает Sink
+	Sink TradeSink
+	// BackfillDelay - Задержка догрузки после переподключения, чтобы стрим успел переподписаться,
+	// по умолчанию DEFAULT_BACKFILL_DELAY
+	BackfillDelay time.Duration
+	// FlushInterval - Период сброса буферов Sink, по умолчанию DEFAULT_FLUSH_INTERVAL
+	FlushInterval time.Duration
+	// Logger - Логгер, по умолчанию логгер клиента MarketDataStream
+	Logger investgo.Logger
+	// Clock - Часы для задержек и границ догрузки, по умолчанию системное время
+	Clock investgo.Clock
+}
+
+// TradeRecorder - Непрерывная запись обезличенных сделок из стрима. После переподключения стрима пропущенные
+// сделки догружаются через GetLastTrades, уже записанные сделки не дублируются. GetLastTrades возвращает
+// только последний час, поэтому более длинный разрыв восстановить полностью нельзя
+type TradeRecorder struct {
+	conf TradeRecorderConfig
+
+	mu      sync.Mutex
+	started time.Time
+	// last - Время последней записанной сделки инструмента, boundary - сделки с этим временем
+	last     map[string]time.Time
+	boundary map[string]map[tradeKey]struct{}
+	// gapFrom - Начало разрыва для инструментов, по которым ожидается догрузка,
+	// sinceGap - сделки, записанные с начала разрыва: сделки boundary на момент разрыва и сделки из стрима после него
+	gapFrom  map[string]time.Time
+	sinceGap map[string]map[tradeKey]struct{}
+	restarts chan struct{}
+}
+
+type tradeKey struct {
+	time      int64
+	units     int64
+	nano      int32
+	quantity  int64
+	direction pb.TradeDirection
+}
+
+func newTradeKey(t *pb.Trade) tradeKey {
+	return tradeKey{
+		time:      t.GetTime().AsTime().UnixNano(),
+		units:     t.GetPrice().GetUnits(),
+		nano:      t.GetPrice().GetNano(),
+		quantity:  t.GetQuantity(),
+		direction: t.GetDirection(),
+	}
+}
+
+// NewTradeRecorder - Создание записи обезличенных сделок
+func NewTradeRecorder(conf TradeRecorderConfig) *TradeRecorder {
+	if conf.BackfillDelay <= 0 {
+		conf.BackfillDelay = DEFAULT_BACKFILL_DELAY
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if conf.Logger == nil && conf.MarketDataStream != nil {
+		conf.Logger = conf.MarketDataStream.Logger()
+	}
+	conf.Clock = clockOrReal(conf.Clock)
+	return &TradeRecorder{
+		conf:     conf,
+		last:     make(map[string]time.Time),
+		boundary: make(map[string]map[tradeKey]struct{}),
+		gapFrom:  make(map[string]time.Time),
+		sinceGap: make(map[string]map[tradeKey]struct{}),
+		restarts: make(chan struct{}, 1),
+	}
+}
+
+// Run - Подписка на сделки и запись до завершения ctx или ошибки стрима
+func (r *TradeRecorder) Run(ctx context.Context) error {
+	if len(r.conf.Instruments) == 0 {
+		return errors.New("no instruments to record")
+	}
+	stream, err := r.conf.MarketDataStream.MarketDataStream()
+	if err != nil {
+		return err
+	}
+	stream.OnRestart(func() {
+		select {
+		case r.restarts <- struct{}{}:
+		default:
+		}
+	})
+	trades, err := stream.SubscribeTrade(r.conf.Instruments)
+	if err != nil {
+		stream.Stop()
+		return err
+	}
+	r.started = r.conf.Clock.Now()
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- stream.Listen()
+	}()
+
+	flush := r.conf.Clock.NewTicker(r.conf.FlushInterval)
+	defer flush.Stop()
+	backfill := r.conf.Clock.NewTimer(0)
+	if !backfill.Stop() {
+		<-backfill.C()
+	}
+	defer backfill.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			stream.Stop()
+			// дожидаемся закрытия каналов стрима
+			for range trades {
+			}
+			<-listenErr
+			return r.conf.Sink.Flush()
+		case t, ok := <-trades:
+			if !ok {
+				if err := <-listenErr; err != nil {
+					return err
+				}
+				return r.conf.Sink.Flush()
+			}
+			if err := r.record(t, false); err != nil {
+				stream.Stop()
+				return err
+			}
+		case <-r.restarts:
+			r.markGap()
+			backfill.Reset(r.conf.BackfillDelay)
+		case <-backfill.C():
+			r.backfill()
+		case <-flush.C():
+			if err := r.conf.Sink.Flush(); err != nil {
+				r.conf.Logger.Errorf("trades flush error %v", err.Error())
+			}
+		}
+	}
+}
+
+// record - Запись сделки, сделки из догрузки пропускаются, если уже были записаны
+func (r *TradeRecorder) record(t *pb.Trade, backfilled bool) error {
+	id := t.GetInstrumentUid()
+	key := newTradeKey(t)
+	tt := t.GetTime().AsTime()
+
+	r.mu.Lock()
+	if backfilled {
+		if _, recorded := r.sinceGap[id][key]; recorded {
+			r.mu.Unlock()
+			return nil
+		}
+	} else if _, ok := r.gapFrom[id]; ok {
+		r.sinceGap[id][key] = struct{}{}
+	}
+	switch last := r.last[id]; {
+	case tt.After(last):
+		r.last[id] = tt
+		r.boundary[id] = map[tradeKey]struct{}{key: {}}
+	case tt.Equal(last):
+		r.boundary[id][key] = struct{}{}
+	}
+	r.mu.Unlock()
+
+	return r.conf.Sink.WriteTrade(t)
+}
+
+// markGap - Запоминание начала разрыва по всем инструментам
+func (r *TradeRecorder) markGap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range r.conf.Instruments {
+		if _, ok := r.gapFrom[id]; ok {
+			continue
+		}
+		from, ok := r.last[id]
+		if !ok {
+			from = r.started
+		}
+		r.gapFrom[id] = from
+		// boundary заменяется следующей сделкой из стрима, поэтому сделки на границе разрыва копируются
+		recorded := make(map[tradeKey]struct{}, len(r.boundary[id]))
+		for key := range r.boundary[id] {
+			recorded[key] = struct{}{}
+		}
+		r.sinceGap[id] = recorded
+	}
+}
+
+// backfill - Догрузка сделок с начала разрыва до текущего момента
+func (r *TradeRecorder) backfill() {
+	r.mu.Lock()
+	gaps := make(map[string]time.Time, len(r.gapFrom))
+	for id, from := range r.gapFrom {
+		gaps[id] = from
+	}
+	r.mu.Unlock()
+
+	now := r.conf.Clock.Now()
+	for id, from := range gaps {
+		if limit := now.Add(-lastTradesDepth); from.Before(limit) {
+			r.conf.Logger.Errorf("%v trades gap from %v is longer than %v, trades before %v are lost", id, from, lastTradesDepth, limit)
+			from = limit
+		}
+		resp, err := r.conf.MarketData.GetLastTrades(id, from, now)
+		if err != nil {
+			// разрыв остается отмеченным, догрузка повторится при следующем переподключении
+			r.conf.Logger.Errorf("%v trades backfill error %v", id, err.Error())
+			continue
+		}
+		for _, t := range resp.GetTrades() {
+			if t.GetInstrumentUid() == "" {
+				t.InstrumentUid = id
+			}
+			if err := r.record(t, true); err != nil {
+				r.conf.Logger.Errorf("%v trades backfill error %v", id, err.Error())
+				break
+			}
+		}
+		r.mu.Lock()
+		delete(r.gapFrom, id)
+		delete(r.sinceGap, id)
+		r.mu.Unlock()
+		r.conf.Logger.Infof("%v trades backfilled from %v to %v", id, from, now)
+	}
+}
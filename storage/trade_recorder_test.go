@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// memoryTradeSink - Получатель сделок в памяти
+type memoryTradeSink struct {
+	mu     sync.Mutex
+	trades []*pb.Trade
+}
+
+func (s *memoryTradeSink) WriteTrade(t *pb.Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trades = append(s.trades, t)
+	return nil
+}
+
+func (s *memoryTradeSink) Flush() error {
+	return nil
+}
+
+func (s *memoryTradeSink) Close() error {
+	return nil
+}
+
+func TestTradeRecorderDefaults(t *testing.T) {
+	client := newTestClient(t, &fakeApi{}, investgo.NewSimulatedClock(tradesDay))
+	r := NewTradeRecorder(TradeRecorderConfig{MarketDataStream: client.NewMarketDataStreamClient()})
+	if r.conf.Logger != client.Logger {
+		t.Fatalf("logger = %v, want client logger", r.conf.Logger)
+	}
+	if r.conf.BackfillDelay != DEFAULT_BACKFILL_DELAY || r.conf.FlushInterval != DEFAULT_FLUSH_INTERVAL {
+		t.Fatalf("conf = %+v", r.conf)
+	}
+}
+
+func TestTradeRecorderBackfill(t *testing.T) {
+	second := func(s int) time.Duration {
+		return time.Duration(s) * time.Second
+	}
+	var (
+		a  = testTrade(second(1), 0)
+		b  = testTrade(second(2), 1)
+		c  = testTrade(second(2), 2)
+		d  = testTrade(second(3), 3)
+		d2 = testTrade(second(2), 4)
+		e  = testTrade(second(5), 5)
+	)
+	// GetLastTrades может не заполнять instrument_uid
+	missed := testTrade(second(4), 6)
+	missed.InstrumentUid = ""
+	api := &fakeApi{trades: map[string][]*pb.Trade{"uid": {a, b, c, d2, d, missed, e}}}
+	clock := investgo.NewSimulatedClock(at(tradesDay, 10, 0))
+	client := newTestClient(t, api, clock)
+	sink := &memoryTradeSink{}
+	r := NewTradeRecorder(TradeRecorderConfig{
+		Instruments: []string{"uid"},
+		MarketData:  client.NewMarketDataServiceClient(),
+		Sink:        sink,
+		Logger:      testLogger{t},
+		Clock:       clock,
+	})
+	r.started = clock.Now()
+
+	record := func(trades ...*pb.Trade) {
+		for _, tr := range trades {
+			if err := r.record(tr, false); err != nil {
+				t.Fatalf("record: %v", err)
+			}
+		}
+	}
+	// b и c - сделки на границе разрыва
+	record(a, b, c)
+	r.markGap()
+	// повторный разрыв до догрузки не сдвигает его начало
+	clock.Advance(second(4))
+	record(e)
+	r.markGap()
+	clock.Advance(time.Minute)
+	r.backfill()
+
+	// догружаются только пропущенные сделки, в том числе сделка d2 со временем границы
+	if q := tradeQuantities(sink.trades); !reflect.DeepEqual(q, []int64{1, 2, 3, 6, 5, 4, 7}) {
+		t.Fatalf("quantities = %v", q)
+	}
+	if sink.trades[6].GetInstrumentUid() != "uid" {
+		t.Fatalf("backfilled trade uid = %q", sink.trades[6].GetInstrumentUid())
+	}
+	if len(api.tradeRequests) != 1 {
+		t.Fatalf("requests = %v", api.tradeRequests)
+	}
+	req := api.tradeRequests[0]
+	if req.GetInstrumentId() != "uid" || !req.GetFrom().AsTime().Equal(b.GetTime().AsTime()) || !req.GetTo().AsTime().Equal(clock.Now()) {
+		t.Fatalf("request = %v", req)
+	}
+	if len(r.gapFrom) != 0 || len(r.sinceGap) != 0 {
+		t.Fatalf("gap is not cleared: %v, %v", r.gapFrom, r.sinceGap)
+	}
+
+	// без сделок разрыв начинается с запуска, а длинный разрыв ограничен глубиной GetLastTrades
+	r.last = map[string]time.Time{}
+	r.boundary = map[string]map[tradeKey]struct{}{}
+	r.markGap()
+	if !r.gapFrom["uid"].Equal(r.started) {
+		t.Fatalf("gap from = %v, want start", r.gapFrom["uid"])
+	}
+	clock.Advance(2 * time.Hour)
+	r.backfill()
+	if req := api.tradeRequests[1]; !req.GetFrom().AsTime().Equal(clock.Now().Add(-lastTradesDepth)) {
+		t.Fatalf("long gap request from = %v", req.GetFrom().AsTime())
+	}
+}
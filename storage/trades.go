@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+const (
+	// DEFAULT_TRADES_ROTATION - Период ротации файлов сделок по умолчанию
+	DEFAULT_TRADES_ROTATION = time.Hour
+	// periodFileLayout - Формат времени начала периода в имени файлов сделок и стаканов
+	periodFileLayout = "20060102T150405Z"
+	tradesFileExt    = ".csv.gz"
+)
+
+var tradesHeader = []string{"time", "instrument_uid", "figi", "direction", "price", "quantity"}
+
+// TradeSink - Получатель обезличенных сделок для TradeRecorder
+type TradeSink interface {
+	// WriteTrade - Сохранение сделки
+	WriteTrade(t *pb.Trade) error
+	// Flush - Сброс буферов на диск
+	Flush() error
+	// Close - Закрытие получателя
+	Close() error
+}
+
+// TradeFiles - Хранение обезличенных сделок в сжатых gzip CSV файлах. Сделки каждого инструмента пишутся
+// в директорию <dir>/<instrumentId>, файл <начало периода>.csv.gz содержит сделки, время которых попадает
+// в период ротации. Колонки: time (RFC3339 UTC с наносекундами), instrument_uid, figi, direction, price, quantity.
+// При повторном открытии в файл дописывается новый gzip поток, сделки внутри файла могут быть не упорядочены
+type TradeFiles struct {
+	dir      string
+	rotation time.Duration
+
+	mu      sync.Mutex
+	writers map[string]*tradesFile
+	latest  time.Time
+}
+
+type tradesFile struct {
+	period time.Time
+	file   *os.File
+	gz     *gzip.Writer
+	csv    *csv.Writer
+}
+
+// NewTradeFiles - Создание хранилища сделок в директории dir с периодом ротации rotation,
+// по умолчанию DEFAULT_TRADES_ROTATION
+func NewTradeFiles(dir string, rotation time.Duration) (*TradeFiles, error) {
+	if rotation <= 0 {
+		rotation = DEFAULT_TRADES_ROTATION
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &TradeFiles{
+		dir:      dir,
+		rotation: rotation,
+		writers:  make(map[string]*tradesFile),
+	}, nil
+}
+
+func (f *TradeFiles) WriteTrade(t *pb.Trade) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tradeTime := t.GetTime().AsTime().UTC()
+	period := tradeTime.Truncate(f.rotation)
+	w, err := f.writer(t.GetInstrumentUid(), period)
+	if err != nil {
+		return err
+	}
+	err = w.csv.Write([]string{
+		tradeTime.Format(time.RFC3339Nano),
+		t.GetInstrumentUid(),
+		t.GetFigi(),
+		t.GetDirection().String(),
+		investgo.QuotationToDecimal(t.GetPrice()).String(),
+		strconv.FormatInt(t.GetQuantity(), 10),
+	})
+	if err != nil {
+		return err
+	}
+	if period.After(f.latest) {
+		f.latest = period
+		// файлы прошлых периодов закрываются, предыдущий оставляем открытым для запоздавших сделок
+		for path, w := range f.writers {
+			if w.period.Before(f.latest.Add(-f.rotation)) {
+				delete(f.writers, path)
+				if err := w.close(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *TradeFiles) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, w := range f.writers {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *TradeFiles) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for path, w := range f.writers {
+		delete(f.writers, path)
+		if err := w.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writer - Открытый файл инструмента за период, новый файл создается с заголовком
+func (f *TradeFiles) writer(instrumentId string, period time.Time) (*tradesFile, error) {
+	dir := filepath.Join(f.dir, escapeFileName(instrumentId))
+	path := filepath.Join(dir, period.Format(periodFileLayout)+tradesFileExt)
+	if w, ok := f.writers[path]; ok {
+		return w, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	w := &tradesFile{period: period, file: file, gz: gz, csv: csv.NewWriter(gz)}
+	if info.Size() == 0 {
+		if err := w.csv.Write(tradesHeader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	f.writers[path] = w
+	return w, nil
+}
+
+func (w *tradesFile) close() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// IterateTrades - Обход сделок инструмента из директории TradeFiles в диапазоне [from, to) по возрастанию времени.
+// Обход прекращается, если fn возвращает ошибку, эта ошибка возвращается из IterateTrades
+func IterateTrades(dir, instrumentId string, from, to time.Time, fn func(t *pb.Trade) error) error {
+	files, err := periodFiles(filepath.Join(dir, escapeFileName(instrumentId)), tradesFileExt)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		if !file.period.Before(to) {
+			break
+		}
+		// в файле нет сделок позже начала следующего периода
+		if i+1 < len(files) && !files[i+1].period.After(from) {
+			continue
+		}
+		trades, err := readTradesFile(file.path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", file.path, err)
+		}
+		for _, t := range trades {
+			tt := t.GetTime().AsTime()
+			if tt.Before(from) || !tt.Before(to) {
+				continue
+			}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadTrades - Сделки инструмента из директории TradeFiles в диапазоне [from, to)
+func ReadTrades(dir, instrumentId string, from, to time.Time) ([]*pb.Trade, error) {
+	trades := make([]*pb.Trade, 0)
+	err := IterateTrades(dir, instrumentId, from, to, func(t *pb.Trade) error {
+		trades = append(trades, t)
+		return nil
+	})
+	return trades, err
+}
+
+type periodFile struct {
+	path   string
+	period time.Time
+}
+
+// periodFiles - Файлы директории инструмента с расширением ext, отсортированные по началу периода
+func periodFiles(dir, ext string) ([]periodFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []periodFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]periodFile, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		period, err := time.Parse(periodFileLayout, strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		files = append(files, periodFile{path: filepath.Join(dir, name), period: period})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].period.Before(files[j].period)
+	})
+	return files, nil
+}
+
+// readTradesFile - Чтение сделок из файла с сортировкой по времени
+func readTradesFile(path string) ([]*pb.Trade, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = len(tradesHeader)
+	trades := make([]*pb.Trade, 0)
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// последний поток мог быть не дописан при аварийном завершении
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec[0] == tradesHeader[0] {
+			continue
+		}
+		t, err := parseTradeRecord(rec)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		trades = append(trades, t)
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].GetTime().AsTime().Before(trades[j].GetTime().AsTime())
+	})
+	return trades, nil
+}
+
+func parseTradeRecord(rec []string) (*pb.Trade, error) {
+	t, err := time.Parse(time.RFC3339Nano, rec[0])
+	if err != nil {
+		return nil, err
+	}
+	price, err := decimal.NewFromString(rec[4])
+	if err != nil {
+		return nil, err
+	}
+	quantity, err := strconv.ParseInt(rec[5], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Trade{
+		Time:          investgo.TimeToTimestamp(t),
+		InstrumentUid: rec[1],
+		Figi:          rec[2],
+		Direction:     pb.TradeDirection(pb.TradeDirection_value[rec[3]]),
+		Price:         investgo.DecimalToQuotation(price),
+		Quantity:      quantity,
+	}, nil
+}
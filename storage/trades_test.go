@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+var tradesDay = time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+// testTrade - Сделка инструмента uid в 10:00 + offset по цене 100.5 + n шагов
+func testTrade(offset time.Duration, n int64) *pb.Trade {
+	return &pb.Trade{
+		InstrumentUid: "uid",
+		Figi:          "figi",
+		Time:          investgo.TimeToTimestamp(at(tradesDay, 10, 0).Add(offset)),
+		Direction:     pb.TradeDirection_TRADE_DIRECTION_SELL,
+		Price:         &pb.Quotation{Units: 100 + n, Nano: 500000000},
+		Quantity:      n + 1,
+	}
+}
+
+func writeTrades(t *testing.T, f *TradeFiles, trades ...*pb.Trade) {
+	t.Helper()
+	for _, tr := range trades {
+		if err := f.WriteTrade(tr); err != nil {
+			t.Fatalf("WriteTrade: %v", err)
+		}
+	}
+}
+
+// tradeQuantities - Количество в сделках, в тестах оно однозначно определяет сделку
+func tradeQuantities(trades []*pb.Trade) []int64 {
+	res := make([]int64, 0, len(trades))
+	for _, tr := range trades {
+		res = append(res, tr.GetQuantity())
+	}
+	return res
+}
+
+// gunzipLines - Строки распакованного файла сделок
+func gunzipLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %v: %v", path, err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("%v is not gzip", path)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("gunzip %v: %v", path, err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(raw, []byte("\n")), []byte("\n"))
+	res := make([]string, 0, len(lines))
+	for _, l := range lines {
+		res = append(res, string(l))
+	}
+	return res
+}
+
+func TestTradeFilesRotation(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewTradeFiles(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTradeFiles: %v", err)
+	}
+	writeTrades(t, f,
+		testTrade(10*time.Minute, 0),
+		testTrade(50*time.Minute, 1),
+		testTrade(65*time.Minute, 2),
+		// запоздавшая сделка пишется в еще открытый файл прошлого часа
+		testTrade(55*time.Minute, 3),
+		// файл 10:00 закрывается
+		testTrade(150*time.Minute, 4),
+		// файл 10:00 открывается повторно, в него дописывается новый gzip поток
+		testTrade(59*time.Minute, 5),
+	)
+	// после Flush сделки читаются без закрытия файлов
+	if err := f.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	trades, err := ReadTrades(dir, "uid", tradesDay, tradesDay.Add(investgo.DAY))
+	if err != nil {
+		t.Fatalf("ReadTrades: %v", err)
+	}
+	if q := tradeQuantities(trades); !reflect.DeepEqual(q, []int64{1, 2, 4, 6, 3, 5}) {
+		t.Fatalf("quantities = %v", q)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "uid", "*"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	want := []string{"20240304T100000Z.csv.gz", "20240304T110000Z.csv.gz", "20240304T120000Z.csv.gz"}
+	if len(files) != len(want) {
+		t.Fatalf("files = %v", files)
+	}
+	for i, name := range want {
+		if filepath.Base(files[i]) != name {
+			t.Fatalf("file %v = %v, want %v", i, files[i], name)
+		}
+	}
+	// заголовок пишется только в новый файл
+	lines := gunzipLines(t, files[0])
+	wantLines := []string{
+		"time,instrument_uid,figi,direction,price,quantity",
+		"2024-03-04T10:10:00Z,uid,figi,TRADE_DIRECTION_SELL,100.5,1",
+		"2024-03-04T10:50:00Z,uid,figi,TRADE_DIRECTION_SELL,101.5,2",
+		"2024-03-04T10:55:00Z,uid,figi,TRADE_DIRECTION_SELL,103.5,4",
+		"2024-03-04T10:59:00Z,uid,figi,TRADE_DIRECTION_SELL,105.5,6",
+	}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Fatalf("lines = %q", lines)
+	}
+
+	got := trades[0]
+	if !got.GetTime().AsTime().Equal(at(tradesDay, 10, 10)) || got.GetInstrumentUid() != "uid" || got.GetFigi() != "figi" ||
+		got.GetDirection() != pb.TradeDirection_TRADE_DIRECTION_SELL || got.GetPrice().GetUnits() != 100 || got.GetPrice().GetNano() != 500000000 {
+		t.Fatalf("trade = %v", got)
+	}
+}
+
+func TestIterateTrades(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewTradeFiles(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTradeFiles: %v", err)
+	}
+	writeTrades(t, f,
+		testTrade(10*time.Minute, 0),
+		testTrade(50*time.Minute, 1),
+		testTrade(time.Hour, 2),
+		testTrade(65*time.Minute+time.Nanosecond, 3),
+		testTrade(4*time.Hour, 4),
+	)
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []int64
+	}{
+		{name: "all", from: tradesDay, to: tradesDay.Add(investgo.DAY), want: []int64{1, 2, 3, 4, 5}},
+		{name: "from inclusive, to exclusive", from: at(tradesDay, 10, 50), to: at(tradesDay, 11, 5), want: []int64{2, 3}},
+		{name: "nanoseconds", from: at(tradesDay, 11, 5).Add(time.Nanosecond), to: at(tradesDay, 14, 0), want: []int64{4}},
+		{name: "between files", from: at(tradesDay, 12, 0), to: at(tradesDay, 13, 0), want: []int64{}},
+		{name: "after last", from: at(tradesDay, 15, 0), to: tradesDay.Add(investgo.DAY), want: []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trades, err := ReadTrades(dir, "uid", tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("ReadTrades: %v", err)
+			}
+			if q := tradeQuantities(trades); !reflect.DeepEqual(q, tt.want) {
+				t.Fatalf("quantities = %v, want %v", q, tt.want)
+			}
+		})
+	}
+
+	errStop := errors.New("stop")
+	visited := 0
+	err = IterateTrades(dir, "uid", tradesDay, tradesDay.Add(investgo.DAY), func(*pb.Trade) error {
+		visited++
+		if visited == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || visited != 2 {
+		t.Fatalf("err = %v, visited = %v", err, visited)
+	}
+	if trades, err := ReadTrades(dir, "unknown", tradesDay, tradesDay.Add(investgo.DAY)); err != nil || len(trades) != 0 {
+		t.Fatalf("unknown instrument = %v, %v", trades, err)
+	}
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+)
+
+// IssueKind - Тип проблемы в ряду свечей
+type IssueKind int
+
+const (
+	// ISSUE_MISSING - Нет свечей в торговое время
+	ISSUE_MISSING IssueKind = iota
+	// ISSUE_DUPLICATE - Несколько свечей с одним временем
+	ISSUE_DUPLICATE
+	// ISSUE_INVALID_OHLC - Некорректные цены или объем свечи
+	ISSUE_INVALID_OHLC
+)
+
+func (k IssueKind) String() string {
+	switch k {
+	case ISSUE_MISSING:
+		return "missing"
+	case ISSUE_DUPLICATE:
+		return "duplicate"
+	case ISSUE_INVALID_OHLC:
+		return "invalid_ohlc"
+	}
+	return fmt.Sprintf("IssueKind(%d)", int(k))
+}
+
+// Issue - Проблема в ряду свечей
+type Issue struct {
+	Kind IssueKind
+	// From, To - Диапазон [From, To) пропущенных свечей или диапазон некорректной свечи
+	From time.Time
+	To   time.Time
+	// Candle - Свеча с проблемой, nil для ISSUE_MISSING
+	Candle *pb.HistoricCandle
+	// Description - Описание проблемы
+	Description string
+}
+
+// ValidateRequest - Параметры проверки ряда свечей
+type ValidateRequest struct {
+	InstrumentId string
+	Interval     pb.CandleInterval
+	// Exchange - Биржа для получения расписания торгов, например MOEX
+	Exchange string
+	From     time.Time
+	To       time.Time
+	// Clock - Часы для определения сформированных свечей, по умолчанию системное время
+	Clock investgo.Clock
+}
+
+// ValidationReport - Результат проверки ряда свечей
+type ValidationReport struct {
+	InstrumentId string
+	Interval     pb.CandleInterval
+	From         time.Time
+	To           time.Time
+	// Sessions - Торговые сессии периода по расписанию биржи
+	Sessions []Session
+	// Expected - Ожидаемое по расписанию количество свечей, Candles - количество свечей в хранилище
+	Expected int
+	Candles  int
+	Issues   []Issue
+}
+
+// Count - Количество проблем типа kind
+func (r *ValidationReport) Count(kind IssueKind) int {
+	n := 0
+	for _, issue := range r.Issues {
+		if issue.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Validate - Проверка ряда свечей из хранилища по расписанию торгов из InstrumentsService.TradingSchedules.
+// Пропуски ищутся только для интервалов до дня включительно, для недельных и месячных свечей проверяются
+// только цены. У неликвидных инструментов минутные пропуски возможны, если в эту минуту не было сделок
+func Validate(store CandleStore, is *investgo.InstrumentsServiceClient, req ValidateRequest) (*ValidationReport, error) {
+	if !req.To.After(req.From) {
+		return nil, fmt.Errorf("invalid period from %v to %v", req.From, req.To)
+	}
+	all, err := TradingSessions(is, req.Exchange, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	// будущие свечи еще не сформированы
+	to := req.To
+	if now := clockOrReal(req.Clock).Now(); now.Before(to) {
+		to = now
+	}
+	// свеча, начавшаяся до From, не попадет в выборку из хранилища, поэтому проверка начинается со следующей
+	from := req.From
+	if d := investgo.CandleIntervalDuration(req.Interval); d > 0 {
+		if t := from.Truncate(d); t.Before(from) {
+			from = t.Add(d)
+		}
+	}
+	sessions := clipSessions(all, from, to)
+	candles, err := store.Candles(req.InstrumentId, req.Interval, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	return &ValidationReport{
+		InstrumentId: req.InstrumentId,
+		Interval:     req.Interval,
+		From:         req.From,
+		To:           req.To,
+		Sessions:     sessions,
+		Expected:     len(expectedBars(req.Interval, sessions)),
+		Candles:      len(candles),
+		Issues:       CheckCandles(candles, req.Interval, sessions),
+	}, nil
+}
+
+// Repair - Повторная загрузка свечей для пропусков и некорректных свечей из отчета и сохранение их в хранилище.
+// Возвращает количество загруженных свечей
+func Repair(store CandleStore, md *investgo.MarketDataServiceClient, report *ValidationReport) (int, error) {
+	loaded := 0
+	for _, issue := range report.Issues {
+		if issue.Kind == ISSUE_DUPLICATE {
+			// хранилища не хранят дубли, повторное сохранение ничего не изменит
+			continue
+		}
+		// GetHistoricCandles отбрасывает первую свечу ответа, поэтому диапазон запрашивается через GetCandles
+		// окнами не длиннее дня, что допустимо для всех проверяемых интервалов
+		for from := issue.From; from.Before(issue.To); from = from.Add(investgo.DAY) {
+			to := from.Add(investgo.DAY)
+			if to.After(issue.To) {
+				to = issue.To
+			}
+			resp, err := md.GetCandles(report.InstrumentId, report.Interval, from, to)
+			if err != nil {
+				return loaded, err
+			}
+			if err := store.Store(report.InstrumentId, report.Interval, resp.GetCandles(), time.Time{}); err != nil {
+				return loaded, err
+			}
+			loaded += len(resp.GetCandles())
+		}
+	}
+	return loaded, nil
+}
+
+// CheckCandles - Проверка свечей на пропуски в торговые сессии sessions, дубли и некорректные цены
+func CheckCandles(candles []*pb.HistoricCandle, interval pb.CandleInterval, sessions []Session) []Issue {
+	sorted := make([]*pb.HistoricCandle, len(candles))
+	copy(sorted, candles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetTime().AsTime().Before(sorted[j].GetTime().AsTime())
+	})
+	d := investgo.CandleIntervalDuration(interval)
+
+	issues := make([]Issue, 0)
+	for i, c := range sorted {
+		t := c.GetTime().AsTime()
+		if i > 0 && sorted[i-1].GetTime().AsTime().Equal(t) {
+			issues = append(issues, Issue{
+				Kind:        ISSUE_DUPLICATE,
+				From:        t,
+				To:          t.Add(d),
+				Candle:      c,
+				Description: fmt.Sprintf("duplicate candle at %v", t),
+			})
+		}
+		if problem := checkOHLC(c); problem != "" {
+			issues = append(issues, Issue{
+				Kind:        ISSUE_INVALID_OHLC,
+				From:        t,
+				To:          t.Add(d),
+				Candle:      c,
+				Description: fmt.Sprintf("candle at %v: %v", t, problem),
+			})
+		}
+	}
+
+	// соседние пропущенные свечи объединяются в один диапазон
+	var missing *Issue
+	for _, bar := range expectedBars(interval, sessions) {
+		end := bar.Add(d)
+		if hasCandle(sorted, bar, end) {
+			if missing != nil {
+				issues = append(issues, *missing)
+				missing = nil
+			}
+			continue
+		}
+		if missing != nil && missing.To.Equal(bar) {
+			missing.To = end
+			continue
+		}
+		if missing != nil {
+			issues = append(issues, *missing)
+		}
+		missing = &Issue{Kind: ISSUE_MISSING, From: bar, To: end}
+	}
+	if missing != nil {
+		issues = append(issues, *missing)
+	}
+	for i := range issues {
+		if issues[i].Kind == ISSUE_MISSING {
+			issues[i].Description = fmt.Sprintf("no candles from %v to %v", issues[i].From, issues[i].To)
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].From.Before(issues[j].From)
+	})
+	return issues
+}
+
+// checkOHLC - Описание проблемы с ценами свечи или пустая строка
+func checkOHLC(c *pb.HistoricCandle) string {
+	open := investgo.QuotationToDecimal(c.GetOpen())
+	high := investgo.QuotationToDecimal(c.GetHigh())
+	low := investgo.QuotationToDecimal(c.GetLow())
+	cl := investgo.QuotationToDecimal(c.GetClose())
+	switch {
+	case high.LessThan(low):
+		return fmt.Sprintf("high %v < low %v", high, low)
+	case open.LessThan(low) || open.GreaterThan(high):
+		return fmt.Sprintf("open %v outside [%v, %v]", open, low, high)
+	case cl.LessThan(low) || cl.GreaterThan(high):
+		return fmt.Sprintf("close %v outside [%v, %v]", cl, low, high)
+	case c.GetVolume() < 0:
+		return fmt.Sprintf("negative volume %v", c.GetVolume())
+	}
+	return ""
+}
+
+// expectedBars - Время начала свечей, которые должны быть сформированы в сессии. Для дневных свечей -
+// начало торговых дней по UTC
+func expectedBars(interval pb.CandleInterval, sessions []Session) []time.Time {
+	d := investgo.CandleIntervalDuration(interval)
+	if d == 0 || d > investgo.DAY {
+		return []time.Time{}
+	}
+	seen := make(map[time.Time]struct{})
+	bars := make([]time.Time, 0)
+	for _, s := range sessions {
+		for bar := s.Start.UTC().Truncate(d); bar.Before(s.End); bar = bar.Add(d) {
+			if _, ok := seen[bar]; ok {
+				continue
+			}
+			seen[bar] = struct{}{}
+			bars = append(bars, bar)
+		}
+	}
+	sort.Slice(bars, func(i, j int) bool {
+		return bars[i].Before(bars[j])
+	})
+	return bars
+}
+
+// hasCandle - Есть ли в отсортированном слайсе свеча со временем в [from, to)
+func hasCandle(candles []*pb.HistoricCandle, from, to time.Time) bool {
+	i := sort.Search(len(candles), func(i int) bool {
+		return !candles[i].GetTime().AsTime().Before(from)
+	})
+	return i < len(candles) && candles[i].GetTime().AsTime().Before(to)
+}
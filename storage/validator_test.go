@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinkoff/invest-api-go-sdk/investgo"
+	pb "github.com/tinkoff/invest-api-go-sdk/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const fiveMinutes = pb.CandleInterval_CANDLE_INTERVAL_5_MIN
+
+// validateDay - Торговый день: премаркет 06:50-07:00, основная сессия 07:00-07:30 с клирингом 07:10-07:15,
+// вечерняя сессия 16:05-16:10 UTC. Предыдущий день - выходной
+var validateDay = time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+func validateSchedule() []*pb.TradingDay {
+	stamp := func(h, m int) *timestamppb.Timestamp {
+		return investgo.TimeToTimestamp(at(validateDay, h, m))
+	}
+	return []*pb.TradingDay{
+		{Date: investgo.TimeToTimestamp(validateDay.Add(-investgo.DAY))},
+		{
+			Date:               investgo.TimeToTimestamp(validateDay),
+			IsTradingDay:       true,
+			PremarketStartTime: stamp(6, 50),
+			PremarketEndTime:   stamp(7, 0),
+			StartTime:          stamp(7, 0),
+			EndTime:            stamp(7, 30),
+			ClearingStartTime:  stamp(7, 10),
+			ClearingEndTime:    stamp(7, 15),
+			EveningStartTime:   stamp(16, 5),
+			EveningEndTime:     stamp(16, 10),
+		},
+	}
+}
+
+// validCandle - Корректная свеча с ценами вокруг price
+func validCandle(t time.Time, price int64) *pb.HistoricCandle {
+	return &pb.HistoricCandle{
+		Time:       investgo.TimeToTimestamp(t),
+		Open:       &pb.Quotation{Units: price},
+		High:       &pb.Quotation{Units: price + 2},
+		Low:        &pb.Quotation{Units: price - 2},
+		Close:      &pb.Quotation{Units: price + 1},
+		Volume:     100,
+		IsComplete: true,
+	}
+}
+
+// dayBars - Все свечи, ожидаемые по validateSchedule
+var dayBars = [][2]int{{6, 50}, {6, 55}, {7, 0}, {7, 5}, {7, 15}, {7, 20}, {7, 25}, {16, 5}}
+
+func TestCheckOHLC(t *testing.T) {
+	q := func(v int64) *pb.Quotation {
+		return &pb.Quotation{Units: v}
+	}
+	tests := []struct {
+		name    string
+		candle  *pb.HistoricCandle
+		problem string
+	}{
+		{name: "valid", candle: &pb.HistoricCandle{Open: q(10), High: q(12), Low: q(9), Close: q(11)}},
+		{name: "flat", candle: &pb.HistoricCandle{Open: q(10), High: q(10), Low: q(10), Close: q(10)}},
+		{name: "high below low", candle: &pb.HistoricCandle{Open: q(10), High: q(9), Low: q(11), Close: q(10)}, problem: "high 9 < low 11"},
+		{name: "open above high", candle: &pb.HistoricCandle{Open: q(13), High: q(12), Low: q(9), Close: q(11)}, problem: "open 13 outside"},
+		{name: "close below low", candle: &pb.HistoricCandle{Open: q(10), High: q(12), Low: q(9), Close: q(8)}, problem: "close 8 outside"},
+		{name: "negative volume", candle: &pb.HistoricCandle{Open: q(10), High: q(12), Low: q(9), Close: q(11), Volume: -1}, problem: "negative volume"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkOHLC(tt.candle)
+			if tt.problem == "" && got != "" || !strings.HasPrefix(got, tt.problem) {
+				t.Fatalf("checkOHLC = %q, want %q", got, tt.problem)
+			}
+		})
+	}
+}
+
+func TestExpectedBars(t *testing.T) {
+	sessions := SessionsFromSchedule(validateSchedule())
+	bars := expectedBars(fiveMinutes, sessions)
+	if len(bars) != len(dayBars) {
+		t.Fatalf("bars = %v, want %v", bars, dayBars)
+	}
+	for i, b := range dayBars {
+		if !bars[i].Equal(at(validateDay, b[0], b[1])) {
+			t.Fatalf("bar %v = %v, want %02d:%02d", i, bars[i], b[0], b[1])
+		}
+	}
+	// часовая свеча 07:00 закрывает обе части основной сессии
+	hours := expectedBars(pb.CandleInterval_CANDLE_INTERVAL_HOUR, sessions)
+	if len(hours) != 3 || !hours[0].Equal(at(validateDay, 6, 0)) || !hours[1].Equal(at(validateDay, 7, 0)) ||
+		!hours[2].Equal(at(validateDay, 16, 0)) {
+		t.Fatalf("hour bars = %v", hours)
+	}
+	if days := expectedBars(pb.CandleInterval_CANDLE_INTERVAL_DAY, sessions); len(days) != 1 || !days[0].Equal(validateDay) {
+		t.Fatalf("day bars = %v", days)
+	}
+	// пропуски недельных и месячных свечей не проверяются
+	if weeks := expectedBars(pb.CandleInterval_CANDLE_INTERVAL_WEEK, sessions); len(weeks) != 0 {
+		t.Fatalf("week bars = %v", weeks)
+	}
+}
+
+func TestCheckCandles(t *testing.T) {
+	sessions := SessionsFromSchedule(validateSchedule())
+	invalid := validCandle(at(validateDay, 7, 20), 100)
+	invalid.High = &pb.Quotation{Units: 90}
+	candles := []*pb.HistoricCandle{
+		validCandle(at(validateDay, 16, 5), 100),
+		validCandle(at(validateDay, 7, 0), 100),
+		// свеча в клиринг не ожидается, но и не является проблемой
+		validCandle(at(validateDay, 7, 10), 100),
+		invalid,
+		validCandle(at(validateDay, 7, 25), 100),
+		validCandle(at(validateDay, 7, 25), 101),
+	}
+	issues := CheckCandles(candles, fiveMinutes, sessions)
+	want := []struct {
+		kind     IssueKind
+		from, to [2]int
+	}{
+		// соседние пропуски объединяются, клиринг разделяет пропуски
+		{ISSUE_MISSING, [2]int{6, 50}, [2]int{7, 0}},
+		{ISSUE_MISSING, [2]int{7, 5}, [2]int{7, 10}},
+		{ISSUE_MISSING, [2]int{7, 15}, [2]int{7, 20}},
+		{ISSUE_INVALID_OHLC, [2]int{7, 20}, [2]int{7, 25}},
+		{ISSUE_DUPLICATE, [2]int{7, 25}, [2]int{7, 30}},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues = %+v", issues)
+	}
+	for i, w := range want {
+		got := issues[i]
+		if got.Kind != w.kind || !got.From.Equal(at(validateDay, w.from[0], w.from[1])) || !got.To.Equal(at(validateDay, w.to[0], w.to[1])) {
+			t.Errorf("issue %v = %v %v - %v, want %v %v - %v", i, got.Kind, got.From, got.To, w.kind, w.from, w.to)
+		}
+		if got.Description == "" || (got.Kind == ISSUE_MISSING) != (got.Candle == nil) {
+			t.Errorf("issue %v = %+v", i, got)
+		}
+	}
+	if issues[3].Candle != invalid {
+		t.Errorf("invalid issue candle = %v", issues[3].Candle)
+	}
+}
+
+func TestValidateAndRepair(t *testing.T) {
+	api := &fakeApi{days: validateSchedule(), candles: map[string][]*pb.HistoricCandle{}}
+	for i, b := range dayBars {
+		api.candles["uid"] = append(api.candles["uid"], validCandle(at(validateDay, b[0], b[1]), int64(100+i)))
+	}
+	clock := investgo.NewSimulatedClock(validateDay.Add(2 * investgo.DAY))
+	client := newTestClient(t, api, clock)
+	is, md := client.NewInstrumentsServiceClient(), client.NewMarketDataServiceClient()
+
+	store := NewMemoryStore()
+	invalid := validCandle(at(validateDay, 7, 20), 0)
+	invalid.Low = &pb.Quotation{Units: 50}
+	// нет 06:50, 06:55, 07:05 и 07:15, свеча 07:20 некорректна
+	stored := []*pb.HistoricCandle{api.candles["uid"][2], invalid, api.candles["uid"][6], api.candles["uid"][7]}
+	if err := store.Store("uid", fiveMinutes, stored, time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	req := ValidateRequest{
+		InstrumentId: "uid",
+		Interval:     fiveMinutes,
+		Exchange:     "moex",
+		From:         validateDay.Add(-investgo.DAY),
+		To:           validateDay.Add(investgo.DAY),
+		Clock:        clock,
+	}
+	report, err := Validate(store, is, req)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if report.Expected != len(dayBars) || report.Candles != 4 || len(report.Sessions) != 4 {
+		t.Fatalf("report expected = %v, candles = %v, sessions = %v", report.Expected, report.Candles, report.Sessions)
+	}
+	if report.Count(ISSUE_MISSING) != 3 || report.Count(ISSUE_INVALID_OHLC) != 1 || report.Count(ISSUE_DUPLICATE) != 0 {
+		t.Fatalf("issues = %+v", report.Issues)
+	}
+
+	loaded, err := Repair(store, md, report)
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if loaded == 0 {
+		t.Fatal("nothing loaded")
+	}
+	report, err = Validate(store, is, req)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if len(report.Issues) != 0 || report.Candles != len(dayBars) {
+		t.Fatalf("issues after repair = %+v, candles = %v", report.Issues, report.Candles)
+	}
+	checkCandlesAt(t, store, api.candles["uid"])
+
+	// будущие свечи не ожидаются: по часам сейчас 07:12
+	clock.Set(at(validateDay, 7, 12))
+	report, err = Validate(store, is, req)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if report.Expected != 4 {
+		t.Fatalf("expected before 07:12 = %v, want 4", report.Expected)
+	}
+	if _, err := Validate(store, is, ValidateRequest{Exchange: "moex", From: validateDay, To: validateDay}); err == nil {
+		t.Fatal("empty period must fail")
+	}
+}
+
+// checkCandlesAt - Свечи хранилища за validateDay совпадают с want
+func checkCandlesAt(t *testing.T, store CandleStore, want []*pb.HistoricCandle) {
+	t.Helper()
+	got, err := store.Candles("uid", fiveMinutes, validateDay, validateDay.Add(investgo.DAY))
+	if err != nil {
+		t.Fatalf("Candles: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("candles = %v, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if !sameCandle(got[i], want[i]) {
+			t.Fatalf("candle %v = %v, want %v", i, got[i], want[i])
+		}
+	}
+}